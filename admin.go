@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"ech-tunnel/pool"
+)
+
+// adminMux 管理接口（-admin）的路由，各模块初始化时在此注册
+var adminMux = http.NewServeMux()
+
+func init() {
+	adminMux.HandleFunc("GET /streams", serveStreams)
+	adminMux.HandleFunc("DELETE /streams/{id}", serveKillStream)
+	adminMux.HandleFunc("POST /ech/refresh", serveRefreshECH)
+	adminMux.HandleFunc("POST /channels/{id}/redial", serveRedialChannel)
+	adminMux.HandleFunc("POST /channels/rotate", serveRotateChannels)
+}
+
+// startAdmin 设置了 -admin 时在该地址提供管理接口（HTTP）；设置了 -admin-token 时要求
+// Authorization: Bearer <令牌>。接口可读取运行数据，请只监听本机或内网地址
+func startAdmin() {
+	if adminAddr == "" {
+		return
+	}
+	go func() {
+		log.Printf("管理接口监听 %s", adminAddr)
+		if err := http.ListenAndServe(adminAddr, adminAuth(adminMux)); err != nil {
+			log.Printf("管理接口退出: %v", err)
+		}
+	}()
+}
+
+// adminAuth 校验 -admin-token
+func adminAuth(next http.Handler) http.Handler {
+	if adminToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminStream GET /streams 返回的单个客户端流
+type adminStream struct {
+	Side    string  `json:"side"` // 固定为 client
+	Pool    string  `json:"pool"`
+	ConnID  string  `json:"conn_id"`
+	Target  string  `json:"target"`
+	Channel int     `json:"channel"` // 未绑定通道时为 -1
+	Up      int64   `json:"up"`
+	Down    int64   `json:"down"`
+	Age     float64 `json:"age"` // 秒
+
+	// 上行拥塞控制状态（协议版本 4，srtt_ms 为 0 表示尚无确认）
+	Cwnd       int64   `json:"cwnd"`
+	InFlight   int64   `json:"in_flight"`
+	SRTT       float64 `json:"srtt_ms"`
+	LossEvents int64   `json:"loss_events"`
+}
+
+// adminServerStream GET /streams 返回的单个服务端流（TCP 流或 UDP 关联）
+type adminServerStream struct {
+	Side   string  `json:"side"` // 固定为 server
+	Client string  `json:"client"`
+	Token  string  `json:"token"` // 令牌摘要（同访问日志）
+	Proto  string  `json:"proto"`
+	ConnID string  `json:"conn_id"`
+	Target string  `json:"target"`
+	Up     int64   `json:"up"`
+	Down   int64   `json:"down"`
+	Age    float64 `json:"age"` // 秒
+}
+
+// serveStreams 列出各连接池的活跃 TCP 流，以及服务端各会话的活动流（各自按建立时间排序）
+func serveStreams(w http.ResponseWriter, r *http.Request) {
+	out := []any{}
+	pools.each(func(name string, p *pool.ECHPool) {
+		for _, s := range p.StreamStats() {
+			out = append(out, adminStream{
+				Side: "client", Pool: name, ConnID: s.ConnID, Target: s.Target, Channel: s.Channel,
+				Up: s.Up, Down: s.Down, Age: s.Duration.Round(time.Millisecond).Seconds(),
+				Cwnd: s.Cwnd, InFlight: s.InFlight, SRTT: ms(s.SRTT), LossEvents: s.LossEvents,
+			})
+		}
+	})
+	for _, s := range server.Load().Streams() {
+		out = append(out, adminServerStream{
+			Side: "server", Client: s.Client, Token: s.Token, Proto: s.Proto,
+			ConnID: s.ConnID, Target: s.Target, Up: s.Up, Down: s.Down,
+			Age: time.Since(s.Start).Round(time.Millisecond).Seconds(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(out)
+}
+
+// serveKillStream 终止指定流：客户端的流向服务端发送 CLOSE 并关闭本地连接；
+// 服务端的流关闭目标连接，随后向客户端发送原因为 admin_close 的 CLOSE（UDP 关联为 UDP_CLOSE）
+func serveKillStream(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	killed := false
+	pools.each(func(name string, p *pool.ECHPool) {
+		if !killed && p.KillStream(id) {
+			killed = true
+			log.Printf("[管理] 已终止连接池 %s 的流 %s", poolName(name), id)
+		}
+	})
+	if n := server.Load().KillStream(id); n > 0 {
+		killed = true
+		log.Printf("[管理] 已终止服务端的流 %s（%d 个）", id, n)
+	}
+	if !killed {
+		http.Error(w, "流不存在", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rotateTimeout 轮换通道时等待单个通道重连的最长时间
+const rotateTimeout = 30 * time.Second
+
+// rotating 是否有通道轮换正在进行
+var rotating atomic.Bool
+
+// adminPool 返回查询参数 pool 指定的已启动连接池（未指定时为默认池）
+func adminPool(r *http.Request) (*pool.ECHPool, string) {
+	want := r.URL.Query().Get("pool")
+	var found *pool.ECHPool
+	pools.each(func(name string, p *pool.ECHPool) {
+		if name == want {
+			found = p
+		}
+	})
+	return found, want
+}
+
+// serveRefreshECH 立即重新查询 ECH 配置（只查询一次，失败时保留原配置）；
+// 已建立的通道不受影响，新配置在通道重连时生效，可随后调用 POST /channels/rotate
+func serveRefreshECH(w http.ResponseWriter, r *http.Request) {
+	started := false
+	pools.each(func(string, *pool.ECHPool) { started = true })
+	if !started {
+		http.Error(w, "没有已启动的连接池（仅客户端可用）", http.StatusConflict)
+		return
+	}
+	log.Printf("[管理] 刷新 ECH 配置")
+	if err := echClient.Fetch(); err != nil {
+		log.Printf("[管理] 刷新 ECH 配置失败: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveRedialChannel 断开并重连指定连接池（?pool=，默认池可省略）的指定通道
+func serveRedialChannel(w http.ResponseWriter, r *http.Request) {
+	p, name := adminPool(r)
+	if p == nil {
+		http.Error(w, "连接池不存在或尚未启动", http.StatusNotFound)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || p.Redial(id) == nil {
+		http.Error(w, "通道不存在或尚未连接", http.StatusNotFound)
+		return
+	}
+	log.Printf("[管理] 已断开连接池 %s 的通道 %d，等待重连", poolName(name), id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveRotateChannels 在后台逐个重连通道；指定 ?pool= 时只轮换该连接池，否则依次轮换全部已启动的连接池。
+// 同一时刻只允许一次轮换
+func serveRotateChannels(w http.ResponseWriter, r *http.Request) {
+	var targets []*pool.ECHPool
+	if r.URL.Query().Has("pool") {
+		p, _ := adminPool(r)
+		if p == nil {
+			http.Error(w, "连接池不存在或尚未启动", http.StatusNotFound)
+			return
+		}
+		targets = append(targets, p)
+	} else {
+		pools.each(func(_ string, p *pool.ECHPool) { targets = append(targets, p) })
+	}
+	if len(targets) == 0 {
+		http.Error(w, "没有已启动的连接池", http.StatusNotFound)
+		return
+	}
+	if !rotating.CompareAndSwap(false, true) {
+		http.Error(w, "通道轮换正在进行", http.StatusConflict)
+		return
+	}
+	log.Printf("[管理] 开始轮换 %d 个连接池的通道", len(targets))
+	go func() {
+		defer rotating.Store(false)
+		for _, p := range targets {
+			p.RotateChannels(rotateTimeout)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ms 以毫秒表示时长（保留微秒精度）
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
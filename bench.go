@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ech-tunnel/pool"
+	"ech-tunnel/tunnel"
+
+	"github.com/google/uuid"
+)
+
+// benchStream 单个测速流的结果
+type benchStream struct {
+	connID  string
+	channel int
+	setup   time.Duration
+	bytes   atomic.Int64
+}
+
+// runBench 客户端测速：通过 -f 服务端对下载、上传各测试 benchDuration
+func runBench(serverAddr string) {
+	u, err := url.Parse(serverAddr)
+	if err != nil || (u.Scheme != "wss" && u.Scheme != "grpc") {
+		log.Fatalf("[测速] 需要通过 -f 指定 wss:// 或 grpc:// 服务端地址")
+	}
+	if benchStreams <= 0 {
+		log.Fatalf("[测速] -bench-streams 必须大于 0")
+	}
+	if err := echClient.Prepare(); err != nil {
+		log.Fatalf("[测速] 获取 ECH 公钥失败: %v", err)
+	}
+
+	// 测速期间加快心跳，以便采集各通道 RTT 与丢失率
+	cfg := poolConfig(serverAddr)
+	cfg.PingInterval = min(cfg.PingInterval, time.Second)
+	p, err := pool.New(cfg)
+	if err != nil {
+		log.Fatalf("[测速] %v", err)
+	}
+	p.Start()
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		connected := 0
+		for _, s := range p.ChannelStats() {
+			if s.Connected {
+				connected++
+			}
+		}
+		if connected == connectionNum {
+			break
+		}
+		if time.Now().After(deadline) {
+			if connected == 0 {
+				log.Fatalf("[测速] 没有可用通道")
+			}
+			log.Printf("[测速] 仅 %d/%d 个通道可用，继续测试", connected, connectionNum)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	log.Printf("[测速] 开始测试: %d 个通道，%d 个并发流，每个方向 %s", connectionNum, benchStreams, benchDuration)
+	down := runBenchPhase(p, tunnel.BenchDownloadTarget)
+	up := runBenchPhase(p, tunnel.BenchUploadTarget)
+	reportBenchPhase("下载", down)
+	reportBenchPhase("上传", up)
+
+	for _, s := range p.ChannelStats() {
+		log.Printf("[测速] 通道 %d: RTT %s（最近 %s），丢失率 %.1f%%，探测 %d 次",
+			s.Channel, s.SRTT.Round(time.Microsecond), s.LastRTT.Round(time.Microsecond), s.Loss*100, s.Probes)
+	}
+}
+
+// runBenchPhase 以 benchStreams 个并发流对指定伪目标测速
+func runBenchPhase(p *pool.ECHPool, target string) []*benchStream {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var streams []*benchStream
+	buf := make([]byte, 32768)
+	_, _ = rand.Read(buf)
+
+	for i := 0; i < benchStreams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local, peer := net.Pipe()
+			defer local.Close()
+			defer peer.Close()
+
+			st := &benchStream{connID: uuid.New().String()}
+			start := time.Now()
+			p.RegisterAndClaim(st.connID, target, "", local)
+			if !p.WaitConnected(st.connID, 10*time.Second) {
+				log.Printf("[测速] 流 %s 建立超时（服务端是否启用了 -allow-bench？）", st.connID)
+				return
+			}
+			st.setup = time.Since(start)
+			st.channel, _ = p.ChannelOf(st.connID)
+			defer func() { _ = p.SendClose(st.connID) }()
+
+			end := time.Now().Add(benchDuration)
+			if target == tunnel.BenchDownloadTarget {
+				rbuf := make([]byte, 32768)
+				_ = peer.SetReadDeadline(end)
+				for {
+					n, err := peer.Read(rbuf)
+					st.bytes.Add(int64(n))
+					if err != nil {
+						break
+					}
+				}
+			} else {
+				for time.Now().Before(end) {
+					if err := p.SendData(st.connID, buf); err != nil {
+						break
+					}
+					st.bytes.Add(int64(len(buf)))
+				}
+			}
+
+			mu.Lock()
+			streams = append(streams, st)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return streams
+}
+
+// reportBenchPhase 输出单个方向的测速结果（总计与按通道汇总）
+func reportBenchPhase(name string, streams []*benchStream) {
+	if len(streams) == 0 {
+		log.Printf("[测速] %s: 无成功的流", name)
+		return
+	}
+	secs := benchDuration.Seconds()
+	var total int64
+	var setup time.Duration
+	perChannel := make(map[int]int64)
+	perChannelStreams := make(map[int]int)
+	for _, st := range streams {
+		b := st.bytes.Load()
+		total += b
+		setup += st.setup
+		perChannel[st.channel] += b
+		perChannelStreams[st.channel]++
+	}
+	log.Printf("[测速] %s: %.2f Mbps（%d 个流，共 %d 字节，平均建连耗时 %s）",
+		name, float64(total)*8/secs/1e6, len(streams), total, (setup / time.Duration(len(streams))).Round(time.Microsecond))
+
+	channels := make([]int, 0, len(perChannel))
+	for ch := range perChannel {
+		channels = append(channels, ch)
+	}
+	sort.Ints(channels)
+	for _, ch := range channels {
+		log.Printf("[测速]   通道 %d: %.2f Mbps（%d 个流）", ch, float64(perChannel[ch])*8/secs/1e6, perChannelStreams[ch])
+	}
+}
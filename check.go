@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"ech-tunnel/echdns"
+	"ech-tunnel/protocol"
+	"ech-tunnel/tunnel"
+)
+
+// checkStep 执行一个诊断步骤并输出耗时，失败时退出
+func checkStep(name string, fn func() (string, error)) {
+	start := time.Now()
+	detail, err := fn()
+	elapsed := time.Since(start).Round(time.Microsecond)
+	if err != nil {
+		log.Fatalf("[检查] ✗ %s 失败（%s）: %v", name, elapsed, err)
+	}
+	if detail != "" {
+		log.Printf("[检查] ✓ %s（%s）: %s", name, elapsed, detail)
+	} else {
+		log.Printf("[检查] ✓ %s（%s）", name, elapsed)
+	}
+}
+
+// runCheck 逐步诊断与 -f 服务端的连通性：DoH 查询 ECH、TCP 连接、TLS(ECH) 握手、
+// WebSocket 升级（含 token 与协议版本）以及控制帧往返
+func runCheck(serverAddr string) {
+	u, err := url.Parse(serverAddr)
+	if err != nil || (u.Scheme != "wss" && u.Scheme != "grpc") {
+		log.Fatalf("[检查] 需要通过 -f 指定 wss:// 或 grpc:// 服务端地址")
+	}
+	serverAddr = tunnel.ExpandPathTemplate(serverAddr)
+	serverName := dialer.ServerName(u)
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	var echBytes []byte
+	checkStep("DoH 查询 ECH 配置", func() (string, error) {
+		raw, domain, err := echClient.Lookup()
+		if err != nil {
+			return "", err
+		}
+		echBytes = raw
+		info := fmt.Sprintf("%s 经 %s，%d 字节，外层 SNI: %s", domain, dnsServer, len(echBytes), echdns.PublicNames(echBytes))
+		if echOuterSNI != "" {
+			if echBytes, err = echdns.SelectPublicName(echBytes, echOuterSNI); err != nil {
+				return "", err
+			}
+		}
+		return info, nil
+	})
+
+	tlsCfg, err := dialer.TLSConfig(serverName, echBytes)
+	if err != nil {
+		log.Fatalf("[检查] ✗ 构建 TLS 配置失败: %v", err)
+	}
+
+	if u.Scheme == "grpc" {
+		var conn tunnel.TunnelConn
+		var version int
+		checkStep("gRPC 通道握手（TCP + TLS/ECH + HTTP/2）", func() (string, error) {
+			c, resp, err := dialer.DialGRPC(serverAddr, tlsCfg, dialer.RequestHeader(u.Hostname()))
+			if err != nil {
+				return "", err
+			}
+			v, err := protocol.NegotiateVersion(resp.Header)
+			if err != nil {
+				c.Close()
+				return "", err
+			}
+			conn, version = c, v
+			return fmt.Sprintf("%s，协议版本 %d", resp.Proto, version), nil
+		})
+		checkRoundTrip(conn, version)
+		return
+	}
+
+	dialAddr := net.JoinHostPort(u.Hostname(), port)
+	if ips := dialer.Config().IPs; ips != nil {
+		dialAddr = net.JoinHostPort(ips.Candidates(1)[0].String(), port)
+	}
+	var rawConn net.Conn
+	checkStep("TCP 连接", func() (string, error) {
+		c, err := net.DialTimeout("tcp", dialAddr, 10*time.Second)
+		if err != nil {
+			return "", err
+		}
+		rawConn = c
+		return fmt.Sprintf("%s -> %s", c.LocalAddr(), c.RemoteAddr()), nil
+	})
+
+	var tlsConn *tls.Conn
+	checkStep("TLS 1.3 + ECH 握手", func() (string, error) {
+		tlsConn = tls.Client(rawConn, tlsCfg)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return "", err
+		}
+		cs := tlsConn.ConnectionState()
+		if !cs.ECHAccepted {
+			return "", fmt.Errorf("服务端未接受 ECH")
+		}
+		return fmt.Sprintf("ECH 已接受，外层 SNI %s，内层 SNI %s，%s，证书: %s", echdns.OuterName(echBytes), serverName, tls.CipherSuiteName(cs.CipherSuite), cs.PeerCertificates[0].Subject), nil
+	})
+
+	var wsConn *websocket.Conn
+	var version int
+	checkStep("WebSocket 升级", func() (string, error) {
+		wsDialer := websocket.Dialer{
+			NetDialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return tlsConn, nil
+			},
+			HandshakeTimeout: 10 * time.Second,
+		}
+		if token != "" {
+			wsDialer.Subprotocols = []string{token}
+		}
+		c, resp, err := wsDialer.Dial(serverAddr, dialer.RequestHeader(u.Hostname()))
+		if err != nil {
+			if resp != nil {
+				return "", fmt.Errorf("%v（HTTP %s，token 或路径是否正确？）", err, resp.Status)
+			}
+			return "", err
+		}
+		v, err := protocol.NegotiateVersion(resp.Header)
+		if err != nil {
+			c.Close()
+			return "", err
+		}
+		wsConn, version = c, v
+		return fmt.Sprintf("路径 %s，协议版本 %d", u.Path, version), nil
+	})
+	checkRoundTrip(wsConn, version)
+}
+
+// checkRoundTrip 通过 Ping/Pong 与 CLAIM/CLAIM_ACK 测量通道往返时延
+func checkRoundTrip(conn tunnel.TunnelConn, version int) {
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	pong := make(chan struct{}, 1)
+	conn.SetPongHandler(func(string) error {
+		select {
+		case pong <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	frames := make(chan protocol.ControlFrame, 16)
+	go func() {
+		defer close(frames)
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if f, ok := protocol.DecodeControl(mt, msg); ok {
+				frames <- f
+			}
+		}
+	}()
+
+	checkStep("Ping/Pong 往返", func() (string, error) {
+		if err := conn.WriteMessage(websocket.PingMessage, []byte("check")); err != nil {
+			return "", err
+		}
+		select {
+		case <-pong:
+			return "", nil
+		case <-time.After(10 * time.Second):
+			return "", fmt.Errorf("等待 Pong 超时")
+		}
+	})
+
+	checkStep("CLAIM 控制帧往返", func() (string, error) {
+		connID := uuid.New().String()
+		mt, b := protocol.EncodeControl(version, protocol.ControlFrame{Type: protocol.CtrlClaim, ConnID: connID})
+		if err := conn.WriteMessage(mt, b); err != nil {
+			return "", err
+		}
+		for f := range frames {
+			if f.Type == protocol.CtrlClaimAck && f.ConnID == connID {
+				return "", nil
+			}
+		}
+		return "", fmt.Errorf("未收到 CLAIM_ACK，连接已关闭")
+	})
+}
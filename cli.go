@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"ech-tunnel/echdns"
+)
+
+// 各模式共用的参数
+var commonFlagNames = []string{
+	"token", "psk", "pace", "coalesce", "nodelay-ports", "ws-compress", "ws-compress-level", "zstd",
+	"padding", "pad-budget", "pad-idle", "service", "service-name", "udp-idle-timeout",
+	"tcp-nodelay", "tcp-keepalive", "tcp-rcvbuf", "tcp-sndbuf", "max-frame", "wire-frame",
+	"mem-budget", "stream-buffer", "ack-interval", "resume-timeout", "log-output", "admin", "admin-token",
+}
+
+// 客户端侧（连接 -f 服务端）参数
+var clientFlagNames = []string{
+	"f", "ip", "ip-probe", "pin-sha256", "client-cert", "client-key", "dns", "dns-bootstrap-ip", "dns-proxy", "ech", "ech-mode", "allow-plaintext-sni", "ech-cache", "ech-host-first", "ech-outer-sni", "tls-fingerprint", "mux", "header", "sni", "host", "n", "claim", "channel-streams",
+	"ping-interval", "pong-timeout", "pong-miss", "connect-timeout", "stream-stats", "stream-stats-interval",
+}
+
+// 服务端参数
+var serverFlagNames = []string{
+	"cert", "key", "cidr", "client-ca", "ech-key", "path", "fallback-url", "allow-bench", "handshake-rate",
+	"access-log", "access-log-max-size", "access-log-rotate", "access-log-backups", "audit-log", "audit-dest", "audit-secret-file", "usage-file",
+	"geoip-db", "geoip-allow", "geoip-deny", "prefer-family", "happy-eyeballs-delay",
+	"resolver", "resolver-ttl", "resolve-cache", "egress-ip", "egress-interface", "egress-mark", "block-ports", "allow-ports", "deny-private", "deny-cidr", "token-policy", "dial-timeout",
+}
+
+// subcommand 子命令：从全局参数中选取与该模式相关的参数组成独立的参数集
+type subcommand struct {
+	name  string
+	args  string // 位置参数说明
+	desc  string
+	flags [][]string
+	// extra 注册该子命令独有的参数（可为 nil）
+	extra func(fs *flag.FlagSet)
+	// apply 解析完成后处理位置参数并设置运行模式
+	apply func(fs *flag.FlagSet) error
+}
+
+var subcommands = []*subcommand{
+	{
+		name: "server", args: "wss://|quic://监听地址:端口/路径", desc: "运行隧道服务端（指定 -f 时作为中继转发到下一跳服务端）",
+		flags: [][]string{commonFlagNames, serverFlagNames, clientFlagNames},
+		apply: func(fs *flag.FlagSet) error {
+			addr, err := singleArg(fs)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(addr, "ws://") && !strings.HasPrefix(addr, "wss://") && !strings.HasPrefix(addr, "quic://") {
+				addr = "wss://" + addr
+			}
+			listenAddrs = stringList{addr}
+			return nil
+		},
+	},
+	{
+		name: "client", args: "监听1/目标1[@通道][?connect-timeout=时长&priority=interactive|bulk&sniff=off|时长&channels=0,1&server=上游&family=dual|ipv4|ipv6],监听2/目标2,...", desc: "运行 TCP 正向转发客户端",
+		flags: [][]string{commonFlagNames, clientFlagNames, {"upstream", "unix-mode", "proxy-protocol", "sniff-timeout", "listen-family", "ctl", "ctl-token-file", "max-conns", "accept-queue", "when-down", "down-queue", "down-queue-timeout"}},
+		apply: func(fs *flag.FlagSet) error {
+			rules, err := singleArg(fs)
+			if err != nil {
+				return err
+			}
+			listenAddrs = stringList{"tcp://" + strings.TrimPrefix(rules, "tcp://")}
+			return requireForward()
+		},
+	},
+	{
+		name: "proxy", args: "[user:pass@]ip:port[?server=名称]", desc: "运行 SOCKS5/HTTP 代理客户端",
+		flags: [][]string{commonFlagNames, clientFlagNames, {"upstream", "unix-mode", "proxy-protocol", "http-forwarded", "socks-sniff-timeout", "udp-rebind", "dns-cache", "listen-family", "ctl", "ctl-token-file", "max-conns", "accept-queue", "when-down", "down-queue", "down-queue-timeout"}},
+		apply: func(fs *flag.FlagSet) error {
+			addr, err := singleArg(fs)
+			if err != nil {
+				return err
+			}
+			listenAddrs = stringList{"proxy://" + strings.TrimPrefix(addr, "proxy://")}
+			return requireForward()
+		},
+	},
+	{
+		name: "ctl", args: "add-rule 监听/目标[?参数] | add-proxy [user:pass@]ip:port[?server=名称] | remove 监听地址 | list", desc: "经 -ctl 控制套接字在运行中的客户端上增删转发规则与代理",
+		flags: [][]string{{"ctl", "ctl-token-file"}},
+		apply: func(fs *flag.FlagSet) error {
+			if ctlAddr == "" {
+				return fmt.Errorf("需要通过 -ctl 指定控制套接字地址")
+			}
+			if fs.NArg() == 0 {
+				return fmt.Errorf("需要指定命令")
+			}
+			ctlArgs = fs.Args()
+			return nil
+		},
+	},
+	{
+		name: "check", desc: "逐步诊断与 -f 服务端的连通性后退出",
+		flags: [][]string{commonFlagNames, clientFlagNames},
+		apply: func(fs *flag.FlagSet) error {
+			if fs.NArg() > 0 {
+				return fmt.Errorf("多余的参数: %s", strings.Join(fs.Args(), " "))
+			}
+			checkMode = true
+			return requireForward()
+		},
+	},
+	{
+		name: "bench", desc: "对 -f 服务端进行带宽测速后退出（服务端需开启 -allow-bench）",
+		flags: [][]string{commonFlagNames, clientFlagNames, {"bench-streams"}},
+		extra: func(fs *flag.FlagSet) {
+			// 以 -duration 代替旧语法的 -bench 参数
+			fs.DurationVar(&benchDuration, "duration", 10*time.Second, "每个方向的测速时长")
+		},
+		apply: func(fs *flag.FlagSet) error {
+			if fs.NArg() > 0 {
+				return fmt.Errorf("多余的参数: %s", strings.Join(fs.Args(), " "))
+			}
+			return requireForward()
+		},
+	},
+	{
+		name: "ech-keygen", args: "外层SNI", desc: "生成服务端 ECH 密钥（-ech-key 文件写到标准输出，DNS HTTPS 记录的 ech 参数写到标准错误）",
+		apply: func(fs *flag.FlagSet) error {
+			name, err := singleArg(fs)
+			if err != nil {
+				return err
+			}
+			echKeygen = name
+			return nil
+		},
+	},
+}
+
+// singleArg 返回唯一的位置参数
+func singleArg(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("需要且仅需要一个位置参数")
+	}
+	return fs.Arg(0), nil
+}
+
+func requireForward() error {
+	if forwardAddr == "" {
+		return fmt.Errorf("需要通过 -f 指定服务地址")
+	}
+	return nil
+}
+
+// parseCommandLine 解析命令行：首个参数为子命令时使用其独立参数集，
+// 否则按旧语法（-l 前缀区分模式）解析全部参数
+func parseCommandLine(args []string) {
+	flag.CommandLine.Usage = usage
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		_ = flag.CommandLine.Parse(args)
+		return
+	}
+	if args[0] == "help" {
+		usage()
+		os.Exit(0)
+	}
+	for _, sc := range subcommands {
+		if sc.name != args[0] {
+			continue
+		}
+		fs := sc.flagSet()
+		_ = fs.Parse(args[1:])
+		if err := sc.apply(fs); err != nil {
+			fmt.Fprintf(fs.Output(), "%s: %v\n", sc.name, err)
+			fs.Usage()
+			os.Exit(2)
+		}
+		return
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "未知的子命令: %s\n", args[0])
+	usage()
+	os.Exit(2)
+}
+
+// flagSet 以全局参数的同一存储构建子命令参数集
+func (sc *subcommand) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(sc.name, flag.ExitOnError)
+	for _, group := range sc.flags {
+		for _, name := range group {
+			f := flag.CommandLine.Lookup(name)
+			if f == nil {
+				panic("未注册的参数: " + name)
+			}
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	}
+	if sc.extra != nil {
+		sc.extra(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: %s %s [参数] %s\n%s\n\n参数:\n", os.Args[0], sc.name, sc.args, sc.desc)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// usage 输出子命令列表与旧语法说明
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "用法: %s <子命令> [参数] [位置参数]\n\n子命令:\n", os.Args[0])
+	for _, sc := range subcommands {
+		fmt.Fprintf(out, "  %-10s %s\n", sc.name, sc.desc)
+	}
+	fmt.Fprintf(out, "\n使用 \"%s <子命令> -h\" 查看该模式的参数。\n", os.Args[0])
+	fmt.Fprintf(out, "\n兼容旧语法: %s -l <ws|wss|tcp|proxy>://... [参数]，可用参数:\n", os.Args[0])
+	flag.CommandLine.PrintDefaults()
+}
+
+// runECHKeygen ech-keygen 子命令：向标准输出写出 -ech-key 文件内容，向标准错误输出 DNS HTTPS 记录的 ech 参数
+func runECHKeygen(publicName string) int {
+	key, list, err := echdns.GenerateKey(publicName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "生成 ECH 密钥失败: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(key)
+	fmt.Fprintf(os.Stderr, "外层 SNI: %s\nHTTPS 记录 ech 参数: %s\n", publicName, base64.StdEncoding.EncodeToString(list))
+	return 0
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"ech-tunnel/echdns"
+	"ech-tunnel/httpproxy"
+	"ech-tunnel/pool"
+	"ech-tunnel/socks5"
+	"ech-tunnel/tunnel"
+)
+
+// echClient 客户端查询与缓存 ECH 配置（由 initECHClient 按 -ech、-dns 等参数创建）
+var echClient *echdns.Client
+
+// initECHClient 按命令行参数创建 ECH 配置查询客户端（此时不发起查询）
+func initECHClient() error {
+	cfg := echdns.Config{
+		Domain:      echDomain,
+		DNSServer:   dnsServer,
+		BootstrapIP: dnsBootstrapIP,
+		Proxy:       dnsProxy,
+		HostFirst:   echHostFirst,
+		OuterSNI:    echOuterSNI,
+		CachePath:   echCachePath,
+	}
+	// 内层 SNI：-sni 或 -f 地址中的主机名
+	if u, err := url.Parse(forwardAddr); err == nil {
+		cfg.Host = u.Hostname()
+	}
+	if sniName != "" {
+		cfg.Host = sniName
+	}
+	c, err := echdns.New(cfg)
+	if err != nil {
+		return err
+	}
+	echClient = c
+	return nil
+}
+
+// frames 本端全部通道共享的帧层（由 initFrames 按 -psk、-zstd 等参数创建）
+var frames *tunnel.Frames
+
+// initFrames 按命令行参数创建帧层
+func initFrames() error {
+	f, err := tunnel.NewFrames(tunnel.FrameConfig{
+		PSK:             psk,
+		Zstd:            zstdPayload,
+		MaxFrameSize:    maxFrameSize,
+		WireFrameSize:   wireFrameSize,
+		StreamBufferMB:  streamBufferMB,
+		MemBudgetMB:     memBudgetMB,
+		AckInterval:     ackInterval,
+		PingInterval:    pingInterval,
+		PongTimeout:     pongTimeout,
+		Padding:         paddingEnabled,
+		PadBudget:       padBudget,
+		PadIdleInterval: padIdleInterval,
+		CoalesceDelay:   coalesceDelay,
+		NoDelayPorts:    noDelayPorts,
+		WSCompress:      wsCompress,
+		WSCompressLevel: wsCompressLvl,
+		Metrics:         &counters,
+	})
+	if err != nil {
+		return err
+	}
+	frames = f
+	return nil
+}
+
+// dialer 客户端建立通道的拨号器（由 initDialer 按 -token、-sni、-ech-mode 等参数创建），各连接池共用
+var dialer *tunnel.Dialer
+
+// initDialer 按命令行参数创建拨号器，须在 initECHClient 与 initFrames 之后调用
+func initDialer() error {
+	header, err := parseUpgradeHeaders()
+	if err != nil {
+		return err
+	}
+	cfg := tunnel.DialConfig{
+		Frames:        frames,
+		ECH:           echClient,
+		Token:         token,
+		SNI:           sniName,
+		HostHeader:    hostHeader,
+		Header:        header,
+		ECHMode:       echMode,
+		AllowPlainSNI: allowPlainSNI,
+		Fingerprint:   tlsFingerprint,
+		ClientCert:    clientCert,
+		ClientKey:     clientKey,
+		PinSHA256:     pinSHA256,
+		Mux:           muxMode,
+	}
+	if u, err := url.Parse(forwardAddr); err == nil {
+		cfg.FrontHost = u.Hostname()
+	}
+	if ipAddr != "" {
+		if cfg.IPs, err = tunnel.ParseFrontingIPs(ipAddr); err != nil {
+			return err
+		}
+	}
+	d, err := tunnel.NewDialer(cfg)
+	if err != nil {
+		return err
+	}
+	dialer = d
+	return nil
+}
+
+// parseUpgradeHeaders 解析 -header（名称: 值），握手与隧道协议使用的请求头不允许覆盖
+func parseUpgradeHeaders() (http.Header, error) {
+	h := http.Header{}
+	for _, spec := range upgradeHeaderSpecs {
+		name, value, ok := strings.Cut(spec, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t\r\n") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("无效的 -header: %q（格式: 名称: 值）", spec)
+		}
+		key := http.CanonicalHeaderKey(name)
+		switch {
+		case key == "Host":
+			return nil, fmt.Errorf("-header 不能设置 Host，请使用 -host")
+		case key == "Upgrade", key == "Connection", key == "Content-Length", key == "Transfer-Encoding",
+			strings.HasPrefix(key, "Sec-Websocket-"), strings.HasPrefix(key, "X-Tunnel-"):
+			return nil, fmt.Errorf("-header 不能设置 %s", key)
+		}
+		h.Add(key, strings.TrimSpace(value))
+	}
+	return h, nil
+}
+
+// poolConfig 按命令行参数返回连接到 addr 的连接池配置
+func poolConfig(addr string) pool.Config {
+	return pool.Config{
+		Addr:                addr,
+		Channels:            connectionNum,
+		Frames:              frames,
+		Dialer:              dialer,
+		Mux:                 muxMode,
+		ClaimMode:           claimMode,
+		ChannelStreams:      channelStreams,
+		PaceRate:            paceRate,
+		PingInterval:        pingInterval,
+		PongTimeout:         pongTimeout,
+		PongMissLimit:       pongMissLimit,
+		ResumeTimeout:       resumeTimeout,
+		ConnectTimeout:      connectTimeout,
+		StreamStatsInterval: streamStatsInterval,
+		StreamStatsLog:      streamStatsLog,
+		WhenDown:            whenDown,
+		DownQueue:           downQueue,
+		DownQueueTimeout:    downQueueTimeout,
+	}
+}
+
+// httpProxyConfig 按命令行参数返回 HTTP 代理配置（连接池与认证参数由 proxy:// 地址决定）
+func httpProxyConfig() httpproxy.Config {
+	return httpproxy.Config{Frames: frames, ConnectTimeout: connectTimeout, Forwarded: httpForwarded}
+}
+
+// socksDNSCache SOCKS5 UDP 的 DNS 应答缓存，各代理共用（未设置 -dns-cache 时为 nil）
+var socksDNSCache *socks5.DNSCache
+
+// socks5Config 按命令行参数返回监听在 host 的 SOCKS5 代理配置（连接池与认证由 proxy:// 地址决定）
+func socks5Config(host string) socks5.Config {
+	cfg := socks5.Config{
+		Frames:         frames,
+		ConnectTimeout: connectTimeout,
+		SniffTimeout:   socksSniffTimeout,
+		UDPIdleTimeout: udpIdleTimeout,
+		UDPRebind:      udpRebind,
+		DNSCache:       socksDNSCache,
+	}
+	// UDP 中继监听在代理的监听IP，UNIX 套接字监听时使用本地回环地址
+	if isUnixAddr(host) {
+		cfg.UDPHost = "127.0.0.1"
+	} else if h, _, err := net.SplitHostPort(host); err == nil {
+		cfg.UDPHost = h
+	}
+	return cfg
+}
+
+// sockOpts 按 -tcp-nodelay 等参数返回 TCP 套接字选项
+func sockOpts() tunnel.SockOpts {
+	return tunnel.SockOpts{NoDelay: tcpNoDelay, KeepAlive: tcpKeepAlive, RecvBuf: tcpRecvBuf, SendBuf: tcpSendBuf}
+}
+
+// serverConfig 按命令行参数返回服务端配置：主路径 path 使用 -token/-cidr，额外路径由 -path 指定
+func serverConfig(path string) (tunnel.ServerConfig, error) {
+	routes := []tunnel.Route{{Path: path, Token: token, CIDRs: cidrs}}
+	for _, spec := range extraPaths {
+		r, err := tunnel.ParseRoute(spec, token, cidrs)
+		if err != nil {
+			return tunnel.ServerConfig{}, fmt.Errorf("无效的 -path 参数 %q: %w", spec, err)
+		}
+		routes = append(routes, r)
+	}
+	return tunnel.ServerConfig{
+		Frames:             frames,
+		Routes:             routes,
+		FallbackURL:        fallbackURL,
+		CertFile:           certFile,
+		KeyFile:            keyFile,
+		ClientCA:           clientCA,
+		ECHKeyFile:         echKeyFile,
+		HandshakeRate:      handshakeRate,
+		DialTimeout:        dialTimeout,
+		UDPIdleTimeout:     udpIdleTimeout,
+		ResumeTimeout:      resumeTimeout,
+		PaceRate:           paceRate,
+		AllowBench:         allowBench,
+		PreferFamily:       preferFamily,
+		HappyEyeballsDelay: happyEyeballsDelay,
+		Resolver:           resolverAddr,
+		ResolverTTL:        resolverTTL,
+		ResolveCacheTTL:    resolveCacheTTL,
+		EgressIP:           egressIP,
+		EgressInterface:    egressInterface,
+		EgressMark:         egressMark,
+		SockOpts:           sockOpts(),
+		BlockPorts:         blockPorts,
+		AllowPorts:         allowPorts,
+		DenyPrivate:        denyPrivate,
+		DenyCIDRs:          denyCIDRs,
+		TokenPolicies:      tokenPolicySpecs,
+		UsageFile:          usageFile,
+		AccessLog:          accessLogPath,
+		AccessLogMaxSize:   accessLogMaxSize,
+		AccessLogRotate:    accessLogRotate,
+		AccessLogBackups:   accessLogBackups,
+		AuditLog:           auditLogPath,
+		AuditDest:          auditDest,
+		AuditSecretFile:    auditSecretFile,
+		GeoIPDB:            geoIPDB,
+		GeoIPAllow:         geoIPAllow,
+		GeoIPDeny:          geoIPDeny,
+	}, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ech-tunnel/internal/secret"
+)
+
+// localListener 运行中的本地监听（tcp:// 规则或 proxy:// 代理）
+type localListener struct {
+	kind string // rule 或 proxy
+	spec string // 规则或代理地址原文
+	ln   net.Listener
+}
+
+// listenerSet 按监听地址索引的本地监听，控制套接字据此在运行时增删规则与代理
+type listenerSet struct {
+	mu sync.Mutex
+	m  map[string]*localListener
+}
+
+var localListeners = &listenerSet{m: make(map[string]*localListener)}
+
+// add 登记监听，同一地址只能有一个
+func (s *listenerSet) add(addr, kind, spec string, ln net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, dup := s.m[addr]; dup {
+		return fmt.Errorf("监听地址 %s 已被使用", addr)
+	}
+	s.m[addr] = &localListener{kind: kind, spec: spec, ln: ln}
+	return nil
+}
+
+// forget 监听结束时注销（仍为同一监听器时）
+func (s *listenerSet) forget(addr string, ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l := s.m[addr]; l != nil && l.ln == ln {
+		delete(s.m, addr)
+	}
+}
+
+// remove 关闭并注销 addr 上的监听，已建立的连接不受影响
+func (s *listenerSet) remove(addr string) (*localListener, bool) {
+	s.mu.Lock()
+	l := s.m[addr]
+	delete(s.m, addr)
+	s.mu.Unlock()
+	if l == nil {
+		return nil, false
+	}
+	_ = l.ln.Close()
+	return l, true
+}
+
+// list 按监听地址排序返回 "类型 监听地址 原文"
+func (s *listenerSet) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, 0, len(s.m))
+	for addr, l := range s.m {
+		out = append(out, l.kind+" "+addr+" "+l.spec)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ctlToken 控制套接字的认证令牌（-ctl-token-file），为空时不认证
+var ctlToken string
+
+// startControlSocket 设置了 -ctl 时在该地址（unix:///path 或本机 host:port）接受控制命令，
+// 每个连接发送一行命令（设置了令牌时先发送一行 AUTH <令牌>），服务端回复若干行结果后关闭连接
+func startControlSocket() {
+	if ctlAddr == "" {
+		return
+	}
+	if ctlTokenFile == "" && !isUnixAddr(ctlAddr) {
+		// 回环地址上的其他本机用户同样可以连接，TCP 控制套接字必须认证
+		log.Fatalf("TCP 控制套接字需要通过 -ctl-token-file 指定认证令牌文件（或改用 unix:// 套接字）")
+	}
+	if ctlTokenFile != "" {
+		token, err := secret.LoadOrCreate(ctlTokenFile)
+		if err != nil {
+			log.Fatalf("读取控制套接字令牌失败: %v", err)
+		}
+		ctlToken = token
+	}
+	ln, err := listenControl(ctlAddr)
+	if err != nil {
+		log.Fatalf("控制套接字监听失败 %s: %v", ctlAddr, err)
+	}
+	log.Printf("控制套接字监听: %s", ctlAddr)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				log.Printf("控制套接字退出: %v", err)
+				return
+			}
+			go handleControlConn(c)
+		}
+	}()
+}
+
+// listenControl UNIX 套接字仅允许当前用户访问；TCP 只允许监听回环地址
+func listenControl(addr string) (net.Listener, error) {
+	if isUnixAddr(addr) {
+		path := strings.TrimPrefix(addr, "unix://")
+		if path == "" {
+			return nil, errors.New("UNIX 套接字路径为空")
+		}
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		ln, err := listenPrivateUnix(path)
+		if err != nil {
+			return nil, err
+		}
+		registerUnixSocketCleanup(path)
+		return ln, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.New("控制套接字只能监听回环地址或 UNIX 套接字")
+	}
+	return net.Listen("tcp", addr)
+}
+
+func handleControlConn(c net.Conn) {
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(30 * time.Second))
+	r := bufio.NewReader(c)
+	if ctlToken != "" {
+		auth, _ := r.ReadString('\n')
+		given, ok := strings.CutPrefix(strings.TrimSpace(auth), "AUTH ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(ctlToken)) != 1 {
+			log.Printf("[控制] 拒绝来自 %s 的连接：令牌错误", c.RemoteAddr())
+			fmt.Fprintln(c, "ERR 认证失败")
+			return
+		}
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	out, err := execControl(strings.Fields(line))
+	if err != nil {
+		fmt.Fprintf(c, "ERR %v\n", err)
+		return
+	}
+	for _, l := range out {
+		fmt.Fprintln(c, l)
+	}
+	fmt.Fprintln(c, "OK")
+}
+
+// execControl 执行一条控制命令：
+//
+//	add-rule 监听/目标[?参数]           添加 tcp:// 转发规则（格式同 -l tcp://）
+//	add-proxy [user:pass@]ip:port[?..]  添加 SOCKS5/HTTP 代理监听（格式同 -l proxy://）
+//	remove 监听地址                     移除规则或代理（关闭监听，已建立的连接不受影响）
+//	list                                列出运行中的规则与代理
+func execControl(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, errors.New("空命令")
+	}
+	cmd, args := args[0], args[1:]
+	switch {
+	case cmd == "list" && len(args) == 0:
+		return localListeners.list(), nil
+	case cmd == "add-rule" && len(args) == 1:
+		spec := strings.TrimPrefix(args[0], "tcp://")
+		rule, err := parseRuleForPool(spec)
+		if err != nil {
+			return nil, err
+		}
+		listener, pool, err := listenForwardRule(spec, rule)
+		if err != nil {
+			return nil, err
+		}
+		go serveForwardRule(listener, rule, pool)
+		log.Printf("[控制] 已添加转发规则 %s", spec)
+		return nil, nil
+	case cmd == "add-proxy" && len(args) == 1:
+		addr := "proxy://" + strings.TrimPrefix(args[0], "proxy://")
+		config, listener, err := listenProxy(addr)
+		if err != nil {
+			return nil, err
+		}
+		go serveProxy(listener, config)
+		log.Printf("[控制] 已添加代理 %s", config.Host)
+		return nil, nil
+	case cmd == "remove" && len(args) == 1:
+		l, ok := localListeners.remove(args[0])
+		if !ok {
+			return nil, fmt.Errorf("没有监听 %s 的规则或代理", args[0])
+		}
+		log.Printf("[控制] 已移除 %s %s", l.kind, args[0])
+		return nil, nil
+	}
+	return nil, fmt.Errorf("未知的命令或参数个数错误: %s（可用: add-rule、add-proxy、remove、list）", cmd)
+}
+
+// runCtl ctl 子命令：向运行中进程的控制套接字发送一条命令并输出结果
+func runCtl(args []string) int {
+	network, addr := "tcp", ctlAddr
+	if isUnixAddr(addr) {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	c, err := net.DialTimeout(network, addr, 5*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "连接控制套接字 %s 失败: %v\n", ctlAddr, err)
+		return 1
+	}
+	defer c.Close()
+	if ctlTokenFile != "" {
+		token, err := os.ReadFile(ctlTokenFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "读取控制套接字令牌失败: %v\n", err)
+			return 1
+		}
+		fmt.Fprintln(c, "AUTH "+strings.TrimSpace(string(token)))
+	}
+	if _, err := fmt.Fprintln(c, strings.Join(args, " ")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	code := 1
+	sc := bufio.NewScanner(c)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "OK":
+			code = 0
+		case strings.HasPrefix(line, "ERR "):
+			fmt.Fprintln(os.Stderr, strings.TrimPrefix(line, "ERR "))
+		default:
+			fmt.Println(line)
+		}
+	}
+	if err := sc.Err(); err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return code
+}
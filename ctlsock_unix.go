@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// umaskMu 串行化临时修改 umask 的监听（umask 为进程级设置）
+var umaskMu sync.Mutex
+
+// listenPrivateUnix 在 umask 0177 下创建 UNIX 套接字，文件自创建起即仅当前用户可访问，
+// 避免先创建再 chmod 之间其他用户连接的窗口
+func listenPrivateUnix(path string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
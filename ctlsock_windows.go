@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// listenPrivateUnix Windows 无 umask，套接字文件的访问权限继承所在目录的 ACL
+func listenPrivateUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
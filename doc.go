@@ -0,0 +1,17 @@
+// ech-tunnel 是基于 WebSocket + TLS1.3 ECH 的多通道 TCP/UDP 隧道。
+//
+// 功能按包划分，各包通过显式的 Config 结构体配置，不读取命令行参数或全局状态：
+//
+//	protocol   隧道线路协议（协议版本协商、控制帧与 DATA 帧头部的编解码）
+//	echdns     ECH 配置获取（DoH 查询 HTTPS 记录）与服务端 ECH 密钥
+//	tunnel     帧层（排序、合并、限速、填充与端到端加密）、客户端拨号器与服务端
+//	pool       客户端多通道连接池与通道健康度
+//	socks5     SOCKS5 代理（含 UDP ASSOCIATE）
+//	httpproxy  HTTP/HTTPS 代理
+//
+// package main 只负责命令行：在 main.go 中注册参数，由 config.go 把参数转换为各包的
+// Config，再按 -l/-f 地址启动服务端、TCP 正向转发（tcp_client.go）或本地代理（proxy.go），
+// 并提供控制套接字、管理接口与统计输出。
+//
+// 新增的线路格式应放在 protocol 包中；新增功能应放入对应的包并经其 Config 配置，不得依赖命令行参数。
+package main
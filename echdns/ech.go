@@ -0,0 +1,460 @@
+// Package echdns 获取并缓存隧道客户端握手所需的 ECH 配置（ECHConfigList）：
+// 经 DoH 查询 HTTPS 记录中的 ech 参数，可选经代理或引导地址连接 DoH 服务器，并可持久化到缓存文件。
+// 包内还提供 ECHConfigList 的解析与服务端 ECH 密钥的生成、读取（echconfig.go、echkey.go）。
+package echdns
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ech-tunnel/internal/dnsmsg"
+	"ech-tunnel/internal/netutil"
+)
+
+// Config ECH 配置的查询参数
+type Config struct {
+	Domain      string // 查询 HTTPS 记录的域名（-ech）
+	DNSServer   string // DoH 服务器地址（-dns），省略协议时为 https://
+	BootstrapIP string // 直接连接 DoH 服务器的地址，逗号分隔（-dns-bootstrap-ip）
+	Proxy       string // DoH 查询经由的 HTTP CONNECT 或 SOCKS5 代理（-dns-proxy）
+	Host        string // 隧道服务端的 TLS 服务器名称（-f 的主机名或 -sni），HostFirst 时先查询
+	HostFirst   bool   // 先查询 Host 的 HTTPS 记录（-ech-host-first）
+	OuterSNI    string // 只使用外层 SNI 为该名称的配置（-ech-outer-sni）
+	CachePath   string // 配置缓存文件（-ech-cache），为空时不缓存
+}
+
+// Client 按 Config 查询 ECH 配置并在运行期缓存，可供多个连接池并发使用
+type Client struct {
+	cfg       Config
+	transport http.RoundTripper // DoH 查询所用的 HTTP 传输
+
+	mu        sync.RWMutex
+	list      []byte
+	fetchedAt time.Time
+
+	refreshes atomic.Int64 // 成功获取 ECH 配置的次数
+}
+
+// New 按 cfg 创建 Client（此时不发起查询）
+func New(cfg Config) (*Client, error) {
+	c := &Client{cfg: cfg, transport: http.DefaultTransport}
+	if err := c.initTransport(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Config 返回创建 Client 时的参数
+func (c *Client) Config() Config { return c.cfg }
+
+// Refreshes 返回成功获取 ECH 配置的次数（含服务端下发的重试配置），c 为 nil 时返回 0
+func (c *Client) Refreshes() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.refreshes.Load()
+}
+
+// Prepare 查询 ECH 配置并缓存，失败时每 2 秒重试直至成功
+func (c *Client) Prepare() error {
+	for {
+		if err := c.Fetch(); err != nil {
+			log.Printf("[客户端] %v，2秒后重试...", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		return nil
+	}
+}
+
+// Fetch 查询一次 ECH 配置，成功时更新运行期缓存
+func (c *Client) Fetch() error {
+	log.Printf("[客户端] 使用 DNS 服务器查询 ECH: %s -> %s", c.cfg.DNSServer, strings.Join(c.lookupDomains(), ", "))
+	raw, domain, err := c.Lookup()
+	if err != nil {
+		return err
+	}
+	c.Set(raw, "doh:"+c.cfg.DNSServer)
+	log.Printf("[客户端] ECHConfigList（%s）长度: %d 字节，外层 SNI: %s", domain, len(raw), PublicNames(raw))
+	return nil
+}
+
+// lookupDomains 查询 ECH 配置的域名：HostFirst 时先查询隧道服务端的主机名，
+// 其 HTTPS 记录中没有 ECH 参数时再查询 Domain
+func (c *Client) lookupDomains() []string {
+	if c.cfg.HostFirst {
+		host := c.cfg.Host
+		if host != "" && net.ParseIP(host) == nil && !strings.EqualFold(host, c.cfg.Domain) {
+			return []string{host, c.cfg.Domain}
+		}
+	}
+	return []string{c.cfg.Domain}
+}
+
+// Lookup 按查询顺序查询 HTTPS 记录（不更新缓存），返回首个含 ECH 参数的配置及其所属域名
+func (c *Client) Lookup() ([]byte, string, error) {
+	domains := c.lookupDomains()
+	var errs []string
+	for i, domain := range domains {
+		raw, err := c.queryECHConfig(domain)
+		if err == nil {
+			return raw, domain, nil
+		}
+		if i < len(domains)-1 {
+			log.Printf("[ECH] %s 未提供可用的 ECH 配置（%v），改为查询 %s", domain, err, domains[i+1])
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", domain, err))
+	}
+	return nil, "", errors.New(strings.Join(errs, "；"))
+}
+
+// queryECHConfig 查询 domain 的 HTTPS 记录并解码其中的 ECHConfigList
+func (c *Client) queryECHConfig(domain string) ([]byte, error) {
+	echBase64, err := c.queryHTTPSRecord(domain)
+	if err != nil {
+		return nil, fmt.Errorf("DNS 查询失败: %v", err)
+	}
+	if echBase64 == "" {
+		return nil, errors.New("未找到 ECH 参数（HTTPS RR key=echconfig/5）")
+	}
+	raw, err := base64.StdEncoding.DecodeString(echBase64)
+	if err != nil {
+		return nil, fmt.Errorf("ECH Base64 解码失败: %v", err)
+	}
+	return raw, nil
+}
+
+// Init 客户端启动时加载 ECH 配置：缓存文件中有同一域名的配置时立即使用并在后台刷新，
+// 否则同步查询（DoH 暂时不可达时也能凭缓存启动）
+func (c *Client) Init() error {
+	if c.loadCache() {
+		go func() {
+			if err := c.Prepare(); err != nil {
+				log.Printf("[ECH] 后台刷新失败: %v", err)
+			}
+		}()
+		return nil
+	}
+	return c.Prepare()
+}
+
+// cacheFile 缓存文件格式
+type cacheFile struct {
+	Domain    string    `json:"domain"` // 查询的域名（HostFirst 时为逗号分隔的查询顺序）
+	Source    string    `json:"source"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Config    []byte    `json:"config"`
+}
+
+// Set 更新运行期 ECH 配置（source 记录来源，如 DoH 或服务端下发的重试配置），并在配置了缓存文件时写入
+func (c *Client) Set(raw []byte, source string) {
+	now := time.Now()
+	c.mu.Lock()
+	c.list = raw
+	c.fetchedAt = now
+	c.mu.Unlock()
+	c.refreshes.Add(1)
+	if c.cfg.CachePath == "" {
+		return
+	}
+	if err := c.saveCache(cacheFile{Domain: strings.Join(c.lookupDomains(), ","), Source: source, FetchedAt: now, Config: raw}); err != nil {
+		log.Printf("[ECH] 写入缓存文件失败: %v", err)
+	}
+}
+
+// saveCache 先写临时文件再重命名，避免进程中途退出留下不完整的缓存
+func (c *Client) saveCache(f cacheFile) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.cfg.CachePath), ".ech-cache-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.cfg.CachePath)
+}
+
+// loadCache 读取缓存文件，域名与当前查询的域名一致时载入运行期缓存
+func (c *Client) loadCache() bool {
+	if c.cfg.CachePath == "" {
+		return false
+	}
+	data, err := os.ReadFile(c.cfg.CachePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ECH] 读取缓存文件失败: %v", err)
+		}
+		return false
+	}
+	var f cacheFile
+	if err := json.Unmarshal(data, &f); err != nil || len(f.Config) == 0 {
+		log.Printf("[ECH] 缓存文件 %s 无效，忽略", c.cfg.CachePath)
+		return false
+	}
+	if domains := strings.Join(c.lookupDomains(), ","); f.Domain != domains {
+		log.Printf("[ECH] 缓存文件对应域名 %s 与当前查询的域名 %s 不一致，忽略", f.Domain, domains)
+		return false
+	}
+	c.mu.Lock()
+	c.list = f.Config
+	c.fetchedAt = f.FetchedAt
+	c.mu.Unlock()
+	log.Printf("[ECH] 已从缓存载入 ECHConfigList（%d 字节，外层 SNI %s，来源 %s，获取于 %s），后台刷新中", len(f.Config), PublicNames(f.Config), f.Source, f.FetchedAt.Format("2006-01-02 15:04:05"))
+	return true
+}
+
+// Refresh 刷新 ECH 配置（用于重试）
+func (c *Client) Refresh() error {
+	log.Printf("[ECH] 刷新 ECH 公钥配置...")
+	return c.Prepare()
+}
+
+// List 获取当前的 ECH 配置列表（设置了 OuterSNI 时只含对应的配置）
+func (c *Client) List() ([]byte, error) {
+	c.mu.RLock()
+	list := c.list
+	c.mu.RUnlock()
+	if len(list) == 0 {
+		return nil, errors.New("ECH 配置尚未加载")
+	}
+	if c.cfg.OuterSNI != "" {
+		return SelectPublicName(list, c.cfg.OuterSNI)
+	}
+	return list, nil
+}
+
+// Age 获取当前 ECH 配置已缓存的时长，c 为 nil 或尚未获取时 ok 为 false
+func (c *Client) Age() (age time.Duration, ok bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.fetchedAt.IsZero() {
+		return 0, false
+	}
+	return time.Since(c.fetchedAt), true
+}
+
+// initTransport 设置了 Proxy 时 DoH 查询经该代理（HTTP CONNECT 或 SOCKS5）发出，由代理连接 DoH 服务器；
+// 设置了 BootstrapIP 时直接连接这些地址（多个地址错峰竞速），TLS 的 SNI 与证书校验、
+// Host 头仍使用 DoH URL 中的主机名，DoH 服务器本身不再经系统 DNS 以明文解析。
+// 两者均未设置时与 http.DefaultTransport 相同，遵循 HTTPS_PROXY/ALL_PROXY 等环境变量中的代理
+func (c *Client) initTransport() error {
+	if c.cfg.Proxy != "" {
+		if c.cfg.BootstrapIP != "" {
+			return errors.New("-dns-proxy 与 -dns-bootstrap-ip 不能同时使用（经代理时由代理连接 DoH 服务器）")
+		}
+		u, err := url.Parse(c.cfg.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("无效的 -dns-proxy: %s", c.cfg.Proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("-dns-proxy 仅支持 http://、https:// 与 socks5:// 代理: %s", c.cfg.Proxy)
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = http.ProxyURL(u)
+		c.transport = t
+		log.Printf("[ECH] DoH 查询经代理 %s 发出", u.Redacted())
+		return nil
+	}
+	if c.cfg.BootstrapIP == "" {
+		return nil
+	}
+	var ips []string
+	for _, s := range strings.Split(c.cfg.BootstrapIP, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return fmt.Errorf("无效的 -dns-bootstrap-ip: %s", s)
+		}
+		ips = append(ips, ip.String())
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// 拨号总是连接指定地址，不能再经环境变量中的代理
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.JoinHostPort(ip, port)
+		}
+		return netutil.RaceDial(ctx, addrs, 250*time.Millisecond, func(ctx context.Context, a string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 3 * time.Second}
+			return d.DialContext(ctx, network, a)
+		})
+	}
+	c.transport = t
+	return nil
+}
+
+// queryHTTPSRecord 查询 DNS HTTPS 记录
+func (c *Client) queryHTTPSRecord(domain string) (string, error) {
+	dohURL := c.cfg.DNSServer
+	if !strings.HasPrefix(dohURL, "https://") && !strings.HasPrefix(dohURL, "http://") {
+		dohURL = "https://" + dohURL
+	}
+	return c.queryDoH(domain, dohURL)
+}
+
+// queryDoH 通过 DoH (DNS over HTTPS) 查询
+func (c *Client) queryDoH(domain, dohURL string) (string, error) {
+	u, err := url.Parse(dohURL)
+	if err != nil {
+		return "", fmt.Errorf("无效的 DoH URL: %v", err)
+	}
+	q := u.Query()
+	q.Set("name", domain)
+	q.Set("type", "HTTPS")
+	dnsQuery := dnsmsg.BuildQuery(domain, dnsmsg.TypeHTTPS)
+	dnsBase64 := base64.RawURLEncoding.EncodeToString(dnsQuery)
+
+	q.Set("dns", dnsBase64)
+	// 移除 name 和 type，因为使用了 dns 参数
+	q.Del("name")
+	q.Del("type")
+
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("Content-Type", "application/dns-message")
+
+	client := &http.Client{Timeout: 3 * time.Second, Transport: c.transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("DoH 请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("DoH 服务器返回错误: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("读取 DoH 响应失败: %v", err)
+	}
+	if err := dnsmsg.CheckResponse(dnsQuery, body); err != nil {
+		return "", err
+	}
+
+	return parseDNSResponse(body)
+}
+
+// parseDNSResponse 解析 DNS 响应报文
+func parseDNSResponse(response []byte) (string, error) {
+	if len(response) < 12 {
+		return "", fmt.Errorf("响应长度无效")
+	}
+	ancount := binary.BigEndian.Uint16(response[6:8])
+	if ancount == 0 {
+		return "", fmt.Errorf("未找到回答记录")
+	}
+	// 跳过 Question
+	offset := 12
+	for offset < len(response) && response[offset] != 0 {
+		offset += int(response[offset]) + 1
+	}
+	offset += 5 // null + type + class
+
+	// Answers
+	for i := 0; i < int(ancount); i++ {
+		if offset >= len(response) {
+			break
+		}
+		// NAME（可能压缩）
+		if response[offset]&0xC0 == 0xC0 {
+			offset += 2
+		} else {
+			for offset < len(response) && response[offset] != 0 {
+				offset += int(response[offset]) + 1
+			}
+			offset++
+		}
+		if offset+10 > len(response) {
+			break
+		}
+		rrType := binary.BigEndian.Uint16(response[offset : offset+2])
+		offset += 8 // type(2) + class(2) + ttl(4)
+		dataLen := binary.BigEndian.Uint16(response[offset : offset+2])
+		offset += 2
+		if offset+int(dataLen) > len(response) {
+			break
+		}
+		data := response[offset : offset+int(dataLen)]
+		offset += int(dataLen)
+
+		if rrType == dnsmsg.TypeHTTPS {
+			if ech := parseHTTPSRecord(data); ech != "" {
+				return ech, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// parseHTTPSRecord 解析 HTTPS 记录，仅抽取 SvcParamKey == 5 (ECHConfigList/echconfig)
+func parseHTTPSRecord(data []byte) string {
+	if len(data) < 2 {
+		return ""
+	}
+	// 跳 priority(2)
+	offset := 2
+	// 跳 targetName
+	if offset < len(data) && data[offset] == 0 {
+		offset++
+	} else {
+		for offset < len(data) && data[offset] != 0 {
+			offset += int(data[offset]) + 1
+		}
+		offset++
+	}
+	// SvcParams
+	for offset+4 <= len(data) {
+		key := binary.BigEndian.Uint16(data[offset : offset+2])
+		length := binary.BigEndian.Uint16(data[offset+2 : offset+4])
+		offset += 4
+		if offset+int(length) > len(data) {
+			break
+		}
+		value := data[offset : offset+int(length)]
+		offset += int(length)
+		if key == 5 {
+			return base64.StdEncoding.EncodeToString(value)
+		}
+	}
+	return ""
+}
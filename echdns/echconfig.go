@@ -0,0 +1,116 @@
+package echdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// echConfigVersion 当前 ECH 草案（draft-ietf-tls-esni）的 ECHConfig 版本，Go 与 uTLS 只使用该版本的配置
+const echConfigVersion = 0xfe0d
+
+// echConfig ECHConfigList 中的一个配置
+type echConfig struct {
+	raw        []byte // 含版本与长度的完整编码
+	version    uint16
+	configID   uint8
+	publicName string // 外层 ClientHello 的 SNI
+}
+
+// parseECHConfigList 解析 ECHConfigList，未知版本的配置只保留原始编码
+func parseECHConfigList(list []byte) ([]echConfig, error) {
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, errors.New("ECHConfigList 长度无效")
+	}
+	var configs []echConfig
+	for b := list[2:]; len(b) > 0; {
+		if len(b) < 4 {
+			return nil, errors.New("ECHConfig 不完整")
+		}
+		n := 4 + int(binary.BigEndian.Uint16(b[2:4]))
+		if n > len(b) {
+			return nil, errors.New("ECHConfig 不完整")
+		}
+		c := echConfig{raw: b[:n], version: binary.BigEndian.Uint16(b)}
+		if c.version == echConfigVersion {
+			if err := c.parseContents(b[4:n]); err != nil {
+				return nil, err
+			}
+		}
+		configs = append(configs, c)
+		b = b[n:]
+	}
+	return configs, nil
+}
+
+// parseContents 解析 0xfe0d 配置的 config_id 与 public_name
+func (c *echConfig) parseContents(b []byte) error {
+	// HpkeKeyConfig: config_id(1) kem_id(2) public_key<2> cipher_suites<2>
+	if len(b) < 5 {
+		return errors.New("ECHConfig 不完整")
+	}
+	c.configID = b[0]
+	off := 3
+	for i := 0; i < 2; i++ {
+		if off+2 > len(b) {
+			return errors.New("ECHConfig 不完整")
+		}
+		off += 2 + int(binary.BigEndian.Uint16(b[off:]))
+	}
+	// maximum_name_length(1) public_name<1>
+	if off+2 > len(b) || off+2+int(b[off+1]) > len(b) {
+		return errors.New("ECHConfig 不完整")
+	}
+	c.publicName = string(b[off+2 : off+2+int(b[off+1])])
+	return nil
+}
+
+// PublicNames 列出各可用配置的 public_name，用于日志
+func PublicNames(list []byte) string {
+	configs, err := parseECHConfigList(list)
+	if err != nil {
+		return "（无法解析）"
+	}
+	var names []string
+	for _, c := range configs {
+		if c.version == echConfigVersion {
+			names = append(names, fmt.Sprintf("%s（config_id %d）", c.publicName, c.configID))
+		}
+	}
+	if len(names) == 0 {
+		return "（无受支持的配置）"
+	}
+	return strings.Join(names, ", ")
+}
+
+// OuterName 握手时外层 ClientHello 的 SNI：列表中首个受支持配置的 public_name
+func OuterName(list []byte) string {
+	configs, _ := parseECHConfigList(list)
+	for _, c := range configs {
+		if c.version == echConfigVersion {
+			return c.publicName
+		}
+	}
+	return ""
+}
+
+// SelectPublicName 只保留 public_name 为 name 的配置（-ech-outer-sni）；
+// public_name 参与 HPKE 加密的上下文，改写会使服务端无法解密，因此只能在已发布的配置中选择
+func SelectPublicName(list []byte, name string) ([]byte, error) {
+	configs, err := parseECHConfigList(list)
+	if err != nil {
+		return nil, err
+	}
+	out := []byte{0, 0}
+	for _, c := range configs {
+		if c.version == echConfigVersion && strings.EqualFold(c.publicName, name) {
+			out = append(out, c.raw...)
+		}
+	}
+	if len(out) == 2 {
+		return nil, fmt.Errorf("ECH 配置中没有外层 SNI 为 %s 的条目（可用: %s）", name, PublicNames(list))
+	}
+	binary.BigEndian.PutUint16(out, uint16(len(out)-2))
+	return out, nil
+}
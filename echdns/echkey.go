@@ -0,0 +1,120 @@
+package echdns
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// 服务端 ECH 私钥（-ech-key）：服务端不经 CDN 直接面对客户端时（quic:// 或直连的 wss://）由服务端自行解密 ECH。
+// 文件为 PEM 格式，依次为 PRIVATE KEY（PKCS#8 编码的 X25519 私钥）与 ECHCONFIG（ECHConfigList，
+// 即 DNS HTTPS 记录中 ech 参数的内容），与 OpenSSL、BoringSSL 使用的 ECH 密钥文件格式一致，可由 GenerateKey（ech-keygen 子命令）生成
+const (
+	echKEMX25519    = 0x0020
+	echKDFSHA256    = 0x0001
+	echAEADAES128   = 0x0001
+	echAEADChaCha20 = 0x0003
+)
+
+// LoadKeys 读取 -ech-key 文件，返回服务端 TLS 配置所需的 ECH 密钥（未配置时为 nil）
+func LoadKeys(path string) ([]tls.EncryptedClientHelloKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var priv *ecdh.PrivateKey
+	var list []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("解析 ECH 私钥失败: %w", err)
+			}
+			ek, ok := k.(*ecdh.PrivateKey)
+			if !ok || ek.Curve() != ecdh.X25519() {
+				return nil, errors.New("ECH 私钥须为 X25519 密钥")
+			}
+			priv = ek
+		case "ECHCONFIG":
+			list = block.Bytes
+		}
+	}
+	if priv == nil || list == nil {
+		return nil, errors.New("ECH 密钥文件须同时包含 PRIVATE KEY 与 ECHCONFIG")
+	}
+	configs, err := parseECHConfigList(list)
+	if err != nil {
+		return nil, err
+	}
+	var keys []tls.EncryptedClientHelloKey
+	for _, c := range configs {
+		if c.version != echConfigVersion {
+			continue
+		}
+		// 客户端使用过期配置时，服务端在拒绝 ECH 的同时下发当前配置（供 -ech-mode=retry 使用）
+		keys = append(keys, tls.EncryptedClientHelloKey{Config: c.raw, PrivateKey: priv.Bytes(), SendAsRetry: true})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("ECHCONFIG 中没有受支持的配置")
+	}
+	return keys, nil
+}
+
+// GenerateKey 生成 X25519 的 ECH 密钥，publicName 为外层 ClientHello 的 SNI；返回 -ech-key 文件内容与 ECHConfigList
+func GenerateKey(publicName string) ([]byte, []byte, error) {
+	if publicName == "" || len(publicName) > 255 {
+		return nil, nil, errors.New("公开名称长度须为 1-255")
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	var id [1]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, nil, err
+	}
+	pub := priv.PublicKey().Bytes()
+
+	// ECHConfigContents: HpkeKeyConfig、maximum_name_length、public_name、extensions
+	contents := []byte{id[0]}
+	contents = binary.BigEndian.AppendUint16(contents, echKEMX25519)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	contents = binary.BigEndian.AppendUint16(contents, 8)
+	contents = binary.BigEndian.AppendUint16(contents, echKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, echAEADAES128)
+	contents = binary.BigEndian.AppendUint16(contents, echKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, echAEADChaCha20)
+	contents = append(contents, 0, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0)
+
+	config := binary.BigEndian.AppendUint16(nil, echConfigVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(config)))
+	list = append(list, config...)
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	out = append(out, pem.EncodeToMemory(&pem.Block{Type: "ECHCONFIG", Bytes: list})...)
+	return out, list, nil
+}
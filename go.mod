@@ -1,8 +1,21 @@
-module ech-tunnel
-
-go 1.21
-
-require (
-	github.com/google/uuid v1.6.0
-	github.com/gorilla/websocket v1.5.3
-)
+module ech-tunnel
+
+go 1.24
+
+require (
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/hashicorp/yamux v0.1.2
+	github.com/klauspost/compress v1.17.4
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/quic-go/quic-go v0.59.1
+	github.com/refraction-networking/utls v1.8.2
+	golang.org/x/crypto v0.41.0
+	golang.org/x/sys v0.35.0
+	google.golang.org/protobuf v1.36.6
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.6 // indirect
+	golang.org/x/net v0.43.0 // indirect
+)
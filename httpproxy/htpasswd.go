@@ -0,0 +1,202 @@
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdRecheck 两次检查凭据文件是否变更的最短间隔
+const htpasswdRecheck = 5 * time.Second
+
+// Htpasswd htpasswd 格式的代理凭据文件（proxy:// 的 ?htpasswd=），每行 用户名:哈希，
+// 支持 bcrypt（$2y$/$2a$/$2b$）、apr1（$apr1$）与 {SHA}；文件修改后自动重新载入，无需重启
+type Htpasswd struct {
+	path string
+
+	mu      sync.Mutex
+	users   map[string]string
+	modTime time.Time
+	checked time.Time
+	// bcrypt 校验较慢，缓存已通过校验的凭据（键为用户名与密码的摘要，值为校验时的哈希）
+	verified map[[sha256.Size]byte]string
+}
+
+// LoadHtpasswd 载入凭据文件，存在无法识别的哈希时返回错误
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f := &Htpasswd{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Path 返回凭据文件路径
+func (f *Htpasswd) Path() string { return f.path }
+
+// reload 重新读取文件（调用方持有 mu 或尚未共享 f）
+func (f *Htpasswd) reload() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("%s 第 %d 行格式错误（应为 用户名:哈希）", f.path, n)
+		}
+		if !htpasswdHashSupported(hash) {
+			return fmt.Errorf("%s 第 %d 行（用户 %s）的哈希格式不受支持，请使用 bcrypt（htpasswd -B）或 apr1（htpasswd -m）", f.path, n, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	f.users, f.modTime = users, st.ModTime()
+	f.verified = make(map[[sha256.Size]byte]string)
+	return nil
+}
+
+// check 校验用户名密码；距上次检查超过 htpasswdRecheck 且文件已修改时先重新载入（载入失败时沿用旧内容）
+func (f *Htpasswd) check(user, pass string) bool {
+	f.mu.Lock()
+	if now := time.Now(); now.Sub(f.checked) >= htpasswdRecheck {
+		f.checked = now
+		if st, err := os.Stat(f.path); err == nil && !st.ModTime().Equal(f.modTime) {
+			if err := f.reload(); err != nil {
+				log.Printf("[代理] 重新载入凭据文件失败，沿用旧内容: %v", err)
+			} else {
+				log.Printf("[代理] 凭据文件 %s 已重新载入（%d 个用户）", f.path, len(f.users))
+			}
+		}
+	}
+	hash, ok := f.users[user]
+	key := sha256.Sum256([]byte(user + "\x00" + pass))
+	cached := f.verified[key] == hash
+	f.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if cached {
+		return true
+	}
+	if !verifyHtpasswdHash(hash, pass) {
+		return false
+	}
+	f.mu.Lock()
+	f.verified[key] = hash
+	f.mu.Unlock()
+	return true
+}
+
+// htpasswdHashSupported 是否为支持的哈希格式
+func htpasswdHashSupported(hash string) bool {
+	for _, prefix := range []string{"$2y$", "$2a$", "$2b$", "$apr1$", "{SHA}"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyHtpasswdHash 校验密码与哈希是否匹配
+func verifyHtpasswdHash(hash, pass string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return constantTimeEqual(apr1Crypt(pass, salt), hash)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return constantTimeEqual("{SHA}"+base64.StdEncoding.EncodeToString(sum[:]), hash)
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	}
+}
+
+// apr1Crypt Apache 的 MD5-crypt 变体（htpasswd -m），salt 至多 8 个字符
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		d.Write(altSum[:min(16, i)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 != 0 {
+			r.Write(pw)
+		} else {
+			r.Write(final)
+		}
+		if i%3 != 0 {
+			r.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			r.Write(pw)
+		}
+		if i&1 != 0 {
+			r.Write(final)
+		} else {
+			r.Write(pw)
+		}
+		final = r.Sum(nil)
+	}
+
+	out := []byte(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return string(out)
+}
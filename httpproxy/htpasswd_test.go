@@ -0,0 +1,40 @@
+package httpproxy
+
+import "testing"
+
+func TestApr1Crypt(t *testing.T) {
+	// 期望值由 openssl passwd -apr1 -salt <salt> <password> 生成（与 htpasswd -m 相同）
+	tests := []struct {
+		password, salt, want string
+	}{
+		{"password", "r31....", "$apr1$r31....$kMmt8Ia8qcWk4vKKEhpgx1"},
+		{"Circle of Life", "12345678", "$apr1$12345678$hvOdOwtKWStnsU8Rvpnzm/"},
+		{"", "ab", "$apr1$ab$S8K6Sgp3W8c9Jb6LxgywZ."},
+		{"a very long password that exceeds sixteen bytes", "saltsalt", "$apr1$saltsalt$Nv1IdMCawkZcjKGxECLFO/"},
+		// salt 超过 8 个字符时截断
+		{"Circle of Life", "123456789", "$apr1$12345678$hvOdOwtKWStnsU8Rvpnzm/"},
+	}
+	for _, tt := range tests {
+		if got := apr1Crypt(tt.password, tt.salt); got != tt.want {
+			t.Errorf("apr1Crypt(%q, %q) = %q，期望 %q", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyHtpasswdHash(t *testing.T) {
+	tests := []struct {
+		hash, pass string
+		want       bool
+	}{
+		{"$apr1$r31....$kMmt8Ia8qcWk4vKKEhpgx1", "password", true},
+		{"$apr1$r31....$kMmt8Ia8qcWk4vKKEhpgx1", "Password", false},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret2", false},
+		{"$2y$04$invalid", "secret", false},
+	}
+	for _, tt := range tests {
+		if got := verifyHtpasswdHash(tt.hash, tt.pass); got != tt.want {
+			t.Errorf("verifyHtpasswdHash(%q, %q) = %v，期望 %v", tt.hash, tt.pass, got, tt.want)
+		}
+	}
+}
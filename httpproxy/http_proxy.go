@@ -0,0 +1,674 @@
+// Package httpproxy 经客户端连接池提供 HTTP/HTTPS（CONNECT）代理，
+// 支持 Basic/Digest/Bearer 认证、htpasswd 凭据文件与转发头（X-Forwarded-For 等）处理（proxyauth.go、htpasswd.go）。
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"ech-tunnel/pool"
+	"ech-tunnel/tunnel"
+
+	"github.com/google/uuid"
+)
+
+// Config HTTP 代理参数（对应 -http-forwarded 与 proxy:// 地址中的认证参数）
+type Config struct {
+	Pool           *pool.ECHPool  // 经由的连接池，不能为 nil
+	Frames         *tunnel.Frames // 帧层，决定小包合并与低延迟目标
+	ConnectTimeout time.Duration  // 等待服务端连上目标的最长时间
+	Forwarded      string         // X-Forwarded-For/Forwarded/Via 的处理: keep|add|strip，为空时为 keep
+
+	Auth     string // 认证方式: basic|digest|bearer，为空时按是否设置 Bearer 选择 basic 或 bearer
+	Username string // basic/digest 的用户名与密码
+	Password string
+	Bearer   string    // bearer 的静态令牌
+	Htpasswd *Htpasswd // htpasswd 格式的凭据文件，替代 Username/Password（仅 basic）
+}
+
+// httpKeepAliveTimeout 普通 HTTP 请求完成后等待客户端在同一连接上发送下一个请求的时长
+const httpKeepAliveTimeout = 60 * time.Second
+
+// Handle 处理 HTTP 代理协议：普通请求按响应边界逐个转发，客户端保持连接时继续处理下一个请求
+func Handle(conn net.Conn, config *Config, clientAddr string, firstByte byte) {
+	// 读取完整的第一行（HTTP 请求行）
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader([]byte{firstByte}), conn))
+
+	for served := 0; ; served++ {
+		// 读取请求行
+		requestLine, err := reader.ReadString('\n')
+		if err != nil {
+			if served == 0 {
+				log.Printf("[HTTP:%s] 读取请求行失败: %v", clientAddr, err)
+			}
+			return
+		}
+
+		// 解析请求行: METHOD URL HTTP/VERSION
+		parts := strings.SplitN(strings.TrimSpace(requestLine), " ", 3)
+		if len(parts) != 3 {
+			log.Printf("[HTTP:%s] 无效的请求行: %s", clientAddr, requestLine)
+			return
+		}
+
+		method := parts[0]
+		requestURL := parts[1]
+
+		log.Printf("[HTTP:%s] %s %s", clientAddr, method, requestURL)
+
+		// CONNECT 方法：建立隧道
+		if method == "CONNECT" {
+			if !handleHTTPConnect(conn, reader, config, clientAddr, requestURL, parts[2]) {
+				return
+			}
+			continue
+		}
+
+		// 其他方法（GET, POST 等）：转发 HTTP 请求
+		if !handleHTTPForward(conn, reader, config, clientAddr, method, requestURL, parts[2]) {
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(httpKeepAliveTimeout))
+	}
+}
+
+// handleHTTPConnect 处理 HTTP CONNECT 方法（用于 HTTPS）；仅在认证失败且客户端保持连接时返回 true
+func handleHTTPConnect(conn net.Conn, reader *bufio.Reader, config *Config, clientAddr, target, proto string) bool {
+	log.Printf("[HTTP:%s] CONNECT 到 %s", clientAddr, target)
+
+	// 读取并验证请求头（包括认证）
+	headers, err := readHTTPHeaders(reader)
+	if err != nil {
+		log.Printf("[HTTP:%s] 读取请求头失败: %v", clientAddr, err)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return false
+	}
+
+	// 验证认证（如果配置了）
+	if config.AuthRequired() && !config.checkHTTPAuth("CONNECT", target, headers) {
+		log.Printf("[HTTP:%s] 认证失败", clientAddr)
+		// 保持连接，客户端可在同一连接上携带凭据重试（Digest 需要先取得质询）
+		keepAlive := httpKeepAlive(proto, headers)
+		writeProxyAuthRequired(conn, config, "CONNECT", target, headers, keepAlive)
+		return keepAlive
+	}
+
+	// 使用连接池建立连接
+	connID := uuid.New().String()
+	_ = conn.SetDeadline(time.Time{})
+
+	config.Pool.RegisterAndClaim(connID, target, "", conn)
+	if !config.Pool.WaitConnected(connID, config.ConnectTimeout) {
+		log.Printf("[HTTP:%s] CONNECT 超时", clientAddr)
+		conn.Write([]byte("HTTP/1.1 504 Gateway Timeout\r\n\r\n"))
+		return false
+	}
+
+	// 发送成功响应
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		log.Printf("[HTTP:%s] 发送响应失败: %v", clientAddr, err)
+		return false
+	}
+
+	log.Printf("[HTTP:%s] CONNECT 隧道已建立到 %s", clientAddr, target)
+
+	defer func() {
+		_ = config.Pool.SendClose(connID)
+		_ = conn.Close()
+		config.Pool.ReleaseStream(connID)
+		log.Printf("[HTTP:%s] CONNECT 隧道关闭", clientAddr)
+	}()
+
+	// 转发数据
+	delay := config.Frames.CoalesceDelayFor(target)
+	ab := tunnel.NewAdaptiveBuffer(config.Pool.MaxPayload(connID), config.Frames.IsLowLatencyTarget(target))
+	for {
+		buf := ab.Bytes()
+		n, err := tunnel.ReadCoalesced(conn, buf, delay)
+		ab.Observe(n)
+		if err != nil {
+			config.Pool.WaitHalfClosed(connID, err)
+			return false
+		}
+		if err := config.Pool.SendData(connID, buf[:n]); err != nil {
+			log.Printf("[HTTP:%s] 发送数据失败: %v", clientAddr, err)
+			return false
+		}
+	}
+}
+
+// handleHTTPForward 处理普通 HTTP 请求（GET, POST 等）。每个请求使用独立的隧道流，
+// 按 Content-Length/chunked 转发请求体，并在响应结束处关闭隧道流；返回客户端连接能否继续发送下一个请求
+func handleHTTPForward(conn net.Conn, reader *bufio.Reader, config *Config, clientAddr, method, requestURL, proto string) bool {
+	log.Printf("[HTTP:%s] 转发 %s %s", clientAddr, method, requestURL)
+
+	// 解析目标 URL
+	parsedURL, err := url.Parse(requestURL)
+	if err != nil {
+		log.Printf("[HTTP:%s] 解析 URL 失败: %v", clientAddr, err)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return false
+	}
+
+	// 读取请求头
+	headers, err := readHTTPHeaders(reader)
+	if err != nil {
+		log.Printf("[HTTP:%s] 读取请求头失败: %v", clientAddr, err)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return false
+	}
+
+	// 验证认证（如果配置了）
+	if config.AuthRequired() && !config.checkHTTPAuth(method, requestURL, headers) {
+		log.Printf("[HTTP:%s] 认证失败", clientAddr)
+		// 未读取的请求体无法跳过时关闭连接，否则保持连接供客户端携带凭据重试
+		keepAlive := httpKeepAlive(proto, headers) && !isChunked(headers) && (headerValue(headers, "Content-Length") == "" || headerValue(headers, "Content-Length") == "0")
+		writeProxyAuthRequired(conn, config, method, requestURL, headers, keepAlive)
+		return keepAlive
+	}
+
+	applyForwardedHeaders(headers, clientAddr, parsedURL.Scheme, config.Forwarded)
+
+	// 确定目标地址
+	target := parsedURL.Host
+	if parsedURL.Port() == "" {
+		if parsedURL.Scheme == "https" || parsedURL.Scheme == "wss" {
+			target += ":443"
+		} else {
+			target += ":80"
+		}
+	}
+
+	// WebSocket 等协议升级请求：握手请求转发后连接切换为双向透传，不读取请求体
+	upgrade := isUpgradeRequest(headers)
+	keepAlive := !upgrade && httpKeepAlive(proto, headers)
+
+	// 请求体：较小且不等待 100 Continue 的定长请求体随请求头一起发送，其余在建连后按边界转发
+	var bodyData []byte
+	chunked := !upgrade && isChunked(headers)
+	var bodyLength int64
+	if contentLength := headerValue(headers, "Content-Length"); contentLength != "" && !upgrade && !chunked {
+		bodyLength, err = strconv.ParseInt(contentLength, 10, 64)
+		if err != nil || bodyLength < 0 {
+			log.Printf("[HTTP:%s] 无效的 Content-Length: %s", clientAddr, contentLength)
+			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			return false
+		}
+		if bodyLength > 0 && bodyLength < 10*1024*1024 && headerValue(headers, "Expect") == "" { // 限制最大 10MB
+			bodyData = make([]byte, bodyLength)
+			_, err := io.ReadFull(reader, bodyData)
+			if err != nil {
+				log.Printf("[HTTP:%s] 读取请求体失败: %v", clientAddr, err)
+				conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+				return false
+			}
+			bodyLength = 0
+		}
+	}
+
+	// 隧道流只承载这一个请求，要求目标在响应后关闭连接
+	if !upgrade {
+		if key, ok := lookupHeaderKey(headers, "Connection"); ok {
+			delete(headers, key)
+		}
+		headers["Connection"] = "close"
+	}
+
+	// 构建转发请求
+	var requestBuffer bytes.Buffer
+
+	// 修改请求行：使用相对路径
+	path := parsedURL.Path
+	if path == "" {
+		path = "/"
+	}
+	if parsedURL.RawQuery != "" {
+		path += "?" + parsedURL.RawQuery
+	}
+	requestBuffer.WriteString(fmt.Sprintf("%s %s HTTP/1.1\r\n", method, path))
+
+	// 写入请求头（移除代理相关头部）
+	for key, value := range headers {
+		if key != "Proxy-Authorization" && key != "Proxy-Connection" {
+			requestBuffer.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+		}
+	}
+
+	// 确保有 Host 头
+	if _, ok := headers["Host"]; !ok {
+		requestBuffer.WriteString(fmt.Sprintf("Host: %s\r\n", parsedURL.Host))
+	}
+
+	requestBuffer.WriteString("\r\n")
+
+	// 写入请求体
+	if len(bodyData) > 0 {
+		requestBuffer.Write(bodyData)
+	}
+
+	firstFrameData := requestBuffer.String()
+
+	// 使用连接池建立连接
+	connID := uuid.New().String()
+	_ = conn.SetDeadline(time.Time{})
+
+	if upgrade {
+		config.Pool.RegisterAndClaim(connID, target, firstFrameData, conn)
+		if !config.Pool.WaitConnected(connID, config.ConnectTimeout) {
+			log.Printf("[HTTP:%s] 连接超时", clientAddr)
+			conn.Write([]byte("HTTP/1.1 504 Gateway Timeout\r\n\r\n"))
+			return false
+		}
+		log.Printf("[HTTP:%s] 协议升级请求（%s）已转发到 %s，切换为双向透传", clientAddr, headerValue(headers, "Upgrade"), target)
+		relayHTTPUpgrade(conn, config, clientAddr, connID, target)
+		return false
+	}
+
+	rc := newHTTPResponseConn(conn, method == "HEAD", keepAlive)
+	defer rc.Close()
+	config.Pool.RegisterAndClaim(connID, target, firstFrameData, rc)
+	if !config.Pool.WaitConnected(connID, config.ConnectTimeout) {
+		log.Printf("[HTTP:%s] 连接超时", clientAddr)
+		conn.Write([]byte("HTTP/1.1 504 Gateway Timeout\r\n\r\n"))
+		return false
+	}
+	log.Printf("[HTTP:%s] 请求已转发到 %s", clientAddr, target)
+
+	defer func() {
+		_ = config.Pool.SendClose(connID)
+		config.Pool.ReleaseStream(connID)
+	}()
+
+	if chunked || bodyLength > 0 {
+		if err := copyHTTPBody(poolWriter{config.Pool, connID}, reader, chunked, bodyLength); err != nil {
+			log.Printf("[HTTP:%s] 转发请求体失败: %v", clientAddr, err)
+			return false
+		}
+	}
+
+	res := <-rc.done
+	if res.err != nil {
+		log.Printf("[HTTP:%s] 转发响应失败: %v", clientAddr, res.err)
+		if !res.started {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		}
+		return false
+	}
+	log.Printf("[HTTP:%s] 请求处理完成", clientAddr)
+	return res.keepAlive
+}
+
+// relayHTTPUpgrade 协议升级后双向透传，直至任一方关闭
+func relayHTTPUpgrade(conn net.Conn, config *Config, clientAddr, connID, target string) {
+	defer func() {
+		_ = config.Pool.SendClose(connID)
+		_ = conn.Close()
+		config.Pool.ReleaseStream(connID)
+		log.Printf("[HTTP:%s] 请求处理完成", clientAddr)
+	}()
+
+	// 响应会通过连接池返回到 conn，这里转发客户端发送的后续数据
+	delay := config.Frames.CoalesceDelayFor(target)
+	ab := tunnel.NewAdaptiveBuffer(config.Pool.MaxPayload(connID), config.Frames.IsLowLatencyTarget(target))
+	for {
+		buf := ab.Bytes()
+		n, err := tunnel.ReadCoalesced(conn, buf, delay)
+		ab.Observe(n)
+		if err != nil {
+			config.Pool.WaitHalfClosed(connID, err)
+			return
+		}
+		if err := config.Pool.SendData(connID, buf[:n]); err != nil {
+			log.Printf("[HTTP:%s] 发送数据失败: %v", clientAddr, err)
+			return
+		}
+	}
+}
+
+// forwardedHeaderNames 转发链路相关的请求头
+var forwardedHeaderNames = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Real-IP", "Forwarded", "Via"}
+
+// applyForwardedHeaders 按 mode（-http-forwarded）处理转发链路请求头：
+// keep 原样透传，add 追加客户端地址与本代理信息，strip 删除全部相关头部以保护隐私
+func applyForwardedHeaders(headers map[string]string, clientAddr, scheme, mode string) {
+	switch mode {
+	case "strip":
+		for _, name := range forwardedHeaderNames {
+			if key, ok := lookupHeaderKey(headers, name); ok {
+				delete(headers, key)
+			}
+		}
+	case "add":
+		ip := clientAddr
+		if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+			ip = host
+		}
+		forwardedFor := ip
+		if strings.Contains(ip, ":") {
+			forwardedFor = "\"[" + ip + "]\""
+		}
+		if scheme == "" {
+			scheme = "http"
+		}
+		appendHeader(headers, "X-Forwarded-For", ip)
+		appendHeader(headers, "Forwarded", "for="+forwardedFor+";proto="+scheme)
+		appendHeader(headers, "Via", "1.1 ech-tunnel")
+	}
+}
+
+// isUpgradeRequest 判断是否为协议升级请求（Connection 含 upgrade 且带 Upgrade 头，如 WebSocket 握手）
+func isUpgradeRequest(headers map[string]string) bool {
+	if headerValue(headers, "Upgrade") == "" {
+		return false
+	}
+	for _, token := range strings.Split(headerValue(headers, "Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// headerValue 不区分大小写读取请求头的值
+func headerValue(headers map[string]string, name string) string {
+	if key, ok := lookupHeaderKey(headers, name); ok {
+		return headers[key]
+	}
+	return ""
+}
+
+// lookupHeaderKey 不区分大小写查找请求头在 map 中的实际键名
+func lookupHeaderKey(headers map[string]string, name string) (string, bool) {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// appendHeader 追加逗号分隔的请求头值（不存在时新建）
+func appendHeader(headers map[string]string, name, value string) {
+	if key, ok := lookupHeaderKey(headers, name); ok {
+		headers[key] += ", " + value
+		return
+	}
+	headers[name] = value
+}
+
+// readHTTPHeaders 读取 HTTP 请求头
+func readHTTPHeaders(reader *bufio.Reader) (map[string]string, error) {
+	headers := make(map[string]string)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break // 空行表示头部结束
+		}
+
+		// 解析头部：Key: Value
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+			headers[key] = value
+		}
+	}
+
+	return headers, nil
+}
+
+// parseBasicAuth 解析 Basic 认证：Basic <base64(username:password)>
+func parseBasicAuth(authHeader string) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(authHeader, "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// httpKeepAlive 按协议版本与 Connection（或旧客户端的 Proxy-Connection）判断对端是否保持连接
+func httpKeepAlive(proto string, headers map[string]string) bool {
+	conn := headerValue(headers, "Connection")
+	if conn == "" {
+		conn = headerValue(headers, "Proxy-Connection")
+	}
+	for _, token := range strings.Split(conn, ",") {
+		switch strings.ToLower(strings.TrimSpace(token)) {
+		case "close":
+			return false
+		case "keep-alive":
+			return true
+		}
+	}
+	return proto != "HTTP/1.0"
+}
+
+// isChunked 报文是否使用分块传输编码
+func isChunked(headers map[string]string) bool {
+	return strings.Contains(strings.ToLower(headerValue(headers, "Transfer-Encoding")), "chunked")
+}
+
+// copyHTTPBody 原样复制一个报文正文：chunked 时复制至末尾的 0 长度块及其尾部头部，否则复制 n 字节
+func copyHTTPBody(w io.Writer, r *bufio.Reader, chunked bool, n int64) error {
+	if !chunked {
+		_, err := io.CopyN(w, r, n)
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+		sizeStr, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("无效的分块长度: %q", strings.TrimSpace(line))
+		}
+		if size == 0 {
+			// 尾部头部（trailer），以空行结束
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return err
+				}
+				if _, err := io.WriteString(w, line); err != nil {
+					return err
+				}
+				if strings.TrimSpace(line) == "" {
+					return nil
+				}
+			}
+		}
+		// 块数据及其后的 CRLF
+		if _, err := io.CopyN(w, r, size+2); err != nil {
+			return err
+		}
+	}
+}
+
+// poolWriter 将写入的数据作为指定流的上行数据发送
+type poolWriter struct {
+	pool   *pool.ECHPool
+	connID string
+}
+
+func (w poolWriter) Write(b []byte) (int, error) {
+	if err := w.pool.SendData(w.connID, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// httpResponseConn 普通 HTTP 请求在连接池中登记的本地连接：连接池写入的下行数据经管道交给 relay，
+// 由其按 HTTP/1.1 报文边界原样写给客户端，响应结束时经 done 通知转发方。Close 只结束管道，不关闭客户端连接
+type httpResponseConn struct {
+	net.Conn
+	pr   *io.PipeReader
+	pw   *io.PipeWriter
+	done chan httpResponseEnd
+}
+
+// httpResponseEnd 一个响应的结束状态
+type httpResponseEnd struct {
+	keepAlive bool // 客户端要求保持连接且响应有明确的结束边界
+	started   bool // 已向客户端写出响应数据
+	err       error
+}
+
+func newHTTPResponseConn(conn net.Conn, head, keepAlive bool) *httpResponseConn {
+	pr, pw := io.Pipe()
+	c := &httpResponseConn{Conn: conn, pr: pr, pw: pw, done: make(chan httpResponseEnd, 1)}
+	go c.relay(head, keepAlive)
+	return c
+}
+
+func (c *httpResponseConn) Write(b []byte) (int, error) {
+	return c.pw.Write(b)
+}
+
+func (c *httpResponseConn) Close() error {
+	return c.pw.Close()
+}
+
+// relay 转发一个响应（含之前的 1xx 中间响应），之后到达的数据丢弃直至流关闭
+func (c *httpResponseConn) relay(head, clientKeepAlive bool) {
+	br := bufio.NewReader(c.pr)
+	cw := &writeCounter{w: c.Conn}
+	keepAlive, err := copyHTTPResponse(cw, br, head, clientKeepAlive)
+	c.done <- httpResponseEnd{keepAlive: keepAlive, started: cw.n > 0, err: err}
+	_, _ = io.Copy(io.Discard, br)
+}
+
+// writeCounter 记录已写出的字节数
+type writeCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *writeCounter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// copyHTTPResponse 复制一个最终响应：1xx 中间响应之后继续读取，101 之后透传至流结束；
+// HEAD 请求与 204/304 响应没有正文，其余按 chunked、Content-Length 或读到流结束确定正文边界。
+// 目标的 Connection/Keep-Alive 等逐跳头只针对隧道流（转发时已要求目标关闭），不转发给客户端；
+// 客户端连接能否保持只取决于客户端请求（clientKeepAlive）与响应是否有明确的正文边界，
+// 并以 Connection 头告知客户端。返回客户端连接能否继续发送下一个请求
+func copyHTTPResponse(w io.Writer, r *bufio.Reader, head, clientKeepAlive bool) (bool, error) {
+	for {
+		statusLine, err := r.ReadString('\n')
+		if err != nil {
+			return false, fmt.Errorf("读取响应状态行失败: %w", err)
+		}
+		fields := strings.Fields(statusLine)
+		if len(fields) < 2 {
+			return false, fmt.Errorf("无效的响应状态行: %q", strings.TrimSpace(statusLine))
+		}
+		code, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return false, fmt.Errorf("无效的响应状态码: %q", fields[1])
+		}
+		// 头部按原顺序转发（保留重复的 Set-Cookie 等），同时解析用于判断正文边界
+		var lines []string
+		headers := make(map[string]string)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return false, fmt.Errorf("读取响应头失败: %w", err)
+			}
+			if strings.TrimSpace(line) == "" {
+				break
+			}
+			lines = append(lines, line)
+			if key, value, ok := strings.Cut(line, ":"); ok {
+				appendHeader(headers, strings.TrimSpace(key), strings.TrimSpace(value))
+			}
+		}
+
+		if code >= 100 && code < 200 {
+			raw := statusLine + strings.Join(lines, "") + "\r\n"
+			if _, err := io.WriteString(w, raw); err != nil {
+				return false, err
+			}
+			if code == 101 {
+				_, err := io.Copy(w, r)
+				return false, err
+			}
+			continue
+		}
+
+		var bodyLength int64 = -1
+		if cl := headerValue(headers, "Content-Length"); cl != "" && !isChunked(headers) {
+			bodyLength, err = strconv.ParseInt(cl, 10, 64)
+			if err != nil || bodyLength < 0 {
+				return false, fmt.Errorf("无效的 Content-Length: %s", cl)
+			}
+		}
+		noBody := head || code == 204 || code == 304
+		// 没有长度信息时正文持续到目标关闭连接，客户端连接随后也须关闭
+		keepAlive := clientKeepAlive && (noBody || isChunked(headers) || bodyLength >= 0)
+		if _, err := io.WriteString(w, responseHeadForClient(statusLine, lines, headers, keepAlive)); err != nil {
+			return false, err
+		}
+		switch {
+		case noBody:
+			return keepAlive, nil
+		case isChunked(headers):
+			return keepAlive, copyHTTPBody(w, r, true, 0)
+		case bodyLength >= 0:
+			return keepAlive, copyHTTPBody(w, r, false, bodyLength)
+		}
+		_, err = io.Copy(w, r)
+		return false, err
+	}
+}
+
+// responseHeadForClient 去除响应头中的逐跳头（Connection、Keep-Alive、Proxy-Connection 及 Connection 中列出的头），
+// 按客户端连接是否保持追加 Connection 头
+func responseHeadForClient(statusLine string, lines []string, headers map[string]string, keepAlive bool) string {
+	hop := map[string]bool{"connection": true, "keep-alive": true, "proxy-connection": true}
+	for _, token := range strings.Split(headerValue(headers, "Connection"), ",") {
+		if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+			hop[token] = true
+		}
+	}
+	var b strings.Builder
+	b.WriteString(statusLine)
+	for _, line := range lines {
+		key, _, _ := strings.Cut(line, ":")
+		if !hop[strings.ToLower(strings.TrimSpace(key))] {
+			b.WriteString(line)
+		}
+	}
+	if keepAlive {
+		b.WriteString("Connection: keep-alive\r\n\r\n")
+	} else {
+		b.WriteString("Connection: close\r\n\r\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCopyHTTPBodyChunked(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string // 完整的正文（原样复制）
+		wantErr bool
+	}{
+		{"single chunk", "5\r\nhello\r\n0\r\n\r\n", false},
+		{"multiple chunks", "4\r\nWiki\r\n5\r\npedia\r\nE\r\n in\r\n\r\nchunks.\r\n0\r\n\r\n", false},
+		{"extension", "5;name=value\r\nhello\r\n0;last\r\n\r\n", false},
+		{"trailer", "3\r\nabc\r\n0\r\nExpires: never\r\nX-Sum: 1\r\n\r\n", false},
+		{"upper hex", "A\r\n0123456789\r\n0\r\n\r\n", false},
+		{"empty", "0\r\n\r\n", false},
+		{"invalid size", "zz\r\nhello\r\n0\r\n\r\n", true},
+		{"negative size", "-1\r\nhello\r\n0\r\n\r\n", true},
+		{"truncated data", "a\r\nhello", true},
+		{"missing trailer end", "0\r\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 正文之后是下一个报文，复制后应停在报文边界
+			const next = "GET / HTTP/1.1\r\n\r\n"
+			r := bufio.NewReader(strings.NewReader(tt.body + next))
+			if tt.wantErr {
+				r = bufio.NewReader(strings.NewReader(tt.body))
+			}
+			var out bytes.Buffer
+			err := copyHTTPBody(&out, r, true, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v，期望出错 %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if out.String() != tt.body {
+				t.Errorf("复制了 %q，期望 %q", out.String(), tt.body)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != next {
+				t.Errorf("剩余 %q，期望 %q", rest, next)
+			}
+		})
+	}
+}
+
+func TestCopyHTTPBodyLength(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("hello world"))
+	var out bytes.Buffer
+	if err := copyHTTPBody(&out, r, false, 5); err != nil || out.String() != "hello" {
+		t.Fatalf("copyHTTPBody = %q, %v", out.String(), err)
+	}
+	if err := copyHTTPBody(&out, r, false, 100); err == nil {
+		t.Error("正文不足 Content-Length 时应返回错误")
+	}
+}
@@ -0,0 +1,278 @@
+package httpproxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyAuthRealm = "ech-tunnel"
+	digestNonceTTL = 5 * time.Minute // Digest nonce 有效期，过期后以 stale=true 要求客户端换用新 nonce
+)
+
+// digestKey 签发 Digest nonce 的进程级密钥（nonce 无需服务端保存，重启后旧 nonce 失效）
+var digestKey = func() []byte {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		panic(err)
+	}
+	return k
+}()
+
+// digestCounters 各 nonce 已接受的最大 nc，拒绝重复或回退的 nc，防止截获的 Proxy-Authorization 被原样重放
+var digestCounters = struct {
+	sync.Mutex
+	m map[string]digestCounter
+}{m: make(map[string]digestCounter)}
+
+type digestCounter struct {
+	nc      uint64
+	expires time.Time // 不晚于 nonce 过期时间，此后 nonce 本身已失效，记录可以清理
+}
+
+// Validate 校验转发头处理方式与认证参数（?auth=basic|digest|bearer 与 ?bearer=），并补全默认值
+func (c *Config) Validate() error {
+	if c.Forwarded == "" {
+		c.Forwarded = "keep"
+	}
+	switch c.Forwarded {
+	case "keep", "add", "strip":
+	default:
+		return fmt.Errorf("无效的转发头处理方式: %s（可选 keep|add|strip）", c.Forwarded)
+	}
+	if c.Auth == "" {
+		c.Auth = "basic"
+		if c.Bearer != "" {
+			c.Auth = "bearer"
+		}
+	}
+	switch c.Auth {
+	case "basic", "digest":
+		if c.Bearer != "" {
+			return fmt.Errorf("?bearer= 只能用于 auth=bearer")
+		}
+		if c.Auth == "digest" && (c.Username == "" || c.Password == "") {
+			// Digest 需要明文密码计算摘要，无法使用只保存哈希的 htpasswd 文件
+			return fmt.Errorf("auth=digest 需要在地址中指定 user:pass@（不支持 ?htpasswd=）")
+		}
+		if c.Htpasswd != nil && c.Username != "" {
+			return fmt.Errorf("?htpasswd= 与地址中的用户名密码只能指定一个")
+		}
+	case "bearer":
+		if c.Bearer == "" {
+			return fmt.Errorf("auth=bearer 需要 ?bearer=<令牌>")
+		}
+		if c.Username != "" || c.Htpasswd != nil {
+			return fmt.Errorf("auth=bearer 不使用用户名密码或凭据文件")
+		}
+	default:
+		return fmt.Errorf("无效的认证方式: %s（可选 basic|digest|bearer）", c.Auth)
+	}
+	return nil
+}
+
+// AuthRequired 代理是否要求认证
+func (c *Config) AuthRequired() bool {
+	return (c.Username != "" && c.Password != "") || c.Bearer != "" || c.Htpasswd != nil
+}
+
+// CheckUserPass 校验 SOCKS5 用户名密码认证；bearer 方式下密码为令牌，用户名任意
+func (c *Config) CheckUserPass(user, pass string) bool {
+	if c.Auth == "bearer" {
+		return constantTimeEqual(pass, c.Bearer)
+	}
+	if c.Htpasswd != nil {
+		return c.Htpasswd.check(user, pass)
+	}
+	return constantTimeEqual(user, c.Username) && constantTimeEqual(pass, c.Password)
+}
+
+// checkHTTPAuth 按认证方式校验 Proxy-Authorization（method 与 uri 为请求行中的方法与目标，Digest 计算摘要时使用）
+func (c *Config) checkHTTPAuth(method, uri string, headers map[string]string) bool {
+	authHeader := headerValue(headers, "Proxy-Authorization")
+	switch c.Auth {
+	case "digest":
+		return c.checkDigest(method, uri, authHeader)
+	case "bearer":
+		token, ok := strings.CutPrefix(authHeader, "Bearer ")
+		return ok && constantTimeEqual(strings.TrimSpace(token), c.Bearer)
+	default:
+		user, pass, ok := parseBasicAuth(authHeader)
+		return ok && c.CheckUserPass(user, pass)
+	}
+}
+
+// writeProxyAuthRequired 回复 407 及对应认证方式的质询；keepAlive 为 false 时告知客户端连接将关闭
+func writeProxyAuthRequired(conn net.Conn, c *Config, method, uri string, headers map[string]string, keepAlive bool) {
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 407 Proxy Authentication Required\r\n")
+	switch c.Auth {
+	case "digest":
+		_, stale := c.verifyDigest(method, uri, headerValue(headers, "Proxy-Authorization"))
+		nonce := newDigestNonce(time.Now())
+		// 同时提供 SHA-256 与 MD5，客户端选用其支持的第一种
+		for _, alg := range []string{"SHA-256", "MD5"} {
+			fmt.Fprintf(&b, "Proxy-Authenticate: Digest realm=%q, qop=\"auth\", algorithm=%s, nonce=%q", proxyAuthRealm, alg, nonce)
+			if stale {
+				b.WriteString(", stale=true")
+			}
+			b.WriteString("\r\n")
+		}
+	case "bearer":
+		fmt.Fprintf(&b, "Proxy-Authenticate: Bearer realm=%q\r\n", proxyAuthRealm)
+	default:
+		b.WriteString("Proxy-Authenticate: Basic realm=\"Proxy\"\r\n")
+	}
+	if !keepAlive {
+		b.WriteString("Connection: close\r\n")
+	}
+	b.WriteString("Content-Length: 0\r\n\r\n")
+	conn.Write([]byte(b.String()))
+}
+
+// newDigestNonce 签发 nonce：签发时间及其 HMAC，校验时无需查表
+func newDigestNonce(now time.Time) string {
+	buf := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(buf, uint64(now.Unix()))
+	mac := hmac.New(sha256.New, digestKey)
+	mac.Write(buf)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(buf))
+}
+
+// checkDigestNonce 校验 nonce 是否由本进程签发，并返回是否已过期
+func checkDigestNonce(nonce string, now time.Time) (valid, expired bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 8+sha256.Size {
+		return false, false
+	}
+	mac := hmac.New(sha256.New, digestKey)
+	mac.Write(raw[:8])
+	if !hmac.Equal(mac.Sum(nil), raw[8:]) {
+		return false, false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	return true, now.Sub(issued) > digestNonceTTL
+}
+
+// checkDigest 校验 Digest 认证，并要求 nc 在同一 nonce 下严格递增
+func (c *Config) checkDigest(method, uri, authHeader string) bool {
+	p, _ := c.verifyDigest(method, uri, authHeader)
+	if p == nil {
+		return false
+	}
+	nc, err := strconv.ParseUint(p["nc"], 16, 64)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	digestCounters.Lock()
+	defer digestCounters.Unlock()
+	if last, seen := digestCounters.m[p["nonce"]]; seen && nc <= last.nc {
+		return false
+	}
+	if len(digestCounters.m) >= 4096 {
+		for k, e := range digestCounters.m {
+			if now.After(e.expires) {
+				delete(digestCounters.m, k)
+			}
+		}
+	}
+	digestCounters.m[p["nonce"]] = digestCounter{nc: nc, expires: now.Add(digestNonceTTL)}
+	return true
+}
+
+// verifyDigest 校验 Digest 摘要（RFC 7616，qop=auth，MD5 或 SHA-256），uri 须与请求行中的目标一致
+// （CONNECT 为 host:port），使截获的凭据不能用于其他目标；ok 时返回认证参数。
+// 摘要正确但 nonce 已过期时 params 为 nil 并返回 stale，质询中据此提示客户端直接用新 nonce 重试
+func (c *Config) verifyDigest(method, uri, authHeader string) (params map[string]string, stale bool) {
+	rest, found := strings.CutPrefix(authHeader, "Digest ")
+	if !found {
+		return nil, false
+	}
+	p := parseAuthParams(rest)
+	var newHash func() hash.Hash
+	switch strings.ToUpper(p["algorithm"]) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return nil, false
+	}
+	if p["username"] != c.Username || p["realm"] != proxyAuthRealm || p["qop"] != "auth" || p["cnonce"] == "" || p["nc"] == "" || p["uri"] != uri {
+		return nil, false
+	}
+	valid, expired := checkDigestNonce(p["nonce"], time.Now())
+	if !valid {
+		return nil, false
+	}
+	want := digestResponse(newHash, c.Username, proxyAuthRealm, c.Password, method, p["uri"], p["nonce"], p["nc"], p["cnonce"])
+	if !constantTimeEqual(strings.ToLower(p["response"]), want) {
+		return nil, false
+	}
+	if expired {
+		return nil, true
+	}
+	return p, false
+}
+
+// digestResponse 按 RFC 7616 计算 qop=auth 时的 response 摘要
+func digestResponse(newHash func() hash.Hash, username, realm, password, method, uri, nonce, nc, cnonce string) string {
+	h := func(s string) string {
+		d := newHash()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	ha1 := h(username + ":" + realm + ":" + password)
+	ha2 := h(method + ":" + uri)
+	return h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+}
+
+// parseAuthParams 解析 key=value 或 key="value" 逗号分隔的认证参数
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// 带引号的值，处理反斜杠转义
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value, s = b.String(), rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// constantTimeEqual 常数时间比较两个字符串
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
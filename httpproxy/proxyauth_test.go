@@ -0,0 +1,76 @@
+package httpproxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"testing"
+	"time"
+)
+
+func TestDigestResponse(t *testing.T) {
+	// RFC 7616 第 3.9.1 节的示例
+	const (
+		nonce  = "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+		cnonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+	)
+	tests := []struct {
+		name    string
+		newHash func() hash.Hash
+		want    string
+	}{
+		{"MD5", md5.New, "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", sha256.New, "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		got := digestResponse(tt.newHash, "Mufasa", "http-auth@example.org", "Circle of Life", "GET", "/dir/index.html", nonce, "00000001", cnonce)
+		if got != tt.want {
+			t.Errorf("%s: digestResponse = %s，期望 %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	got := parseAuthParams(`username="Mufasa", realm="http-auth@example.org", uri="/dir/index.html", algorithm=SHA-256, nc=00000001, qop=auth, opaque="a\"b,c"`)
+	want := map[string]string{
+		"username": "Mufasa", "realm": "http-auth@example.org", "uri": "/dir/index.html",
+		"algorithm": "SHA-256", "nc": "00000001", "qop": "auth", "opaque": `a"b,c`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseAuthParams = %v，期望 %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q，期望 %q", k, got[k], v)
+		}
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	c := &Config{Username: "user", Password: "pass"}
+	header := func(nonce, uri, nc string) string {
+		resp := digestResponse(sha256.New, "user", proxyAuthRealm, "pass", "CONNECT", uri, nonce, nc, "cn")
+		return `Digest username="user", realm="` + proxyAuthRealm + `", nonce="` + nonce + `", uri="` + uri +
+			`", algorithm=SHA-256, qop=auth, nc=` + nc + `, cnonce="cn", response="` + resp + `"`
+	}
+	fresh := newDigestNonce(time.Now())
+	old := newDigestNonce(time.Now().Add(-2 * digestNonceTTL))
+	tests := []struct {
+		name      string
+		uri       string
+		auth      string
+		ok, stale bool
+	}{
+		{"valid", "example.com:443", header(fresh, "example.com:443", "00000001"), true, false},
+		{"other target", "other.com:443", header(fresh, "example.com:443", "00000001"), false, false},
+		{"forged nonce", "example.com:443", header("AAAA", "example.com:443", "00000001"), false, false},
+		{"expired nonce", "example.com:443", header(old, "example.com:443", "00000001"), false, true},
+		{"basic", "example.com:443", "Basic dXNlcjpwYXNz", false, false},
+	}
+	for _, tt := range tests {
+		p, stale := c.verifyDigest("CONNECT", tt.uri, tt.auth)
+		if (p != nil) != tt.ok || stale != tt.stale {
+			t.Errorf("%s: verifyDigest = %v, stale %v，期望通过 %v, stale %v", tt.name, p != nil, stale, tt.ok, tt.stale)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Package dnsmsg 提供 ECH 配置查询与服务端目标解析共用的 DNS 报文编解码。
+package dnsmsg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// DNS 记录类型
+const (
+	TypeA     = 1  // A 记录
+	TypeAAAA  = 28 // AAAA 记录
+	TypeHTTPS = 65 // HTTPS 记录
+)
+
+// BuildQuery 构建 DNS 查询报文（ID 随机，增加伪造应答的难度）
+func BuildQuery(domain string, qtype uint16) []byte {
+	query := make([]byte, 2, 512)
+	// Header
+	_, _ = rand.Read(query[:2])                               // ID
+	query = append(query, 0x01, 0x00)                         // 标准查询
+	query = append(query, 0x00, 0x01)                         // QDCOUNT = 1
+	query = append(query, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // AN/NS/AR = 0
+	// QNAME
+	for _, label := range strings.Split(domain, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, []byte(label)...)
+	}
+	query = append(query, 0x00) // root
+	// QTYPE/QCLASS
+	query = append(query, byte(qtype>>8), byte(qtype))
+	query = append(query, 0x00, 0x01) // IN
+	return query
+}
+
+// CheckResponse 校验响应的 ID 与问题段是否与查询一致（域名不区分大小写）
+func CheckResponse(query, resp []byte) error {
+	if len(resp) < 12 || len(query) < 12 {
+		return errors.New("响应长度无效")
+	}
+	if resp[0] != query[0] || resp[1] != query[1] || resp[2]&0x80 == 0 {
+		return errors.New("响应 ID 与查询不一致")
+	}
+	qend := SkipName(query, 12) + 4
+	if qend > len(query) || qend > len(resp) || binary.BigEndian.Uint16(resp[4:6]) != 1 ||
+		!bytes.EqualFold(resp[12:qend], query[12:qend]) {
+		return errors.New("响应的问题段与查询不一致")
+	}
+	return nil
+}
+
+// SkipName 跳过报文中 offset 处的域名（支持压缩指针），返回其后的偏移
+func SkipName(msg []byte, offset int) int {
+	for offset < len(msg) {
+		l := int(msg[offset])
+		switch {
+		case l == 0:
+			return offset + 1
+		case l&0xC0 == 0xC0:
+			return offset + 2
+		default:
+			offset += l + 1
+		}
+	}
+	return len(msg) + 1
+}
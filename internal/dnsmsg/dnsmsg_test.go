@@ -0,0 +1,53 @@
+package dnsmsg
+
+import (
+	"testing"
+
+	"ech-tunnel/internal/dnsmsg/dnstest"
+)
+
+func TestCheckResponse(t *testing.T) {
+	query := dnstest.Query(0xBEEF, "Example.COM", TypeA)
+	mixedCase := dnstest.Response(dnstest.Query(0xBEEF, "example.com", TypeA), 0)
+	otherID := dnstest.Response(dnstest.Query(0xBEEE, "example.com", TypeA), 0)
+	otherName := dnstest.Response(dnstest.Query(0xBEEF, "example.org", TypeA), 0)
+	otherType := dnstest.Response(dnstest.Query(0xBEEF, "example.com", TypeAAAA), 0)
+	tests := []struct {
+		name string
+		resp []byte
+		ok   bool
+	}{
+		{"match", dnstest.Response(query, 0), true},
+		{"case insensitive", mixedCase, true},
+		{"other id", otherID, false},
+		{"other name", otherName, false},
+		{"other type", otherType, false},
+		{"not a response", query, false},
+		{"short", query[:11], false},
+	}
+	for _, tt := range tests {
+		if err := CheckResponse(query, tt.resp); (err == nil) != tt.ok {
+			t.Errorf("%s: CheckResponse = %v，期望通过 %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestSkipName(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    []byte
+		offset int
+		want   int
+	}{
+		{"root", []byte{0}, 0, 1},
+		{"labels", []byte{3, 'w', 'w', 'w', 2, 'i', 'o', 0, 0xFF}, 0, 8},
+		{"pointer", []byte{0, 0, 0xC0, 0x0C, 0xFF}, 2, 4},
+		{"label then pointer", []byte{1, 'a', 0xC0, 0x0C}, 0, 4},
+		{"truncated", []byte{5, 'a', 'b'}, 0, 4},
+	}
+	for _, tt := range tests {
+		if got := SkipName(tt.msg, tt.offset); got != tt.want {
+			t.Errorf("%s: SkipName = %d，期望 %d", tt.name, got, tt.want)
+		}
+	}
+}
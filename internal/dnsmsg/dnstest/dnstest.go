@@ -0,0 +1,52 @@
+// Package dnstest 构造测试用的 DNS 查询与应答报文。
+package dnstest
+
+import "encoding/binary"
+
+// Query 构造 ID 为 id、查询 name 的 qtype 记录的报文
+func Query(id uint16, name string, qtype uint16) []byte {
+	msg := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range splitLabels(name) {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(msg, qtype), 1)
+}
+
+func splitLabels(name string) []string {
+	var labels []string
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || name[i] == '.' {
+			if i > start {
+				labels = append(labels, name[start:i])
+			}
+			start = i + 1
+		}
+	}
+	return labels
+}
+
+// RR 一条以压缩指针引用问题段域名（偏移 12）的资源记录
+type RR struct {
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+// Response 以 query 的 ID 与问题段构造应答，rcode 为响应码
+func Response(query []byte, rcode byte, answers ...RR) []byte {
+	msg := append([]byte(nil), query...)
+	msg[2], msg[3] = 0x81, 0x80|rcode
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(answers)))
+	for _, rr := range answers {
+		msg = append(msg, 0xC0, 12)
+		msg = binary.BigEndian.AppendUint16(msg, rr.Type)
+		msg = binary.BigEndian.AppendUint16(msg, 1)
+		msg = binary.BigEndian.AppendUint32(msg, rr.TTL)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rr.Data)))
+		msg = append(msg, rr.Data...)
+	}
+	return msg
+}
@@ -0,0 +1,99 @@
+// Package netutil 汇集 ech-tunnel 各包共用的网络辅助函数。
+package netutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// RaceDial 按顺序错峰以 dial 发起连接尝试，返回最先成功的连接（delay 为 0 时仅在失败后尝试下一个地址）
+func RaceDial(ctx context.Context, addrs []string, delay time.Duration, dial func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			c, err := dial(ctx, addr)
+			results <- result{c, err}
+		}()
+	}
+
+	var timer *time.Timer
+	var tick <-chan time.Time
+	if delay > 0 {
+		timer = time.NewTimer(delay)
+		defer timer.Stop()
+		tick = timer.C
+	}
+	startNext := func() {
+		if next < len(addrs) {
+			start()
+			if timer != nil {
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	start()
+	var errs []string
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 关闭其余尝试中晚到的成功连接
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if late := <-results; late.conn != nil {
+							_ = late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err.Error())
+			startNext()
+		case <-tick:
+			startNext()
+		}
+	}
+	if len(errs) == 1 {
+		return nil, errors.New(errs[0])
+	}
+	return nil, fmt.Errorf("所有地址均连接失败: %s", strings.Join(errs, "; "))
+}
+
+// IsNormalCloseError 判断是否为正常的网络关闭错误
+func IsNormalCloseError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	errStr := err.Error()
+	return strings.Contains(errStr, "use of closed network connection") ||
+		strings.Contains(errStr, "broken pipe") ||
+		strings.Contains(errStr, "connection reset by peer") ||
+		strings.Contains(errStr, "normal closure")
+}
+
+// CloseWrite 关闭连接的写方向（发送 FIN），连接不支持半关闭时返回 false
+func CloseWrite(c net.Conn) bool {
+	cw, ok := c.(interface{ CloseWrite() error })
+	return ok && cw.CloseWrite() == nil
+}
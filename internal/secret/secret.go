@@ -0,0 +1,42 @@
+// Package secret 读取或生成控制套接字令牌、审计日志摘要密钥等本地密钥文件。
+package secret
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// LoadOrCreate 读取 path 中的密钥；文件不存在时生成 32 字节随机密钥，以十六进制写入（权限 0600）
+func LoadOrCreate(path string) (string, error) {
+	if b, err := os.ReadFile(path); err == nil {
+		secret := strings.TrimSpace(string(b))
+		if secret == "" {
+			return "", fmt.Errorf("%s 为空", path)
+		}
+		return secret, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b[:])
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintln(f, secret); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	log.Printf("已生成密钥文件 %s", path)
+	return secret, nil
+}
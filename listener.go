@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"ech-tunnel/tunnel"
+)
+
+var (
+	// 需要在退出时清理的 UNIX 套接字文件
+	unixSocketsMu sync.Mutex
+	unixSockets   []string
+	cleanupOnce   sync.Once
+)
+
+// isUnixAddr 判断是否为 unix:// 监听地址
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, "unix://")
+}
+
+// listenLocal 创建本地监听器，支持 host:port 与 unix:///path/to.sock，family 为 TCP 监听的地址族
+// （auto|dual|ipv4|ipv6）；开启 -proxy-protocol 时要求每个连接携带 PROXY 协议头
+func listenLocal(addr, family string) (net.Listener, error) {
+	ln, err := listenLocalRaw(addr, family)
+	if err != nil || !proxyProtocol {
+		return ln, err
+	}
+	return &proxyProtoListener{Listener: ln}, nil
+}
+
+func listenLocalRaw(addr, family string) (net.Listener, error) {
+	if !isUnixAddr(addr) {
+		ln, err := tunnel.ListenTCPFamily(addr, family)
+		if err != nil {
+			return nil, err
+		}
+		return &tunedListener{Listener: ln, opts: sockOpts()}, nil
+	}
+
+	path := strings.TrimPrefix(addr, "unix://")
+	if path == "" {
+		return nil, fmt.Errorf("UNIX 套接字路径为空")
+	}
+
+	// 先解析权限再创建套接字，参数无效时不留下套接字文件
+	mode, err := strconv.ParseUint(unixSocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return nil, fmt.Errorf("无效的套接字权限 %q", unixSocketMode)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	// 套接字以仅当前用户可访问的权限创建，再放宽到 -unix-socket-mode，
+	// 不存在其他用户可以连接的中间窗口
+	ln, err := listenPrivateUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("设置套接字权限失败: %v", err)
+	}
+
+	registerUnixSocketCleanup(path)
+	return ln, nil
+}
+
+// removeStaleSocket 清理上次异常退出残留的套接字文件（仍有进程监听时不删除）
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s 已存在且不是套接字文件", path)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("%s 已被其他进程监听", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("删除残留套接字失败: %v", err)
+	}
+	return nil
+}
+
+// connLimiter 单个本地监听器的并发连接上限（-max-conns）与等待队列（-accept-queue）：
+// 名额已满时新连接排队等待（不读取数据），队列也满时立即拒绝，处理协程数因此有上限
+type connLimiter struct {
+	addr  string
+	max   int
+	queue int
+	slots chan struct{}
+
+	mu sync.Mutex
+	n  int // 已接受的连接数（处理中与排队中）
+}
+
+// newConnLimiter 按参数创建监听器 addr 的连接限制（未设置 -max-conns 时返回 nil，不限制）
+func newConnLimiter(addr string) *connLimiter {
+	if maxConns <= 0 {
+		return nil
+	}
+	return &connLimiter{addr: addr, max: maxConns, queue: acceptQueue, slots: make(chan struct{}, maxConns)}
+}
+
+// enter 在接受循环中为新连接预留处理名额或排队位置，均已占满时返回 false
+func (l *connLimiter) enter() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n >= l.max+l.queue {
+		return false
+	}
+	l.n++
+	if l.n > l.max {
+		log.Printf("监听 %s 的连接数已达上限 %d，新连接排队等待（%d/%d）", l.addr, l.max, l.n-l.max, l.queue)
+	}
+	return true
+}
+
+// wait 阻塞至获得处理名额（enter 返回 true 后在连接的处理协程中调用）
+func (l *connLimiter) wait() {
+	if l != nil {
+		l.slots <- struct{}{}
+	}
+}
+
+// leave 连接处理结束，释放名额
+func (l *connLimiter) leave() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+	l.mu.Lock()
+	l.n--
+	l.mu.Unlock()
+}
+
+// registerUnixSocketCleanup 在收到退出信号时删除套接字文件
+func registerUnixSocketCleanup(path string) {
+	unixSocketsMu.Lock()
+	unixSockets = append(unixSockets, path)
+	unixSocketsMu.Unlock()
+
+	cleanupOnce.Do(func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-sigCh
+			unixSocketsMu.Lock()
+			for _, p := range unixSockets {
+				_ = os.Remove(p)
+			}
+			unixSocketsMu.Unlock()
+			log.Printf("收到信号 %v，已清理 UNIX 套接字并退出", sig)
+			os.Exit(0)
+		}()
+	})
+}
+
+// tunedListener 对接受的每个连接应用 TCP 套接字选项
+type tunedListener struct {
+	net.Listener
+	opts tunnel.SockOpts
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.opts.Tune(c)
+	}
+	return c, err
+}
@@ -0,0 +1,41 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenLocalUnixMode(t *testing.T) {
+	defer func(m string) { unixSocketMode = m }(unixSocketMode)
+	path := filepath.Join(t.TempDir(), "t.sock")
+
+	unixSocketMode = "0640"
+	ln, err := listenLocalRaw("unix://"+path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0o640 {
+		t.Errorf("套接字权限 %o，期望 640", got)
+	}
+
+	// 权限参数无效时不创建套接字
+	os.Remove(path)
+	for _, mode := range []string{"rw", "1777", "999"} {
+		unixSocketMode = mode
+		if ln, err := listenLocalRaw("unix://"+path, ""); err == nil {
+			ln.Close()
+			t.Errorf("接受了无效的权限 %q", mode)
+		}
+		if _, err := os.Lstat(path); err == nil {
+			t.Errorf("权限 %q 无效时仍创建了套接字文件", mode)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// logTag syslog/journald 中的程序标识
+const logTag = "ech-tunnel"
+
+// initLogOutput 按 -log-output 设置日志输出目标：
+//
+//	stderr                     默认，输出到标准错误
+//	syslog                     本机 syslog（/dev/log）
+//	syslog://host:514          远程 syslog（UDP），syslog+tcp://host:601 使用 TCP
+//	journald                   systemd-journald 原生协议
+//
+// syslog 与 journald 自带时间戳，日志行不再重复记录时间
+func initLogOutput() error {
+	if logOutput == "" || logOutput == "stderr" {
+		return nil
+	}
+	var w *logSink
+	switch {
+	case logOutput == "journald":
+		w = &logSink{network: "unixgram", addr: "/run/systemd/journal/socket", format: formatJournald}
+	case logOutput == "syslog":
+		w = &logSink{network: "unixgram", addr: "/dev/log", format: formatSyslog}
+	default:
+		u, err := url.Parse(logOutput)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("无效的日志输出: %s（可选 stderr|syslog|syslog://host:port|syslog+tcp://host:port|journald）", logOutput)
+		}
+		switch u.Scheme {
+		case "syslog", "syslog+udp":
+			w = &logSink{network: "udp", addr: u.Host, format: formatSyslog}
+		case "syslog+tcp":
+			w = &logSink{network: "tcp", addr: u.Host, format: formatSyslog}
+		default:
+			return fmt.Errorf("不支持的日志输出协议: %s", u.Scheme)
+		}
+		if u.Port() == "" {
+			w.addr = net.JoinHostPort(u.Hostname(), "514")
+		}
+	}
+	if err := w.dial(); err != nil {
+		return fmt.Errorf("连接日志输出 %s 失败: %w", logOutput, err)
+	}
+	w.hostname, _ = os.Hostname()
+	log.SetFlags(0)
+	log.SetOutput(w)
+	return nil
+}
+
+// logSink 将每条日志作为一条 syslog/journald 消息发送。发送失败时断开并在后台按退避间隔重连，
+// 断开期间的日志写到标准错误，日志调用方不会因重连而阻塞
+type logSink struct {
+	mu       sync.Mutex
+	network  string
+	addr     string
+	hostname string
+	format   func(w *logSink, msg []byte) []byte
+	conn     net.Conn
+
+	dialing bool          // 后台重连进行中
+	backoff time.Duration // 下次重连失败后的等待时间
+	retryAt time.Time     // 此前不再发起重连
+}
+
+const (
+	logDialTimeout  = 5 * time.Second
+	logWriteTimeout = 2 * time.Second // 远程 syslog 接收缓慢时单条日志的写入上限
+	logMinBackoff   = time.Second
+	logMaxBackoff   = time.Minute
+)
+
+func (w *logSink) dial() error {
+	c, err := net.DialTimeout(w.network, w.addr, logDialTimeout)
+	if err != nil {
+		return err
+	}
+	w.conn = c
+	return nil
+}
+
+// Write 由 log 包对每条日志调用一次
+func (w *logSink) Write(p []byte) (int, error) {
+	msg := w.format(w, bytes.TrimRight(p, "\n"))
+	w.mu.Lock()
+	if w.conn != nil {
+		_ = w.conn.SetWriteDeadline(time.Now().Add(logWriteTimeout))
+		if _, err := w.conn.Write(msg); err == nil {
+			w.mu.Unlock()
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	if !w.dialing && time.Now().After(w.retryAt) {
+		w.dialing = true
+		go w.redial()
+	}
+	w.mu.Unlock()
+	return os.Stderr.Write(p)
+}
+
+// redial 在后台重连日志输出，失败时按指数退避（1 秒起，至多 1 分钟）推迟下次重连
+func (w *logSink) redial() {
+	c, err := net.DialTimeout(w.network, w.addr, logDialTimeout)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dialing = false
+	if err != nil {
+		w.backoff = min(max(w.backoff*2, logMinBackoff), logMaxBackoff)
+		w.retryAt = time.Now().Add(w.backoff)
+		fmt.Fprintf(os.Stderr, "重连日志输出 %s 失败: %v，%s 后重试\n", w.addr, err, w.backoff)
+		return
+	}
+	w.conn, w.backoff = c, 0
+}
+
+// formatSyslog RFC 3164 格式（facility daemon，severity info），TCP 以换行分隔消息
+func formatSyslog(w *logSink, msg []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>%s %s %s[%d]: ", 3<<3|6, time.Now().Format(time.Stamp), w.hostname, logTag, os.Getpid())
+	b.Write(msg)
+	if w.network == "tcp" {
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// formatJournald journald 原生协议：每行一个字段，含换行的 MESSAGE 使用长度前缀的二进制格式
+func formatJournald(_ *logSink, msg []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "SYSLOG_IDENTIFIER=%s\nPRIORITY=6\n", logTag)
+	if bytes.IndexByte(msg, '\n') < 0 {
+		b.WriteString("MESSAGE=")
+		b.Write(msg)
+	} else {
+		b.WriteString("MESSAGE\n")
+		_ = binary.Write(&b, binary.LittleEndian, uint64(len(msg)))
+		b.Write(msg)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
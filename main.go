@@ -1,66 +1,491 @@
-package main
-
-import (
-	"flag"
-	"log"
-	"strings"
-)
-
-// 全局参数
-var (
-	listenAddr    string
-	forwardAddr   string
-	ipAddr        string
-	certFile      string
-	keyFile       string
-	token         string
-	cidrs         string
-	connectionNum int
-
-	// ECH/DNS 参数
-	dnsServer string // -dns
-	echDomain string // -ech
-
-	// 多通道连接池
-	echPool *ECHPool
-)
-
-func init() {
-	flag.StringVar(&listenAddr, "l", "", "监听地址 (tcp://监听1/目标1,监听2/目标2,... 或 ws://ip:port/path 或 wss://ip:port/path 或 proxy://[user:pass@]ip:port)")
-	flag.StringVar(&forwardAddr, "f", "", "服务地址 (格式: wss://host:port/path)")
-	flag.StringVar(&ipAddr, "ip", "", "指定解析的IP地址（仅客户端：将 wss 主机名定向到该 IP 连接）")
-	flag.StringVar(&certFile, "cert", "", "TLS证书文件路径（默认:自动生成，仅服务端）")
-	flag.StringVar(&keyFile, "key", "", "TLS密钥文件路径（默认:自动生成，仅服务端）")
-	flag.StringVar(&token, "token", "", "身份验证令牌（WebSocket Subprotocol）")
-	flag.StringVar(&cidrs, "cidr", "0.0.0.0/0,::/0", "允许的来源 IP 范围 (CIDR),多个范围用逗号分隔")
-	flag.StringVar(&dnsServer, "dns", "dns.alidns.com/dns-query", "查询 ECH 公钥所用的 DoH 服务器地址")
-	flag.StringVar(&echDomain, "ech", "cloudflare-ech.com", "用于查询 ECH 公钥的域名")
-	flag.IntVar(&connectionNum, "n", 3, "WebSocket连接数量")
-}
-
-func main() {
-	flag.Parse()
-
-	if strings.HasPrefix(listenAddr, "ws://") || strings.HasPrefix(listenAddr, "wss://") {
-		runWebSocketServer(listenAddr)
-		return
-	}
-	if strings.HasPrefix(listenAddr, "tcp://") {
-		// 客户端模式：预先获取 ECH 公钥（失败则直接退出，严格禁止回退）
-		if err := prepareECH(); err != nil {
-			log.Fatalf("[客户端] 获取 ECH 公钥失败: %v", err)
-		}
-		runTCPClient(listenAddr, forwardAddr)
-		return
-	}
-	if strings.HasPrefix(listenAddr, "proxy://") {
-		// 代理模式（支持 SOCKS5 和 HTTP）：预先获取 ECH 公钥
-		if err := prepareECH(); err != nil {
-			log.Fatalf("[代理] 获取 ECH 公钥失败: %v", err)
-		}
-		runProxyServer(listenAddr, forwardAddr)
-		return
-	}
-
-	log.Fatal("监听地址格式错误，请使用 ws://, wss://, tcp:// 或 proxy:// 前缀")
-}
+package main
+
+import (
+	"flag"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ech-tunnel/protocol"
+	"ech-tunnel/socks5"
+	"ech-tunnel/tunnel"
+)
+
+// 全局参数
+var (
+	listenAddrs   stringList // -l（客户端模式可重复）
+	forwardAddr   string
+	ipAddr        string
+	upstreamAddrs string // -upstream
+	certFile      string
+	keyFile       string
+	token         string
+	psk           string
+	cidrs         string
+	connectionNum int
+
+	// 候选 IP 探测参数
+	ipProbeInterval time.Duration // -ip-probe
+
+	// 通道分配参数
+	channelStreams int    // -channel-streams
+	claimMode      string // -claim
+
+	// TLS 参数
+	pinSHA256  string // -pin-sha256
+	clientCert string // -client-cert
+	clientKey  string // -client-key
+	clientCA   string // -client-ca
+	echKeyFile string // -ech-key
+
+	// ECH/DNS 参数
+	dnsServer      string // -dns
+	dnsBootstrapIP string // -dns-bootstrap-ip
+	dnsProxy       string // -dns-proxy
+	echDomain      string // -ech
+	echMode        string // -ech-mode
+	echCachePath   string // -ech-cache
+	echOuterSNI    string // -ech-outer-sni
+	echHostFirst   bool   // -ech-host-first
+	allowPlainSNI  bool   // -allow-plaintext-sni
+
+	// 握手伪装参数
+	tlsFingerprint     string     // -tls-fingerprint
+	upgradeHeaderSpecs stringList // -header（可重复）
+	sniName            string     // -sni
+	hostHeader         string     // -host
+
+	// 传输参数
+	pingInterval      time.Duration // -ping-interval
+	pongTimeout       time.Duration // -pong-timeout
+	pongMissLimit     int           // -pong-miss
+	paceRate          float64       // -pace
+	coalesceDelay     time.Duration // -coalesce
+	noDelayPorts      string        // -nodelay-ports
+	sniffTimeout      time.Duration // -sniff-timeout
+	socksSniffTimeout time.Duration // -socks-sniff-timeout
+	udpIdleTimeout    time.Duration // -udp-idle-timeout
+	dialTimeout       time.Duration // -dial-timeout
+	connectTimeout    time.Duration // -connect-timeout
+	ackInterval       time.Duration // -ack-interval
+	resumeTimeout     time.Duration // -resume-timeout
+	maxFrameSize      int           // -max-frame
+	wireFrameSize     int           // -wire-frame
+	wsCompress        bool          // -ws-compress
+	zstdPayload       bool          // -zstd
+	muxMode           string        // -mux
+	wsCompressLvl     int           // -ws-compress-level
+
+	// TCP 套接字参数（本地监听接受的连接与服务端出站连接）
+	tcpNoDelay   bool          // -tcp-nodelay
+	tcpKeepAlive time.Duration // -tcp-keepalive
+	tcpRecvBuf   int           // -tcp-rcvbuf
+	tcpSendBuf   int           // -tcp-sndbuf
+
+	// 内存预算参数
+	memBudgetMB    int // -mem-budget
+	streamBufferMB int // -stream-buffer
+
+	// 流统计参数
+	streamStatsLog      bool          // -stream-stats
+	streamStatsInterval time.Duration // -stream-stats-interval
+
+	// 流量混淆参数
+	paddingEnabled  bool          // -padding
+	padBudget       int           // -pad-budget
+	padIdleInterval time.Duration // -pad-idle
+
+	// 本地监听参数
+	unixSocketMode string // -unix-mode
+	proxyProtocol  bool   // -proxy-protocol
+	httpForwarded  string // -http-forwarded
+	udpRebind      bool   // -udp-rebind
+	dnsCacheSize   int    // -dns-cache
+	maxConns       int    // -max-conns
+	acceptQueue    int    // -accept-queue
+	listenFamily   string // -listen-family
+
+	// 通道全部不可用时的本地连接处理参数
+	whenDown         string        // -when-down
+	downQueue        int           // -down-queue
+	downQueueTimeout time.Duration // -down-queue-timeout
+
+	// Windows 服务参数
+	serviceCmd  string // -service
+	serviceName string // -service-name
+
+	// 服务端参数
+	fallbackURL   string     // -fallback-url
+	extraPaths    stringList // -path（可重复）
+	allowBench    bool       // -allow-bench
+	handshakeRate int        // -handshake-rate
+
+	// 出站连接参数（仅服务端）
+	preferFamily       string        // -prefer-family
+	happyEyeballsDelay time.Duration // -happy-eyeballs-delay
+	resolverAddr       string        // -resolver
+	resolverTTL        time.Duration // -resolver-ttl
+	resolveCacheTTL    time.Duration // -resolve-cache
+	egressIP           string        // -egress-ip
+	egressInterface    string        // -egress-interface
+	egressMark         uint          // -egress-mark
+	blockPorts         string        // -block-ports
+	allowPorts         string        // -allow-ports
+	denyPrivate        bool          // -deny-private
+	denyCIDRs          string        // -deny-cidr
+	tokenPolicySpecs   stringList    // -token-policy（可重复）
+
+	// 访问日志参数（仅服务端）
+	accessLogPath    string        // -access-log
+	accessLogMaxSize int           // -access-log-max-size
+	accessLogRotate  time.Duration // -access-log-rotate
+	accessLogBackups int           // -access-log-backups
+	usageFile        string        // -usage-file
+	auditLogPath     string        // -audit-log
+	auditDest        string        // -audit-dest
+	auditSecretFile  string        // -audit-secret-file
+
+	// GeoIP 访问控制参数（仅服务端）
+	geoIPDB    string // -geoip-db
+	geoIPAllow string // -geoip-allow
+	geoIPDeny  string // -geoip-deny
+
+	// 日志参数
+	logOutput string // -log-output
+
+	// 管理接口参数
+	adminAddr    string   // -admin
+	adminToken   string   // -admin-token
+	ctlAddr      string   // -ctl
+	ctlTokenFile string   // -ctl-token-file
+	ctlArgs      []string // ctl 子命令发送的命令（为 nil 时正常运行）
+	echKeygen    string   // ech-keygen 子命令的外层 SNI（为空时正常运行）
+
+	// 测速与诊断参数
+	benchDuration time.Duration // -bench
+	benchStreams  int           // -bench-streams
+	checkMode     bool          // -check
+
+	// 服务端模式下运行的隧道服务端（客户端模式为 nil），管理接口与统计输出经此读取
+	server atomic.Pointer[tunnel.Server]
+)
+
+// stringList 可重复指定的字符串参数（-path、-l、-token-policy）
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, " ") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func init() {
+	flag.Var(&listenAddrs, "l", "监听地址 (tcp://监听1/目标1,监听2/目标2,... 或 ws://ip:port/path 或 wss://ip:port/path 或 quic://ip:port/path 或 proxy://[user:pass@]ip:port[?server=名称]，本地监听可用 unix:///path/to.sock)；tcp:// 与 proxy:// 可重复指定，在同一进程中同时运行")
+	flag.StringVar(&forwardAddr, "f", "", "服务地址 (格式: wss://host:port/path 或 grpc://host:port/path 或 quic://host:port/path)")
+	flag.StringVar(&upstreamAddrs, "upstream", "", "额外的命名连接池，格式 名称=wss://host:port/path，多个用逗号分隔；tcp:// 规则与 proxy:// 以 ?server=名称 选用，未指定时经 -f 转发")
+	flag.StringVar(&ipAddr, "ip", "", "指定 -f 服务端主机名解析到的 IP（仅客户端），可用逗号分隔多个地址或 CIDR 网段，建连时在候选间竞速并优先使用上次成功的地址；-upstream 中主机名不同的连接池不受影响")
+	flag.DurationVar(&ipProbeInterval, "ip-probe", 0, "按该间隔在后台测量 -ip 候选地址的 TCP+TLS 握手耗时，当前优选地址劣化时自动切换（0 表示关闭）")
+	flag.StringVar(&certFile, "cert", "", "TLS证书文件路径（默认:自动生成，仅服务端）")
+	flag.StringVar(&keyFile, "key", "", "TLS密钥文件路径（默认:自动生成，仅服务端）")
+	flag.StringVar(&token, "token", "", "身份验证令牌（WebSocket Subprotocol）")
+	flag.StringVar(&psk, "psk", "", "端到端负载加密预共享密钥（ChaCha20-Poly1305，两端需一致，为空则不启用）")
+	flag.StringVar(&cidrs, "cidr", "0.0.0.0/0,::/0", "允许的来源 IP 范围 (CIDR),多个范围用逗号分隔")
+	flag.StringVar(&pinSHA256, "pin-sha256", "", "服务端证书链 SPKI 的 SHA-256 指纹（Base64），多个用逗号分隔（仅客户端）")
+	flag.StringVar(&clientCert, "client-cert", "", "客户端 TLS 证书文件（mTLS，仅客户端）")
+	flag.StringVar(&clientKey, "client-key", "", "客户端 TLS 私钥文件（mTLS，仅客户端）")
+	flag.StringVar(&clientCA, "client-ca", "", "校验客户端证书的 CA 文件，设置后强制 mTLS（仅服务端）")
+	flag.StringVar(&echKeyFile, "ech-key", "", "服务端 ECH 密钥文件（PEM：PRIVATE KEY 与 ECHCONFIG，可由 ech-keygen 子命令生成），服务端自行解密 ECH；quic:// 服务端必须指定")
+	flag.StringVar(&dnsServer, "dns", "dns.alidns.com/dns-query", "查询 ECH 公钥所用的 DoH 服务器地址")
+	flag.StringVar(&dnsProxy, "dns-proxy", "", "查询 ECH 公钥的 DoH 请求经该代理发出，如 http://[user:pass@]proxy:8080 或 socks5://127.0.0.1:1080（为空时遵循 HTTPS_PROXY 等环境变量）")
+	flag.StringVar(&dnsBootstrapIP, "dns-bootstrap-ip", "", "DoH 服务器的 IP 地址（逗号分隔，如 223.5.5.5,223.6.6.6）：直接连接该地址，SNI 与 Host 仍为 -dns 中的主机名，避免以明文 DNS 解析 DoH 服务器")
+	flag.StringVar(&echDomain, "ech", "cloudflare-ech.com", "用于查询 ECH 公钥的域名")
+	flag.StringVar(&echMode, "ech-mode", "strict", "服务器拒绝 ECH 时的处理: strict 仅重新查询 DoH 后重试 | retry 使用服务器下发的重试配置 | grease 重试仍失败时以 GREASE ECH 扩展连接（明文 SNI，须同时指定 -allow-plaintext-sni）")
+	flag.BoolVar(&allowPlainSNI, "allow-plaintext-sni", false, "危险：允许 -ech-mode=grease 在 ECH 不可用时以明文 SNI 连接，服务端域名将暴露给沿途网络")
+	flag.StringVar(&tlsFingerprint, "tls-fingerprint", "go", "客户端 TLS 握手指纹: go 使用标准库 | chrome | firefox | safari 模拟对应浏览器的 ClientHello（uTLS，仍使用 ECH，仅 wss://）")
+	flag.Var(&upgradeHeaderSpecs, "header", "通道握手请求附加的请求头（可重复），格式: \"名称: 值\"，如 \"User-Agent: Mozilla/5.0 ...\"，使升级请求与普通浏览器流量一致或满足 CDN 的安全规则")
+	flag.StringVar(&sniName, "sni", "", "通道 TLS 握手使用的服务器名称（启用 ECH 时为内层 SNI，同时用于校验证书），默认取 -f 地址中的主机名（仅用于与 -f 主机名相同的连接池）")
+	flag.StringVar(&hostHeader, "host", "", "通道握手请求的 Host 头，默认取 -f 地址中的主机名；与 -sni 分别设置可实现域前置（TCP 仍连接 -f 或 -ip 指定的地址，仅用于与 -f 主机名相同的连接池）")
+	flag.BoolVar(&echHostFirst, "ech-host-first", false, "先查询 -f 地址主机名（设置了 -sni 时为该名称）自身 HTTPS 记录中的 ECH 配置，没有时再查询 -ech 域名，适用于非 Cloudflare 的 ECH 部署")
+	flag.StringVar(&echOuterSNI, "ech-outer-sni", "", "只使用外层 SNI（ECH 配置的 public_name）为该名称的 ECH 配置；public_name 参与 ECH 加密，只能从已发布的配置中选择（为空则使用首个可用配置）")
+	flag.StringVar(&echCachePath, "ech-cache", "", "ECH 配置缓存文件路径：启动时优先使用缓存并在后台刷新，获取新配置后写回（为空则不缓存）")
+	flag.IntVar(&connectionNum, "n", 3, "WebSocket连接数量")
+	flag.StringVar(&claimMode, "claim", "race", "新流的通道分配方式: race 向所有通道发起 CLAIM 竞选 | roundrobin 依次轮转 | pinned 固定使用 RTT 最低的通道直至其断开或已满 | hash 按目标主机一致性哈希（同一目标的流共享通道及其拥塞窗口）；race 以外的方式不发送 CLAIM，建连省去一次往返")
+	flag.IntVar(&channelStreams, "channel-streams", 0, "每个通道同时承载的 TCP 流上限，已满的通道不参与 CLAIM 竞选，新流溢出到其他通道（全部已满时使用负载最低的通道，0 表示不限制）")
+	flag.DurationVar(&pingInterval, "ping-interval", 10*time.Second, "客户端 WebSocket 心跳间隔")
+	flag.DurationVar(&pongTimeout, "pong-timeout", 30*time.Second, "超过该时间未收到对端任何数据或心跳即判定通道失联并重连（0 表示不检测）")
+	flag.IntVar(&pongMissLimit, "pong-miss", 3, "连续该次数的 Ping 未收到 Pong 即关闭并重连通道（即使仍有数据到达），0 表示不检测；-ping-interval 应大于通道 RTT")
+	flag.Float64Var(&paceRate, "pace", 0, "每个通道的发送节奏带宽（Mbps，按瓶颈带宽设置，0 表示不限制）")
+	flag.DurationVar(&coalesceDelay, "coalesce", 0, "小包合并等待时间（如 2ms，0 表示关闭）")
+	flag.DurationVar(&sniffTimeout, "sniff-timeout", 5*time.Second, "tcp:// 转发建连前等待客户端首包（随建连请求发送）的最长时间，0 表示不等待（服务端先发数据的协议如 SMTP、MySQL 应设为 0）")
+	flag.DurationVar(&socksSniffTimeout, "socks-sniff-timeout", 100*time.Millisecond, "SOCKS5 CONNECT 建连前等待客户端首包的最长时间，0 表示不等待")
+	flag.DurationVar(&dialTimeout, "dial-timeout", 10*time.Second, "服务端连接目标地址的超时时间（含域名解析，0 表示不限制）")
+	flag.DurationVar(&ackInterval, "ack-interval", 10*time.Millisecond, "累计确认的最长延迟：已交付数据不足 32KB 时至多等待该时间再发送 ACK（0 表示每次交付立即确认）")
+	flag.DurationVar(&resumeTimeout, "resume-timeout", 30*time.Second, "会话恢复：通道断开后其上的 TCP 流保留该时间，等待客户端重连后在新通道上恢复（两端均需开启，0 表示关闭，断开即关闭流）")
+	flag.IntVar(&memBudgetMB, "mem-budget", 0, "全部流乱序重排缓存的内存预算（MB），用尽时暂停读取通道等待交付，0 表示不限制")
+	flag.IntVar(&streamBufferMB, "stream-buffer", 4, "单个流乱序重排缓存上限（MB），超过即关闭该流")
+	flag.IntVar(&maxFrameSize, "max-frame", 1<<20, "通道单条消息大小上限（字节，握手时与对端协商取较小值，超过即断开通道，最小 131072）")
+	flag.IntVar(&wireFrameSize, "wire-frame", 0, "本端发送的 WebSocket 帧大小上限（字节）：流数据按该大小拆分为多条消息，其余超过该大小的消息以 continuation 帧分片（0 表示不限制，最小 2048）")
+	flag.DurationVar(&connectTimeout, "connect-timeout", 5*time.Second, "客户端等待服务端连上目标的最长时间（tcp:// 规则可用 ?connect-timeout= 单独指定），应不小于服务端 -dial-timeout 才能收到其连接失败原因")
+	flag.DurationVar(&udpIdleTimeout, "udp-idle-timeout", 5*time.Minute, "UDP 关联双向均无数据超过该时间即回收（服务端关闭套接字并通知客户端，SOCKS5 客户端终止关联），0 表示不回收")
+	flag.StringVar(&noDelayPorts, "nodelay-ports", "22,3389", "延迟敏感的目标端口，逗号分隔（不进行小包合并，流默认为交互式优先级）")
+	flag.BoolVar(&tcpNoDelay, "tcp-nodelay", true, "本地接受的连接与服务端出站连接是否设置 TCP_NODELAY（关闭后启用 Nagle 算法，适合带宽受限的设备）")
+	flag.DurationVar(&tcpKeepAlive, "tcp-keepalive", 0, "TCP keepalive 探测间隔（0 使用系统默认，负数关闭 keepalive）")
+	flag.IntVar(&tcpRecvBuf, "tcp-rcvbuf", 0, "TCP 接收缓冲区大小（字节，0 使用系统默认）")
+	flag.IntVar(&tcpSendBuf, "tcp-sndbuf", 0, "TCP 发送缓冲区大小（字节，0 使用系统默认）")
+	flag.StringVar(&muxMode, "mux", "", "通道上的流多路复用方式: 为空使用隧道自身的 DATA/控制帧 | yamux 每个 TCP 流为一条 yamux 流（逐流流量控制与背压，服务端须支持；不支持 UDP、-psk 与会话恢复）")
+	flag.BoolVar(&zstdPayload, "zstd", false, "启用 DATA 负载的 zstd 压缩协商（两端均开启才生效，按熵估计跳过已压缩或加密的数据）")
+	flag.BoolVar(&wsCompress, "ws-compress", false, "启用 WebSocket permessage-deflate 压缩协商（两端均开启才生效，仅支持 no_context_takeover）")
+	flag.IntVar(&wsCompressLvl, "ws-compress-level", 1, "WebSocket 压缩级别（-2~9，1 为最快）")
+	flag.BoolVar(&streamStatsLog, "stream-stats", false, "客户端在每个 TCP 流关闭时输出传输统计（字节数、时长、平均速度、所用通道、上行拥塞窗口与 RTT）")
+	flag.DurationVar(&streamStatsInterval, "stream-stats-interval", 0, "客户端周期输出长连接流传输统计的间隔（0 表示不输出）")
+	flag.BoolVar(&paddingEnabled, "padding", false, "启用流量填充与空闲伪帧混淆（两端均需支持）")
+	flag.IntVar(&padBudget, "pad-budget", 30, "填充流量占真实流量的最大百分比")
+	flag.DurationVar(&padIdleInterval, "pad-idle", 5*time.Second, "空闲通道发送伪帧的平均间隔（0 表示不发送）")
+	flag.StringVar(&unixSocketMode, "unix-mode", "0660", "unix:// 监听套接字文件权限（八进制）")
+	flag.StringVar(&httpForwarded, "http-forwarded", "keep", "HTTP 代理转发普通请求时对 X-Forwarded-For/Forwarded/Via 等头部的处理: keep 原样透传 | add 追加客户端地址 | strip 全部删除")
+	flag.BoolVar(&udpRebind, "udp-rebind", false, "SOCKS5 UDP ASSOCIATE 中客户端来源端口变化（NAT 重新映射）时，若来源 IP 不变则改用新地址，而不是丢弃数据包")
+	flag.IntVar(&dnsCacheSize, "dns-cache", 0, "SOCKS5 UDP 发往 53 端口的 A/AAAA 查询按 TTL 缓存的最大条数，命中时本地应答而不经隧道，0 表示关闭")
+	flag.StringVar(&whenDown, "when-down", "accept", "所有通道均不可用（含启动后尚未连上）时对新的本地连接的处理: accept 照常接受（等待 -connect-timeout 后关闭）| refuse 立即拒绝（TCP 连接以 RST 关闭），应用可立即失败重试 | queue 保持连接等待通道恢复，超过 -down-queue 或 -down-queue-timeout 时拒绝")
+	flag.IntVar(&downQueue, "down-queue", 64, "-when-down queue 时至多同时保持等待的本地连接数")
+	flag.DurationVar(&downQueueTimeout, "down-queue-timeout", 30*time.Second, "-when-down queue 时本地连接等待通道恢复的最长时间")
+	flag.IntVar(&maxConns, "max-conns", 0, "每个本地监听器（tcp:// 规则或 proxy://）同时处理的连接数上限，0 表示不限制")
+	flag.StringVar(&listenFamily, "listen-family", "auto", "本地 TCP 监听（tcp:// 规则与 proxy://）的地址族: auto 按地址形式由系统决定 | dual 在 IPv4 与 IPv6 上分别监听 | ipv4 | ipv6 仅监听该地址族；tcp:// 规则可用 ?family= 单独指定")
+	flag.IntVar(&acceptQueue, "accept-queue", 64, "达到 -max-conns 后至多排队等待空闲名额的连接数，超出即以 RST 拒绝")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false, "本地监听（tcp:// 与 proxy://）要求连接携带 HAProxy PROXY 协议 v1/v2 头部，并以其中的地址作为客户端地址")
+	flag.StringVar(&serviceCmd, "service", "", "Windows 服务管理: install|uninstall|start|stop（安装时其余参数作为服务启动参数）")
+	flag.StringVar(&serviceName, "service-name", "ech-tunnel", "Windows 服务名称")
+	flag.Var(&extraPaths, "path", "额外的隧道路径及独立认证（仅服务端，可重复），格式: /路径[=token][@cidr1,cidr2]")
+	flag.StringVar(&fallbackURL, "fallback-url", "", "非隧道流量回落的反向代理地址（仅服务端，如 http://127.0.0.1:8080）")
+	flag.BoolVar(&allowBench, "allow-bench", false, "允许客户端使用测速伪目标（仅服务端）")
+	flag.StringVar(&preferFamily, "prefer-family", "auto", "连接目标时首选的地址族: auto|ipv4|ipv6|ipv4-only|ipv6-only（仅服务端，auto 按解析结果顺序）")
+	flag.DurationVar(&happyEyeballsDelay, "happy-eyeballs-delay", 250*time.Millisecond, "双栈目标依次发起连接尝试的间隔（RFC 8305，仅服务端，0 表示仅在失败后尝试下一个地址）")
+	flag.StringVar(&resolverAddr, "resolver", "", "解析目标域名所用的 DNS 服务器（仅服务端，如 8.8.8.8、tcp://8.8.8.8、tls://1.1.1.1、https://dns.google/dns-query，空表示使用系统解析）")
+	flag.DurationVar(&resolverTTL, "resolver-ttl", 0, "-resolver 解析结果的缓存时长（0 表示按记录 TTL 缓存）")
+	flag.DurationVar(&resolveCacheTTL, "resolve-cache", 30*time.Second, "未配置 -resolver 时系统解析目标域名结果的缓存时长（仅服务端，0 表示不缓存）")
+	flag.StringVar(&egressIP, "egress-ip", "", "连接目标时绑定的源地址，可指定一个 IPv4 与一个 IPv6（逗号分隔，仅服务端）")
+	flag.StringVar(&egressInterface, "egress-interface", "", "连接目标时使用的网络接口（Linux 绑定到该接口，其他平台使用其地址作为源地址，仅服务端）")
+	flag.UintVar(&egressMark, "egress-mark", 0, "为连接目标的出站套接字设置防火墙标记 SO_MARK，配合策略路由使用（仅 Linux 服务端，需 CAP_NET_ADMIN，0 表示不设置）")
+	flag.StringVar(&blockPorts, "block-ports", "25,465,587", "禁止经隧道连接的目标端口，逗号分隔，可写范围 6881-6889 或加协议前缀 tcp/25、udp/53（仅服务端，默认禁止 SMTP 端口防止滥发邮件，空表示不限制）")
+	flag.StringVar(&allowPorts, "allow-ports", "", "放行的目标端口（格式同 -block-ports，优先于 -block-ports，仅服务端）；-block-ports 1-65535 配合本参数即为白名单")
+	flag.BoolVar(&denyPrivate, "deny-private", false, "禁止经隧道连接本机、内网、链路本地与组播地址（仅服务端，域名目标按解析结果检查，可防御 DNS 重绑定）")
+	flag.StringVar(&denyCIDRs, "deny-cidr", "", "禁止经隧道连接的目标网段（CIDR），逗号分隔（仅服务端，域名目标按解析结果检查）")
+	flag.Var(&tokenPolicySpecs, "token-policy", "令牌权限（仅服务端，可重复），格式: 令牌?proto=tcp,udp&ports=80,443&cidr=0.0.0.0/0&rate=10&streams=200&quota=100&egress=203.0.113.10（rate 为每个方向的带宽上限 Mbps，streams 为并发流上限，quota 为每月流量上限 GB，egress 为该令牌的出口地址）")
+	flag.IntVar(&handshakeRate, "handshake-rate", 0, "每个来源 IP 每分钟允许的隧道握手次数，超过返回 429（仅服务端，0 表示不限制）")
+	flag.StringVar(&accessLogPath, "access-log", "", "访问日志文件路径，每个隧道流关闭时记录一行（仅服务端，空表示不记录）")
+	flag.IntVar(&accessLogMaxSize, "access-log-max-size", 100, "访问日志单文件大小上限（MB，超过后轮转，0 表示不按大小轮转）")
+	flag.DurationVar(&accessLogRotate, "access-log-rotate", 0, "访问日志按时间轮转的周期（如 24h，0 表示不按时间轮转）")
+	flag.IntVar(&accessLogBackups, "access-log-backups", 7, "访问日志保留的轮转文件数量（0 表示不清理）")
+	flag.StringVar(&auditLogPath, "audit-log", "", "审计日志文件路径，每个隧道流关闭时以 JSON 行记录令牌、来源 IP、目标、起止时间与流量（仅服务端，轮转参数同访问日志，空表示不记录）")
+	flag.StringVar(&auditDest, "audit-dest", "full", "审计日志中目标地址的记录方式: full|hash|truncate（hash 记录主机名的带密钥摘要，truncate 只保留主域名或 /24、/48 网段）")
+	flag.StringVar(&auditSecretFile, "audit-secret-file", "", "-audit-dest hash 使用的密钥文件：文件不存在时生成随机密钥（默认为审计日志路径加 -secret）")
+	flag.StringVar(&usageFile, "usage-file", "", "各令牌每月流量计数的保存文件（JSON，仅服务端，重启后继续累计，空表示只在内存中计数）")
+	flag.StringVar(&logOutput, "log-output", "stderr", "日志输出目标: stderr|syslog|syslog://host:514|syslog+tcp://host:601|journald（syslog 为本机 /dev/log）")
+	flag.StringVar(&adminAddr, "admin", "", "管理接口（HTTP）监听地址，如 127.0.0.1:9090（空表示不启用，请勿暴露到公网）")
+	flag.StringVar(&ctlAddr, "ctl", "", "控制套接字地址（unix:///path/to.sock 或 127.0.0.1:port，仅客户端），用于运行时增删转发规则与代理（见 ctl 子命令）")
+	flag.StringVar(&ctlTokenFile, "ctl-token-file", "", "控制套接字认证令牌文件（TCP 控制套接字必需）：文件不存在时生成随机令牌，ctl 子命令读取同一文件")
+	flag.StringVar(&adminToken, "admin-token", "", "访问管理接口所需的令牌（Authorization: Bearer <令牌>，空表示不校验）")
+	flag.StringVar(&geoIPDB, "geoip-db", "", "MaxMind GeoLite2/GeoIP2 Country 或 City 数据库路径（.mmdb，仅服务端）")
+	flag.StringVar(&geoIPAllow, "geoip-allow", "", "仅允许这些国家/地区建立隧道会话，逗号分隔的 ISO 代码（如 CN,HK，仅服务端）")
+	flag.StringVar(&geoIPDeny, "geoip-deny", "", "拒绝这些国家/地区建立隧道会话，逗号分隔的 ISO 代码（仅服务端）")
+	flag.DurationVar(&benchDuration, "bench", 0, "对 -f 服务端进行带宽测速，每个方向持续该时长后退出（如 10s，服务端需开启 -allow-bench）")
+	flag.IntVar(&benchStreams, "bench-streams", 4, "测速并发流数量")
+	flag.BoolVar(&checkMode, "check", false, "逐步诊断与 -f 服务端的连通性（DoH 查询 ECH、TCP、TLS/ECH 握手、WebSocket 升级、往返时延）后退出")
+}
+
+func main() {
+	parseCommandLine(os.Args[1:])
+	if ctlArgs != nil {
+		os.Exit(runCtl(ctlArgs))
+	}
+	if echKeygen != "" {
+		os.Exit(runECHKeygen(echKeygen))
+	}
+	if err := initLogOutput(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Windows 服务管理命令（install/uninstall/start/stop）
+	if serviceCmd != "" {
+		if err := handleServiceCommand(serviceCmd); err != nil {
+			log.Fatalf("[服务] %s 失败: %v", serviceCmd, err)
+		}
+		return
+	}
+
+	if pingInterval <= 0 {
+		log.Fatal("-ping-interval 必须大于 0")
+	}
+	if pongTimeout > 0 && pongTimeout <= pingInterval {
+		log.Printf("警告: -pong-timeout (%s) 不大于 -ping-interval (%s)，通道可能被误判失联", pongTimeout, pingInterval)
+	}
+	if connectTimeout <= 0 {
+		log.Fatal("-connect-timeout 必须大于 0")
+	}
+	switch claimMode {
+	case "race", "roundrobin", "pinned", "hash":
+	default:
+		log.Fatalf("无效的 -claim: %s（可选 race、roundrobin、pinned、hash）", claimMode)
+	}
+	switch whenDown {
+	case "accept", "refuse", "queue":
+	default:
+		log.Fatalf("无效的 -when-down: %s（可选 accept、refuse、queue）", whenDown)
+	}
+	if whenDown == "queue" && (downQueue <= 0 || downQueueTimeout <= 0) {
+		log.Fatal("-when-down queue 需要 -down-queue 与 -down-queue-timeout 大于 0")
+	}
+	switch httpForwarded {
+	case "keep", "add", "strip":
+	default:
+		log.Fatalf("无效的 -http-forwarded 参数: %s（可选 keep|add|strip）", httpForwarded)
+	}
+	if _, err := tunnel.ParseListenFamily(listenFamily); err != nil {
+		log.Fatalf("-listen-family 参数错误: %v", err)
+	}
+	if maxConns < 0 || acceptQueue < 0 {
+		log.Fatal("-max-conns 与 -accept-queue 不能为负数")
+	}
+	if channelStreams < 0 {
+		log.Fatal("-channel-streams 不能为负数")
+	}
+	if maxFrameSize < protocol.MinMaxFrameSize {
+		log.Fatalf("-max-frame 不能小于 %d", protocol.MinMaxFrameSize)
+	}
+	if wireFrameSize != 0 && wireFrameSize < tunnel.MinWireFrameSize {
+		log.Fatalf("-wire-frame 不能小于 %d", tunnel.MinWireFrameSize)
+	}
+	if streamBufferMB <= 0 {
+		log.Fatal("-stream-buffer 必须大于 0")
+	}
+
+	switch muxMode {
+	case "", protocol.MuxYamux:
+	default:
+		log.Fatalf("无效的 -mux 参数: %s（可选 yamux）", muxMode)
+	}
+	if muxMode != "" && psk != "" {
+		log.Fatal("-mux 与 -psk 不能同时使用：yamux 流不经端到端加密")
+	}
+
+	switch echMode {
+	case "strict", "retry":
+	case "grease":
+		// GREASE ECH 扩展只是伪装，真实域名仍以明文 SNI 发送，必须显式确认
+		if !allowPlainSNI {
+			log.Fatal("-ech-mode=grease 在 ECH 不可用时以明文 SNI 连接（会暴露服务端域名），须同时指定 -allow-plaintext-sni")
+		}
+	default:
+		log.Fatalf("无效的 -ech-mode 参数: %s（可选 strict|retry|grease）", echMode)
+	}
+	if allowPlainSNI && echMode != "grease" {
+		log.Fatal("-allow-plaintext-sni 仅用于 -ech-mode=grease")
+	}
+	if echMode != "strict" {
+		log.Printf("警告: -ech-mode=%s 已放宽 ECH 防回退策略", echMode)
+	}
+	if allowPlainSNI {
+		log.Printf("警告: 已指定 -allow-plaintext-sni，ECH 不可用时服务端域名将以明文 SNI 暴露")
+	}
+	if err := initECHClient(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initFrames(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initDialer(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initPools(); err != nil {
+		log.Fatalf("连接池配置错误: %v", err)
+	}
+
+	// 由 Windows 服务管理器启动时，以服务方式运行
+	if runAsService(run) {
+		return
+	}
+
+	startStatsTrigger()
+	run()
+}
+
+// run 根据监听地址前缀选择运行模式（阻塞运行）
+func run() {
+	startAdmin()
+	if checkMode {
+		runCheck(forwardAddr)
+		return
+	}
+	if benchDuration > 0 {
+		runBench(forwardAddr)
+		return
+	}
+	if len(listenAddrs) == 1 && (strings.HasPrefix(listenAddrs[0], "ws://") || strings.HasPrefix(listenAddrs[0], "wss://") || strings.HasPrefix(listenAddrs[0], "quic://")) {
+		runServer(listenAddrs[0])
+		return
+	}
+
+	// 客户端模式：tcp:// 与 proxy:// 可同时指定多个，经按名称共享的连接池转发
+	for _, addr := range listenAddrs {
+		if !strings.HasPrefix(addr, "tcp://") && !strings.HasPrefix(addr, "proxy://") {
+			log.Fatal("监听地址格式错误，请使用 ws://, wss://, quic://, tcp:// 或 proxy:// 前缀（服务端模式只能指定一个 -l）")
+		}
+	}
+	if len(listenAddrs) == 0 {
+		log.Fatal("需要通过 -l 指定监听地址")
+	}
+	// 预先获取 ECH 公钥（可来自 -ech-cache；失败则直接退出，严格禁止回退）
+	if err := echClient.Init(); err != nil {
+		log.Fatalf("[客户端] 获取 ECH 公钥失败: %v", err)
+	}
+	socksDNSCache = socks5.NewDNSCache(dnsCacheSize)
+	startControlSocket()
+	var wg sync.WaitGroup
+	for _, addr := range listenAddrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if strings.HasPrefix(addr, "tcp://") {
+				runTCPClient(addr)
+			} else {
+				// 代理模式（支持 SOCKS5 和 HTTP）
+				runProxyServer(addr)
+			}
+		}()
+	}
+	wg.Wait()
+	if ctlAddr != "" {
+		// 启动时的规则均已移除，继续等待经控制套接字添加的规则
+		select {}
+	}
+}
+
+// runServer 以服务端模式运行：按命令行参数创建隧道服务端并在 addr（ws://、wss:// 或 quic://）上监听
+func runServer(addr string) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		log.Fatal("无效的 WebSocket 地址:", err)
+	}
+	cfg, err := serverConfig(u.Path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	relay, err := startRelay()
+	if err != nil {
+		log.Fatalf("[中继] %v", err)
+	}
+	if relay != nil {
+		cfg.Relay = relay
+	}
+	s, err := tunnel.NewServer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Store(s)
+	adminMux.HandleFunc("/usage", s.ServeUsage)
+	log.Fatal(s.ListenAndServe(u.Scheme, u.Host))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"ech-tunnel/pool"
+	"ech-tunnel/tunnel"
+)
+
+// counters 核心计数器（由帧层、连接池与服务端累计），经管理接口（-admin）的 /debug/vars 以 expvar 标准格式发布，
+// /metrics 以 Prometheus 文本格式发布同一组数据
+var counters tunnel.Metrics
+
+func init() {
+	for name, v := range map[string]*atomic.Int64{
+		"streams_opened":     &counters.StreamsOpened,
+		"streams_closed":     &counters.StreamsClosed,
+		"bytes_up":           &counters.BytesUp,
+		"bytes_down":         &counters.BytesDown,
+		"channel_reconnects": &counters.Reconnects,
+		"cc_loss_events":     &counters.CCLossEvents,
+	} {
+		expvar.Publish(name, expvar.Func(func() any { return v.Load() }))
+	}
+	// 成功获取 ECH 配置的次数，由 echClient 累计
+	expvar.Publish("ech_refreshes", expvar.Func(func() any { return echClient.Refreshes() }))
+	expvar.Publish("active_sessions", expvar.Func(func() any { return server.Load().Stats().Sessions }))
+	expvar.Publish("active_tcp_streams", expvar.Func(func() any { return server.Load().Stats().TCPStreams }))
+	expvar.Publish("active_udp_streams", expvar.Func(func() any { return server.Load().Stats().UDPStreams }))
+	// 客户端各连接池按通道汇总的上行拥塞控制状态（键为连接池名称，默认池为 "默认"）
+	expvar.Publish("channel_cc", expvar.Func(func() any {
+		m := map[string][]pool.ChannelCC{}
+		pools.each(func(name string, p *pool.ECHPool) { m[poolName(name)] = p.ChannelCCStats() })
+		return m
+	}))
+	adminMux.Handle("/debug/vars", expvar.Handler())
+	adminMux.HandleFunc("GET /metrics", serveMetrics)
+}
+
+// promMetric 一组同名的 Prometheus 指标
+type promMetric struct {
+	name, typ, help string
+	samples         []promSample
+}
+
+type promSample struct {
+	labels string // 已编码的标签，如 {pool="默认",channel="0"}
+	value  float64
+}
+
+// serveMetrics 以 Prometheus 文本格式（0.0.4）输出计数器、活跃会话与各通道的拥塞控制状态
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	single := func(name, typ, help string, v float64) promMetric {
+		return promMetric{name: name, typ: typ, help: help, samples: []promSample{{value: v}}}
+	}
+	st := server.Load().Stats()
+	metrics := []promMetric{
+		single("ech_tunnel_streams_opened_total", "counter", "打开的 TCP 流与 UDP 关联", float64(counters.StreamsOpened.Load())),
+		single("ech_tunnel_streams_closed_total", "counter", "关闭的 TCP 流与 UDP 关联", float64(counters.StreamsClosed.Load())),
+		single("ech_tunnel_bytes_up_total", "counter", "客户端发往目标的字节数", float64(counters.BytesUp.Load())),
+		single("ech_tunnel_bytes_down_total", "counter", "目标发往客户端的字节数", float64(counters.BytesDown.Load())),
+		single("ech_tunnel_channel_reconnects_total", "counter", "客户端通道断线后重连成功的次数", float64(counters.Reconnects.Load())),
+		single("ech_tunnel_ech_refreshes_total", "counter", "成功获取 ECH 配置的次数", float64(echClient.Refreshes())),
+		single("ech_tunnel_cc_loss_events_total", "counter", "拥塞控制因排队时延收缩窗口的次数", float64(counters.CCLossEvents.Load())),
+		single("ech_tunnel_active_sessions", "gauge", "服务端活跃的隧道会话", float64(st.Sessions)),
+		single("ech_tunnel_active_tcp_streams", "gauge", "服务端活跃的 TCP 流", float64(st.TCPStreams)),
+		single("ech_tunnel_active_udp_streams", "gauge", "服务端活跃的 UDP 关联", float64(st.UDPStreams)),
+	}
+
+	// 客户端各连接池按通道汇总的上行拥塞控制状态
+	channel := []promMetric{
+		{name: "ech_tunnel_channel_connected", typ: "gauge", help: "通道是否已连接"},
+		{name: "ech_tunnel_channel_streams", typ: "gauge", help: "通道上的活跃 TCP 流"},
+		{name: "ech_tunnel_channel_cwnd_bytes", typ: "gauge", help: "通道上各流拥塞窗口之和"},
+		{name: "ech_tunnel_channel_in_flight_bytes", typ: "gauge", help: "通道上各流在途字节之和"},
+		{name: "ech_tunnel_channel_limited_streams", typ: "gauge", help: "通道上受拥塞窗口限制的流"},
+		{name: "ech_tunnel_channel_srtt_seconds", typ: "gauge", help: "通道上各流平滑 RTT 的平均值（尚无确认的流不计入）"},
+		{name: "ech_tunnel_channel_ping_rtt_seconds", typ: "gauge", help: "通道心跳探测的平滑 RTT"},
+		{name: "ech_tunnel_channel_loss_events", typ: "gauge", help: "通道上活跃流收缩窗口的次数之和"},
+	}
+	pools.each(func(name string, p *pool.ECHPool) {
+		for _, c := range p.ChannelCCStats() {
+			labels := fmt.Sprintf(`{pool="%s",channel="%d"}`, promEscape(poolName(name)), c.Channel)
+			connected := 0.0
+			if c.Connected {
+				connected = 1
+			}
+			for i, v := range []float64{connected, float64(c.Streams), float64(c.Cwnd), float64(c.InFlight),
+				float64(c.Limited), c.SRTT / 1000, c.PingRTT / 1000, float64(c.LossEvents)} {
+				channel[i].samples = append(channel[i].samples, promSample{labels: labels, value: v})
+			}
+		}
+	})
+	metrics = append(metrics, channel...)
+
+	var b bytes.Buffer
+	for _, m := range metrics {
+		if len(m.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, s := range m.samples {
+			fmt.Fprintf(&b, "%s%s %s\n", m.name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// promEscape 转义 Prometheus 标签值中的反斜杠、双引号与换行
+func promEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
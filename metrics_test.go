@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeMetrics(t *testing.T) {
+	counters.StreamsOpened.Add(3)
+	rec := httptest.NewRecorder()
+	serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type = %q，期望 Prometheus 文本格式", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE ech_tunnel_streams_opened_total counter\n",
+		"# TYPE ech_tunnel_active_sessions gauge\n",
+		"ech_tunnel_active_tcp_streams 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("缺少 %q:\n%s", want, body)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if f := strings.Fields(line); len(f) != 2 {
+			t.Errorf("样本行格式错误: %q", line)
+		}
+	}
+}
+
+func TestPromEscape(t *testing.T) {
+	if got, want := promEscape("a\\b\"c\nd"), `a\\b\"c\nd`; got != want {
+		t.Fatalf("promEscape = %q，期望 %q", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+package pool
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// channelHealth 通道健康度（基于周期性 Ping/Pong 探测）
+type channelHealth struct {
+	mu          sync.Mutex
+	srtt        time.Duration // 平滑 RTT
+	lastRTT     time.Duration
+	loss        float64 // 丢失率（指数加权）
+	pendingPing int64   // 尚未收到 Pong 的 Ping 时间戳（UnixNano）
+	probes      int64
+	missed      int // 连续未收到 Pong 的次数
+}
+
+// ChannelStats 通道健康度快照
+type ChannelStats struct {
+	Channel   int
+	Connected bool
+	SRTT      time.Duration
+	LastRTT   time.Duration
+	Loss      float64
+	Probes    int64
+}
+
+// pingPayload 生成探测 Ping 负载并记录发送时间
+func (h *channelHealth) pingPayload() []byte {
+	now := time.Now().UnixNano()
+	h.mu.Lock()
+	if h.pendingPing != 0 {
+		// 上一次探测未收到回应，计为一次丢失
+		h.loss = h.loss*0.9 + 0.1
+		h.missed++
+	}
+	h.pendingPing = now
+	h.probes++
+	h.mu.Unlock()
+	return strconv.AppendInt(nil, now, 10)
+}
+
+// onPong 处理 Pong，更新 RTT 与丢失率
+func (h *channelHealth) onPong(payload string) {
+	ts, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ts != h.pendingPing {
+		return
+	}
+	h.pendingPing = 0
+	h.observeLocked(time.Duration(time.Now().UnixNano() - ts))
+}
+
+// observe 记录一次由多路复用会话的 Ping 测得的往返时延
+func (h *channelHealth) observe(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probes++
+	h.observeLocked(rtt)
+}
+
+func (h *channelHealth) observeLocked(rtt time.Duration) {
+	h.missed = 0
+	h.lastRTT = rtt
+	if h.srtt == 0 {
+		h.srtt = h.lastRTT
+	} else {
+		h.srtt = (h.srtt*7 + h.lastRTT) / 8
+	}
+	h.loss *= 0.9
+}
+
+// reset 通道重连后清除未完成的探测
+func (h *channelHealth) reset() {
+	h.mu.Lock()
+	h.pendingPing = 0
+	h.missed = 0
+	h.mu.Unlock()
+}
+
+// missedPongs 返回连续未收到 Pong 的探测次数
+func (h *channelHealth) missedPongs() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.missed
+}
+
+// ChannelStats 返回所有通道的健康度快照
+func (p *ECHPool) ChannelStats() []ChannelStats {
+	p.mu.RLock()
+	connected := make([]bool, len(p.wsConns))
+	for i, ws := range p.wsConns {
+		connected[i] = ws != nil
+	}
+	p.mu.RUnlock()
+
+	stats := make([]ChannelStats, len(p.health))
+	for i, h := range p.health {
+		h.mu.Lock()
+		stats[i] = ChannelStats{
+			Channel:   i,
+			Connected: connected[i],
+			SRTT:      h.srtt,
+			LastRTT:   h.lastRTT,
+			Loss:      h.loss,
+			Probes:    h.probes,
+		}
+		h.mu.Unlock()
+	}
+	return stats
+}
+
+// rankedChannels 按平滑 RTT 从低到高返回已连接的通道（尚无测量值的排在最后）
+func (p *ECHPool) rankedChannels() []int {
+	stats := p.ChannelStats()
+	var ids []int
+	for _, s := range stats {
+		if s.Connected {
+			ids = append(ids, s.Channel)
+		}
+	}
+	sort.SliceStable(ids, func(a, b int) bool {
+		ra, rb := stats[ids[a]].SRTT, stats[ids[b]].SRTT
+		if ra == 0 || rb == 0 {
+			return ra != 0
+		}
+		return ra < rb
+	})
+	return ids
+}
+
+// fastestOf 返回候选通道中平滑 RTT 最低的一个（尚无测量值的排在最后，不访问 p.mu）
+func (p *ECHPool) fastestOf(candidates []int) int {
+	best, bestRTT := candidates[0], time.Duration(0)
+	for _, i := range candidates {
+		h := p.health[i]
+		h.mu.Lock()
+		rtt := h.srtt
+		h.mu.Unlock()
+		if rtt > 0 && (bestRTT == 0 || rtt < bestRTT) {
+			best, bestRTT = i, rtt
+		}
+	}
+	return best
+}
+
+// setChannelUp 记录通道连接状态的变化：全部通道断开时记录日志，首个通道恢复时唤醒排队的本地连接
+func (p *ECHPool) setChannelUp(channelID int, up bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !up {
+		if p.up--; p.up == 0 {
+			log.Printf("[客户端] 通道 %d 断开，当前没有可用通道", channelID)
+		}
+		return
+	}
+	if p.up++; p.up == 1 {
+		close(p.upWake)
+		p.upWake = make(chan struct{})
+	}
+}
+
+// Admit 决定是否接受新的本地连接：有可用通道或 -when-down accept 时接受；否则 refuse 立即拒绝，
+// queue 保持连接等待通道恢复，排队已满或等待超过 -down-queue-timeout 时拒绝
+func (p *ECHPool) Admit() bool {
+	p.mu.Lock()
+	if p.up > 0 || p.cfg.WhenDown == "accept" {
+		p.mu.Unlock()
+		return true
+	}
+	if p.cfg.WhenDown == "refuse" || p.held >= p.cfg.DownQueue {
+		p.mu.Unlock()
+		return false
+	}
+	p.held++
+	wake := p.upWake
+	p.mu.Unlock()
+
+	timer := time.NewTimer(p.cfg.DownQueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-wake:
+	case <-timer.C:
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.held--
+	return p.up > 0
+}
@@ -0,0 +1,199 @@
+package pool
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"ech-tunnel/internal/netutil"
+	"ech-tunnel/protocol"
+	"ech-tunnel/tunnel"
+)
+
+// handleMuxChannel 多路复用模式下的通道处理：在通道上运行 yamux 会话直至其结束（心跳超时、读写失败或
+// 主动重连），会话结束时其上的流随之关闭，随后重连通道
+func (p *ECHPool) handleMuxChannel(channelID int, wsConn tunnel.TunnelConn) {
+	p.mu.RLock()
+	maxFrame := p.maxFrames[channelID]
+	p.mu.RUnlock()
+	session, err := p.frames.ClientMuxSession(wsConn, maxFrame)
+	if err != nil {
+		log.Printf("[客户端] 通道 %d 建立多路复用会话失败: %v", channelID, err)
+		_ = wsConn.Close()
+		p.redialChannel(channelID)
+		return
+	}
+	p.health[channelID].reset()
+	p.mu.Lock()
+	p.muxSessions[channelID] = session
+	p.mu.Unlock()
+	p.setChannelUp(channelID, true)
+
+	// 会话的 Ping 同时用于通道 RTT 测量（分配通道与 /channels 使用），失联由 yamux 心跳或 QUIC 空闲超时判定
+	health := p.health[channelID]
+	t := time.NewTicker(p.cfg.PingInterval)
+	defer t.Stop()
+probe:
+	for {
+		select {
+		case <-session.CloseChan():
+			break probe
+		case <-t.C:
+			if rtt, err := session.Ping(); err == nil {
+				health.observe(rtt)
+			}
+		}
+	}
+	log.Printf("[客户端] 通道 %d 的多路复用会话已结束", channelID)
+	_ = wsConn.Close()
+	p.setChannelUp(channelID, false)
+	p.mu.Lock()
+	p.muxSessions[channelID] = nil
+	p.mu.Unlock()
+	p.redialChannel(channelID)
+}
+
+// openMuxStream 多路复用模式下为已注册的流选择通道并打开流，收到服务端的建连应答后结束 WaitConnected
+// 的等待，随后将服务端的数据写入本地连接。没有可用通道时按退避间隔重试，直至流被 WaitConnected 放弃
+func (p *ECHPool) openMuxStream(connID, target, first string, channels []int) {
+	delay := claimRetryDelay
+	for {
+		p.mu.Lock()
+		if _, pending := p.connInfo[connID]; !pending {
+			p.mu.Unlock()
+			return
+		}
+		var live []int
+		for _, i := range p.claimCandidatesLocked(channels) {
+			if s := p.muxSessions[i]; s != nil && !s.IsClosed() {
+				live = append(live, i)
+			}
+		}
+		var session tunnel.MuxSession
+		ch := -1
+		if len(live) > 0 {
+			// 不发送 CLAIM，race 方式改为选择 RTT 最低的通道
+			if p.cfg.ClaimMode == "race" {
+				ch = p.fastestOf(live)
+			} else {
+				ch = p.pickChannelLocked(target, live)
+			}
+			session = p.muxSessions[ch]
+		}
+		p.mu.Unlock()
+
+		if session == nil {
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		}
+		stream, bound, err := dialMuxStream(session, target, first)
+		var me *protocol.MuxError
+		if errors.As(err, &me) {
+			// 建连失败：立即结束等待，本地连接交由调用方回复错误后关闭
+			log.Printf("[客户端] 连接 %s 建立失败(%d): %s", connID, me.Code, me.Message)
+			p.mu.Lock()
+			delete(p.tcpMap, connID)
+			delete(p.connInfo, connID)
+			done := p.connected[connID]
+			p.removeStreamLocked(connID)
+			p.mu.Unlock()
+			if done != nil {
+				select {
+				case done <- false:
+				default:
+				}
+			}
+			return
+		}
+		if err != nil {
+			log.Printf("[客户端] 连接 %s 在通道 %d 上打开流失败: %v，重试", connID, ch, err)
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		}
+
+		p.mu.Lock()
+		st, c := p.seqMap[connID], p.tcpMap[connID]
+		if _, pending := p.connInfo[connID]; !pending || st == nil || c == nil {
+			// 等待期间已超时放弃
+			p.mu.Unlock()
+			tunnel.CloseMuxStream(stream)
+			return
+		}
+		delete(p.connInfo, connID)
+		p.channelMap[connID] = ch
+		p.muxStreams[connID] = stream
+		st.bound = bound
+		done := p.connected[connID]
+		p.mu.Unlock()
+		log.Printf("[客户端] 连接 %s 分配到通道 %d（多路复用）", connID, ch)
+		if done != nil {
+			select {
+			case done <- true:
+			default:
+			}
+		}
+		p.muxDownstream(ch, connID, stream, c, st)
+		return
+	}
+}
+
+// dialMuxStream 在会话上打开流并完成建连，返回服务端出站连接的本地地址
+func dialMuxStream(session tunnel.MuxSession, target, first string) (tunnel.MuxStream, string, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := protocol.WriteMuxRequest(stream, target, first); err != nil {
+		tunnel.CloseMuxStream(stream)
+		return nil, "", err
+	}
+	bound, err := protocol.ReadMuxReply(stream)
+	if err != nil {
+		tunnel.CloseMuxStream(stream)
+		return nil, "", err
+	}
+	return stream, bound, nil
+}
+
+// muxDownstream 将流上服务端的数据写入本地连接。服务端方向结束时仅关闭本地连接的写方向，
+// 等待本地方向也结束；本地连接不支持半关闭或读写失败时整体关闭流
+func (p *ECHPool) muxDownstream(channelID int, connID string, stream tunnel.MuxStream, c net.Conn, st *streamSeq) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if _, werr := c.Write(buf[:n]); werr != nil {
+				log.Printf("[客户端] 写入本地TCP连接失败: %v，关闭流", werr)
+				break
+			}
+			st.down.Add(int64(n))
+			p.frames.Metrics().BytesDown.Add(int64(n))
+		}
+		if err == io.EOF {
+			p.mu.Lock()
+			st.finRecv = true
+			halfClosed := !st.finSent && netutil.CloseWrite(c)
+			p.mu.Unlock()
+			if halfClosed {
+				<-st.done
+				return
+			}
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	p.closeStream(channelID, connID)
+}
+
+// muxStream 返回流所在的多路复用流（非多路复用模式或流尚未建立时为 nil）
+func (p *ECHPool) muxStream(connID string) tunnel.MuxStream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.muxStreams[connID]
+}
@@ -0,0 +1,66 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"ech-tunnel/protocol"
+)
+
+// TestMuxEchoHalfClose 多路复用模式下传输超过初始流窗口的数据，本地关闭写方向后仍能读完目标的全部回显
+func TestMuxEchoHalfClose(t *testing.T) {
+	echo := startEchoServer(t)
+	p := startTestPool(t, 2, protocol.MuxYamux)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := p.Dial(ctx, echo, "hello ", testFrames.PriorityFor(echo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 64<<10) // 1MB
+	go func() {
+		c.Write(msg)
+		c.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("读取回显失败: %v（已读 %d 字节）", err, len(got))
+	}
+	if want := append([]byte("hello "), msg...); !bytes.Equal(got, want) {
+		t.Fatalf("回显 %d 字节，期望 %d 字节", len(got), len(want))
+	}
+}
+
+// TestMuxDialError 服务端连接目标失败时立即结束等待，而不是等到超时
+func TestMuxDialError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	p := startTestPool(t, 1, protocol.MuxYamux)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := p.Dial(ctx, closed, "", testFrames.PriorityFor(closed)); err == nil {
+		t.Fatal("连接已关闭的端口应失败")
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("连接失败 %s 后才返回", d)
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.seqMap) != 0 || len(p.tcpMap) != 0 || len(p.muxStreams) != 0 {
+		t.Errorf("失败的流未清理: seqMap %d, tcpMap %d, muxStreams %d", len(p.seqMap), len(p.tcpMap), len(p.muxStreams))
+	}
+}
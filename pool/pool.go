@@ -0,0 +1,1313 @@
+// Package pool 实现隧道客户端的多通道连接池：按 Config 建立并维护到服务端的若干通道，
+// 在通道间分配流、重排与确认数据、检测通道健康度并在断线后重连与恢复流（health.go、mux.go、relay.go）。
+package pool
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"ech-tunnel/internal/netutil"
+	"ech-tunnel/protocol"
+	"ech-tunnel/tunnel"
+)
+
+// streamSeq 单个流的收发序号状态与传输统计
+type streamSeq struct {
+	send atomic.Uint64
+	recv *tunnel.ReorderBuffer
+	cc   *tunnel.CongestionController // 客户端到服务端方向的拥塞控制（协议版本 4）
+	ack  *tunnel.AckScheduler         // 服务端到客户端方向的累计确认
+
+	priority tunnel.StreamPriority
+
+	target   string
+	start    time.Time
+	up, down atomic.Int64
+	bound    string // 服务端出站连接的本地地址（CONNECTED 帧提供）
+
+	// 半关闭状态（由 p.mu 保护）：finSent 本地读到 EOF 并已发送 FIN，finRecv 收到服务端 FIN；
+	// done 在流被移除时关闭
+	finSent, finRecv bool
+	done             chan struct{}
+}
+
+// Config 客户端连接池参数（对应 -n、-claim、-when-down 等命令行参数）
+type Config struct {
+	Addr     string         // 服务地址（wss://、grpc:// 或 quic://）
+	Channels int            // 通道数
+	Frames   *tunnel.Frames // 帧层，不能为 nil
+	Dialer   *tunnel.Dialer // 建立通道的拨号器，不能为 nil
+	Mux      string         // 流多路复用方式，为空时使用隧道自身的帧（quic:// 总是多路复用）
+
+	ClaimMode      string  // 新流的通道分配方式: race|roundrobin|pinned|hash，为空时为 race
+	ChannelStreams int     // 每个通道同时承载的流上限，0 表示不限制
+	PaceRate       float64 // 每个通道的发送节奏带宽（Mbps），0 表示不限制
+
+	PingInterval  time.Duration // 通道心跳间隔，须大于 0
+	PongTimeout   time.Duration // 超过该时间未收到对端任何消息即判定通道失联（与帧层一致，仅用于日志）
+	PongMissLimit int           // 连续该次数的 Ping 未收到 Pong 即重连通道，0 表示不检测
+	ResumeTimeout time.Duration // 大于 0 时通道断开后恢复其上的流（多路复用模式不支持）
+
+	ConnectTimeout      time.Duration // 等待服务端连上目标的最长时间
+	StreamStatsInterval time.Duration // 周期输出长连接流统计的间隔，0 表示不输出
+	StreamStatsLog      bool          // 每个流关闭时输出传输统计
+
+	WhenDown         string        // 全部通道不可用时对新连接的处理: accept|refuse|queue，为空时为 accept
+	DownQueue        int           // queue 时至多同时等待的连接数
+	DownQueueTimeout time.Duration // queue 时等待通道恢复的最长时间
+}
+
+// ECHPool 多通道客户端连接池
+type ECHPool struct {
+	cfg           Config
+	frames        *tunnel.Frames
+	wsServerAddr  string
+	connectionNum int
+	sessionID     string // 会话 ID，各通道握手时携带，用于断线重连后恢复流（-resume-timeout 为 0 时为空）
+	// 建立通道连接，返回连接、协商的协议版本、单条消息上限与是否启用 zstd（默认为 Config.Dialer.Dial）
+	dial func(addr string, maxRetries int, sessionID string) (tunnel.TunnelConn, int, int, bool, error)
+
+	wsConns   []tunnel.TunnelConn
+	wsMutexes []sync.Mutex
+	queues    []*tunnel.SendQueue // 各通道 DATA 帧的发送队列（优先级与公平调度）
+	pacers    []*tunnel.Pacer
+	padders   []*tunnel.Padder
+	health    []*channelHealth
+	activity  []tunnel.ActivityClock // 各通道最近一次收到消息的时间（发送窗口等待时判断通道是否失联）
+	versions  []int                  // 各通道协商的协议版本
+	maxFrames []int                  // 各通道协商的单条消息上限
+	zstd      []bool                 // 各通道是否协商了 zstd 负载压缩
+
+	// 多路复用模式（-mux 或 quic://）：各通道的多路复用会话（未连接时为 nil）与各流所在的流（由 mu 保护）
+	mux         bool
+	muxSessions []tunnel.MuxSession
+	muxStreams  map[string]tunnel.MuxStream
+
+	mu               sync.RWMutex
+	tcpMap           map[string]net.Conn
+	seqMap           map[string]*streamSeq
+	udpMap           map[string]UDPHandler
+	channelMap       map[string]int
+	connInfo         map[string]struct{ targetAddr, firstFrameData string }
+	claimTimes       map[string]map[int]time.Time
+	connected        map[string]chan bool
+	boundByChannel   map[int]string
+	pendingByChannel map[int]string
+
+	// 非竞选分配方式（-claim）的状态，由 mu 保护
+	rrNext int // roundrobin: 下一个通道的轮转计数
+	pinned int // pinned: 当前固定使用的通道（-1 表示未选定）
+
+	// 通道可用状态（-when-down），由 mu 保护
+	up     int           // 读循环正在运行的通道数
+	upWake chan struct{} // 首个通道恢复时关闭，唤醒排队等待的本地连接
+	held   int           // 排队等待通道恢复的本地连接数
+}
+
+// New 校验参数并创建连接池（调用 Start 后开始建立通道）
+func New(cfg Config) (*ECHPool, error) {
+	if cfg.Frames == nil || cfg.Dialer == nil {
+		return nil, errors.New("缺少帧层或拨号器配置")
+	}
+	if cfg.Channels <= 0 {
+		return nil, errors.New("通道数必须大于 0")
+	}
+	if cfg.PingInterval <= 0 {
+		return nil, errors.New("心跳间隔必须大于 0")
+	}
+	if cfg.ClaimMode == "" {
+		cfg.ClaimMode = "race"
+	}
+	switch cfg.ClaimMode {
+	case "race", "roundrobin", "pinned", "hash":
+	default:
+		return nil, fmt.Errorf("无效的通道分配方式: %s（可选 race、roundrobin、pinned、hash）", cfg.ClaimMode)
+	}
+	if cfg.WhenDown == "" {
+		cfg.WhenDown = "accept"
+	}
+	switch cfg.WhenDown {
+	case "accept", "refuse", "queue":
+	default:
+		return nil, fmt.Errorf("无效的通道不可用处理方式: %s（可选 accept、refuse、queue）", cfg.WhenDown)
+	}
+	n := cfg.Channels
+	mux := cfg.Mux != "" || strings.HasPrefix(cfg.Addr, "quic://")
+	var sessionID string
+	if cfg.ResumeTimeout > 0 && !mux {
+		sessionID = uuid.New().String()
+	}
+	return &ECHPool{
+		cfg:              cfg,
+		frames:           cfg.Frames,
+		wsServerAddr:     cfg.Addr,
+		connectionNum:    n,
+		sessionID:        sessionID,
+		dial:             cfg.Dialer.Dial,
+		wsConns:          make([]tunnel.TunnelConn, n),
+		wsMutexes:        make([]sync.Mutex, n),
+		queues:           make([]*tunnel.SendQueue, n),
+		pacers:           make([]*tunnel.Pacer, n),
+		padders:          make([]*tunnel.Padder, n),
+		health:           make([]*channelHealth, n),
+		activity:         make([]tunnel.ActivityClock, n),
+		versions:         make([]int, n),
+		maxFrames:        make([]int, n),
+		zstd:             make([]bool, n),
+		mux:              mux,
+		muxSessions:      make([]tunnel.MuxSession, n),
+		muxStreams:       make(map[string]tunnel.MuxStream),
+		tcpMap:           make(map[string]net.Conn),
+		seqMap:           make(map[string]*streamSeq),
+		udpMap:           make(map[string]UDPHandler),
+		channelMap:       make(map[string]int),
+		connInfo:         make(map[string]struct{ targetAddr, firstFrameData string }),
+		claimTimes:       make(map[string]map[int]time.Time),
+		connected:        make(map[string]chan bool),
+		boundByChannel:   make(map[int]string),
+		pendingByChannel: make(map[int]string),
+		pinned:           -1,
+		upWake:           make(chan struct{}),
+	}, nil
+}
+
+// Addr 返回连接池连接的服务端地址
+func (p *ECHPool) Addr() string { return p.wsServerAddr }
+
+// Start 启动连接池的所有连接
+func (p *ECHPool) Start() {
+	for i := 0; i < p.connectionNum; i++ {
+		p.pacers[i] = tunnel.NewPacer(p.cfg.PaceRate)
+		p.padders[i] = p.frames.NewPadder()
+		p.health[i] = &channelHealth{}
+		p.queues[i] = tunnel.NewSendQueue()
+		go p.queues[i].Run(func(connID string, seq uint64, payload []byte) error {
+			return p.writeData(i, connID, seq, payload)
+		})
+		go p.dialOnce(i)
+	}
+	if p.cfg.StreamStatsInterval > 0 {
+		go p.streamStatsLoop(p.cfg.StreamStatsInterval)
+	}
+}
+
+// dialOnce 为指定通道建立连接
+func (p *ECHPool) dialOnce(index int) {
+	for {
+		wsConn, version, maxFrame, compress, err := p.dial(p.wsServerAddr, 2, p.sessionID)
+		if err != nil {
+			log.Printf("[客户端] 通道 %d WebSocket(ECH) 连接失败: %v，2秒后重试", index, err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		p.mu.Lock()
+		p.versions[index] = version
+		p.maxFrames[index] = maxFrame
+		p.zstd[index] = compress
+		p.wsConns[index] = wsConn
+		p.mu.Unlock()
+		log.Printf("[客户端] 通道 %d WebSocket(ECH) 已连接，协议版本 %d", index, version)
+		go p.handleChannel(index, wsConn)
+		return
+	}
+}
+
+// RegisterAndClaim 注册一个本地TCP连接，并对所有通道发起认领（优先级按目标端口推断）
+func (p *ECHPool) RegisterAndClaim(connID, target, firstFrame string, tcpConn net.Conn) {
+	p.RegisterAndClaimOn(connID, target, firstFrame, tcpConn, nil, p.frames.PriorityFor(target))
+}
+
+// RegisterAndClaimOn 注册一个本地TCP连接，仅对指定通道发起认领（channels 为空表示所有通道）
+func (p *ECHPool) RegisterAndClaimOn(connID, target, firstFrame string, tcpConn net.Conn, channels []int, prio tunnel.StreamPriority) {
+	p.mu.Lock()
+	p.tcpMap[connID] = tcpConn
+	st := &streamSeq{recv: p.frames.NewReorderBuffer(), cc: p.frames.NewCongestionController(), priority: prio, target: target, start: time.Now(), done: make(chan struct{})}
+	st.up.Store(int64(len(firstFrame))) // 首帧随 TCP 建连请求发送
+	p.frames.Metrics().StreamsOpened.Add(1)
+	p.frames.Metrics().BytesUp.Add(int64(len(firstFrame)))
+	st.ack = p.frames.NewAckScheduler(connID, st.recv, func(f protocol.ControlFrame) { _ = p.sendStreamControl(connID, f) })
+	p.seqMap[connID] = st
+	p.connInfo[connID] = struct{ targetAddr, firstFrameData string }{targetAddr: target, firstFrameData: firstFrame}
+	if _, ok := p.connected[connID]; !ok {
+		p.connected[connID] = make(chan bool, 1)
+	}
+	p.mu.Unlock()
+
+	if p.mux {
+		go p.openMuxStream(connID, target, firstFrame, channels)
+		return
+	}
+	if p.assignChannel(connID, target, channels) {
+		go p.reclaim(connID, target, channels)
+	}
+}
+
+// 首次重新认领前的等待时间，之后每次加倍
+const claimRetryDelay = time.Second
+
+// reclaim 超时仍未收到任何 CLAIM_ACK（如 CLAIM 发出时各通道均在重连）或没有可用通道时，按退避间隔
+// 向当前可用的通道重新发起认领，直至流被绑定，或等待超时被放弃（见 WaitConnected）
+func (p *ECHPool) reclaim(connID, target string, channels []int) {
+	delay := claimRetryDelay
+	for attempt := 1; ; attempt++ {
+		time.Sleep(delay)
+		if !p.assignChannel(connID, target, channels) {
+			return
+		}
+		log.Printf("[客户端] 连接 %s 尚未分配到通道，第 %d 次重新认领", connID, attempt)
+		delay *= 2
+	}
+}
+
+// assignChannel 为待绑定的流分配通道：race 方式向候选通道发送 CLAIM 由最先响应者承载，
+// 其他方式直接选定通道并发送建连请求（省去 CLAIM 往返）。返回 true 表示仍需等待（重新认领）
+func (p *ECHPool) assignChannel(connID, target string, channels []int) bool {
+	p.mu.Lock()
+	_, pending := p.connInfo[connID]
+	_, bound := p.channelMap[connID]
+	if !pending || bound {
+		p.mu.Unlock()
+		return false
+	}
+	candidates := p.claimCandidatesLocked(channels)
+	if p.cfg.ClaimMode != "race" && len(candidates) > 0 {
+		ch := p.pickChannelLocked(target, candidates)
+		p.mu.Unlock()
+		p.bindStream(ch, connID, false)
+		return false
+	}
+	if p.claimTimes[connID] == nil {
+		p.claimTimes[connID] = make(map[int]time.Time)
+	}
+	now := time.Now()
+	for _, i := range candidates {
+		p.claimTimes[connID][i] = now
+	}
+	p.mu.Unlock()
+
+	for _, i := range candidates {
+		ws, version, _ := p.channelConn(i)
+		if ws == nil {
+			// 解锁后通道断开，由其余候选通道竞选
+			continue
+		}
+		err := tunnel.WriteControl(ws, &p.wsMutexes[i], version, protocol.ControlFrame{Type: protocol.CtrlClaim, ConnID: connID, Channel: i})
+		if err != nil {
+			log.Printf("[客户端] 通道 %d 发送CLAIM失败: %v", i, err)
+		}
+	}
+	return true
+}
+
+// claimCandidatesLocked 返回参与认领竞选的通道：已连接、在亲和集合内，且设置 -channel-streams 时
+// 活跃流未达上限；全部已满时溢出到负载最低的通道（调用方持有 p.mu）
+func (p *ECHPool) claimCandidatesLocked(channels []int) []int {
+	var load []int
+	if p.cfg.ChannelStreams > 0 {
+		load = make([]int, len(p.wsConns))
+		for _, ch := range p.channelMap {
+			if ch < len(load) {
+				load[ch]++
+			}
+		}
+	}
+	var open, connected []int
+	for i, ws := range p.wsConns {
+		if ws == nil || !channelAllowed(channels, i) {
+			continue
+		}
+		connected = append(connected, i)
+		if load == nil || load[i] < p.cfg.ChannelStreams {
+			open = append(open, i)
+		}
+	}
+	if len(open) > 0 || len(connected) == 0 {
+		return open
+	}
+	least := connected[0]
+	for _, i := range connected[1:] {
+		if load[i] < load[least] {
+			least = i
+		}
+	}
+	log.Printf("[客户端] 所有通道均已达到 %d 个流的上限，使用负载最低的通道 %d", p.cfg.ChannelStreams, least)
+	return []int{least}
+}
+
+// pickChannelLocked 非竞选分配方式下从候选通道中选择一个（调用方持有 p.mu）
+func (p *ECHPool) pickChannelLocked(target string, candidates []int) int {
+	switch p.cfg.ClaimMode {
+	case "hash":
+		return hashChannel(target, candidates)
+	case "roundrobin":
+		p.rrNext++
+		return candidates[p.rrNext%len(candidates)]
+	}
+	// pinned: 固定使用一个通道，直至其断开或已满时改用 RTT 最低的候选通道
+	if !slices.Contains(candidates, p.pinned) {
+		p.pinned = p.fastestOf(candidates)
+		log.Printf("[客户端] 新流固定使用通道 %d", p.pinned)
+	}
+	return p.pinned
+}
+
+// hashChannel 按目标主机在候选通道中做最高随机权重（rendezvous）哈希：同一主机的流固定落在同一通道，
+// 共享该通道底层连接已增长的拥塞窗口，且同一目标的流之间保持直观的先后顺序；
+// 某通道断开或已满时仅原本落在该通道上的主机改用其他通道
+func hashChannel(target string, candidates []int) int {
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	best, bestWeight := candidates[0], uint64(0)
+	for _, ch := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(host))
+		h.Write([]byte{'#', byte(ch), byte(ch >> 8)})
+		if w := h.Sum64(); w > bestWeight {
+			best, bestWeight = ch, w
+		}
+	}
+	return best
+}
+
+// channelAllowed 判断通道是否在亲和集合内
+func channelAllowed(channels []int, id int) bool {
+	if len(channels) == 0 {
+		return true
+	}
+	for _, c := range channels {
+		if c == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseChannelSet 解析通道亲和集合，如 "2"、"0-1"、"0+3"
+func ParseChannelSet(s string, n int) ([]int, error) {
+	var channels []int
+	for _, part := range strings.Split(s, "+") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("无效的通道编号: %s", part)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil || end < start {
+				return nil, fmt.Errorf("无效的通道范围: %s", part)
+			}
+		}
+		if start < 0 || end >= n {
+			return nil, fmt.Errorf("通道编号超出范围 [0, %d): %s", n, part)
+		}
+		for i := start; i <= end; i++ {
+			channels = append(channels, i)
+		}
+	}
+	return channels, nil
+}
+
+// UDPHandler 接收服务端经 UDP 关联发回的数据（由 SOCKS5 的 UDP 关联实现）
+type UDPHandler interface {
+	// HandleUDPResponse 处理来自 addrData（host:port）的数据报
+	HandleUDPResponse(addrData string, data []byte)
+	// Terminate 服务端已关闭关联，本地随之终止
+	Terminate()
+}
+
+// RegisterUDP 注册UDP关联
+func (p *ECHPool) RegisterUDP(connID string, assoc UDPHandler) {
+	p.mu.Lock()
+	p.udpMap[connID] = assoc
+	if _, ok := p.connected[connID]; !ok {
+		p.connected[connID] = make(chan bool, 1)
+	}
+	p.mu.Unlock()
+}
+
+// SendUDPConnect 发送UDP连接请求（选择 RTT 最低的可用通道）
+func (p *ECHPool) SendUDPConnect(connID, target string) error {
+	if p.mux {
+		return fmt.Errorf("多路复用模式（-mux）不支持 UDP")
+	}
+	var ws tunnel.TunnelConn
+	var chID, version int
+	if ranked := p.rankedChannels(); len(ranked) > 0 {
+		chID = ranked[0]
+		ws, version, _ = p.channelConn(chID)
+	}
+
+	if ws == nil {
+		return fmt.Errorf("没有可用的 WebSocket 连接")
+	}
+
+	// 记录通道映射
+	p.mu.Lock()
+	p.channelMap[connID] = chID
+	p.boundByChannel[chID] = connID
+	p.mu.Unlock()
+
+	return tunnel.WriteControl(ws, &p.wsMutexes[chID], version, protocol.ControlFrame{Type: protocol.CtrlUDPConnect, ConnID: connID, Target: target})
+}
+
+// SendUDPData 发送UDP数据
+func (p *ECHPool) SendUDPData(connID string, data []byte) error {
+	p.mu.RLock()
+	chID, ok := p.channelMap[connID]
+	var ws tunnel.TunnelConn
+	if ok && chID < len(p.wsConns) {
+		ws = p.wsConns[chID]
+	}
+	p.mu.RUnlock()
+
+	if !ok || ws == nil {
+		return fmt.Errorf("未分配通道")
+	}
+
+	bp := tunnel.GetFrameBuf()
+	msg := append(*bp, "UDP_DATA:"...)
+	msg = append(msg, connID...)
+	msg = append(msg, '|')
+	msg = p.frames.SealPayload(msg, data, []byte(connID))
+	p.wsMutexes[chID].Lock()
+	err := ws.WriteMessage(websocket.BinaryMessage, msg)
+	p.wsMutexes[chID].Unlock()
+	*bp = msg
+	tunnel.PutFrameBuf(bp)
+
+	return err
+}
+
+// SendUDPClose 关闭UDP连接
+func (p *ECHPool) SendUDPClose(connID string) error {
+	p.mu.RLock()
+	chID, ok := p.channelMap[connID]
+	var ws tunnel.TunnelConn
+	var version int
+	if ok && chID < len(p.wsConns) {
+		ws, version = p.wsConns[chID], p.versions[chID]
+	}
+	p.mu.RUnlock()
+
+	if !ok || ws == nil {
+		return nil
+	}
+
+	err := tunnel.WriteControl(ws, &p.wsMutexes[chID], version, protocol.ControlFrame{Type: protocol.CtrlUDPClose, ConnID: connID})
+
+	// 清理映射
+	p.mu.Lock()
+	delete(p.channelMap, connID)
+	delete(p.boundByChannel, chID)
+	delete(p.udpMap, connID)
+	delete(p.connected, connID)
+	p.mu.Unlock()
+
+	return err
+}
+
+// WaitConnected 等待连接建立（服务端返回 ERROR 时立即返回 false）。TCP 流超时时放弃该流：
+// 已绑定通道则通知服务端关闭，并清理全部认领与流状态（本地连接由调用方关闭）
+func (p *ECHPool) WaitConnected(connID string, timeout time.Duration) bool {
+	p.mu.RLock()
+	ch := p.connected[connID]
+	p.mu.RUnlock()
+	if ch == nil {
+		return false
+	}
+	select {
+	case ok := <-ch:
+		return ok
+	case <-time.After(timeout):
+		p.abandon(connID)
+		return false
+	}
+}
+
+// abandon 清理建连超时的 TCP 流（UDP 关联由其自身的关闭流程清理）
+func (p *ECHPool) abandon(connID string) {
+	p.mu.RLock()
+	_, isTCP := p.seqMap[connID]
+	p.mu.RUnlock()
+	if !isTCP {
+		return
+	}
+	_ = p.SendClose(connID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.tcpMap, connID)
+	p.removeStreamLocked(connID)
+	if ch, ok := p.channelMap[connID]; ok {
+		delete(p.channelMap, connID)
+		if p.boundByChannel[ch] == connID {
+			delete(p.boundByChannel, ch)
+		}
+	}
+	delete(p.connInfo, connID)
+	delete(p.claimTimes, connID)
+}
+
+// BoundAddr 返回服务端为该连接建立的出站连接的本地地址（未知时为空）
+func (p *ECHPool) BoundAddr(connID string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if st := p.seqMap[connID]; st != nil {
+		return st.bound
+	}
+	return ""
+}
+
+// MaxPayload 返回流所在通道单个 DATA 帧可承载的最大负载（通道未知时按协商下限）
+func (p *ECHPool) MaxPayload(connID string) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	limit := protocol.MinMaxFrameSize
+	if ch, ok := p.channelMap[connID]; ok && ch < len(p.maxFrames) && p.maxFrames[ch] > 0 {
+		limit = p.maxFrames[ch]
+	}
+	return p.frames.MaxPayloadFor(limit)
+}
+
+// ChannelOf 返回连接绑定的通道
+func (p *ECHPool) ChannelOf(connID string) (int, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ch, ok := p.channelMap[connID]
+	return ch, ok
+}
+
+// handleChannel 处理单个通道的消息
+func (p *ECHPool) handleChannel(channelID int, wsConn tunnel.TunnelConn) {
+	if p.mux {
+		p.handleMuxChannel(channelID, wsConn)
+		return
+	}
+	health := p.health[channelID]
+	health.reset()
+	p.setChannelUp(channelID, true)
+	// 该连接协商的协议版本与是否启用 zstd 负载压缩（重连后由新连接的处理协程读取新值）
+	p.mu.RLock()
+	version, compressed := p.versions[channelID], p.zstd[channelID]
+	p.mu.RUnlock()
+	activity := &p.activity[channelID]
+	p.frames.ExtendReadDeadline(wsConn)
+	activity.Touch()
+	wsConn.SetPongHandler(func(message string) error {
+		p.frames.ExtendReadDeadline(wsConn)
+		activity.Touch()
+		health.onPong(message)
+		return nil
+	})
+	wsConn.SetPingHandler(func(message string) error {
+		p.frames.ExtendReadDeadline(wsConn)
+		activity.Touch()
+		p.wsMutexes[channelID].Lock()
+		err := wsConn.WriteMessage(websocket.PongMessage, []byte(message))
+		p.wsMutexes[channelID].Unlock()
+		return err
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	var pongLost atomic.Bool
+	go p.padders[channelID].IdleLoop(done, func(frame []byte) error {
+		p.wsMutexes[channelID].Lock()
+		defer p.wsMutexes[channelID].Unlock()
+		return wsConn.WriteMessage(websocket.BinaryMessage, frame)
+	})
+
+	go func() {
+		t := time.NewTicker(p.cfg.PingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			p.wsMutexes[channelID].Lock()
+			_ = wsConn.WriteMessage(websocket.PingMessage, health.pingPayload())
+			p.wsMutexes[channelID].Unlock()
+			// 连续多次未收到 Pong：即使仍有数据到达也视为黑洞通道，
+			// 将读超时设为当前时间使读循环立即退出并重连，避免其继续赢得 CLAIM
+			if p.cfg.PongMissLimit > 0 && health.missedPongs() >= p.cfg.PongMissLimit {
+				pongLost.Store(true)
+				_ = wsConn.SetReadDeadline(time.Now())
+			}
+		}
+	}()
+
+	for {
+		mt, msg, err := wsConn.ReadMessage()
+		if err != nil || pongLost.Load() {
+			if pongLost.Load() {
+				log.Printf("[客户端] 通道 %d 连续 %d 次未收到 Pong，判定失联", channelID, p.cfg.PongMissLimit)
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Printf("[客户端] 通道 %d 超过 %s 未收到心跳，判定失联", channelID, p.cfg.PongTimeout)
+			} else {
+				log.Printf("[客户端] 通道 %d WebSocket读取失败: %v", channelID, err)
+			}
+			_ = wsConn.Close()
+			p.setChannelUp(channelID, false)
+			// 重连通道
+			p.redialChannel(channelID)
+			return
+		}
+		p.frames.ExtendReadDeadline(wsConn)
+		activity.Touch()
+
+		if mt == websocket.BinaryMessage {
+			// 处理 UDP 数据响应: UDP_DATA:<connID>|<host>:<port>|<data>
+			if len(msg) > 9 && string(msg[:9]) == "UDP_DATA:" {
+				parts := bytes.SplitN(msg[9:], []byte("|"), 3)
+				if len(parts) == 3 {
+					addrData := string(parts[1])
+					data, err := p.frames.OpenPayload(parts[2], parts[0])
+					if err != nil {
+						log.Printf("[客户端UDP:%s] %v", parts[0], err)
+						continue
+					}
+
+					p.mu.RLock()
+					assoc := p.udpMap[string(parts[0])]
+					p.mu.RUnlock()
+
+					if assoc != nil {
+						assoc.HandleUDPResponse(addrData, data)
+					}
+				}
+				continue
+			}
+
+			// 空闲伪帧直接丢弃
+			if bytes.HasPrefix(msg, []byte("PAD:")) {
+				continue
+			}
+
+			// 结构化控制帧（协议版本 2）
+			if bytes.HasPrefix(msg, []byte(protocol.ControlPrefix)) {
+				if f, ok := protocol.DecodeControl(mt, msg); ok {
+					p.handleControl(channelID, wsConn, f)
+				}
+				continue
+			}
+
+			// 填充帧去除填充后按 DATA 处理
+			body, isData := []byte(nil), false
+			if bytes.HasPrefix(msg, []byte("DATAP:")) {
+				body, isData = tunnel.UnpadDataFrame(msg[6:])
+			} else if bytes.HasPrefix(msg, []byte("DATA:")) {
+				body, isData = msg[5:], true
+			}
+
+			// 支持二进制多路复用：DATA:<id>|<seq>|<payload>
+			if isData {
+				if id, seq, payload, ok := protocol.ParseDataFrame(body, version); ok {
+					p.mu.RLock()
+					c := p.tcpMap[id]
+					st := p.seqMap[id]
+					p.mu.RUnlock()
+					if c != nil && st != nil {
+						if version < protocol.DataSeqVersion {
+							// 旧版服务端的 DATA 帧不含序号，流固定在单个通道上，按到达顺序编号
+							seq = st.recv.Delivered()
+						}
+						plain, err := p.frames.OpenPayload(payload, tunnel.StreamAAD(id, seq))
+						if err == nil && compressed {
+							plain, err = p.frames.DecompressPayload(plain)
+						}
+						var chunks [][]byte
+						if err == nil {
+							chunks, err = st.recv.Push(seq, plain)
+						}
+						written := 0
+						if err == nil {
+							for _, chunk := range chunks {
+								if _, err = c.Write(chunk); err != nil {
+									break
+								}
+								st.down.Add(int64(len(chunk)))
+								p.frames.Metrics().BytesDown.Add(int64(len(chunk)))
+								written += len(chunk)
+							}
+						}
+						// 数据写入本地连接后确认，服务端据此推进发送窗口
+						if err == nil && written > 0 && version >= protocol.FlowControlVersion && !tunnel.AcksOnRead(c) {
+							st.ack.Delivered(written)
+						}
+						if err != nil {
+							log.Printf("[客户端] 写入本地TCP连接失败: %v，发送CLOSE", err)
+							go p.SendClose(id)
+							c.Close()
+							p.mu.Lock()
+							delete(p.tcpMap, id)
+							p.removeStreamLocked(id)
+							p.mu.Unlock()
+						}
+					} else {
+						go p.SendClose(id)
+					}
+					continue
+				}
+			}
+			p.mu.RLock()
+			connID := p.boundByChannel[channelID]
+			c := p.tcpMap[connID]
+			p.mu.RUnlock()
+			if connID != "" && c != nil {
+				if _, err := c.Write(msg); err != nil {
+					log.Printf("[客户端] 通道 %d 写入本地TCP连接失败: %v，发送CLOSE", channelID, err)
+					go p.SendClose(connID)
+					c.Close()
+					p.mu.Lock()
+					delete(p.tcpMap, connID)
+					p.removeStreamLocked(connID)
+					p.mu.Unlock()
+				}
+			}
+			continue
+		}
+
+		if f, ok := protocol.DecodeControl(mt, msg); ok {
+			p.handleControl(channelID, wsConn, f)
+		}
+	}
+}
+
+// bindStream 将待绑定的流绑定到通道并发送建连请求（claimed 表示由 CLAIM_ACK 触发；流已绑定时忽略）
+func (p *ECHPool) bindStream(channelID int, connID string, claimed bool) {
+	p.mu.Lock()
+	if _, exists := p.channelMap[connID]; exists {
+		p.mu.Unlock()
+		return
+	}
+	info, ok := p.connInfo[connID]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	var latency float64
+	if chTimes, ok := p.claimTimes[connID]; ok {
+		if t, ok := chTimes[channelID]; ok {
+			latency = float64(time.Since(t).Nanoseconds()) / 1e6
+			delete(chTimes, channelID)
+			if len(chTimes) == 0 {
+				delete(p.claimTimes, connID)
+			}
+		}
+	}
+	p.channelMap[connID] = channelID
+	p.boundByChannel[channelID] = connID
+	delete(p.connInfo, connID)
+	var flags uint64
+	if st := p.seqMap[connID]; st != nil {
+		flags = st.priority.TCPFlags()
+	}
+	ws, version := p.wsConns[channelID], p.versions[channelID]
+	p.mu.Unlock()
+	if claimed {
+		log.Printf("[客户端] 通道 %d 获胜，连接 %s，延迟 %.2fms", channelID, connID, latency)
+	} else {
+		log.Printf("[客户端] 连接 %s 分配到通道 %d（%s）", connID, channelID, p.cfg.ClaimMode)
+	}
+	var first []byte
+	if info.firstFrameData != "" {
+		first = p.frames.SealPayload(nil, []byte(info.firstFrameData), []byte(connID))
+	}
+	err := tunnel.WriteControl(ws, &p.wsMutexes[channelID], version, protocol.ControlFrame{Type: protocol.CtrlTCP, ConnID: connID, Target: info.targetAddr, Payload: first, Flags: flags})
+	if err != nil {
+		p.mu.Lock()
+		if c, ok := p.tcpMap[connID]; ok {
+			c.Close()
+			delete(p.tcpMap, connID)
+		}
+		p.removeStreamLocked(connID)
+		delete(p.channelMap, connID)
+		delete(p.boundByChannel, channelID)
+		delete(p.connInfo, connID)
+		delete(p.claimTimes, connID)
+		p.mu.Unlock()
+	}
+}
+
+// handleControl 处理通道收到的控制帧
+func (p *ECHPool) handleControl(channelID int, wsConn tunnel.TunnelConn, f protocol.ControlFrame) {
+	connID := f.ConnID
+	switch f.Type {
+	case protocol.CtrlUDPConnected, protocol.CtrlConnected:
+		p.mu.Lock()
+		ch := p.connected[connID]
+		if st := p.seqMap[connID]; st != nil && f.Type == protocol.CtrlConnected {
+			st.bound = f.Target
+		}
+		p.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- true:
+			default:
+			}
+		}
+
+	case protocol.CtrlUDPError:
+		log.Printf("[客户端UDP:%s] 错误(%d): %s", connID, f.Code, f.Message)
+
+	case protocol.CtrlUDPClose:
+		// 服务端回收了空闲的 UDP 关联，本地同步终止
+		p.mu.RLock()
+		assoc := p.udpMap[connID]
+		p.mu.RUnlock()
+		if assoc != nil {
+			log.Printf("[客户端UDP:%s] 服务端已关闭关联", connID)
+			assoc.Terminate()
+		}
+
+	case protocol.CtrlClaimAck:
+		p.bindStream(channelID, connID, true)
+
+	case protocol.CtrlError:
+		if connID == "" {
+			log.Printf("[客户端] 通道 %d 错误(%d): %s", channelID, f.Code, f.Message)
+			return
+		}
+		// 建连失败：立即结束等待，本地连接交由调用方回复错误后关闭（随后的 CLOSE 不再关闭它）
+		log.Printf("[客户端] 连接 %s 建立失败(%d): %s", connID, f.Code, f.Message)
+		p.mu.Lock()
+		delete(p.tcpMap, connID)
+		ch := p.connected[connID]
+		p.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- false:
+			default:
+			}
+		}
+
+	case protocol.CtrlFIN:
+		// 服务端方向结束：仅关闭本地连接的写方向，本地仍可继续上传
+		p.mu.Lock()
+		st, c := p.seqMap[connID], p.tcpMap[connID]
+		if st != nil && st.finRecv {
+			// 恢复后重发的 FIN
+			p.mu.Unlock()
+			return
+		}
+		if st != nil && c != nil {
+			st.finRecv = true
+			if !st.finSent && netutil.CloseWrite(c) {
+				p.mu.Unlock()
+				return
+			}
+		}
+		p.mu.Unlock()
+		// 双向均已结束（或本地连接不支持半关闭）：通知服务端并整体关闭
+		_ = p.SendClose(connID)
+		p.closeStream(channelID, connID)
+
+	case protocol.CtrlClose:
+		if f.Code != protocol.CtrlErrUnknown {
+			log.Printf("[客户端] 连接 %s 被服务端关闭(%d): %s", connID, f.Code, f.Message)
+		}
+		p.mu.RLock()
+		if st := p.seqMap[connID]; st != nil {
+			tunnel.CloseAccounting("客户端", connID, f, st.up.Load(), st.down.Load())
+		}
+		p.mu.RUnlock()
+		p.closeStream(channelID, connID)
+
+	case protocol.CtrlAck:
+		p.mu.RLock()
+		st := p.seqMap[connID]
+		p.mu.RUnlock()
+		if st != nil {
+			st.cc.OnAck(f)
+		}
+
+	case protocol.CtrlResume:
+		go p.retransmit(connID, f.Seq)
+	}
+}
+
+// channelConn 在 p.mu 下读取通道 chID 当前的连接、协商的协议版本与是否启用 zstd。
+// 通道重连时三者在 p.mu 下一同替换，调用方须使用同一次读取的值，避免以旧版本编码发往新连接的帧
+func (p *ECHPool) channelConn(chID int) (tunnel.TunnelConn, int, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if chID < 0 || chID >= len(p.wsConns) {
+		return nil, 0, false
+	}
+	return p.wsConns[chID], p.versions[chID], p.zstd[chID]
+}
+
+// sendStreamControl 在流绑定的通道上发送控制帧
+func (p *ECHPool) sendStreamControl(connID string, f protocol.ControlFrame) error {
+	if p.mux {
+		// 多路复用模式的通道只承载多路复用会话，确认由流级流量控制取代
+		return nil
+	}
+	p.mu.RLock()
+	chID, ok := p.channelMap[connID]
+	var ws tunnel.TunnelConn
+	var version int
+	if ok && chID < len(p.wsConns) {
+		ws, version = p.wsConns[chID], p.versions[chID]
+	}
+	p.mu.RUnlock()
+	if ws == nil {
+		return fmt.Errorf("未分配通道")
+	}
+	return tunnel.WriteControl(ws, &p.wsMutexes[chID], version, f)
+}
+
+// ReleaseStream 本地连接结束后移除流的状态（连接由调用方关闭）
+func (p *ECHPool) ReleaseStream(connID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.tcpMap, connID)
+	p.removeStreamLocked(connID)
+}
+
+// closeStream 关闭本地连接并清理流的全部状态
+func (p *ECHPool) closeStream(channelID int, connID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.tcpMap[connID]; ok {
+		_ = c.Close()
+		delete(p.tcpMap, connID)
+	}
+	p.removeStreamLocked(connID)
+	delete(p.channelMap, connID)
+	delete(p.connInfo, connID)
+	delete(p.claimTimes, connID)
+	delete(p.boundByChannel, channelID)
+}
+
+// WaitHalfClosed 本地连接读取结束时调用：读到 EOF 且通道支持半关闭（协议版本 3）时向服务端发送 FIN，
+// 并阻塞至服务端方向也结束，期间下行数据继续写入本地连接；其他情况立即返回，由调用方整体关闭
+func (p *ECHPool) WaitHalfClosed(connID string, err error) {
+	if err != io.EOF {
+		return
+	}
+	p.mu.Lock()
+	st := p.seqMap[connID]
+	if s := p.muxStreams[connID]; s != nil && st != nil {
+		// 多路复用：关闭流的写方向（FIN），下行数据由 muxDownstream 继续写入本地连接
+		if st.finRecv {
+			p.mu.Unlock()
+			return
+		}
+		st.finSent = true
+		p.mu.Unlock()
+		_ = s.Close()
+		<-st.done
+		return
+	}
+	chID, ok := p.channelMap[connID]
+	if st == nil || !ok || chID >= len(p.wsConns) || p.wsConns[chID] == nil || p.versions[chID] < protocol.HalfCloseVersion || st.finRecv {
+		p.mu.Unlock()
+		return
+	}
+	st.finSent = true
+	ws, version := p.wsConns[chID], p.versions[chID]
+	p.mu.Unlock()
+	p.queues[chID].Drain(connID)
+	if tunnel.WriteControl(ws, &p.wsMutexes[chID], version, protocol.ControlFrame{Type: protocol.CtrlFIN, ConnID: connID}) != nil {
+		return
+	}
+	<-st.done
+}
+
+// redialChannel 重连指定通道
+func (p *ECHPool) redialChannel(channelID int) {
+	for {
+		newConn, version, maxFrame, compress, err := p.dial(p.wsServerAddr, 2, p.sessionID)
+		if err != nil {
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		// 通道上可能仍有等待恢复的流在并发发送，加锁替换连接
+		p.mu.Lock()
+		p.versions[channelID] = version
+		p.maxFrames[channelID] = maxFrame
+		p.zstd[channelID] = compress
+		p.wsConns[channelID] = newConn
+		p.mu.Unlock()
+		log.Printf("[客户端] 通道 %d 已重连", channelID)
+		p.frames.Metrics().Reconnects.Add(1)
+		go p.handleChannel(channelID, newConn)
+		p.resumeStreams(channelID)
+		return
+	}
+}
+
+// Redial 主动断开指定通道，由其读循环按常规流程重连（支持会话恢复时通道上的流在新连接上继续），
+// 返回被替换的旧连接；通道不存在或尚未建立时返回 nil
+func (p *ECHPool) Redial(channelID int) tunnel.TunnelConn {
+	p.mu.RLock()
+	var ws tunnel.TunnelConn
+	if channelID >= 0 && channelID < len(p.wsConns) {
+		ws = p.wsConns[channelID]
+	}
+	p.mu.RUnlock()
+	if ws == nil {
+		return nil
+	}
+	log.Printf("[客户端] 通道 %d 主动重连", channelID)
+	_ = ws.Close()
+	return ws
+}
+
+// waitRedialed 等待指定通道的连接被替换为 old 之外的新连接，超时返回 false
+func (p *ECHPool) waitRedialed(channelID int, old tunnel.TunnelConn, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		p.mu.RLock()
+		ws := p.wsConns[channelID]
+		p.mu.RUnlock()
+		if ws != old {
+			return true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return false
+}
+
+// RotateChannels 逐个重连全部通道：前一个通道重连成功（或等待超时）后再断开下一个，
+// 任一时刻最多只有一个通道处于重连中
+func (p *ECHPool) RotateChannels(timeout time.Duration) {
+	for i := 0; i < p.connectionNum; i++ {
+		old := p.Redial(i)
+		if old == nil {
+			continue
+		}
+		if !p.waitRedialed(i, old, timeout) {
+			log.Printf("[客户端] 通道 %d 在 %s 内未能重连，继续轮换下一个通道", i, timeout)
+		}
+	}
+	log.Printf("[客户端] 已轮换全部 %d 个通道", p.connectionNum)
+}
+
+// resumable 协商版本为 version 的通道是否支持会话恢复（本端开启、未使用多路复用且协议版本不低于 5）
+func (p *ECHPool) resumable(version int) bool {
+	return !p.mux && p.sessionID != "" && version >= protocol.ResumeVersion
+}
+
+// resumeStreams 通道重连后恢复其上原有的 TCP 流：逐个发送 RESUME（附带本端已交付的位置），
+// 服务端回复 RESUME 后双方重传对端未收到的数据；不支持会话恢复时关闭这些流
+func (p *ECHPool) resumeStreams(channelID int) {
+	p.mu.RLock()
+	streams := make(map[string]*streamSeq)
+	for id, ch := range p.channelMap {
+		if st := p.seqMap[id]; ch == channelID && st != nil {
+			streams[id] = st
+		}
+	}
+	ws, version := p.wsConns[channelID], p.versions[channelID]
+	p.mu.RUnlock()
+	if len(streams) == 0 {
+		return
+	}
+	if !p.resumable(version) {
+		log.Printf("[客户端] 通道 %d 不支持会话恢复，关闭其上的 %d 个流", channelID, len(streams))
+		for id := range streams {
+			p.closeStream(channelID, id)
+		}
+		return
+	}
+	log.Printf("[客户端] 通道 %d 恢复 %d 个流", channelID, len(streams))
+	for id, st := range streams {
+		f := protocol.ControlFrame{Type: protocol.CtrlResume, ConnID: id, Seq: st.recv.Delivered()}
+		if err := tunnel.WriteControl(ws, &p.wsMutexes[channelID], version, f); err != nil {
+			return
+		}
+	}
+}
+
+// retransmit 服务端已在新通道上恢复流：从服务端已交付的位置（peerSeq）起重传在途数据，断开期间发出的 FIN 一并重发
+func (p *ECHPool) retransmit(connID string, peerSeq uint64) {
+	p.mu.RLock()
+	st := p.seqMap[connID]
+	chID, ok := p.channelMap[connID]
+	p.mu.RUnlock()
+	if st == nil || !ok {
+		return
+	}
+	first, frames, ok := st.cc.Resume(peerSeq)
+	if !ok {
+		log.Printf("[客户端] 连接 %s 缺少重传数据，无法恢复", connID)
+		_ = p.SendClose(connID)
+		p.closeStream(chID, connID)
+		return
+	}
+	for i, data := range frames {
+		seq := first + uint64(i)
+		if err := p.queues[chID].Push(connID, st.priority, seq, tunnel.QueuedPayload(data)); err != nil {
+			return
+		}
+	}
+	p.mu.RLock()
+	finSent := st.finSent
+	p.mu.RUnlock()
+	if finSent {
+		p.queues[chID].Drain(connID)
+		_ = p.sendStreamControl(connID, protocol.ControlFrame{Type: protocol.CtrlFIN, ConnID: connID})
+	}
+	log.Printf("[客户端] 连接 %s 已恢复，重传 %d 帧", connID, len(frames))
+}
+
+// channelIdle 流当前所在通道的空闲时长（通道重连期间持续增长）
+func (p *ECHPool) channelIdle(connID string) time.Duration {
+	p.mu.RLock()
+	chID, ok := p.channelMap[connID]
+	p.mu.RUnlock()
+	if !ok || chID >= len(p.activity) {
+		return tunnel.CCStallTimeout
+	}
+	return p.activity[chID].Idle()
+}
+
+// SendData 发送TCP数据
+func (p *ECHPool) SendData(connID string, b []byte) error {
+	if p.mux {
+		// 多路复用：流的发送窗口已满时在此阻塞
+		s := p.muxStream(connID)
+		if s == nil {
+			return fmt.Errorf("未分配通道")
+		}
+		if _, err := s.Write(b); err != nil {
+			return err
+		}
+		p.mu.RLock()
+		if st := p.seqMap[connID]; st != nil {
+			st.up.Add(int64(len(b)))
+		}
+		p.mu.RUnlock()
+		p.frames.Metrics().BytesUp.Add(int64(len(b)))
+		return nil
+	}
+	p.mu.RLock()
+	chID, ok := p.channelMap[connID]
+	st := p.seqMap[connID]
+	var ws tunnel.TunnelConn
+	var version int
+	if ok && chID < len(p.wsConns) {
+		ws, version = p.wsConns[chID], p.versions[chID]
+	}
+	p.mu.RUnlock()
+	if !ok || ws == nil || st == nil {
+		return fmt.Errorf("未分配通道")
+	}
+	seq := st.send.Add(1) - 1
+	// 发送窗口已满时在此阻塞，暂停读取本地连接
+	if version >= protocol.FlowControlVersion && !st.cc.Acquire(seq, len(b), func() time.Duration { return p.channelIdle(connID) }) {
+		return fmt.Errorf("流已关闭或等待确认期间通道超过 %s 未收到任何消息", tunnel.CCStallTimeout)
+	}
+	if p.resumable(version) {
+		st.cc.Keep(seq, b)
+	}
+	st.up.Add(int64(len(b)))
+	p.frames.Metrics().BytesUp.Add(int64(len(b)))
+	return p.queues[chID].Push(connID, st.priority, seq, tunnel.QueuedPayload(b))
+}
+
+// writeData 发送协程写出一个 DATA 帧（写入通道当前的连接，按该连接协商的压缩方式编码负载）
+func (p *ECHPool) writeData(chID int, connID string, seq uint64, payload []byte) error {
+	ws, version, compress := p.channelConn(chID)
+	if ws == nil {
+		return fmt.Errorf("通道 %d 未连接", chID)
+	}
+	bp := tunnel.GetFrameBuf()
+	defer tunnel.PutFrameBuf(bp)
+	*bp = p.frames.EncodePayload(*bp, connID, seq, payload, compress)
+	p.pacers[chID].Wait(len(*bp))
+	p.wsMutexes[chID].Lock()
+	err := tunnel.WriteDataFrame(ws, websocket.TextMessage, version, p.padders[chID], connID, seq, *bp)
+	p.wsMutexes[chID].Unlock()
+	if err != nil && p.resumable(version) {
+		// 通道断开：帧已保存，通道重连恢复流后重传
+		return nil
+	}
+	return err
+}
+
+// SendClose 发送关闭连接消息
+func (p *ECHPool) SendClose(connID string) error {
+	if p.mux {
+		if s := p.muxStream(connID); s != nil {
+			return s.Close()
+		}
+		return nil
+	}
+	p.mu.RLock()
+	chID, ok := p.channelMap[connID]
+	var ws tunnel.TunnelConn
+	var version int
+	if ok && chID < len(p.wsConns) {
+		ws, version = p.wsConns[chID], p.versions[chID]
+	}
+	p.mu.RUnlock()
+	if !ok || ws == nil {
+		return nil
+	}
+	// 已排队的数据先于 CLOSE 发出
+	p.queues[chID].Drain(connID)
+	f := protocol.ControlFrame{Type: protocol.CtrlClose, ConnID: connID}
+	p.mu.RLock()
+	if st := p.seqMap[connID]; st != nil {
+		f.Sent, f.Received, f.Reason = uint64(st.up.Load()), uint64(st.down.Load()), tunnel.CloseClient
+	}
+	p.mu.RUnlock()
+	return tunnel.WriteControl(ws, &p.wsMutexes[chID], version, f)
+}
+
+// LogStats 输出连接池状态快照
+func (p *ECHPool) LogStats() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	perChannel := make(map[int]int)
+	for _, chID := range p.channelMap {
+		perChannel[chID]++
+	}
+	for i, ws := range p.wsConns {
+		state := "未连接"
+		if ws != nil {
+			state = "已连接 " + ws.RemoteAddr().String()
+		}
+		h := p.health[i]
+		h.mu.Lock()
+		srtt, loss := h.srtt, h.loss
+		h.mu.Unlock()
+		log.Printf("[统计] 通道 %d: %s，活跃流 %d，RTT %s，丢失率 %.1f%%", i, state, perChannel[i], srtt.Round(time.Microsecond), loss*100)
+	}
+	log.Printf("[统计] TCP流: %d，UDP关联: %d，等待认领: %d，等待建立: %d",
+		len(p.tcpMap), len(p.udpMap), len(p.connInfo), len(p.connected))
+
+	// 上行拥塞控制汇总：窗口已满的流长期较多说明默认窗口偏小或通道拥塞
+	var inFlight, losses int64
+	var limited int
+	for _, st := range p.seqMap {
+		cc := st.cc.Stats()
+		inFlight += cc.InFlight
+		losses += cc.LossEvents
+		if cc.InFlight > 0 && cc.InFlight+tunnel.CCSegment > cc.Cwnd {
+			limited++
+		}
+	}
+	log.Printf("[统计] 上行在途: %d KB，受窗口限制的流: %d，窗口收缩累计: %d 次", inFlight>>10, limited, losses)
+}
@@ -0,0 +1,213 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"ech-tunnel/echdns"
+	"ech-tunnel/protocol"
+	"ech-tunnel/tunnel"
+)
+
+// 测试共用的帧层与拨号器（参数同命令行默认值）
+var (
+	testFrames *tunnel.Frames
+	testDialer *tunnel.Dialer
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	testFrames, err = tunnel.NewFrames(tunnel.FrameConfig{
+		MaxFrameSize:    1 << 20,
+		StreamBufferMB:  4,
+		AckInterval:     10 * time.Millisecond,
+		PingInterval:    10 * time.Second,
+		PongTimeout:     30 * time.Second,
+		PadBudget:       30,
+		PadIdleInterval: 5 * time.Second,
+		NoDelayPorts:    "22,3389",
+	})
+	if err != nil {
+		panic(err)
+	}
+	ech, err := echdns.New(echdns.Config{Domain: "cloudflare-ech.com", DNSServer: "dns.alidns.com/dns-query"})
+	if err != nil {
+		panic(err)
+	}
+	if testDialer, err = tunnel.NewDialer(tunnel.DialConfig{Frames: testFrames, ECH: ech}); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// testPoolConfig 返回连接到 addr 的 n 通道连接池配置（其余参数同命令行默认值）
+func testPoolConfig(addr string, n int) Config {
+	return Config{
+		Addr:             addr,
+		Channels:         n,
+		Frames:           testFrames,
+		Dialer:           testDialer,
+		PingInterval:     10 * time.Second,
+		PongTimeout:      30 * time.Second,
+		PongMissLimit:    3,
+		ResumeTimeout:    30 * time.Second,
+		ConnectTimeout:   5 * time.Second,
+		DownQueue:        64,
+		DownQueueTimeout: 30 * time.Second,
+	}
+}
+
+// startEchoServer 启动回显 TCP 服务，返回其地址
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startTestPool 启动进程内的隧道服务端，并返回经明文 WebSocket（不经 ECH）连接它的 n 通道连接池，
+// mux 非空时以该方式多路复用（同 -mux）
+func startTestPool(t *testing.T, n int, mux string) *ECHPool {
+	t.Helper()
+	s, err := tunnel.NewServer(tunnel.ServerConfig{
+		Frames:        testFrames,
+		Routes:        []tunnel.Route{{Path: "/tunnel", CIDRs: "0.0.0.0/0,::/0"}},
+		ResumeTimeout: 30 * time.Second,
+		DialTimeout:   10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+
+	addr := "ws" + strings.TrimPrefix(srv.URL, "http") + "/tunnel"
+	cfg := testPoolConfig(addr, n)
+	cfg.Mux = mux
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.dial = func(addr string, _ int, sessionID string) (tunnel.TunnelConn, int, int, bool, error) {
+		header := testDialer.RequestHeader("")
+		if sessionID != "" {
+			header.Set(protocol.SessionHeader, sessionID)
+		}
+		if mux != "" {
+			header.Set(protocol.MuxHeader, mux)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(addr, header)
+		if err != nil {
+			return nil, 0, 0, false, err
+		}
+		return testFrames.NegotiateChannel(conn, resp.Header, mux)
+	}
+	p.Start()
+	waitChannelsUp(t, p, n)
+	return p
+}
+
+// waitChannelsUp 等待连接池的 n 个通道全部连接
+func waitChannelsUp(t *testing.T, p *ECHPool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		up := 0
+		for _, st := range p.ChannelStats() {
+			if st.Connected {
+				up++
+			}
+		}
+		if up == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("只有 %d/%d 个通道连接成功", up, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPoolRedialWithActiveStreams 通道反复重连的同时各流持续收发（配合 -race 检查通道连接、
+// 协议版本与压缩标志的并发读写），多路复用模式同样检查
+func TestPoolRedialWithActiveStreams(t *testing.T) {
+	for _, mux := range []string{"", protocol.MuxYamux} {
+		t.Run("mux="+mux, func(t *testing.T) { testPoolRedial(t, mux) })
+	}
+}
+
+func testPoolRedial(t *testing.T, mux string) {
+	echo := startEchoServer(t)
+	p := startTestPool(t, 2, mux)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var ok atomic.Int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := bytes.Repeat([]byte{byte('a' + i)}, 4096)
+			buf := make([]byte, len(msg))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				c, err := p.Dial(ctx, echo, "", testFrames.PriorityFor(echo))
+				cancel()
+				if err != nil {
+					continue
+				}
+				c.SetReadDeadline(time.Now().Add(2 * time.Second))
+				if _, err := c.Write(msg); err == nil {
+					if _, err := io.ReadFull(c, buf); err == nil && bytes.Equal(buf, msg) {
+						ok.Add(1)
+					}
+				}
+				c.Close()
+			}
+		}()
+	}
+
+	for round := 0; round < 10; round++ {
+		time.Sleep(50 * time.Millisecond)
+		for ch := 0; ch < 2; ch++ {
+			p.Redial(ch)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if ok.Load() == 0 {
+		t.Fatal("重连期间没有任何流完成收发")
+	}
+}
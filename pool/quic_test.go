@@ -0,0 +1,149 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ech-tunnel/echdns"
+	"ech-tunnel/tunnel"
+)
+
+// startQUICTestServer 启动以新生成的 ECH 密钥解密 ECH 的 QUIC 服务端，返回服务地址与客户端应使用的 ECHConfigList
+func startQUICTestServer(t *testing.T) (string, []byte) {
+	t.Helper()
+	key, list, err := echdns.GenerateKey("public.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ech.pem")
+	if err := os.WriteFile(path, key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := tunnel.NewServer(tunnel.ServerConfig{
+		Frames:     testFrames,
+		Routes:     []tunnel.Route{{Path: "/tunnel", CIDRs: "0.0.0.0/0,::/0"}},
+		ECHKeyFile: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg, _, err := s.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := s.ListenQUIC("127.0.0.1:0", tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go tunnel.ServeQUIC(ln, s.Handler())
+	return "quic://" + ln.Addr().String() + "/tunnel", list
+}
+
+// testQUICClientTLS 测试用的客户端 TLS 配置：自签名证书不含主机名，跳过证书校验（含 ECH 被拒绝时对外层证书的校验），ECH 照常生效
+func testQUICClientTLS(list []byte) *tls.Config {
+	return &tls.Config{
+		MinVersion:                          tls.VersionTLS13,
+		ServerName:                          "tunnel.example",
+		InsecureSkipVerify:                  true,
+		EncryptedClientHelloConfigList:      list,
+		EncryptedClientHelloRejectionVerify: func(tls.ConnectionState) error { return nil },
+	}
+}
+
+func TestQUICHandshakeECH(t *testing.T) {
+	addr, list := startQUICTestServer(t)
+
+	conn, resp, err := testDialer.DialQUIC(addr, testQUICClientTLS(list), testDialer.RequestHeader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, _, _, err := testFrames.NegotiateChannel(conn, resp.Header, ""); err != nil {
+		t.Fatal(err)
+	}
+	if cs := conn.(*tunnel.QuicConn).Conn.ConnectionState().TLS; !cs.ECHAccepted || cs.ServerName != "tunnel.example" {
+		t.Errorf("ECHAccepted = %v，ServerName = %q，期望 true, tunnel.example", cs.ECHAccepted, cs.ServerName)
+	}
+
+	// 使用其他密钥的配置时服务端拒绝 ECH，错误须能被 ECH 重试逻辑识别
+	_, other, err := echdns.GenerateKey("public.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = testDialer.DialQUIC(addr, testQUICClientTLS(other), testDialer.RequestHeader(""))
+	if err == nil || !strings.Contains(err.Error(), "ECH") {
+		t.Errorf("ECH 被拒绝时的错误 = %v，期望包含 ECH", err)
+	}
+	var rejection *tls.ECHRejectionError
+	if !errors.As(err, &rejection) || len(rejection.RetryConfigList) == 0 {
+		t.Errorf("ECH 被拒绝时应返回含重试配置的 ECHRejectionError，实际 %v", err)
+	}
+}
+
+func TestQUICHandshakeRejected(t *testing.T) {
+	addr, list := startQUICTestServer(t)
+	if _, _, err := testDialer.DialQUIC(strings.Replace(addr, "/tunnel", "/other", 1), testQUICClientTLS(list), testDialer.RequestHeader("")); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("未知路径的握手错误 = %v，期望 404", err)
+	}
+}
+
+// TestQUICPoolEcho 经 quic:// 连接池并发传输多个流，每个流为独立的 QUIC 流并支持半关闭
+func TestQUICPoolEcho(t *testing.T) {
+	echo := startEchoServer(t)
+	addr, list := startQUICTestServer(t)
+
+	cfg := testPoolConfig(addr, 2)
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.mux {
+		t.Fatal("quic:// 连接池应以多路复用方式承载流")
+	}
+	p.dial = func(addr string, _ int, _ string) (tunnel.TunnelConn, int, int, bool, error) {
+		conn, resp, err := testDialer.DialQUIC(addr, testQUICClientTLS(list), testDialer.RequestHeader(""))
+		if err != nil {
+			return nil, 0, 0, false, err
+		}
+		return testFrames.NegotiateChannel(conn, resp.Header, "")
+	}
+	p.Start()
+	waitChannelsUp(t, p, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, err := p.Dial(ctx, echo, "", testFrames.PriorityFor(echo))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			msg := bytes.Repeat([]byte{byte('a' + i)}, 256<<10)
+			go func() {
+				c.Write(msg)
+				c.(interface{ CloseWrite() error }).CloseWrite()
+			}()
+			c.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got, err := io.ReadAll(c)
+			if err != nil || !bytes.Equal(got, msg) {
+				t.Errorf("流 %d 回显 %d 字节（%v），期望 %d 字节", i, len(got), err, len(msg))
+			}
+		}()
+	}
+	wg.Wait()
+}
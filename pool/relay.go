@@ -0,0 +1,61 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"ech-tunnel/tunnel"
+
+	"github.com/google/uuid"
+)
+
+// Dial 经连接池打开到 target 的流（实现服务端的 Relay），首帧随建连请求一起发出。返回的连接与目标连接一样
+// 读写（支持读超时与半关闭），等待时间取 ctx 的截止时间，未设置时为 -connect-timeout
+func (p *ECHPool) Dial(ctx context.Context, target, first string, prio tunnel.StreamPriority) (net.Conn, error) {
+	local, remote := tunnel.NewRelayPipe(target, int(p.frames.MaxWindow())+tunnel.RelayPipeBuffer)
+	connID := uuid.New().String()
+	p.RegisterAndClaimOn(connID, target, first, remote, nil, prio)
+	p.mu.RLock()
+	if st := p.seqMap[connID]; st != nil {
+		remote.AckOnRead(st.ack.Delivered)
+	}
+	p.mu.RUnlock()
+
+	wait := p.cfg.ConnectTimeout
+	if dl, ok := ctx.Deadline(); ok {
+		wait = time.Until(dl)
+	}
+	if !p.WaitConnected(connID, wait) {
+		_ = local.Close()
+		_ = remote.Close()
+		return nil, fmt.Errorf("经下一跳 %s 连接失败", p.wsServerAddr)
+	}
+	local.Bound = p.BoundAddr(connID)
+	go pumpRelay(p, connID, remote)
+	return local, nil
+}
+
+// pumpRelay 将服务端写往目标的数据经中继连接池发出（对应客户端转发本地连接的读取循环）
+func pumpRelay(pool *ECHPool, connID string, remote *tunnel.RelayConn) {
+	defer func() {
+		_ = pool.SendClose(connID)
+		_ = remote.Close()
+	}()
+	ab := tunnel.NewAdaptiveBuffer(pool.MaxPayload(connID), false)
+	for {
+		buf := ab.Bytes()
+		n, err := remote.Read(buf)
+		ab.Observe(n)
+		if err != nil {
+			pool.WaitHalfClosed(connID, err)
+			return
+		}
+		if err := pool.SendData(connID, buf[:n]); err != nil {
+			log.Printf("[中继] 发送数据到下一跳失败: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package pool
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"ech-tunnel/tunnel"
+)
+
+// StreamStat 客户端单个 TCP 流的传输统计快照
+type StreamStat struct {
+	ConnID   string
+	Target   string
+	Channel  int // 未绑定通道时为 -1
+	Start    time.Time
+	Duration time.Duration
+	Up       int64 // 上行字节（本地 -> 服务端）
+	Down     int64 // 下行字节（服务端 -> 本地）
+
+	// 上行方向的拥塞控制状态（协议版本 4，SRTT 为 0 表示尚无确认）
+	Cwnd       int64
+	InFlight   int64
+	SRTT       time.Duration
+	LossEvents int64
+}
+
+// snapshotLocked 生成流统计快照（调用方持有 p.mu）
+func (p *ECHPool) snapshotLocked(connID string, st *streamSeq) StreamStat {
+	ch, ok := p.channelMap[connID]
+	if !ok {
+		ch = -1
+	}
+	cc := st.cc.Stats()
+	return StreamStat{
+		ConnID:     connID,
+		Target:     st.target,
+		Channel:    ch,
+		Start:      st.start,
+		Duration:   time.Since(st.start),
+		Up:         st.up.Load(),
+		Down:       st.down.Load(),
+		Cwnd:       cc.Cwnd,
+		InFlight:   cc.InFlight,
+		SRTT:       cc.SRTT,
+		LossEvents: cc.LossEvents,
+	}
+}
+
+// ChannelCC 客户端单个通道上各流上行拥塞控制状态的汇总（经 /debug/vars 的 channel_cc 发布）
+type ChannelCC struct {
+	Channel    int     `json:"channel"`
+	Connected  bool    `json:"connected"`
+	Streams    int     `json:"streams"`
+	Cwnd       int64   `json:"cwnd"`      // 各流拥塞窗口之和（字节）
+	InFlight   int64   `json:"in_flight"` // 各流在途字节之和
+	Limited    int     `json:"limited"`   // 受窗口限制的流
+	SRTT       float64 `json:"srtt_ms"`   // 各流平滑 RTT 的平均值（尚无确认的流不计入）
+	PingRTT    float64 `json:"ping_rtt_ms"`
+	LossEvents int64   `json:"loss_events"` // 各流因排队时延收缩窗口的次数之和
+}
+
+// ChannelCCStats 按通道汇总活跃流的拥塞控制状态
+func (p *ECHPool) ChannelCCStats() []ChannelCC {
+	health := p.ChannelStats()
+	out := make([]ChannelCC, len(health))
+	srttSum := make([]time.Duration, len(health))
+	srttN := make([]int, len(health))
+	for i, h := range health {
+		out[i] = ChannelCC{Channel: i, Connected: h.Connected, PingRTT: ms(h.SRTT)}
+	}
+	p.mu.RLock()
+	for id, st := range p.seqMap {
+		ch, ok := p.channelMap[id]
+		if !ok || ch >= len(out) {
+			continue
+		}
+		cc := st.cc.Stats()
+		c := &out[ch]
+		c.Streams++
+		c.Cwnd += cc.Cwnd
+		c.InFlight += cc.InFlight
+		c.LossEvents += cc.LossEvents
+		if cc.InFlight > 0 && cc.InFlight+tunnel.CCSegment > cc.Cwnd {
+			c.Limited++
+		}
+		if cc.SRTT > 0 {
+			srttSum[ch] += cc.SRTT
+			srttN[ch]++
+		}
+	}
+	p.mu.RUnlock()
+	for i := range out {
+		if srttN[i] > 0 {
+			out[i].SRTT = ms(srttSum[i] / time.Duration(srttN[i]))
+		}
+	}
+	return out
+}
+
+// ms 以毫秒表示时长（保留微秒精度）
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// StreamStats 返回所有活跃 TCP 流的统计快照（按建立时间排序）
+func (p *ECHPool) StreamStats() []StreamStat {
+	p.mu.RLock()
+	stats := make([]StreamStat, 0, len(p.seqMap))
+	for id, st := range p.seqMap {
+		stats = append(stats, p.snapshotLocked(id, st))
+	}
+	p.mu.RUnlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Start.Before(stats[j].Start) })
+	return stats
+}
+
+// KillStream 终止流：向服务端发送 CLOSE 并关闭本地连接，流不存在时返回 false
+func (p *ECHPool) KillStream(connID string) bool {
+	p.mu.RLock()
+	_, ok := p.seqMap[connID]
+	chID, bound := p.channelMap[connID]
+	local := p.tcpMap[connID]
+	p.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if !bound {
+		// 尚未绑定通道（仍在认领），按建连超时清理
+		p.abandon(connID)
+		if local != nil {
+			_ = local.Close()
+		}
+		return true
+	}
+	_ = p.SendClose(connID)
+	p.closeStream(chID, connID)
+	return true
+}
+
+// removeStreamLocked 移除流状态，并在启用 -stream-stats 时输出最终统计（调用方持有 p.mu）
+func (p *ECHPool) removeStreamLocked(connID string) {
+	st, ok := p.seqMap[connID]
+	if !ok {
+		return
+	}
+	delete(p.seqMap, connID)
+	delete(p.connected, connID)
+	if s := p.muxStreams[connID]; s != nil {
+		delete(p.muxStreams, connID)
+		go tunnel.CloseMuxStream(s)
+	}
+	close(st.done)
+	p.frames.Metrics().StreamsClosed.Add(1)
+	st.recv.Discard()
+	st.cc.Close()
+	st.ack.Stop()
+	if p.cfg.StreamStatsLog {
+		logStreamStat("关闭", p.snapshotLocked(connID, st))
+	}
+}
+
+// streamStatsLoop 周期输出长连接流的统计
+func (p *ECHPool) streamStatsLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		for _, s := range p.StreamStats() {
+			if s.Duration >= interval {
+				logStreamStat("进行中", s)
+			}
+		}
+	}
+}
+
+// logStreamStat 输出单个流的统计
+func logStreamStat(state string, s StreamStat) {
+	secs := s.Duration.Seconds()
+	if secs <= 0 {
+		secs = 1e-9
+	}
+	var cc string
+	if s.SRTT > 0 {
+		cc = fmt.Sprintf("，拥塞窗口 %d KB，在途 %d KB，RTT %s，窗口收缩 %d 次",
+			s.Cwnd>>10, s.InFlight>>10, s.SRTT.Round(time.Microsecond), s.LossEvents)
+	}
+	log.Printf("[流统计] %s %s -> %s，通道 %d，时长 %s，上行 %d 字节（%.1f KB/s），下行 %d 字节（%.1f KB/s）%s",
+		state, s.ConnID, s.Target, s.Channel, s.Duration.Round(time.Millisecond),
+		s.Up, float64(s.Up)/secs/1024, s.Down, float64(s.Down)/secs/1024, cc)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"ech-tunnel/pool"
+	"ech-tunnel/tunnel"
+)
+
+// poolManager 按名称管理客户端连接池：默认池（名称为空，对应 -f）与 -upstream 定义的命名池。
+// 各池在首次被引用时创建并启动，此后由引用它的所有本地监听器（tcp:// 规则、proxy://、中继）共享，
+// 同一进程中的 tcp:// 与 proxy:// 可经同一条或不同的通道池转发。各池共用 -n、-token、-ech 等客户端参数，-ip、-sni 与 -host 仅用于与 -f 主机名相同的池
+type poolManager struct {
+	mu    sync.Mutex
+	addrs map[string]string // 名称 -> 服务地址
+	pools map[string]*pool.ECHPool
+}
+
+// pools 进程内的全部客户端连接池
+var pools = &poolManager{addrs: make(map[string]string), pools: make(map[string]*pool.ECHPool)}
+
+// poolName 日志中连接池的名称
+func poolName(name string) string {
+	if name == "" {
+		return "默认"
+	}
+	return name
+}
+
+// define 登记名为 name 的服务地址（仅支持 wss://、grpc:// 与 quic://）
+func (m *poolManager) define(name, addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "wss" && u.Scheme != "grpc" && u.Scheme != "quic") {
+		return fmt.Errorf("连接池 %s 的地址无效: %s（仅支持 wss://、grpc:// 或 quic://，客户端必须使用 ECH/TLS1.3）", poolName(name), addr)
+	}
+	if _, err := tunnel.ParsePathTemplate(u.Path); err != nil {
+		return fmt.Errorf("连接池 %s: %w", poolName(name), err)
+	}
+	if u.Scheme != "wss" && tlsFingerprint != "go" {
+		// gRPC 经 net/http 的 HTTP/2 传输、QUIC 经 quic-go，只能使用标准库 TLS 握手
+		return fmt.Errorf("连接池 %s: -tls-fingerprint 仅支持 wss:// 地址", poolName(name))
+	}
+	if u.Scheme != "wss" && echMode == "grease" {
+		// GREASE ECH 扩展需要 uTLS 完成握手，同样只适用于 wss://
+		return fmt.Errorf("连接池 %s: -ech-mode=grease 仅支持 wss:// 地址", poolName(name))
+	}
+	if u.Scheme == "quic" && psk != "" {
+		// QUIC 流与 yamux 流相同，不经端到端加密
+		return fmt.Errorf("连接池 %s: quic:// 地址不支持 -psk", poolName(name))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, dup := m.addrs[name]; dup {
+		return fmt.Errorf("重复的连接池名称: %s", poolName(name))
+	}
+	m.addrs[name] = addr
+	return nil
+}
+
+// has 是否定义了名为 name 的连接池
+func (m *poolManager) has(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.addrs[name]
+	return ok
+}
+
+// get 返回名为 name 的连接池，首次引用时创建并启动；未定义时返回 nil
+func (m *poolManager) get(name string) *pool.ECHPool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.pools[name]; p != nil {
+		return p
+	}
+	addr, ok := m.addrs[name]
+	if !ok {
+		return nil
+	}
+	log.Printf("[客户端] 启动连接池 %s: %s（%d 个通道）", poolName(name), addr, connectionNum)
+	p, err := pool.New(poolConfig(addr))
+	if err != nil {
+		log.Printf("[客户端] 创建连接池 %s 失败: %v", poolName(name), err)
+		return nil
+	}
+	p.Start()
+	m.pools[name] = p
+	if name == "" {
+		// -ip 候选地址针对 -f 的服务端
+		dialer.StartIPProber(addr, ipProbeInterval)
+	}
+	return p
+}
+
+// each 按名称顺序遍历已启动的连接池
+func (m *poolManager) each(fn func(name string, p *pool.ECHPool)) {
+	m.mu.Lock()
+	started := make(map[string]*pool.ECHPool, len(m.pools))
+	names := make([]string, 0, len(m.pools))
+	for name, p := range m.pools {
+		started[name] = p
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		fn(name, started[name])
+	}
+}
+
+// logStats 输出已启动的各连接池状态
+func (m *poolManager) logStats() {
+	m.each(func(name string, p *pool.ECHPool) {
+		log.Printf("[统计] 连接池 %s（%s）:", poolName(name), p.Addr())
+		p.LogStats()
+	})
+}
+
+// parseUpstreams 解析 -upstream 参数: 名称=wss://host:port/path，多个用逗号分隔
+func parseUpstreams(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(part, "=")
+		name, addr = strings.TrimSpace(name), strings.TrimSpace(addr)
+		if !ok || name == "" || addr == "" {
+			return nil, fmt.Errorf("无效的连接池配置: %s，应为 名称=服务地址", part)
+		}
+		if _, dup := m[name]; dup {
+			return nil, fmt.Errorf("重复的连接池名称: %s", name)
+		}
+		m[name] = addr
+	}
+	return m, nil
+}
+
+// initPools 登记 -f 的默认连接池与 -upstream 的命名连接池（此时均不建立连接）
+func initPools() error {
+	if forwardAddr != "" {
+		if err := pools.define("", forwardAddr); err != nil {
+			return err
+		}
+	}
+	m, err := parseUpstreams(upstreamAddrs)
+	if err != nil {
+		return err
+	}
+	for name, addr := range m {
+		if err := pools.define(name, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startRelay 服务端指定了 -f 时以中继方式运行：客户端的 TCP 流不在本机连接目标，而是经本机的
+// ECH 连接池转发给 -f 指定的下一跳服务端，由其连接目标（客户端 → 中继 → 出口，可多级串联）。
+// 通往下一跳的通道使用全部客户端参数（-n、-token、-ech、-ip 等）。未指定 -f 时返回 nil
+func startRelay() (*pool.ECHPool, error) {
+	if !pools.has("") {
+		return nil, nil
+	}
+	if err := echClient.Init(); err != nil {
+		return nil, fmt.Errorf("获取 ECH 公钥失败: %w", err)
+	}
+	log.Printf("[中继] 客户端的 TCP 流经 %s 转发", forwardAddr)
+	return pools.get(""), nil
+}
@@ -0,0 +1,309 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ControlType 控制帧类型
+type ControlType uint64
+
+const (
+	CtrlClaim ControlType = iota + 1
+	CtrlClaimAck
+	CtrlTCP
+	CtrlConnected
+	CtrlClose
+	CtrlError
+	CtrlUDPConnect
+	CtrlUDPConnected
+	CtrlUDPError
+	CtrlUDPClose
+	CtrlFIN    // 发送方向已结束（半关闭，协议版本 3）
+	CtrlAck    // 确认已按序交付的 DATA 帧（拥塞控制，协议版本 4）
+	CtrlResume // 在新通道上恢复流，Seq 为发送方已按序交付的帧数（会话恢复，协议版本 5）
+)
+
+// 控制帧错误码
+const (
+	CtrlErrUnknown = iota
+	CtrlErrResolve
+	CtrlErrSocket
+	CtrlErrDial
+	CtrlErrResume // 流无法恢复（会话已过期或流已关闭）
+	CtrlErrPolicy // 目标被服务端策略禁止
+	CtrlErrQuota  // 超过令牌的并发流上限
+)
+
+// ControlPrefix 结构化控制帧前缀（协议版本 2 起，二进制消息）
+const ControlPrefix = "CTRL:"
+
+// ControlFrame 控制帧
+//
+// 协议版本 2 起以 protobuf 编码（字段号见 Marshal），未知字段被忽略，
+// 因此新增可选字段无需再提升协议版本；版本 0、1 仍使用文本格式。
+type ControlFrame struct {
+	Type    ControlType
+	ConnID  string
+	Target  string // 目标地址；CONNECTED 中为服务端出站连接的本地地址
+	Payload []byte // 首帧数据
+	Channel int
+	Code    int // 错误码
+	Message string
+	Flags   uint64
+
+	// CLOSE 帧携带的流量统计（发送方视角，Reason 非空时有效，仅协议版本 2）
+	Sent     uint64 // 发送方经隧道发出的字节数
+	Received uint64 // 发送方经隧道收到的字节数
+	Reason   string // 关闭原因
+
+	// ACK 帧字段（协议版本 4），RESUME 帧亦使用 Seq
+	Seq      uint64   // 接收方已按序交付的帧数（即下一个期望的序号）
+	SACK     []uint64 // 乱序缓存中已收到的序号区间，[起, 止) 成对排列
+	AckDelay uint64   // 接收方延迟发送确认的时间（微秒）
+}
+
+// controlPrefixes 文本格式（协议版本 0、1）的帧前缀
+var controlPrefixes = map[ControlType]string{
+	CtrlClaim:        "CLAIM:",
+	CtrlClaimAck:     "CLAIM_ACK:",
+	CtrlTCP:          "TCP:",
+	CtrlConnected:    "CONNECTED:",
+	CtrlClose:        "CLOSE:",
+	CtrlError:        "ERROR:",
+	CtrlUDPConnect:   "UDP_CONNECT:",
+	CtrlUDPConnected: "UDP_CONNECTED:",
+	CtrlUDPError:     "UDP_ERROR:",
+	CtrlUDPClose:     "UDP_CLOSE:",
+	CtrlFIN:          "FIN:",
+	CtrlAck:          "ACK:",
+	CtrlResume:       "RESUME:",
+}
+
+// Marshal 以 protobuf 编码控制帧
+func (f *ControlFrame) Marshal(b []byte) []byte {
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(f.Type))
+	if f.ConnID != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, f.ConnID)
+	}
+	if f.Target != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, f.Target)
+	}
+	if len(f.Payload) > 0 {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, f.Payload)
+	}
+	if f.Channel != 0 {
+		b = protowire.AppendTag(b, 5, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(f.Channel))
+	}
+	if f.Code != 0 {
+		b = protowire.AppendTag(b, 6, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(f.Code))
+	}
+	if f.Message != "" {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendString(b, f.Message)
+	}
+	if f.Flags != 0 {
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, f.Flags)
+	}
+	if f.Sent != 0 {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, f.Sent)
+	}
+	if f.Received != 0 {
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, f.Received)
+	}
+	if f.Reason != "" {
+		b = protowire.AppendTag(b, 11, protowire.BytesType)
+		b = protowire.AppendString(b, f.Reason)
+	}
+	if f.Seq != 0 {
+		b = protowire.AppendTag(b, 12, protowire.VarintType)
+		b = protowire.AppendVarint(b, f.Seq)
+	}
+	if len(f.SACK) > 0 {
+		// packed repeated uint64
+		var packed []byte
+		for _, v := range f.SACK {
+			packed = protowire.AppendVarint(packed, v)
+		}
+		b = protowire.AppendTag(b, 13, protowire.BytesType)
+		b = protowire.AppendBytes(b, packed)
+	}
+	if f.AckDelay != 0 {
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, f.AckDelay)
+	}
+	return b
+}
+
+// UnmarshalControlFrame 解析 protobuf 编码的控制帧
+func UnmarshalControlFrame(b []byte) (ControlFrame, error) {
+	var f ControlFrame
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return f, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case typ == protowire.VarintType && (num == 1 || num == 5 || num == 6 || num == 8 || num == 9 || num == 10 || num == 12 || num == 14):
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return f, protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case 1:
+				f.Type = ControlType(v)
+			case 5:
+				f.Channel = int(v)
+			case 6:
+				f.Code = int(v)
+			case 8:
+				f.Flags = v
+			case 9:
+				f.Sent = v
+			case 10:
+				f.Received = v
+			case 12:
+				f.Seq = v
+			case 14:
+				f.AckDelay = v
+			}
+		case typ == protowire.BytesType && (num >= 2 && num <= 7 || num == 11 || num == 13):
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return f, protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case 2:
+				f.ConnID = string(v)
+			case 3:
+				f.Target = string(v)
+			case 4:
+				f.Payload = v
+			case 7:
+				f.Message = string(v)
+			case 11:
+				f.Reason = string(v)
+			case 13:
+				for len(v) > 0 {
+					x, n := protowire.ConsumeVarint(v)
+					if n < 0 {
+						return f, protowire.ParseError(n)
+					}
+					f.SACK, v = append(f.SACK, x), v[n:]
+				}
+			}
+		default:
+			// 未知字段跳过，保持向前兼容
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return f, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	if _, ok := controlPrefixes[f.Type]; !ok {
+		return f, errors.New("未知的控制帧类型")
+	}
+	return f, nil
+}
+
+// Text 以文本格式（协议版本 0、1）编码控制帧
+func (f *ControlFrame) Text() string {
+	s := controlPrefixes[f.Type] + f.ConnID
+	switch f.Type {
+	case CtrlClaim, CtrlClaimAck:
+		s += "|" + strconv.Itoa(f.Channel)
+	case CtrlTCP:
+		s += "|" + f.Target + "|" + string(f.Payload)
+	case CtrlUDPConnect:
+		s += "|" + f.Target
+	case CtrlError, CtrlUDPError:
+		s += "|" + f.Message
+	}
+	return s
+}
+
+// ParseTextControl 解析文本格式（协议版本 0、1）的控制帧
+func ParseTextControl(s string) (ControlFrame, bool) {
+	var f ControlFrame
+	for t, prefix := range controlPrefixes {
+		// "UDP_CONNECTED:" 与 "CONNECTED:" 等前缀互不包含，可直接匹配
+		if strings.HasPrefix(s, prefix) {
+			f.Type = t
+			s = s[len(prefix):]
+			break
+		}
+	}
+	switch f.Type {
+	case 0:
+		return f, false
+	case CtrlClaim, CtrlClaimAck:
+		id, ch, ok := strings.Cut(s, "|")
+		if !ok {
+			return f, false
+		}
+		f.ConnID = id
+		f.Channel, _ = strconv.Atoi(ch)
+	case CtrlTCP:
+		parts := strings.SplitN(s, "|", 3)
+		if len(parts) < 2 {
+			return f, false
+		}
+		f.ConnID, f.Target = parts[0], parts[1]
+		if len(parts) == 3 {
+			f.Payload = []byte(parts[2])
+		}
+	case CtrlUDPConnect:
+		id, target, ok := strings.Cut(s, "|")
+		if !ok {
+			return f, false
+		}
+		f.ConnID, f.Target = id, target
+	case CtrlError, CtrlUDPError:
+		// 服务端 ERROR 帧可能只有错误信息
+		if id, msg, ok := strings.Cut(s, "|"); ok {
+			f.ConnID, f.Message = id, msg
+		} else {
+			f.Message = s
+		}
+	default:
+		f.ConnID = s
+	}
+	return f, true
+}
+
+// DecodeControl 解析控制帧（兼容文本格式与结构化格式）
+func DecodeControl(mt int, msg []byte) (ControlFrame, bool) {
+	if mt == websocket.BinaryMessage {
+		if len(msg) < len(ControlPrefix) || string(msg[:len(ControlPrefix)]) != ControlPrefix {
+			return ControlFrame{}, false
+		}
+		f, err := UnmarshalControlFrame(msg[len(ControlPrefix):])
+		return f, err == nil
+	}
+	return ParseTextControl(string(msg))
+}
+
+// EncodeControl 按协商的协议版本编码控制帧，返回消息类型与内容
+func EncodeControl(version int, f ControlFrame) (int, []byte) {
+	if version >= StructuredControlVersion {
+		return websocket.BinaryMessage, f.Marshal([]byte(ControlPrefix))
+	}
+	return websocket.TextMessage, []byte(f.Text())
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestControlFrameMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		f    ControlFrame
+		hex  string
+	}{
+		{"claim", ControlFrame{Type: CtrlClaim, ConnID: "a", Channel: 2}, "0801120161" + "2802"},
+		{"tcp", ControlFrame{Type: CtrlTCP, ConnID: "i", Target: "h:80", Payload: []byte("hi")}, "0803120169" + "1a04683a3830" + "22026869"},
+		{"close", ControlFrame{Type: CtrlClose, ConnID: "x", Sent: 1, Received: 2, Reason: "r"}, "0805120178" + "4801" + "5002" + "5a0172"},
+		{"error", ControlFrame{Type: CtrlError, ConnID: "e", Code: CtrlErrDial, Message: "no"}, "0806120165" + "3003" + "3a026e6f"},
+		{"ack", ControlFrame{Type: CtrlAck, ConnID: "c", Seq: 5, SACK: []uint64{7, 9}, AckDelay: 300}, "080c120163" + "6005" + "6a020709" + "70ac02"},
+		{"resume", ControlFrame{Type: CtrlResume, ConnID: "r", Seq: 128}, "080d120172" + "608001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.f.Marshal(nil)
+			if hex.EncodeToString(got) != tt.hex {
+				t.Fatalf("Marshal = %x，期望 %s", got, tt.hex)
+			}
+			f, err := UnmarshalControlFrame(got)
+			if err != nil {
+				t.Fatalf("UnmarshalControlFrame: %v", err)
+			}
+			if !reflect.DeepEqual(f, tt.f) {
+				t.Fatalf("UnmarshalControlFrame = %+v，期望 %+v", f, tt.f)
+			}
+		})
+	}
+}
+
+func TestUnmarshalControlFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		hex     string
+		want    ControlFrame
+		wantErr bool
+	}{
+		// 字段 15（varint）与字段 16（bytes）为未知字段，应跳过
+		{"unknown fields", "080b" + "120161" + "7801" + "820102abcd", ControlFrame{Type: CtrlFIN, ConnID: "a"}, false},
+		{"unknown type", "0863", ControlFrame{}, true},
+		{"missing type", "120161", ControlFrame{}, true},
+		{"truncated bytes", "08011205", ControlFrame{}, true},
+		{"truncated varint", "0880", ControlFrame{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := hex.DecodeString(tt.hex)
+			f, err := UnmarshalControlFrame(b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v，期望出错 %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(f, tt.want) {
+				t.Fatalf("UnmarshalControlFrame = %+v，期望 %+v", f, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextControl(t *testing.T) {
+	tests := []struct {
+		text string
+		want ControlFrame
+	}{
+		{"CLAIM:id|3", ControlFrame{Type: CtrlClaim, ConnID: "id", Channel: 3}},
+		{"CLAIM_ACK:id|0", ControlFrame{Type: CtrlClaimAck, ConnID: "id"}},
+		{"TCP:id|host:80|a|b", ControlFrame{Type: CtrlTCP, ConnID: "id", Target: "host:80", Payload: []byte("a|b")}},
+		{"UDP_CONNECT:id|8.8.8.8:53", ControlFrame{Type: CtrlUDPConnect, ConnID: "id", Target: "8.8.8.8:53"}},
+		{"UDP_CONNECTED:id", ControlFrame{Type: CtrlUDPConnected, ConnID: "id"}},
+		{"CONNECTED:id", ControlFrame{Type: CtrlConnected, ConnID: "id"}},
+		{"ERROR:id|refused", ControlFrame{Type: CtrlError, ConnID: "id", Message: "refused"}},
+		{"FIN:id", ControlFrame{Type: CtrlFIN, ConnID: "id"}},
+	}
+	for _, tt := range tests {
+		f, ok := ParseTextControl(tt.text)
+		if !ok || !reflect.DeepEqual(f, tt.want) {
+			t.Errorf("ParseTextControl(%q) = %+v, %v，期望 %+v", tt.text, f, ok, tt.want)
+			continue
+		}
+		if got := f.Text(); got != tt.text {
+			t.Errorf("Text() = %q，期望 %q", got, tt.text)
+		}
+	}
+
+	// 服务端的 ERROR 帧可能只有错误信息
+	if f, ok := ParseTextControl("ERROR:bad token"); !ok || f.ConnID != "" || f.Message != "bad token" {
+		t.Errorf("ParseTextControl(ERROR 无 ID) = %+v, %v", f, ok)
+	}
+	for _, s := range []string{"", "DATA:id|x", "CLAIM:id", "TCP:id", "UDP_CONNECT:id"} {
+		if f, ok := ParseTextControl(s); ok {
+			t.Errorf("ParseTextControl(%q) = %+v，期望失败", s, f)
+		}
+	}
+}
+
+func TestEncodeDecodeControl(t *testing.T) {
+	f := ControlFrame{Type: CtrlClose, ConnID: "id"}
+	for _, version := range []int{0, 1, StructuredControlVersion, Version} {
+		mt, msg := EncodeControl(version, f)
+		wantMT := websocket.TextMessage
+		if version >= StructuredControlVersion {
+			wantMT = websocket.BinaryMessage
+			if !bytes.HasPrefix(msg, []byte(ControlPrefix)) {
+				t.Errorf("版本 %d: 缺少 %s 前缀: %q", version, ControlPrefix, msg)
+			}
+		}
+		if mt != wantMT {
+			t.Errorf("版本 %d: 消息类型 %d，期望 %d", version, mt, wantMT)
+		}
+		got, ok := DecodeControl(mt, msg)
+		if !ok || !reflect.DeepEqual(got, f) {
+			t.Errorf("版本 %d: DecodeControl = %+v, %v，期望 %+v", version, got, ok, f)
+		}
+	}
+	if _, ok := DecodeControl(websocket.BinaryMessage, []byte("DATA:x")); ok {
+		t.Error("DecodeControl 接受了不带 CTRL: 前缀的二进制消息")
+	}
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// DataPrefix DATA 帧前缀
+const DataPrefix = "DATA:"
+
+// AppendDataHeader 在 dst 后追加 DATA 帧头部: DATA:<connID>|<seq>|
+func AppendDataHeader(dst []byte, version int, connID string, seq uint64) []byte {
+	dst = append(dst, DataPrefix...)
+	return AppendStreamTag(dst, version, connID, seq)
+}
+
+// AppendStreamTag 在 dst 后追加 DATA 帧负载前的流标识 <connID>|<seq>|；
+// 旧版（版本 0）对端的 DATA 帧不含序号，只追加 <connID>|
+func AppendStreamTag(dst []byte, version int, connID string, seq uint64) []byte {
+	dst = append(dst, connID...)
+	dst = append(dst, '|')
+	if version < DataSeqVersion {
+		return dst
+	}
+	dst = strconv.AppendUint(dst, seq, 10)
+	return append(dst, '|')
+}
+
+// ParseDataFrame 解析 DATA 帧负载: <connID>|<seq>|<payload>，payload 引用 body 不复制；
+// 旧版（版本 0）对端的负载为 <connID>|<payload>，不含序号，seq 为 0，由调用方按到达顺序补齐
+func ParseDataFrame(body []byte, version int) (connID string, seq uint64, payload []byte, ok bool) {
+	i := bytes.IndexByte(body, '|')
+	if i < 0 {
+		return "", 0, nil, false
+	}
+	if version < DataSeqVersion {
+		return string(body[:i]), 0, body[i+1:], true
+	}
+	j := bytes.IndexByte(body[i+1:], '|')
+	if j < 0 {
+		return "", 0, nil, false
+	}
+	seq, err := strconv.ParseUint(string(body[i+1:i+1+j]), 10, 64)
+	if err != nil {
+		return "", 0, nil, false
+	}
+	return string(body[:i]), seq, body[i+2+j:], true
+}
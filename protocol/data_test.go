@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDataFrame(t *testing.T) {
+	tests := []struct {
+		version int
+		connID  string
+		seq     uint64
+		header  string
+	}{
+		{0, "id", 7, "DATA:id|"},
+		{DataSeqVersion, "id", 0, "DATA:id|0|"},
+		{Version, "id", 18446744073709551615, "DATA:id|18446744073709551615|"},
+	}
+	for _, tt := range tests {
+		frame := AppendDataHeader(nil, tt.version, tt.connID, tt.seq)
+		if string(frame) != tt.header {
+			t.Errorf("AppendDataHeader(版本 %d) = %q，期望 %q", tt.version, frame, tt.header)
+		}
+		frame = append(frame, "a|b"...)
+		connID, seq, payload, ok := ParseDataFrame(frame[len(DataPrefix):], tt.version)
+		wantSeq := tt.seq
+		if tt.version < DataSeqVersion {
+			wantSeq = 0
+		}
+		if !ok || connID != tt.connID || seq != wantSeq || !bytes.Equal(payload, []byte("a|b")) {
+			t.Errorf("ParseDataFrame(%q) = %q, %d, %q, %v", frame, connID, seq, payload, ok)
+		}
+	}
+}
+
+func TestParseDataFrameInvalid(t *testing.T) {
+	for _, body := range []string{"", "id", "id|", "id|x|data", "id|-1|data"} {
+		if _, _, _, ok := ParseDataFrame([]byte(body), Version); ok {
+			t.Errorf("ParseDataFrame(%q) 应失败", body)
+		}
+	}
+	if _, _, _, ok := ParseDataFrame([]byte("id"), 0); ok {
+		t.Error("ParseDataFrame(版本 0, 无分隔符) 应失败")
+	}
+}
@@ -0,0 +1,9 @@
+// Package protocol 实现 ech-tunnel 的隧道线路协议，供嵌入隧道客户端或服务端的 Go 程序直接使用：
+//
+//   - 握手头中的协议版本与单条消息上限协商（version.go）
+//   - 控制帧：版本 2 起的 protobuf 编码（CTRL: 前缀）与版本 0、1 的文本格式（control.go）
+//   - DATA 帧头部 DATA:<connID>|<seq>| 的编码与解析（data.go）
+//   - 多路复用模式下 yamux 流的建连请求与应答（mux.go）
+//
+// 本包不依赖 ech-tunnel 的命令行参数与全局状态，负载的压缩、加密与填充由调用方在帧头之后处理。
+package protocol
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// 多路复用模式（握手头 X-Tunnel-Mux: yamux）：通道不再承载 DATA/控制帧，通道上的二进制消息依次拼接为
+// yamux 会话的字节流，每个 TCP 流是一条 yamux 流。客户端打开流后先写入建连请求，服务端连接目标后
+// 写回建连应答，其后流上即为双向透传的 TCP 数据：
+//
+//	请求: <目标地址长度 uint16><目标地址><首帧长度 uint32><首帧>
+//	应答: <结果 1 字节，0 成功><错误码 1 字节，同 CtrlErr*><文本长度 uint16><文本>
+//
+// 成功时文本为服务端出站连接的本地地址，失败时为错误原因。
+const (
+	MuxHeader = "X-Tunnel-Mux"
+	MuxYamux  = "yamux"
+
+	// 建连请求中首帧的长度上限
+	MaxMuxFirstFrame = 1 << 20
+)
+
+var errMuxTooLong = errors.New("多路复用建连请求过长")
+
+// WriteMuxRequest 写入建连请求
+func WriteMuxRequest(w io.Writer, target, first string) error {
+	if len(target) > 0xffff || len(first) > MaxMuxFirstFrame {
+		return errMuxTooLong
+	}
+	b := make([]byte, 0, 6+len(target)+len(first))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(target)))
+	b = append(b, target...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(first)))
+	b = append(b, first...)
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadMuxRequest 读取建连请求
+func ReadMuxRequest(r io.Reader) (target, first string, err error) {
+	var n [4]byte
+	if _, err = io.ReadFull(r, n[:2]); err != nil {
+		return "", "", err
+	}
+	t := make([]byte, binary.BigEndian.Uint16(n[:2]))
+	if _, err = io.ReadFull(r, t); err != nil {
+		return "", "", err
+	}
+	if _, err = io.ReadFull(r, n[:]); err != nil {
+		return "", "", err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if size > MaxMuxFirstFrame {
+		return "", "", errMuxTooLong
+	}
+	f := make([]byte, size)
+	if _, err = io.ReadFull(r, f); err != nil {
+		return "", "", err
+	}
+	return string(t), string(f), nil
+}
+
+// WriteMuxReply 写入建连应答：err 为 nil 时 text 为出站连接的本地地址，否则 code 与 err 为失败原因
+func WriteMuxReply(w io.Writer, bound string, code int, err error) error {
+	status, text := byte(0), bound
+	if err != nil {
+		status, text = 1, err.Error()
+	}
+	if len(text) > 0xffff {
+		text = text[:0xffff]
+	}
+	b := []byte{status, byte(code)}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(text)))
+	b = append(b, text...)
+	_, werr := w.Write(b)
+	return werr
+}
+
+// MuxError 服务端在建连应答中返回的失败原因
+type MuxError struct {
+	Code    int
+	Message string
+}
+
+func (e *MuxError) Error() string { return e.Message }
+
+// ReadMuxReply 读取建连应答，返回出站连接的本地地址；服务端连接目标失败时返回 *MuxError
+func ReadMuxReply(r io.Reader) (bound string, err error) {
+	var h [4]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return "", err
+	}
+	text := make([]byte, binary.BigEndian.Uint16(h[2:]))
+	if _, err = io.ReadFull(r, text); err != nil {
+		return "", err
+	}
+	if h[0] != 0 {
+		return "", &MuxError{Code: int(h[1]), Message: string(text)}
+	}
+	return string(text), nil
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMuxRequest(t *testing.T) {
+	for _, first := range []string{"", "GET / HTTP/1.1\r\n\r\n"} {
+		var b bytes.Buffer
+		if err := WriteMuxRequest(&b, "example.com:443", first); err != nil {
+			t.Fatal(err)
+		}
+		target, got, err := ReadMuxRequest(&b)
+		if err != nil || target != "example.com:443" || got != first {
+			t.Errorf("ReadMuxRequest = %q, %q, %v，期望 %q, %q", target, got, err, "example.com:443", first)
+		}
+	}
+}
+
+func TestMuxRequestTooLong(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteMuxRequest(&b, "a:1", strings.Repeat("x", MaxMuxFirstFrame+1)); err == nil {
+		t.Error("首帧超过上限时 WriteMuxRequest 应失败")
+	}
+	// 对端声明的首帧长度超过上限时不分配内存
+	b.Reset()
+	b.Write([]byte{0, 3, 'a', ':', '1', 0xff, 0xff, 0xff, 0xff})
+	if _, _, err := ReadMuxRequest(&b); err == nil {
+		t.Error("首帧长度超过上限时 ReadMuxRequest 应失败")
+	}
+	// 截断的请求
+	if _, _, err := ReadMuxRequest(bytes.NewReader([]byte{0, 9, 'a'})); err == nil {
+		t.Error("截断的请求应失败")
+	}
+}
+
+func TestMuxReply(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteMuxReply(&b, "10.0.0.1:50000", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if bound, err := ReadMuxReply(&b); err != nil || bound != "10.0.0.1:50000" {
+		t.Errorf("ReadMuxReply = %q, %v，期望 10.0.0.1:50000", bound, err)
+	}
+
+	b.Reset()
+	if err := WriteMuxReply(&b, "", CtrlErrPolicy, errors.New("目标被禁止")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ReadMuxReply(&b)
+	var me *MuxError
+	if !errors.As(err, &me) || me.Code != CtrlErrPolicy || me.Message != "目标被禁止" {
+		t.Errorf("ReadMuxReply 错误 = %v，期望 CtrlErrPolicy: 目标被禁止", err)
+	}
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 隧道协议版本，通过 WebSocket 握手头协商：
+// 客户端在请求头中声明支持的最高版本，服务端返回双方共同支持的最高版本。
+// 未携带该头的对端为引入版本协商之前的旧版，视为版本 0。
+//
+//	版本 0: 文本控制帧（CLAIM:/TCP:/CLOSE: 等），DATA 帧不含序号（DATA:<id>|<payload>）
+//	版本 1: DATA 帧携带流内序号（DATA:<id>|<seq>|<payload>），接收端按序号重排
+//	版本 2: protobuf 编码的结构化控制帧（CTRL:，见 control.go）
+//	版本 3: 新增 FIN 控制帧，支持 TCP 流半关闭
+//	版本 4: 新增 ACK 控制帧，TCP 流双向按发送窗口进行拥塞控制
+//	版本 5: 新增 RESUME 控制帧，通道断开重连后在新通道上恢复原有 TCP 流
+const (
+	Version       = 5
+	MinVersion    = 0
+	VersionHeader = "X-Tunnel-Version"
+
+	// DATA 帧携带序号的最低协议版本
+	DataSeqVersion = 1
+	// 使用 protobuf 控制帧的最低协议版本
+	StructuredControlVersion = 2
+	// 支持 FIN 半关闭的最低协议版本
+	HalfCloseVersion = 3
+	// 支持 ACK 与拥塞控制的最低协议版本
+	FlowControlVersion = 4
+	// 支持会话恢复的最低协议版本
+	ResumeVersion = 5
+
+	// 客户端连接池的会话 ID，同一连接池的各通道携带相同的值，服务端据此在重连的通道上恢复流
+	SessionHeader = "X-Tunnel-Session"
+
+	// 单条消息大小上限，与协议版本一同在握手头中协商（双方取较小值），
+	// 缺少该头的对端按本端的上限处理
+	MaxFrameHeader = "X-Tunnel-Max-Frame"
+	// 上限不得低于最大的正常帧（64KB UDP 数据报加帧头、加密开销与填充）
+	MinMaxFrameSize = 128 << 10
+)
+
+// ParseVersion 解析握手头中的协议版本（缺省为旧版 0）
+func ParseVersion(h http.Header) (int, error) {
+	v := strings.TrimSpace(h.Get(VersionHeader))
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("无效的协议版本: %q", v)
+	}
+	return n, nil
+}
+
+// NegotiateVersion 根据对端声明的版本确定双方使用的版本
+func NegotiateVersion(h http.Header) (int, error) {
+	peer, err := ParseVersion(h)
+	if err != nil {
+		return 0, err
+	}
+	v := min(peer, Version)
+	if v < MinVersion {
+		return 0, fmt.Errorf("协议版本不兼容: 对端 %d，本端支持 %d-%d", peer, MinVersion, Version)
+	}
+	return v, nil
+}
+
+// NegotiateMaxFrame 根据对端声明的单条消息上限与本端上限 local 确定双方使用的上限
+func NegotiateMaxFrame(h http.Header, local int) int {
+	limit := local
+	if n, err := strconv.Atoi(strings.TrimSpace(h.Get(MaxFrameHeader))); err == nil && n < limit {
+		limit = n
+	}
+	return max(limit, MinMaxFrameSize)
+}
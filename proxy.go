@@ -1,129 +1,200 @@
-package main
-
-import (
-	"fmt"
-	"log"
-	"net"
-	"net/url"
-	"strings"
-	"time"
-)
-
-// ProxyConfig 代理服务器配置
-type ProxyConfig struct {
-	Username string
-	Password string
-	Host     string
-}
-
-// parseProxyAddr 解析代理地址
-func parseProxyAddr(addr string) (*ProxyConfig, error) {
-	// 格式: proxy://[user:pass@]ip:port
-	addr = strings.TrimPrefix(addr, "proxy://")
-
-	config := &ProxyConfig{}
-
-	// 检查是否有认证信息
-	if strings.Contains(addr, "@") {
-		parts := strings.SplitN(addr, "@", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("无效的代理地址格式")
-		}
-
-		// 解析用户名密码
-		auth := parts[0]
-		if strings.Contains(auth, ":") {
-			authParts := strings.SplitN(auth, ":", 2)
-			config.Username = authParts[0]
-			config.Password = authParts[1]
-		}
-
-		config.Host = parts[1]
-	} else {
-		config.Host = addr
-	}
-
-	return config, nil
-}
-
-// runProxyServer 运行代理服务器（支持 SOCKS5 和 HTTP）
-func runProxyServer(addr, wsServerAddr string) {
-	if wsServerAddr == "" {
-		log.Fatal("代理服务器需要指定 WebSocket 服务端地址 (-f)")
-	}
-
-	// 验证必须使用 wss://（强制 ECH）
-	u, err := url.Parse(wsServerAddr)
-	if err != nil {
-		log.Fatalf("解析 WebSocket 服务端地址失败: %v", err)
-	}
-	if u.Scheme != "wss" {
-		log.Fatalf("[代理] 仅支持 wss://（客户端必须使用 ECH/TLS1.3）")
-	}
-
-	config, err := parseProxyAddr(addr)
-	if err != nil {
-		log.Fatalf("解析代理地址失败: %v", err)
-	}
-
-	listener, err := net.Listen("tcp", config.Host)
-	if err != nil {
-		log.Fatalf("代理监听失败 %s: %v", config.Host, err)
-	}
-	defer listener.Close()
-
-	log.Printf("代理服务器启动（支持 SOCKS5 和 HTTP）监听: %s", config.Host)
-	if config.Username != "" {
-		log.Printf("代理认证已启用，用户名: %s", config.Username)
-	}
-
-	echPool = NewECHPool(wsServerAddr, connectionNum)
-	echPool.Start()
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("接受连接失败: %v", err)
-			continue
-		}
-
-		go handleProxyConnection(conn, config)
-	}
-}
-
-// handleProxyConnection 处理代理连接（自动检测协议类型）
-func handleProxyConnection(conn net.Conn, config *ProxyConfig) {
-	defer conn.Close()
-
-	clientAddr := conn.RemoteAddr().String()
-	log.Printf("[代理:%s] 新连接", clientAddr)
-
-	// 设置连接超时
-	conn.SetDeadline(time.Now().Add(30 * time.Second))
-
-	// 读取第一个字节判断协议类型
-	buf := make([]byte, 1)
-	if _, err := conn.Read(buf); err != nil {
-		log.Printf("[代理:%s] 读取第一个字节失败: %v", clientAddr, err)
-		return
-	}
-
-	firstByte := buf[0]
-
-	// SOCKS5: 第一个字节是 0x05
-	if firstByte == 0x05 {
-		log.Printf("[代理:%s] 检测到 SOCKS5 协议", clientAddr)
-		handleSOCKS5Protocol(conn, config, clientAddr)
-		return
-	}
-
-	// HTTP: 第一个字节是字母 (GET, POST, CONNECT, HEAD, PUT, DELETE, OPTIONS, PATCH)
-	if firstByte == 'G' || firstByte == 'P' || firstByte == 'C' || firstByte == 'H' ||
-		firstByte == 'D' || firstByte == 'O' {
-		log.Printf("[代理:%s] 检测到 HTTP 协议", clientAddr)
-		handleHTTPProtocol(conn, config, clientAddr, firstByte)
-		return
-	}
-
-	log.Printf("[代理:%s] 未知协议，第一个字节: 0x%02X", clientAddr, firstByte)
-}
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"ech-tunnel/httpproxy"
+	"ech-tunnel/pool"
+	"ech-tunnel/socks5"
+)
+
+// ProxyConfig 代理服务器配置
+type ProxyConfig struct {
+	Host   string
+	Server string        // 经由的连接池名称（?server=，见 -upstream），为空时使用 -f
+	Pool   *pool.ECHPool // 代理请求经由的连接池
+
+	HTTP   httpproxy.Config // 认证参数（?auth=、?bearer=、?htpasswd= 与地址中的用户名密码）同时用于 SOCKS5
+	SOCKS5 socks5.Config
+}
+
+// parseProxyAddr 解析代理地址
+func parseProxyAddr(addr string) (*ProxyConfig, error) {
+	// 格式: proxy://[user:pass@]ip:port[?server=名称&auth=basic|digest|bearer&bearer=令牌&htpasswd=文件] 或 proxy://[user:pass@]unix:///path/to.sock
+	addr = strings.TrimPrefix(addr, "proxy://")
+
+	config := &ProxyConfig{HTTP: httpProxyConfig()}
+	addr, query, _ := strings.Cut(addr, "?")
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	for key, v := range values {
+		switch key {
+		case "server":
+			config.Server = v[len(v)-1]
+		case "auth":
+			config.HTTP.Auth = v[len(v)-1]
+		case "bearer":
+			config.HTTP.Bearer = v[len(v)-1]
+		case "htpasswd":
+			if config.HTTP.Htpasswd, err = httpproxy.LoadHtpasswd(v[len(v)-1]); err != nil {
+				return nil, fmt.Errorf("载入凭据文件失败: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("未知的代理参数: %s", key)
+		}
+	}
+
+	// 检查是否有认证信息
+	if strings.Contains(addr, "@") {
+		parts := strings.SplitN(addr, "@", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("无效的代理地址格式")
+		}
+
+		// 解析用户名密码
+		auth := parts[0]
+		if strings.Contains(auth, ":") {
+			authParts := strings.SplitN(auth, ":", 2)
+			config.HTTP.Username = authParts[0]
+			config.HTTP.Password = authParts[1]
+		}
+
+		config.Host = parts[1]
+	} else {
+		config.Host = addr
+	}
+
+	if err := config.HTTP.Validate(); err != nil {
+		return nil, err
+	}
+	config.SOCKS5 = socks5Config(config.Host)
+	if config.HTTP.AuthRequired() {
+		config.SOCKS5.Authenticate = config.HTTP.CheckUserPass
+	}
+	return config, nil
+}
+
+// runProxyServer 运行代理服务器（支持 SOCKS5 和 HTTP）
+func runProxyServer(addr string) {
+	config, listener, err := listenProxy(addr)
+	if err != nil {
+		log.Fatalf("[代理] %v", err)
+	}
+	serveProxy(listener, config)
+}
+
+// listenProxy 解析代理地址，创建本地监听并登记到运行中的监听表
+func listenProxy(addr string) (*ProxyConfig, net.Listener, error) {
+	config, err := parseProxyAddr(addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析代理地址失败: %w", err)
+	}
+	if config.Server == "" && !pools.has("") {
+		return nil, nil, errors.New("代理服务器需要指定 WebSocket 服务端地址 (-f)")
+	}
+	if !pools.has(config.Server) {
+		return nil, nil, fmt.Errorf("未定义的连接池: %s（见 -upstream）", config.Server)
+	}
+
+	listener, err := listenLocal(config.Host, listenFamily)
+	if err != nil {
+		return nil, nil, fmt.Errorf("代理监听失败 %s: %w", config.Host, err)
+	}
+	if err := localListeners.add(config.Host, "proxy", addr, listener); err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+
+	log.Printf("代理服务器启动（支持 SOCKS5 和 HTTP）监听: %s", config.Host)
+	if auth := &config.HTTP; auth.AuthRequired() {
+		if auth.Htpasswd != nil {
+			log.Printf("代理认证已启用（HTTP %s），凭据文件: %s", auth.Auth, auth.Htpasswd.Path())
+		} else if auth.Username != "" {
+			log.Printf("代理认证已启用（HTTP %s），用户名: %s", auth.Auth, auth.Username)
+		} else {
+			log.Printf("代理认证已启用（HTTP %s）", auth.Auth)
+		}
+	}
+	config.Pool = pools.get(config.Server)
+	config.HTTP.Pool = config.Pool
+	config.SOCKS5.Pool = config.Pool
+	return config, listener, nil
+}
+
+// serveProxy 在监听器上接受代理连接，监听器关闭（代理被移除）时返回
+func serveProxy(listener net.Listener, config *ProxyConfig) {
+	defer localListeners.forget(config.Host, listener)
+	limiter := newConnLimiter(config.Host)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("接受连接失败: %v", err)
+			continue
+		}
+
+		if !limiter.enter() {
+			log.Printf("[代理] 连接数与排队均已满，拒绝 %s", conn.RemoteAddr())
+			refuseConn(conn)
+			continue
+		}
+		go func() {
+			defer limiter.leave()
+			limiter.wait()
+			if !config.Pool.Admit() {
+				log.Printf("[代理] 没有可用通道，拒绝本地连接 %s（-when-down %s）", conn.RemoteAddr(), whenDown)
+				refuseConn(conn)
+				return
+			}
+			handleProxyConnection(conn, config)
+		}()
+	}
+}
+
+// handleProxyConnection 处理代理连接（自动检测协议类型）
+func handleProxyConnection(conn net.Conn, config *ProxyConfig) {
+	defer conn.Close()
+
+	clientAddr := conn.RemoteAddr().String()
+	log.Printf("[代理:%s] 新连接", clientAddr)
+
+	// 设置连接超时
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// 读取第一个字节判断协议类型
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil {
+		log.Printf("[代理:%s] 读取第一个字节失败: %v", clientAddr, err)
+		return
+	}
+
+	firstByte := buf[0]
+
+	// SOCKS5: 第一个字节是 0x05
+	if firstByte == 0x05 {
+		log.Printf("[代理:%s] 检测到 SOCKS5 协议", clientAddr)
+		socks5.Handle(conn, &config.SOCKS5, clientAddr)
+		return
+	}
+
+	// HTTP: 第一个字节是字母 (GET, POST, CONNECT, HEAD, PUT, DELETE, OPTIONS, PATCH)
+	if firstByte == 'G' || firstByte == 'P' || firstByte == 'C' || firstByte == 'H' ||
+		firstByte == 'D' || firstByte == 'O' {
+		log.Printf("[代理:%s] 检测到 HTTP 协议", clientAddr)
+		httpproxy.Handle(conn, &config.HTTP, clientAddr, firstByte)
+		return
+	}
+
+	log.Printf("[代理:%s] 未知协议，第一个字节: 0x%02X", clientAddr, firstByte)
+}
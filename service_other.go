@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// handleServiceCommand 非 Windows 平台不支持服务管理
+func handleServiceCommand(cmd string) error {
+	return errors.New("仅 Windows 平台支持 -service，其他平台请使用 systemd 等服务管理器")
+}
+
+// runAsService 非 Windows 平台始终以前台进程运行
+func runAsService(run func()) bool {
+	return false
+}
@@ -0,0 +1,216 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// tunnelService 实现 svc.Handler
+type tunnelService struct {
+	run func()
+}
+
+// Execute 服务主循环：启动隧道并等待停止指令
+func (s *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+
+	changes <- svc.Status{State: svc.StartPending}
+	go s.run()
+	changes <- svc.Status{State: svc.Running, Accepts: accepted}
+	log.Printf("[服务] %s 已启动", serviceName)
+
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			changes <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			log.Printf("[服务] %s 正在停止", serviceName)
+			changes <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// runAsService 若由服务管理器启动则以服务方式运行，返回 true 表示已处理
+func runAsService(run func()) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Fatalf("[服务] 无法判断运行环境: %v", err)
+	}
+	if !isService {
+		return false
+	}
+
+	// 服务没有控制台，未指定 -log-output 时日志写入程序目录下的文件
+	if exe, err := os.Executable(); err == nil && (logOutput == "" || logOutput == "stderr") {
+		logPath := filepath.Join(filepath.Dir(exe), serviceName+".log")
+		if f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			log.SetOutput(f)
+		}
+	}
+
+	if err := svc.Run(serviceName, &tunnelService{run: run}); err != nil {
+		log.Fatalf("[服务] 运行失败: %v", err)
+	}
+	return true
+}
+
+// handleServiceCommand 处理 -service 子命令
+func handleServiceCommand(cmd string) error {
+	switch cmd {
+	case "install":
+		return installService()
+	case "uninstall":
+		return uninstallService()
+	case "start":
+		return startService()
+	case "stop":
+		return controlService(svc.Stop, svc.Stopped)
+	default:
+		return fmt.Errorf("未知的服务命令: %s（可选 install|uninstall|start|stop）", cmd)
+	}
+}
+
+// serviceArgs 返回去除 -service 参数后的启动参数
+func serviceArgs() []string {
+	var args []string
+	skip := false
+	for _, a := range os.Args[1:] {
+		if skip {
+			skip = false
+			continue
+		}
+		name := strings.TrimLeft(a, "-")
+		if name == "service" {
+			skip = true
+			continue
+		}
+		if strings.HasPrefix(name, "service=") {
+			continue
+		}
+		args = append(args, a)
+	}
+	return args
+}
+
+// installService 注册为自动启动的 Windows 服务
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("服务 %s 已存在", serviceName)
+	}
+
+	args := serviceArgs()
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "ECH Tunnel (" + serviceName + ")",
+		Description: "ECH 加密 WebSocket 隧道",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	log.Printf("[服务] %s 已安装，启动参数: %s", serviceName, strings.Join(args, " "))
+	return nil
+}
+
+// uninstallService 删除 Windows 服务
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("服务 %s 未安装", serviceName)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	log.Printf("[服务] %s 已卸载", serviceName)
+	return nil
+}
+
+// startService 启动 Windows 服务
+func startService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("无法打开服务 %s: %v", serviceName, err)
+	}
+	defer s.Close()
+
+	if err := s.Start(); err != nil {
+		return err
+	}
+	log.Printf("[服务] %s 已启动", serviceName)
+	return nil
+}
+
+// controlService 发送控制指令并等待服务进入目标状态
+func controlService(c svc.Cmd, to svc.State) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("无法打开服务 %s: %v", serviceName, err)
+	}
+	defer s.Close()
+
+	status, err := s.Control(c)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Now().Add(10 * time.Second)
+	for status.State != to {
+		if time.Now().After(timeout) {
+			return fmt.Errorf("等待服务进入状态 %d 超时", to)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	log.Printf("[服务] %s 已停止", serviceName)
+	return nil
+}
@@ -0,0 +1,229 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ech-tunnel/internal/dnsmsg"
+)
+
+const (
+	// typeOPT EDNS0 伪记录类型，其 TTL 字段是扩展标志而非存活时间
+	typeOPT = 41
+	// dnsPendingTimeout 转发的查询等待应答的时长，超时后到达的应答不缓存
+	dnsPendingTimeout = 10 * time.Second
+)
+
+// DNSCache 客户端 SOCKS5 UDP 中发往 53 端口的 A/AAAA 查询的应答缓存（-dns-cache）：
+// 命中时直接在本地回复，不经隧道建立 UDP 关联；未命中的查询照常转发并登记，
+// 只有与登记的查询（关联、ID 与问题段）一致的成功应答才按其最小 TTL 缓存，避免伪造的应答污染缓存。
+// 缓存键包含上游 DNS 服务器，不同服务器（如内外网分离解析）的应答互不混用
+type DNSCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*dnsCachedAnswer
+	pending map[dnsPendingKey]dnsPendingQuery
+}
+
+// dnsPendingKey 已转发、等待应答的查询：所属 UDP 关联、报文 ID 与原样的问题段
+type dnsPendingKey struct {
+	assoc    string
+	id       uint16
+	question string
+}
+
+type dnsPendingQuery struct {
+	server  string // 查询发往的上游 DNS 服务器（SOCKS5 请求中的目标地址）
+	expires time.Time
+}
+
+type dnsCachedAnswer struct {
+	msg     []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// NewDNSCache 创建至多 size 条的缓存（-dns-cache），size 不大于 0 时返回 nil
+func NewDNSCache(size int) *DNSCache {
+	if size <= 0 {
+		return nil
+	}
+	log.Printf("[客户端] SOCKS5 UDP DNS 缓存已开启（至多 %d 条）", size)
+	return &DNSCache{max: size, entries: make(map[string]*dnsCachedAnswer), pending: make(map[dnsPendingKey]dnsPendingQuery)}
+}
+
+// isDNSPort target 是否为 53 端口
+func isDNSPort(target string) bool {
+	i := strings.LastIndexByte(target, ':')
+	return i >= 0 && target[i+1:] == "53"
+}
+
+// dnsQuestion 解析报文中唯一的问题，返回缓存键（小写域名/类型）与问题段结束的偏移；
+// 仅接受 IN 类的 A/AAAA 标准查询，response 指定报文应为应答还是查询
+func dnsQuestion(msg []byte, response bool) (string, int, bool) {
+	if len(msg) < 12 || (msg[2]&0x80 != 0) != response || msg[2]&0x78 != 0 {
+		return "", 0, false
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return "", 0, false
+	}
+	var name strings.Builder
+	offset := 12
+	for {
+		if offset >= len(msg) {
+			return "", 0, false
+		}
+		l := int(msg[offset])
+		if l == 0 {
+			offset++
+			break
+		}
+		// 问题段中的域名不应使用压缩指针
+		if l&0xC0 != 0 || offset+1+l > len(msg) {
+			return "", 0, false
+		}
+		name.WriteString(strings.ToLower(string(msg[offset+1 : offset+1+l])))
+		name.WriteByte('.')
+		offset += l + 1
+	}
+	if offset+4 > len(msg) {
+		return "", 0, false
+	}
+	qtype := binary.BigEndian.Uint16(msg[offset : offset+2])
+	qclass := binary.BigEndian.Uint16(msg[offset+2 : offset+4])
+	if (qtype != dnsmsg.TypeA && qtype != dnsmsg.TypeAAAA) || qclass != 1 {
+		return "", 0, false
+	}
+	return name.String() + "/" + strconv.Itoa(int(qtype)), offset + 4, true
+}
+
+// walkDNSRecords 依次回调应答、授权与附加段中每条记录的类型及 TTL 字段偏移，报文不完整时返回 false
+func walkDNSRecords(msg []byte, offset int, fn func(rrType uint16, ttlOffset int)) bool {
+	count := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) + int(binary.BigEndian.Uint16(msg[10:12]))
+	for i := 0; i < count; i++ {
+		offset = dnsmsg.SkipName(msg, offset)
+		if offset+10 > len(msg) {
+			return false
+		}
+		fn(binary.BigEndian.Uint16(msg[offset:offset+2]), offset+4)
+		offset += 10 + int(binary.BigEndian.Uint16(msg[offset+8:offset+10]))
+	}
+	return offset <= len(msg)
+}
+
+// lookup 查询命中且未过期时返回以该查询的 ID 与问题段改写、TTL 扣除已缓存时长后的应答
+func (c *DNSCache) lookup(server string, query []byte) []byte {
+	key, qend, ok := dnsQuestion(query, false)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	e := c.entries[server+"|"+key]
+	c.mu.Unlock()
+	now := time.Now()
+	if e == nil || !now.Before(e.expires) {
+		return nil
+	}
+	resp := append([]byte(nil), e.msg...)
+	copy(resp[0:2], query[0:2])
+	// 保留查询中域名的大小写（部分解析器使用 0x20 随机大小写校验应答）
+	copy(resp[12:qend], query[12:qend])
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	walkDNSRecords(resp, qend, func(rrType uint16, ttlOffset int) {
+		if rrType == typeOPT {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(resp[ttlOffset:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(resp[ttlOffset:], ttl)
+	})
+	return resp
+}
+
+// expect 登记关联 assoc 经隧道转发给 server 的查询，其应答到达时由 store 核对
+func (c *DNSCache) expect(assoc, server string, query []byte) {
+	_, qend, ok := dnsQuestion(query, false)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) >= c.max {
+		for k, q := range c.pending {
+			if !now.Before(q.expires) {
+				delete(c.pending, k)
+			}
+		}
+		// 仍然已满时不登记，该查询的应答照常转发但不缓存
+		if len(c.pending) >= c.max {
+			return
+		}
+	}
+	k := dnsPendingKey{assoc: assoc, id: binary.BigEndian.Uint16(query[0:2]), question: string(query[12:qend])}
+	c.pending[k] = dnsPendingQuery{server: server, expires: now.Add(dnsPendingTimeout)}
+}
+
+// store 缓存与登记的查询一致、成功且含应答记录的响应，有效期为其中记录的最小 TTL
+// （TTL 为 0 或被截断的响应不缓存）
+func (c *DNSCache) store(assoc string, resp []byte) {
+	key, qend, ok := dnsQuestion(resp, true)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	k := dnsPendingKey{assoc: assoc, id: binary.BigEndian.Uint16(resp[0:2]), question: string(resp[12:qend])}
+	c.mu.Lock()
+	q, found := c.pending[k]
+	delete(c.pending, k)
+	c.mu.Unlock()
+	if !found || !now.Before(q.expires) {
+		return
+	}
+	if resp[2]&0x02 != 0 || resp[3]&0x0F != 0 || binary.BigEndian.Uint16(resp[6:8]) == 0 {
+		return
+	}
+	var minTTL uint32
+	first := true
+	if !walkDNSRecords(resp, qend, func(rrType uint16, ttlOffset int) {
+		if rrType == typeOPT {
+			return
+		}
+		if ttl := binary.BigEndian.Uint32(resp[ttlOffset:]); first || ttl < minTTL {
+			minTTL, first = ttl, false
+		}
+	}) || minTTL == 0 {
+		return
+	}
+
+	key = q.server + "|" + key
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// 仍然已满时随机淘汰一条
+		for k := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &dnsCachedAnswer{
+		msg:     append([]byte(nil), resp...),
+		stored:  now,
+		expires: now.Add(time.Duration(minTTL) * time.Second),
+	}
+}
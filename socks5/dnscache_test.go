@@ -0,0 +1,105 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"ech-tunnel/internal/dnsmsg"
+	"ech-tunnel/internal/dnsmsg/dnstest"
+)
+
+func TestDNSQuestion(t *testing.T) {
+	query := dnstest.Query(1, "WWW.Example.com", dnsmsg.TypeAAAA)
+	compressed := append(dnstest.Query(1, "", dnsmsg.TypeA)[:12], 0xC0, 12, 0, 1, 0, 1)
+	tests := []struct {
+		name     string
+		msg      []byte
+		response bool
+		key      string
+		qend     int
+		ok       bool
+	}{
+		{"query", query, false, "www.example.com./28", len(query), true},
+		{"response", dnstest.Response(query, 0), true, "www.example.com./28", len(query), true},
+		{"query as response", query, true, "", 0, false},
+		{"response as query", dnstest.Response(query, 0), false, "", 0, false},
+		{"mx", dnstest.Query(1, "example.com", 15), false, "", 0, false},
+		{"pointer in question", compressed, false, "", 0, false},
+		{"truncated", query[:len(query)-1], false, "", 0, false},
+	}
+	for _, tt := range tests {
+		key, qend, ok := dnsQuestion(tt.msg, tt.response)
+		if key != tt.key || qend != tt.qend || ok != tt.ok {
+			t.Errorf("%s: dnsQuestion = %q, %d, %v，期望 %q, %d, %v", tt.name, key, qend, ok, tt.key, tt.qend, tt.ok)
+		}
+	}
+
+	// 非标准查询（opcode 不为 0）不缓存
+	status := dnstest.Query(1, "example.com", dnsmsg.TypeA)
+	status[2] |= 2 << 3
+	if _, _, ok := dnsQuestion(status, false); ok {
+		t.Error("dnsQuestion 接受了非标准查询")
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	c := NewDNSCache(16)
+	const server = "8.8.8.8:53"
+	query := dnstest.Query(0x0101, "example.com", dnsmsg.TypeA)
+	resp := dnstest.Response(query, 0, dnstest.RR{Type: dnsmsg.TypeA, TTL: 300, Data: []byte{1, 2, 3, 4}})
+
+	// 未登记的应答不缓存
+	c.store("assoc", resp)
+	if c.lookup(server, query) != nil {
+		t.Fatal("缓存了未登记查询的应答")
+	}
+
+	c.expect("assoc", server, query)
+	c.store("other", resp)
+	if c.lookup(server, query) != nil {
+		t.Fatal("缓存了其他关联收到的应答")
+	}
+	c.store("assoc", resp)
+	if c.lookup("1.1.1.1:53", query) != nil {
+		t.Fatal("不同上游服务器的应答被混用")
+	}
+
+	// 命中时改写为新查询的 ID 与域名大小写
+	again := dnstest.Query(0x0202, "EXAMPLE.com", dnsmsg.TypeA)
+	got := c.lookup(server, again)
+	if got == nil {
+		t.Fatal("未命中已缓存的应答")
+	}
+	if !bytes.Equal(got[:2], again[:2]) || !bytes.Equal(got[12:len(again)], again[12:]) {
+		t.Errorf("应答未按查询改写 ID 与问题段: %x", got)
+	}
+	if ttl := binary.BigEndian.Uint32(got[len(got)-10:]); ttl > 300 || ttl < 299 {
+		t.Errorf("TTL = %d，期望 300", ttl)
+	}
+
+	// 过期后不再命中
+	c.entries[server+"|example.com./1"].expires = time.Now()
+	if c.lookup(server, again) != nil {
+		t.Error("命中了已过期的应答")
+	}
+
+	// TTL 为 0 或失败的应答不缓存
+	for _, tt := range []struct {
+		name  string
+		rcode byte
+		rrs   []dnstest.RR
+	}{
+		{"zero.com", 0, []dnstest.RR{{Type: dnsmsg.TypeA, TTL: 0, Data: []byte{1, 2, 3, 4}}}},
+		{"fail.com", 2, nil},
+		{"empty.com", 0, nil},
+	} {
+		q := dnstest.Query(3, tt.name, dnsmsg.TypeA)
+		c.expect("assoc", server, q)
+		c.store("assoc", dnstest.Response(q, tt.rcode, tt.rrs...))
+		if c.lookup(server, q) != nil {
+			t.Errorf("缓存了不应缓存的应答 %s", tt.name)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"time"
+)
+
+// dumpRuntimeStats 输出运行状态快照，用于排查卡住的传输
+func dumpRuntimeStats() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	log.Printf("[统计] ===== 运行状态快照 =====")
+	log.Printf("[统计] goroutine: %d，堆内存: %.1fMB，GC 次数: %d",
+		runtime.NumGoroutine(), float64(m.HeapAlloc)/1024/1024, m.NumGC)
+
+	if age, ok := echClient.Age(); ok {
+		log.Printf("[统计] ECH 配置已缓存 %s", age.Round(time.Second))
+	}
+
+	pools.logStats()
+
+	if st := server.Load().Stats(); st.Sessions > 0 {
+		log.Printf("[统计] 服务端 WebSocket 会话: %d，TCP流: %d，UDP流: %d",
+			st.Sessions, st.TCPStreams, st.UDPStreams)
+		server.Load().LogStats()
+	}
+	log.Printf("[统计] ==========================")
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// startStatsTrigger 收到 SIGUSR1 时输出运行状态快照
+func startStatsTrigger() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	go func() {
+		for range sigCh {
+			dumpRuntimeStats()
+		}
+	}()
+}
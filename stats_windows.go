@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// startStatsTrigger Windows 无 SIGUSR1，在控制台输入 s 并回车时输出运行状态快照
+func startStatsTrigger() {
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if strings.EqualFold(strings.TrimSpace(scanner.Text()), "s") {
+				dumpRuntimeStats()
+			}
+		}
+	}()
+}
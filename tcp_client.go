@@ -1,232 +1,290 @@
-package main
-
-import (
-	"crypto/tls"
-	"crypto/x509"
-	"errors"
-	"fmt"
-	"log"
-	"net"
-	"net/url"
-	"strings"
-	"sync"
-	"time"
-
-	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
-)
-
-// buildTLSConfigWithECH 构建带 ECH 的 TLS 配置
-func buildTLSConfigWithECH(serverName string, echList []byte) (*tls.Config, error) {
-	roots, err := x509.SystemCertPool()
-	if err != nil {
-		return nil, fmt.Errorf("加载系统根证书失败: %w", err)
-	}
-	tcfg := &tls.Config{
-		MinVersion: tls.VersionTLS13,
-		ServerName: serverName,
-		// 完全采用 ECH，禁止回退
-		EncryptedClientHelloConfigList: echList,
-		EncryptedClientHelloRejectionVerify: func(cs tls.ConnectionState) error {
-			return errors.New("服务器拒绝 ECH（禁止回退）")
-		},
-		RootCAs: roots,
-	}
-	return tcfg, nil
-}
-
-// runTCPClient 运行 TCP 正向转发客户端（采用 ECH）
-func runTCPClient(listenForwardAddr, wsServerAddr string) {
-	// 移除 tcp:// 前缀
-	rulesStr := strings.TrimPrefix(listenForwardAddr, "tcp://")
-
-	// 按逗号分割多个规则
-	rules := strings.Split(rulesStr, ",")
-
-	if len(rules) == 0 {
-		log.Fatal("TCP 地址格式错误，应为 tcp://监听地址/目标地址[,监听地址/目标地址...]")
-	}
-
-	if wsServerAddr == "" {
-		log.Fatal("TCP 正向转发客户端需要指定 WebSocket 服务端地址 (-f)")
-	}
-
-	u, err := url.Parse(wsServerAddr)
-	if err != nil {
-		log.Fatalf("[客户端] 无效的 WebSocket 服务端地址: %v", err)
-	}
-	if u.Scheme != "wss" {
-		log.Fatalf("[客户端] 仅支持 wss://（客户端必须使用 ECH/TLS1.3）")
-	}
-
-	echPool = NewECHPool(wsServerAddr, connectionNum)
-	echPool.Start()
-
-	var wg sync.WaitGroup
-
-	// 为每个规则启动监听器（多通道模型：启动固定数量的 WebSocket 长连接池）
-	for _, rule := range rules {
-		rule = strings.TrimSpace(rule)
-		if rule == "" {
-			continue
-		}
-
-		parts := strings.Split(rule, "/")
-		if len(parts) != 2 {
-			log.Fatalf("规则格式错误: %s，应为 监听地址/目标地址", rule)
-		}
-
-		listenAddress := strings.TrimSpace(parts[0])
-		targetAddress := strings.TrimSpace(parts[1])
-
-		wg.Add(1)
-		go func(listen, target string) {
-			defer wg.Done()
-			startMultiChannelTCPForwarder(listen, target, echPool)
-		}(listenAddress, targetAddress)
-
-		log.Printf("[客户端] 已添加转发规则: %s -> %s", listenAddress, targetAddress)
-	}
-
-	log.Printf("[客户端] 共启动 %d 个TCP转发监听器(多通道)", len(rules))
-
-	// 等待所有监听器
-	wg.Wait()
-}
-
-// startMultiChannelTCPForwarder 启动多通道 TCP 转发器
-func startMultiChannelTCPForwarder(listenAddress, targetAddress string, pool *ECHPool) {
-	listener, err := net.Listen("tcp", listenAddress)
-	if err != nil {
-		log.Fatalf("TCP监听失败 %s: %v", listenAddress, err)
-	}
-	log.Printf("[客户端] TCP正向转发(多通道)监听: %s -> %s", listenAddress, targetAddress)
-
-	// 接受 TCP 连接
-	for {
-		tcpConn, err := listener.Accept()
-		if err != nil {
-			if !strings.Contains(err.Error(), "use of closed network connection") {
-				log.Printf("[客户端] 接受TCP连接失败 %s: %v", listenAddress, err)
-			}
-			return
-		}
-
-		connID := uuid.New().String()
-		log.Printf("[客户端] 新的TCP连接 %s，连接ID: %s", tcpConn.RemoteAddr(), connID)
-
-		// 读取第一帧
-		_ = tcpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-		buffer := make([]byte, 32768)
-		n, _ := tcpConn.Read(buffer)
-		_ = tcpConn.SetReadDeadline(time.Time{})
-		first := ""
-		if n > 0 {
-			first = string(buffer[:n])
-		}
-
-		pool.RegisterAndClaim(connID, targetAddress, first, tcpConn)
-
-		if !pool.WaitConnected(connID, 5*time.Second) {
-			log.Printf("[客户端] 连接 %s 建立超时，关闭", connID)
-			_ = tcpConn.Close()
-			continue
-		}
-
-		go func(cID string, c net.Conn) {
-			defer func() {
-				_ = pool.SendClose(cID)
-				_ = c.Close()
-			}()
-
-			buf := make([]byte, 32768)
-			for {
-				n, err := c.Read(buf)
-				if err != nil {
-					return
-				}
-				if err := pool.SendData(cID, buf[:n]); err != nil {
-					log.Printf("[客户端] 发送数据到通道失败: %v", err)
-					return
-				}
-			}
-		}(connID, tcpConn)
-	}
-}
-
-// dialWebSocketWithECH 建立 WebSocket 连接（带 ECH 重试）
-func dialWebSocketWithECH(wsServerAddr string, maxRetries int) (*websocket.Conn, error) {
-	u, err := url.Parse(wsServerAddr)
-	if err != nil {
-		return nil, fmt.Errorf("解析 wsServerAddr 失败: %v", err)
-	}
-	serverName := u.Hostname()
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		echBytes, echErr := getECHList()
-		if echErr != nil {
-			log.Printf("[ECH] 获取 ECH 配置失败: %v", echErr)
-			if attempt < maxRetries {
-				log.Printf("[ECH] 尝试刷新 ECH 配置...")
-				if refreshErr := refreshECH(); refreshErr != nil {
-					log.Printf("[ECH] 刷新失败: %v", refreshErr)
-				}
-				continue
-			}
-			return nil, fmt.Errorf("ECH 配置不可用: %v", echErr)
-		}
-
-		tlsCfg, tlsErr := buildTLSConfigWithECH(serverName, echBytes)
-		if tlsErr != nil {
-			return nil, fmt.Errorf("构建 TLS(ECH) 配置失败: %v", tlsErr)
-		}
-
-		// 配置WebSocket Dialer（增加缓冲区大小）
-		dialer := websocket.Dialer{
-			TLSClientConfig: tlsCfg,
-			Subprotocols: func() []string {
-				if token == "" {
-					return nil
-				}
-				return []string{token}
-			}(),
-			HandshakeTimeout: 10 * time.Second,
-			ReadBufferSize:   65536, // 增加读缓冲区到64KB
-			WriteBufferSize:  65536, // 增加写缓冲区到64KB
-		}
-
-		// 如果指定了IP地址，配置自定义拨号器（SNI 仍为 serverName）
-		if ipAddr != "" {
-			dialer.NetDial = func(network, address string) (net.Conn, error) {
-				_, port, err := net.SplitHostPort(address)
-				if err != nil {
-					return nil, err
-				}
-				address = net.JoinHostPort(ipAddr, port)
-				return net.DialTimeout(network, address, 10*time.Second)
-			}
-		}
-
-		// 连接到WebSocket服务端（必须 wss）
-		wsConn, _, dialErr := dialer.Dial(wsServerAddr, nil)
-		if dialErr != nil {
-			// 检查是否为 ECH 相关错误
-			if strings.Contains(dialErr.Error(), "ECH") || strings.Contains(dialErr.Error(), "ech") {
-				log.Printf("[ECH] 连接失败（可能 ECH 公钥已轮换）: %v", dialErr)
-				if attempt < maxRetries {
-					log.Printf("[ECH] 尝试刷新 ECH 配置并重试 (尝试 %d/%d)...", attempt, maxRetries)
-					if refreshErr := refreshECH(); refreshErr != nil {
-						log.Printf("[ECH] 刷新失败: %v", refreshErr)
-					}
-					time.Sleep(time.Second)
-					continue
-				}
-			}
-			return nil, dialErr
-		}
-
-		return wsConn, nil
-	}
-
-	return nil, fmt.Errorf("WebSocket 连接失败，已达最大重试次数")
-}
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"ech-tunnel/pool"
+	"ech-tunnel/tunnel"
+
+	"github.com/google/uuid"
+)
+
+// runTCPClient 运行 TCP 正向转发客户端（采用 ECH），各规则经其引用的连接池转发
+func runTCPClient(listenForwardAddr string) {
+	// 移除 tcp:// 前缀
+	rulesStr := strings.TrimPrefix(listenForwardAddr, "tcp://")
+
+	// 按逗号分割多个规则（channels 参数中的逗号属于所在规则）
+	rules, err := splitRules(rulesStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(rules) == 0 {
+		log.Fatal("TCP 地址格式错误，应为 tcp://监听地址/目标地址[,监听地址/目标地址...]")
+	}
+
+	// 先解析全部规则，格式错误时在建立通道前退出
+	var parsed []*forwardRule
+	for _, r := range rules {
+		rule, err := parseRuleForPool(r)
+		if err != nil {
+			log.Fatalf("规则 %s 错误: %v", r, err)
+		}
+		parsed = append(parsed, rule)
+	}
+
+	var wg sync.WaitGroup
+
+	// 为每个规则启动监听器（多通道模型：引用同一连接池的规则共享其固定数量的 WebSocket 长连接）
+	for i, rule := range parsed {
+		listener, p, err := listenForwardRule(rules[i], rule)
+		if err != nil {
+			log.Fatalf("TCP监听失败 %s: %v", rule.listen, err)
+		}
+		wg.Add(1)
+		go func(rule *forwardRule) {
+			defer wg.Done()
+			serveForwardRule(listener, rule, p)
+		}(rule)
+	}
+
+	log.Printf("[客户端] 共启动 %d 个TCP转发监听器(多通道)", len(parsed))
+
+	// 等待所有监听器（经控制套接字移除的规则同样在此结束）
+	wg.Wait()
+}
+
+// parseRuleForPool 解析单条规则并检查其引用的连接池已定义
+func parseRuleForPool(spec string) (*forwardRule, error) {
+	rule, err := parseForwardRule(spec, connectionNum)
+	if err != nil {
+		return nil, err
+	}
+	if rule.server == "" && !pools.has("") {
+		return nil, errors.New("TCP 正向转发客户端需要指定 WebSocket 服务端地址 (-f)")
+	}
+	if !pools.has(rule.server) {
+		return nil, fmt.Errorf("未定义的连接池 %s（见 -upstream）", rule.server)
+	}
+	return rule, nil
+}
+
+// listenForwardRule 为规则创建本地监听并登记到运行中的监听表（spec 为规则原文）
+func listenForwardRule(spec string, rule *forwardRule) (net.Listener, *pool.ECHPool, error) {
+	listener, err := listenLocal(rule.listen, rule.family)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := localListeners.add(rule.listen, "rule", spec, listener); err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+	via := ""
+	if rule.server != "" {
+		via = "（经连接池 " + rule.server + "）"
+	}
+	if len(rule.channels) > 0 {
+		log.Printf("[客户端] 已添加转发规则: %s -> %s（通道 %v）%s", rule.listen, rule.target, rule.channels, via)
+	} else {
+		log.Printf("[客户端] 已添加转发规则: %s -> %s%s", rule.listen, rule.target, via)
+	}
+	return listener, pools.get(rule.server), nil
+}
+
+// forwardRule 一条 TCP 转发规则: 监听地址/目标地址[@通道][?参数]，
+// 参数未指定时取全局默认值
+type forwardRule struct {
+	listen   string
+	target   string
+	channels []int                 // 通道亲和集合（@通道 或 channels），为空时使用全部通道
+	wait     time.Duration         // 等待服务端连上目标的最长时间（connect-timeout）
+	priority tunnel.StreamPriority // 通道发送优先级（priority），缺省按目标端口推断
+	sniff    time.Duration         // 等待本地客户端首包的时间（sniff），0 表示不等待
+	server   string                // 经由的连接池名称（server，见 -upstream），为空时使用 -f
+	family   string                // 监听的地址族（family，见 -listen-family）
+}
+
+// splitRules 按逗号分割规则。channels 参数位于规则末尾时，其中的逗号属于该参数（如 ?channels=0,1），
+// 随后不含 "/" 的通道编号或范围片段并入上一条规则；其余不含 "/" 的片段不是有效规则，返回错误
+func splitRules(s string) ([]string, error) {
+	var rules []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			if len(rules) == 0 || !continuesChannels(rules[len(rules)-1], part) {
+				return nil, fmt.Errorf("规则 %s 格式错误，应为 监听地址/目标地址", part)
+			}
+			rules[len(rules)-1] += "," + part
+			continue
+		}
+		rules = append(rules, part)
+	}
+	return rules, nil
+}
+
+// continuesChannels part 是否为 rule 末尾 channels 参数的后续通道编号或范围
+func continuesChannels(rule, part string) bool {
+	_, query, ok := strings.Cut(rule, "?")
+	if !ok {
+		return false
+	}
+	params := strings.Split(query, "&")
+	if !strings.HasPrefix(params[len(params)-1], "channels=") {
+		return false
+	}
+	return strings.Trim(part, "0123456789-") == ""
+}
+
+// parseForwardRule 解析单条规则，n 为通道数。可选参数:
+// connect-timeout=时长、priority=interactive|bulk（或 high|low）、sniff=off|时长、channels=0,1|0-1、server=连接池名称、
+// family=auto|dual|ipv4|ipv6
+func parseForwardRule(s string, n int) (*forwardRule, error) {
+	// 可选的规则参数: 目标地址?connect-timeout=30s&priority=bulk
+	s, query, _ := strings.Cut(s, "?")
+
+	// 目标地址不含 "/"，按最后一个 "/" 切分以兼容 unix:///path/to.sock
+	idx := strings.LastIndex(s, "/")
+	if idx <= 0 || (!isUnixAddr(s) && strings.Count(s, "/") != 1) {
+		return nil, errors.New("格式应为 监听地址/目标地址")
+	}
+	rule := &forwardRule{
+		listen: strings.TrimSpace(s[:idx]),
+		target: strings.TrimSpace(s[idx+1:]),
+		sniff:  sniffTimeout,
+		family: listenFamily,
+	}
+
+	// 可选的通道亲和: 目标地址@通道集合，如 10.0.0.1:80@0-1
+	var err error
+	if at := strings.LastIndex(rule.target, "@"); at >= 0 {
+		if rule.channels, err = pool.ParseChannelSet(rule.target[at+1:], n); err != nil {
+			return nil, fmt.Errorf("通道亲和配置错误: %w", err)
+		}
+		rule.target = rule.target[:at]
+	}
+	rule.wait, rule.priority = connectTimeout, frames.PriorityFor(rule.target)
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	for key, v := range values {
+		val := v[len(v)-1]
+		switch key {
+		case "connect-timeout":
+			rule.wait, err = time.ParseDuration(val)
+			if err != nil || rule.wait <= 0 {
+				return nil, fmt.Errorf("无效的 connect-timeout: %s", val)
+			}
+		case "priority":
+			if rule.priority, err = tunnel.ParsePriority(val); err != nil {
+				return nil, err
+			}
+		case "sniff":
+			if val == "off" {
+				rule.sniff = 0
+			} else if rule.sniff, err = time.ParseDuration(val); err != nil || rule.sniff < 0 {
+				return nil, fmt.Errorf("无效的 sniff: %s（可选 off 或时长）", val)
+			}
+		case "channels":
+			// 查询串中的 "+" 已解码为空格
+			set := strings.NewReplacer(",", "+", " ", "+").Replace(val)
+			if rule.channels, err = pool.ParseChannelSet(set, n); err != nil {
+				return nil, fmt.Errorf("通道亲和配置错误: %w", err)
+			}
+		case "server":
+			rule.server = val
+		case "family":
+			if rule.family, err = tunnel.ParseListenFamily(val); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("未知的规则参数: %s", key)
+		}
+	}
+	return rule, nil
+}
+
+// serveForwardRule 在规则的监听器上接受本地连接并经多通道转发，监听器关闭（规则被移除）时返回
+func serveForwardRule(listener net.Listener, rule *forwardRule, p *pool.ECHPool) {
+	defer localListeners.forget(rule.listen, listener)
+	log.Printf("[客户端] TCP正向转发(多通道)监听: %s -> %s", rule.listen, rule.target)
+	limiter := newConnLimiter(rule.listen)
+
+	// 接受 TCP 连接
+	for {
+		tcpConn, err := listener.Accept()
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("[客户端] 接受TCP连接失败 %s: %v", rule.listen, err)
+			}
+			return
+		}
+
+		if !limiter.enter() {
+			log.Printf("[客户端] 监听 %s 的连接数与排队均已满，拒绝 %s", rule.listen, tcpConn.RemoteAddr())
+			refuseConn(tcpConn)
+			continue
+		}
+		// 建连在独立协程中进行，等待通道恢复（-when-down queue）或服务端连上目标时不阻塞接受新连接
+		go func() {
+			defer limiter.leave()
+			limiter.wait()
+			forwardTCPConn(tcpConn, rule, p)
+		}()
+	}
+}
+
+// forwardTCPConn 按规则经隧道转发单个本地连接
+func forwardTCPConn(tcpConn net.Conn, rule *forwardRule, p *pool.ECHPool) {
+	if !p.Admit() {
+		log.Printf("[客户端] 没有可用通道，拒绝本地连接 %s（-when-down %s）", tcpConn.RemoteAddr(), whenDown)
+		refuseConn(tcpConn)
+		return
+	}
+
+	connID := uuid.New().String()
+	log.Printf("[客户端] 新的TCP连接 %s，连接ID: %s", tcpConn.RemoteAddr(), connID)
+
+	// 读取第一帧
+	first := tunnel.ReadFirstFrame(tcpConn, rule.sniff)
+
+	p.RegisterAndClaimOn(connID, rule.target, first, tcpConn, rule.channels, rule.priority)
+
+	if !p.WaitConnected(connID, rule.wait) {
+		log.Printf("[客户端] 连接 %s 建立超时，关闭", connID)
+		_ = tcpConn.Close()
+		return
+	}
+
+	defer func() {
+		_ = p.SendClose(connID)
+		_ = tcpConn.Close()
+	}()
+
+	delay := frames.CoalesceDelayFor(rule.target)
+	ab := tunnel.NewAdaptiveBuffer(p.MaxPayload(connID), frames.IsLowLatencyTarget(rule.target))
+	for {
+		buf := ab.Bytes()
+		n, err := tunnel.ReadCoalesced(tcpConn, buf, delay)
+		ab.Observe(n)
+		if err != nil {
+			p.WaitHalfClosed(connID, err)
+			return
+		}
+		if err := p.SendData(connID, buf[:n]); err != nil {
+			log.Printf("[客户端] 发送数据到通道失败: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ech-tunnel/protocol"
+)
+
+// sessionInfo 服务端隧道会话的来源信息
+type sessionInfo struct {
+	clientIP string
+	path     string
+	tokenID  string       // token 的 SHA-256 摘要前缀，不记录明文
+	maxFrame int          // 协商的单条消息上限
+	zstd     bool         // 是否协商了 zstd 负载压缩
+	resumeID string       // 客户端连接池的会话 ID（可恢复会话，协议版本 5）
+	relay    Relay        // 中继模式下通往下一跳的连接（为 nil 时直接连接目标）
+	policy   *tokenPolicy // 令牌权限（未配置 -token-policy 时为 nil）
+	usage    *tokenUsage  // 令牌当月的流量计数
+}
+
+// tokenID 返回 token 的短标识（未设置 token 时为 "-"）
+func tokenID(token string) string {
+	if token == "" {
+		return "-"
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
+
+// streamAccounting 服务端单个流的访问日志统计
+type streamAccounting struct {
+	proto          string
+	target         string
+	start          time.Time
+	up, down       atomic.Int64 // up: 客户端 -> 目标，down: 目标 -> 客户端
+	closedByClient atomic.Bool
+	forced         atomic.Value // string：本端强制关闭流的原因（closeQuota、closeAdmin）
+	usage          *tokenUsage  // 同时累计到令牌的流量计数（可为 nil）
+	metrics        *Metrics
+}
+
+func (s *Server) newStreamAccounting(proto, target string, usage *tokenUsage) *streamAccounting {
+	return &streamAccounting{proto: proto, target: target, start: time.Now(), usage: usage, metrics: s.frames.metrics}
+}
+
+// addUp 记录客户端发往目标的字节数
+func (a *streamAccounting) addUp(n int) {
+	a.up.Add(int64(n))
+	a.usage.addUp(n)
+	a.metrics.BytesUp.Add(int64(n))
+}
+
+// addDown 记录目标发往客户端的字节数
+func (a *streamAccounting) addDown(n int) {
+	a.down.Add(int64(n))
+	a.usage.addDown(n)
+	a.metrics.BytesDown.Add(int64(n))
+}
+
+// force 记录本端强制关闭流的原因（调用方随后关闭目标连接）
+func (a *streamAccounting) force(reason string) {
+	a.forced.CompareAndSwap(nil, reason)
+}
+
+// forcedReason 流被强制关闭的原因，未被强制关闭时为空
+func (a *streamAccounting) forcedReason() string {
+	r, _ := a.forced.Load().(string)
+	return r
+}
+
+// closeFrame 构造携带本端流量统计的 CLOSE 帧（服务端视角：发出为 down，收到为 up）
+func (a *streamAccounting) closeFrame(connID, reason string) protocol.ControlFrame {
+	return protocol.ControlFrame{Type: protocol.CtrlClose, ConnID: connID, Sent: uint64(a.down.Load()), Received: uint64(a.up.Load()), Reason: reason}
+}
+
+// 访问日志关闭原因
+const (
+	CloseClient      = "client_close"
+	closeTarget      = "target_close"
+	closeTargetError = "target_error"
+	closeDialError   = "dial_error"
+	closePolicy      = "policy_denied"
+	closeQuota       = "quota_exceeded"
+	closeSession     = "session_end"
+	closeTunnelError = "tunnel_error"
+	closeIdle        = "idle_timeout"
+	closeAdmin       = "admin_close" // 经管理接口终止
+)
+
+// openAccessLog 按参数打开访问日志（未配置 AccessLog 时返回 nil）
+func openAccessLog(cfg ServerConfig) (*rotatingFile, error) {
+	if cfg.AccessLog == "" {
+		return nil, nil
+	}
+	f, err := openRotatingFile(cfg.AccessLog, int64(cfg.AccessLogMaxSize)<<20, cfg.AccessLogRotate, cfg.AccessLogBackups)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("访问日志: %s（单文件上限 %d MB，轮转周期 %s，保留 %d 份）", cfg.AccessLog, cfg.AccessLogMaxSize, cfg.AccessLogRotate, cfg.AccessLogBackups)
+	return f, nil
+}
+
+// logAccess 记录一条流访问日志（并写入审计日志）
+func (s *Server) logAccess(sess *sessionInfo, connID string, a *streamAccounting, reason string) {
+	if a.closedByClient.Load() {
+		reason = CloseClient
+	} else if r := a.forcedReason(); r != "" {
+		reason = r
+	}
+	s.logAudit(sess, connID, a, reason)
+	if s.accessLog == nil {
+		return
+	}
+	line := fmt.Sprintf("%s client=%s path=%s token=%s proto=%s conn=%s target=%s up=%d down=%d duration=%s reason=%s\n",
+		time.Now().Format(time.RFC3339), sess.clientIP, sess.path, sess.tokenID, a.proto, connID, a.target,
+		a.up.Load(), a.down.Load(), time.Since(a.start).Round(time.Millisecond), reason)
+	if _, err := s.accessLog.Write([]byte(line)); err != nil {
+		log.Printf("写入访问日志失败: %v", err)
+	}
+}
+
+// rotatingFile 按大小与时间轮转的日志文件
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	backups  int
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size, r.openedAt = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write 写入一行，超过大小或时间阈值时先轮转
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if (r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize && r.size > 0) ||
+		(r.maxAge > 0 && time.Since(r.openedAt) >= r.maxAge) {
+		if err := r.rotate(); err != nil {
+			log.Printf("访问日志轮转失败: %v", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate 将当前文件重命名为带时间戳的备份并清理超出数量的旧备份
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	backup := r.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.backups > 0 {
+		old, _ := filepath.Glob(r.path + ".*")
+		sort.Strings(old)
+		for len(old) > r.backups {
+			_ = os.Remove(old[0])
+			old = old[1:]
+		}
+	}
+	return nil
+}
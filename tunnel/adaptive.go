@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"time"
+)
+
+const (
+	adaptiveMinBuffer = 16 << 10 // 读缓冲区初始/最小大小
+	adaptiveMaxBuffer = 1 << 20  // 读缓冲区上限（另受协商的单条消息上限与 -wire-frame 约束）
+	MinWireFrameSize  = 2048     // -wire-frame 的下限，扣除帧头预留后仍可承载数据
+	// 按该时长内可到达的数据量确定缓冲区大小：每次读取约承载 20ms 的数据
+	adaptiveTarget = 20 * time.Millisecond
+	// 吞吐统计周期
+	adaptiveWindow = 100 * time.Millisecond
+	// 读取间隔超过该时间视为空闲，缓冲区回到最小值
+	adaptiveIdle = time.Second
+)
+
+// adaptiveBuffer 按流的实测吞吐调整读缓冲区大小：从 16KB 起，每个统计周期按吞吐×20ms
+// 取不小于该值的 2 的幂（至多 max）；流空闲后回到最小值释放内存。低时延流（-nodelay-ports）
+// 固定使用最小缓冲区，避免大块读取增加交互延迟
+type adaptiveBuffer struct {
+	buf        []byte
+	max        int
+	lowLatency bool
+
+	windowStart time.Time
+	windowBytes int
+	lastRead    time.Time
+}
+
+// NewAdaptiveBuffer 创建读缓冲区，maxPayload 为单帧可承载的最大负载（小于 16KB 时固定使用该大小）
+func NewAdaptiveBuffer(maxPayload int, lowLatency bool) *adaptiveBuffer {
+	now := time.Now()
+	limit := min(maxPayload, adaptiveMaxBuffer)
+	return &adaptiveBuffer{
+		buf:         make([]byte, min(adaptiveMinBuffer, limit)),
+		max:         limit,
+		lowLatency:  lowLatency,
+		windowStart: now,
+		lastRead:    now,
+	}
+}
+
+// Bytes 返回当前读缓冲区（下一次 observe 前有效）
+func (b *adaptiveBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// Observe 记录一次读取了 n 字节，并按吞吐调整下一次读取的缓冲区大小
+func (b *adaptiveBuffer) Observe(n int) {
+	if b.lowLatency || n == 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(b.lastRead) > adaptiveIdle {
+		b.resize(min(adaptiveMinBuffer, b.max))
+		b.windowStart, b.windowBytes = now, 0
+	}
+	b.lastRead = now
+	b.windowBytes += n
+	elapsed := now.Sub(b.windowStart)
+	if elapsed < adaptiveWindow {
+		return
+	}
+	want := int(float64(b.windowBytes) / elapsed.Seconds() * adaptiveTarget.Seconds())
+	size := adaptiveMinBuffer
+	for size < want && size < b.max {
+		size *= 2
+	}
+	b.resize(min(size, b.max))
+	b.windowStart, b.windowBytes = now, 0
+}
+
+func (b *adaptiveBuffer) resize(size int) {
+	if size != len(b.buf) {
+		b.buf = make([]byte, size)
+	}
+}
+
+// MaxPayloadFor 返回单条消息上限为 limit 时一个 DATA 帧可承载的最大负载（预留帧头、加密与填充开销）；
+// 设置了 WireFrameSize 时另受其约束，使每个 DATA 帧可在单个 WebSocket 帧中发出
+func (f *Frames) MaxPayloadFor(limit int) int {
+	if f.cfg.WireFrameSize > 0 {
+		limit = min(limit, f.cfg.WireFrameSize)
+	}
+	return limit - 4*frameHeaderReserve
+}
+
+// wsWriteBufferSize WebSocket 写缓冲区大小：gorilla/websocket 在缓冲区写满时发出一个帧，
+// 超过该大小的消息以 continuation 帧分片，设置了 WireFrameSize 时据此限制帧大小
+func (f *Frames) wsWriteBufferSize() int {
+	if f.cfg.WireFrameSize > 0 {
+		return f.cfg.WireFrameSize
+	}
+	return 65536
+}
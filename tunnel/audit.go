@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"ech-tunnel/internal/secret"
+)
+
+// auditRecord 审计日志的一行（JSON Lines），每个隧道流关闭时写入
+type auditRecord struct {
+	Token  string    `json:"token"`
+	Client string    `json:"client"`
+	Path   string    `json:"path"`
+	Proto  string    `json:"proto"`
+	Conn   string    `json:"conn"`
+	Dest   string    `json:"dest"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Up     int64     `json:"up"`
+	Down   int64     `json:"down"`
+	Reason string    `json:"reason"`
+}
+
+// openAuditLog 按参数打开审计日志（未配置 AuditLog 时返回 nil），轮转参数与访问日志相同；
+// 同时返回 AuditDest 为 hash 时计算主机名 HMAC 的密钥
+func openAuditLog(cfg ServerConfig) (*rotatingFile, []byte, error) {
+	switch cfg.AuditDest {
+	case "full", "hash", "truncate":
+	default:
+		return nil, nil, fmt.Errorf("无效的目标地址记录方式: %s（可选 full|hash|truncate）", cfg.AuditDest)
+	}
+	if cfg.AuditLog == "" {
+		return nil, nil, nil
+	}
+	var key []byte
+	if cfg.AuditDest == "hash" {
+		// 密钥持久保存，重启后同一主机名的摘要保持不变，便于跨日志关联；
+		// 默认文件名不以 "<日志路径>." 开头，避免被当作轮转备份清理
+		path := cfg.AuditSecretFile
+		if path == "" {
+			path = cfg.AuditLog + "-secret"
+		}
+		k, err := secret.LoadOrCreate(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("读取审计日志密钥失败: %w", err)
+		}
+		key = []byte(k)
+	}
+	f, err := openRotatingFile(cfg.AuditLog, int64(cfg.AccessLogMaxSize)<<20, cfg.AccessLogRotate, cfg.AccessLogBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("审计日志: %s（目标地址: %s）", cfg.AuditLog, cfg.AuditDest)
+	return f, key, nil
+}
+
+// logAudit 记录一条流审计日志
+func (s *Server) logAudit(sess *sessionInfo, connID string, a *streamAccounting, reason string) {
+	if s.auditLog == nil {
+		return
+	}
+	rec := auditRecord{
+		Token: sess.tokenID, Client: sess.clientIP, Path: sess.path, Proto: a.proto, Conn: connID,
+		Dest: auditTarget(a.target, s.cfg.AuditDest, s.auditKey), Start: a.start, End: time.Now(),
+		Up: a.up.Load(), Down: a.down.Load(), Reason: reason,
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	if _, err := s.auditLog.Write(append(line, '\n')); err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+	}
+}
+
+// auditTarget 按 mode 处理记录的目标地址（host:port）：full 原样记录；hash 以密钥 key 计算的主机名
+// HMAC-SHA256 前缀代替主机名（不知道密钥无法以字典反查）；truncate 域名只保留最后两级，IPv4 截断为 /24，IPv6 截断为 /48。端口均保留
+func auditTarget(target, mode string, key []byte) string {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || mode == "full" {
+		return target
+	}
+	switch mode {
+	case "hash":
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(strings.ToLower(host)))
+		host = hex.EncodeToString(mac.Sum(nil)[:8])
+	case "truncate":
+		if ip := net.ParseIP(host); ip != nil {
+			if v4 := ip.To4(); v4 != nil {
+				host = (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+			} else {
+				host = (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+			}
+		} else if labels := strings.Split(strings.TrimSuffix(host, "."), "."); len(labels) > 2 {
+			host = strings.Join(labels[len(labels)-2:], ".")
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+)
+
+// 测速伪目标（服务端 -allow-bench 时由进程内生成/吸收数据，不连接真实地址）
+const (
+	BenchUploadTarget   = "bench:upload"
+	BenchDownloadTarget = "bench:download"
+)
+
+// dialBenchTarget 服务端打开测速伪目标，非测速目标或未启用时返回 false
+func (s *Server) dialBenchTarget(target string) (net.Conn, bool) {
+	if !s.cfg.AllowBench || (target != BenchUploadTarget && target != BenchDownloadTarget) {
+		return nil, false
+	}
+	local, remote := net.Pipe()
+	if target == BenchUploadTarget {
+		go func() {
+			_, _ = io.Copy(io.Discard, remote)
+			_ = remote.Close()
+		}()
+	} else {
+		go func() {
+			buf := make([]byte, 32768)
+			_, _ = rand.Read(buf)
+			for {
+				if _, err := remote.Write(buf); err != nil {
+					_ = remote.Close()
+					return
+				}
+			}
+		}()
+	}
+	return local, true
+}
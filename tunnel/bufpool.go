@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"ech-tunnel/protocol"
+)
+
+// 帧头部预留空间（前缀 + connID + 序号）
+const frameHeaderReserve = 64
+
+// frameBufPool 复用帧构建缓冲区，降低高吞吐下的 GC 压力
+var frameBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 32768+frameHeaderReserve)
+		return &b
+	},
+}
+
+// GetFrameBuf 获取一个空的帧缓冲区
+func GetFrameBuf() *[]byte {
+	bp := frameBufPool.Get().(*[]byte)
+	*bp = (*bp)[:0]
+	return bp
+}
+
+// PutFrameBuf 归还帧缓冲区（过大的缓冲区直接丢弃）
+func PutFrameBuf(bp *[]byte) {
+	if cap(*bp) > 1<<20 {
+		return
+	}
+	frameBufPool.Put(bp)
+}
+
+// QueuedPayload 将 DATA 帧的原始负载复制到池化缓冲区，供发送队列异步写出。
+// 压缩与加密在写出时按通道当前的协商结果进行（见 encodePayload），排队期间通道重连不影响已排队的帧
+func QueuedPayload(payload []byte) *[]byte {
+	bp := GetFrameBuf()
+	*bp = append(*bp, payload...)
+	return bp
+}
+
+// EncodePayload 在 dst 后追加写出的 DATA 帧负载（启用端到端加密时为密文）；
+// compress 为通道是否协商了 zstd 压缩，压缩在加密之前进行
+func (f *Frames) EncodePayload(dst []byte, connID string, seq uint64, payload []byte, compress bool) []byte {
+	switch {
+	case compress && f.aead == nil:
+		return f.appendCompressed(dst, payload)
+	case compress:
+		plain := GetFrameBuf()
+		*plain = f.appendCompressed(*plain, payload)
+		dst = f.SealPayload(dst, *plain, StreamAAD(connID, seq))
+		PutFrameBuf(plain)
+		return dst
+	case f.aead == nil:
+		return append(dst, payload...)
+	default:
+		return f.SealPayload(dst, payload, StreamAAD(connID, seq))
+	}
+}
+
+// WriteDataFrame 发送一个 DATA 帧（调用方持有通道写锁）。WebSocket 通道且未启用填充时
+// 通过 NextWriter 依次写入帧头与负载，负载直接从调用方缓冲区写出，省去拼接整帧的复制；
+// 其余情况在池化缓冲区中构建整帧后发送
+func WriteDataFrame(conn TunnelConn, messageType, version int, pd *Padder, connID string, seq uint64, payload []byte) error {
+	ws, ok := conn.(*websocket.Conn)
+	if fc, isFrag := conn.(fragmentedWSConn); isFrag {
+		ws, ok = fc.Conn, true
+	}
+	if ok && pd == nil {
+		w, err := ws.NextWriter(messageType)
+		if err != nil {
+			return err
+		}
+		var hdr [frameHeaderReserve]byte
+		if _, err := w.Write(protocol.AppendDataHeader(hdr[:0], version, connID, seq)); err != nil {
+			_ = w.Close()
+			return err
+		}
+		if _, err := w.Write(payload); err != nil {
+			_ = w.Close()
+			return err
+		}
+		return w.Close()
+	}
+	bp := GetFrameBuf()
+	frame := pd.appendFrame(*bp, version, connID, seq, payload)
+	err := conn.WriteMessage(messageType, frame)
+	*bp = frame
+	PutFrameBuf(bp)
+	return err
+}
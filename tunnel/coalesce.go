@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"net"
+	"time"
+)
+
+// 合并后的数据达到该大小即立即发送
+const coalesceThreshold = 16384
+
+// CoalesceDelayFor 返回目标对应的小包合并等待时间（0 表示不合并）
+func (f *Frames) CoalesceDelayFor(target string) time.Duration {
+	if f.cfg.CoalesceDelay <= 0 || f.IsLowLatencyTarget(target) {
+		return 0
+	}
+	return f.cfg.CoalesceDelay
+}
+
+// ReadCoalesced 读取数据；若首次读到的是小包，则在 delay 内继续读取并合并，
+// 减少每个小包单独占用一个 WebSocket 帧的开销
+func ReadCoalesced(c net.Conn, buf []byte, delay time.Duration) (int, error) {
+	n, err := c.Read(buf)
+	if err != nil || delay <= 0 || n >= coalesceThreshold {
+		return n, err
+	}
+
+	limit := len(buf)
+	if limit > coalesceThreshold {
+		limit = coalesceThreshold
+	}
+	_ = c.SetReadDeadline(time.Now().Add(delay))
+	for n < limit {
+		m, err := c.Read(buf[n:limit])
+		n += m
+		if err != nil {
+			// 超时或出错都先交付已读数据，错误会在下一次读取时再次返回
+			break
+		}
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	return n, nil
+}
+
+// ReadFirstFrame 在 timeout 内读取客户端首个数据包，随建连请求一起发送以节省一次往返。
+// timeout 为 0 时不等待（适用于 SMTP、MySQL 等服务端先发数据的协议）
+func ReadFirstFrame(c net.Conn, timeout time.Duration) string {
+	if timeout <= 0 {
+		return ""
+	}
+	_ = c.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 32768)
+	n, _ := c.Read(buffer)
+	_ = c.SetReadDeadline(time.Time{})
+	if n <= 0 {
+		return ""
+	}
+	return string(buffer[:n])
+}
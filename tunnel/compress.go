@@ -0,0 +1,98 @@
+package tunnel
+
+import (
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DATA 负载的 zstd 压缩（-zstd），握手时按通道协商：客户端在请求头中声明，服务端同样开启时在响应头中确认。
+// 协商成功的通道上每个 DATA 负载（加密前）以 1 字节标记开头，标记后为原始数据或 zstd 帧；
+// 熵过高（已压缩或加密的数据）、过短或压缩后未变小的负载以原始数据发送
+const (
+	compressHeader = "X-Tunnel-Compress"
+
+	payloadRaw  = 0
+	payloadZstd = 1
+
+	// 短于该长度的负载不压缩
+	zstdMinPayload = 256
+	// 抽样的字节熵（比特/字节）超过该值视为不可压缩
+	zstdMaxEntropy = 7.2
+	// 熵估计的抽样字节数
+	entropySample = 2048
+)
+
+// newZstd 创建编解码器（EncodeAll/DecodeAll 可并发调用，各通道共享；
+// 编码器默认按 GOMAXPROCS 保留内部编码状态，多个通道的发送协程可同时压缩）
+func newZstd(maxFrameSize int) (*zstd.Encoder, *zstd.Decoder, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		return nil, nil, err
+	}
+	// 解压结果不会超过单条消息上限，据此限制异常对端可迫使本端分配的内存
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(uint64(maxFrameSize)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, dec, nil
+}
+
+// negotiateZstd 对端的握手头是否声明了 zstd（本端未开启 zstd 时总为 false）
+func (f *Frames) negotiateZstd(h http.Header) bool {
+	return f.enc != nil && h.Get(compressHeader) == "zstd"
+}
+
+// appendCompressed 在 dst 后追加带标记的负载：可压缩时为 zstd 帧，否则为原始数据
+func (f *Frames) appendCompressed(dst, payload []byte) []byte {
+	start := len(dst)
+	if len(payload) >= zstdMinPayload && !highEntropy(payload) {
+		dst = f.enc.EncodeAll(payload, append(dst, payloadZstd))
+		if len(dst)-start-1 < len(payload) {
+			return dst
+		}
+		dst = dst[:start]
+	}
+	dst = append(dst, payloadRaw)
+	return append(dst, payload...)
+}
+
+// DecompressPayload 解析带标记的负载
+func (f *Frames) DecompressPayload(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("压缩负载缺少标记")
+	}
+	switch data[0] {
+	case payloadRaw:
+		return data[1:], nil
+	case payloadZstd:
+		out, err := f.dec.DecodeAll(data[1:], nil)
+		if err != nil {
+			return nil, errors.New("zstd 解压失败: " + err.Error())
+		}
+		return out, nil
+	default:
+		return nil, errors.New("未知的负载压缩标记")
+	}
+}
+
+// highEntropy 按等间隔抽样估计字节熵，判断数据是否已压缩或加密
+func highEntropy(b []byte) bool {
+	step := max(len(b)/entropySample, 1)
+	var counts [256]int
+	n := 0
+	for i := 0; i < len(b); i += step {
+		counts[b[i]]++
+		n++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy > zstdMaxEntropy
+}
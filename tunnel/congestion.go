@@ -0,0 +1,342 @@
+package tunnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ech-tunnel/protocol"
+)
+
+const (
+	ccInitialWindow = 256 << 10 // 初始拥塞窗口（字节）
+	ccMinWindow     = 64 << 10  // 窗口下限
+	CCSegment       = 32 << 10  // 线性增长阶段每个 RTT 增加的字节数（一个满读缓冲区）
+	// 排队时延低于该值时不收缩窗口，避免低时延链路上的抖动被误判为拥塞
+	ccMinQueueDelay = 5 * time.Millisecond
+	// 窗口已满且流所在通道超过该时间没有收到任何消息（含心跳）时放弃等待（通道已失联），由调用方关闭流
+	CCStallTimeout = 30 * time.Second
+)
+
+// CongestionController 单个流发送方向的拥塞控制（协议版本 4）：
+// 每个 DATA 帧计入在途字节，对端按序交付后以 ACK 确认；在途字节达到窗口时阻塞发送方，
+// 从而暂停读取本地/目标连接，避免单个大流灌满通道写缓冲而饿死同通道的其他流。
+// 窗口按时延调整：RTT 接近最小 RTT 时增长（慢启动后线性增长），RTT 超过最小 RTT 两倍视为排队拥塞并收缩。
+type CongestionController struct {
+	mu         sync.Mutex
+	cwnd       int64
+	ssthresh   int64
+	inFlight   int64
+	srtt       time.Duration
+	minRTT     time.Duration
+	lossEvents int64
+	lastCut    time.Time
+	pacer      *Pacer // 按 cwnd/srtt 估计的带宽平滑发送，首个 RTT 采样前为 nil（不限速）
+	maxWindow  int64
+	losses     *atomic.Int64 // 全部流的窗口收缩计数
+
+	acked  uint64      // 已确认的帧数（下一个待确认的序号）
+	queue  []sentFrame // 在途帧，queue[i] 的序号为 acked+i
+	wake   chan struct{}
+	closed bool
+}
+
+type sentFrame struct {
+	size int64
+	at   time.Time
+	data []byte // 帧数据副本（仅可恢复的流保存，用于会话恢复后重传）
+}
+
+func (f *Frames) NewCongestionController() *CongestionController {
+	return &CongestionController{
+		cwnd:      ccInitialWindow,
+		ssthresh:  f.MaxWindow(),
+		maxWindow: f.MaxWindow(),
+		losses:    &f.metrics.CCLossEvents,
+		wake:      make(chan struct{}),
+	}
+}
+
+// MaxWindow 窗口上限：不超过对端单流乱序缓存上限（StreamBufferMB，两端通常一致）
+func (f *Frames) MaxWindow() int64 {
+	return max(f.streamBuffer(), ccMinWindow)
+}
+
+// Acquire 发送序号为 seq、长度为 n 的帧前调用，窗口已满时阻塞到收到确认；
+// 控制器关闭，或等待期间流所在通道超过 ccStallTimeout 没有收到任何消息（idle 返回通道空闲时长）时返回 false。
+// 接收方被背压（消费慢、乱序缓存满）时同样长时间收不到确认，只要通道仍有数据或心跳到达就继续等待
+func (c *CongestionController) Acquire(seq uint64, n int, idle func() time.Duration) bool {
+	wait := CCStallTimeout
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return false
+		}
+		if c.inFlight == 0 || c.inFlight+int64(n) <= c.cwnd {
+			if seq == c.acked+uint64(len(c.queue)) {
+				c.queue = append(c.queue, sentFrame{size: int64(n), at: time.Now()})
+				c.inFlight += int64(n)
+			}
+			pc := c.pace()
+			c.mu.Unlock()
+			// 窗口内的数据也按估计带宽分散发出，避免整窗突发抬高同通道交互流的时延
+			pc.Wait(n)
+			return true
+		}
+		wake := c.wake
+		c.mu.Unlock()
+
+		select {
+		case <-wake:
+			wait = CCStallTimeout
+		case <-time.After(wait):
+			d := idle()
+			if d >= CCStallTimeout {
+				return false
+			}
+			wait = CCStallTimeout - d
+		}
+	}
+}
+
+// 拥塞控制的发送速率增益：慢启动阶段为估计带宽的 2 倍以免限制窗口增长，此后为 1.25 倍
+const (
+	ccPaceGainStartup = 2.0
+	ccPaceGain        = 1.25
+)
+
+// pace 按当前窗口与平滑 RTT 更新并返回发送节奏（调用方持有 c.mu）；尚无 RTT 采样时返回 nil
+func (c *CongestionController) pace() *Pacer {
+	if c.srtt <= 0 {
+		return nil
+	}
+	gain := ccPaceGain
+	if c.cwnd < c.ssthresh {
+		gain = ccPaceGainStartup
+	}
+	rate := gain * float64(c.cwnd) / c.srtt.Seconds()
+	if c.pacer == nil {
+		c.pacer = newRatePacer(rate)
+	} else {
+		c.pacer.setRate(rate)
+	}
+	return c.pacer
+}
+
+// ActivityClock 通道最近一次收到任何消息（数据、控制帧或心跳）的时间
+type ActivityClock struct {
+	at atomic.Int64
+}
+
+// Touch 记录收到消息
+func (a *ActivityClock) Touch() {
+	a.at.Store(time.Now().UnixNano())
+}
+
+// Idle 距最近一次收到消息的时长
+func (a *ActivityClock) Idle() time.Duration {
+	return time.Since(time.Unix(0, a.at.Load()))
+}
+
+// OnAck 处理对端的确认：f.Seq 为对端已按序交付的帧数，f.SACK 为对端乱序缓存中已收到的
+// 序号区间（[起, 止) 成对排列），f.AckDelay 为对端延迟发送确认的时间（微秒），计算 RTT 时扣除
+func (c *CongestionController) OnAck(f protocol.ControlFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delay := time.Duration(f.AckDelay) * time.Microsecond
+	if f.Seq <= c.acked {
+		// 累计确认未推进（缺口未补齐）：仅用 SACK 中最新收到的帧更新 RTT，
+		// 这些帧仍占用对端缓存，不释放窗口
+		if n := len(f.SACK); n >= 2 && f.SACK[n-1] > c.acked {
+			if i := f.SACK[n-1] - 1 - c.acked; i < uint64(len(c.queue)) {
+				c.sampleRTT(time.Since(c.queue[i].at) - delay)
+			}
+		}
+		return
+	}
+	k := int(min(f.Seq-c.acked, uint64(len(c.queue))))
+	if k == 0 {
+		return
+	}
+	var bytes int64
+	for _, sf := range c.queue[:k] {
+		bytes += sf.size
+	}
+	rtt := time.Since(c.queue[k-1].at) - delay
+	c.queue = c.queue[k:]
+	c.acked = f.Seq
+	c.inFlight -= bytes
+	c.sampleRTT(rtt)
+
+	switch {
+	case rtt > 2*c.minRTT && rtt-c.minRTT > ccMinQueueDelay && time.Since(c.lastCut) > c.srtt:
+		// 排队时延明显增加：乘性减小（每个 RTT 至多一次）
+		c.ssthresh = max(c.cwnd*7/10, ccMinWindow)
+		c.cwnd = c.ssthresh
+		c.lossEvents++
+		c.losses.Add(1)
+		c.lastCut = time.Now()
+	case c.cwnd < c.ssthresh:
+		c.cwnd += bytes
+	default:
+		c.cwnd += max(CCSegment*bytes/c.cwnd, 1)
+	}
+	c.cwnd = min(c.cwnd, c.maxWindow)
+	c.signal()
+}
+
+// sampleRTT 以一次 RTT 采样更新最小 RTT 与平滑 RTT（调用方持有 c.mu）
+func (c *CongestionController) sampleRTT(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	if c.minRTT == 0 || rtt < c.minRTT {
+		c.minRTT = rtt
+	}
+	if c.srtt == 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt = (c.srtt*7 + rtt) / 8
+	}
+}
+
+// Keep 保存已发送帧 seq 的数据副本，直至对端确认（会话恢复后据此重传）
+func (c *CongestionController) Keep(seq uint64, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq >= c.acked && seq-c.acked < uint64(len(c.queue)) {
+		c.queue[seq-c.acked].data = append([]byte(nil), b...)
+	}
+}
+
+// Resume 会话恢复：对端已按序交付 seq 之前的帧，释放这些帧，返回其余在途帧的起始序号与数据以便按序重传。
+// 有帧未保存数据时返回 false（流无法恢复）
+func (c *CongestionController) Resume(seq uint64) (uint64, [][]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq > c.acked {
+		k := int(min(seq-c.acked, uint64(len(c.queue))))
+		for _, sf := range c.queue[:k] {
+			c.inFlight -= sf.size
+		}
+		c.queue = c.queue[k:]
+		c.acked += uint64(k)
+	}
+	frames := make([][]byte, len(c.queue))
+	now := time.Now()
+	for i := range c.queue {
+		if c.queue[i].data == nil && c.queue[i].size > 0 {
+			return 0, nil, false
+		}
+		frames[i] = c.queue[i].data
+		// 重传时间作为新的发送时间，避免断线期间被计入 RTT
+		c.queue[i].at = now
+	}
+	c.signal()
+	return c.acked, frames, true
+}
+
+// ccStats 拥塞控制状态快照
+type ccStats struct {
+	Cwnd, InFlight int64
+	SRTT           time.Duration // 尚未收到确认时为 0
+	LossEvents     int64         // 因排队时延收缩窗口的次数
+}
+
+func (c *CongestionController) Stats() ccStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ccStats{Cwnd: c.cwnd, InFlight: c.inFlight, SRTT: c.srtt, LossEvents: c.lossEvents}
+}
+
+// Close 流结束时唤醒阻塞的发送方
+func (c *CongestionController) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.signal()
+	c.mu.Unlock()
+}
+
+// signal 唤醒所有等待者（调用方持有 c.mu）
+func (c *CongestionController) signal() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+// 未确认的已交付字节达到该值时立即确认（不超过最小窗口的一半，发送方不会因等待确认而停顿）
+const ackBytesThreshold = ccMinWindow / 2
+
+// 每个 ACK 至多携带的 SACK 区间数
+const maxSACKRanges = 4
+
+// AckScheduler 接收方向的累计确认：按序交付的数据先累计，未确认字节达到 ackBytesThreshold
+// 或距首个未确认交付超过 AckInterval 时发送一次 ACK（确认到当前交付位置，附带乱序缓存中的
+// SACK 区间与确认延迟），高包率下显著减少控制帧数量
+type AckScheduler struct {
+	mu      sync.Mutex
+	recv    *ReorderBuffer
+	send    func(protocol.ControlFrame)
+	connID  string
+	pending int64     // 已交付但未确认的字节数
+	last    time.Time // 最近一次交付的时间（用于计算确认延迟）
+	timer   *time.Timer
+	stopped bool
+
+	interval time.Duration
+}
+
+func (f *Frames) NewAckScheduler(connID string, recv *ReorderBuffer, send func(protocol.ControlFrame)) *AckScheduler {
+	return &AckScheduler{connID: connID, recv: recv, send: send, interval: f.cfg.AckInterval}
+}
+
+// Delivered 记录已按序写出 n 字节，按阈值或定时器发送 ACK
+func (a *AckScheduler) Delivered(n int) {
+	a.mu.Lock()
+	a.pending += int64(n)
+	a.last = time.Now()
+	if a.pending < ackBytesThreshold && a.interval > 0 {
+		if a.timer == nil && !a.stopped {
+			a.timer = time.AfterFunc(a.interval, a.flush)
+		}
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+	a.flush()
+}
+
+// flush 立即发送累计确认
+func (a *AckScheduler) flush() {
+	a.mu.Lock()
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	if a.pending == 0 || a.stopped {
+		a.mu.Unlock()
+		return
+	}
+	a.pending = 0
+	delay := time.Since(a.last)
+	a.mu.Unlock()
+
+	a.send(protocol.ControlFrame{
+		Type:     protocol.CtrlAck,
+		ConnID:   a.connID,
+		Seq:      a.recv.Delivered(),
+		SACK:     a.recv.sackRanges(maxSACKRanges),
+		AckDelay: uint64(delay.Microseconds()),
+	})
+}
+
+// Stop 流结束时停止定时确认
+func (a *AckScheduler) Stop() {
+	a.mu.Lock()
+	a.stopped = true
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.mu.Unlock()
+}
@@ -0,0 +1,31 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"ech-tunnel/protocol"
+)
+
+// WriteControl 加锁写入控制帧
+func WriteControl(ws TunnelConn, mu *sync.Mutex, version int, f protocol.ControlFrame) error {
+	mt, b := protocol.EncodeControl(version, f)
+	mu.Lock()
+	defer mu.Unlock()
+	return ws.WriteMessage(mt, b)
+}
+
+// CloseAccounting 对比对端 CLOSE 帧中的统计与本端计数，输出一行对称的流量记录；
+// 对端发出的字节数与本端收到的不一致时提示传输可能被截断
+func CloseAccounting(side, connID string, f protocol.ControlFrame, sent, received int64) {
+	if f.Reason == "" {
+		return
+	}
+	msg := fmt.Sprintf("[%s] 连接 %s 对端关闭（%s）：对端发送 %d / 接收 %d 字节，本端发送 %d / 接收 %d 字节",
+		side, connID, f.Reason, f.Sent, f.Received, sent, received)
+	if uint64(received) != f.Sent {
+		msg += "，数据可能被截断"
+	}
+	log.Print(msg)
+}
@@ -0,0 +1,425 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	utls "github.com/refraction-networking/utls"
+
+	"ech-tunnel/echdns"
+	"ech-tunnel/internal/netutil"
+	"ech-tunnel/protocol"
+)
+
+// DialConfig 客户端建立通道的参数（对应 -token、-sni、-ech-mode 等命令行参数）
+type DialConfig struct {
+	Frames        *Frames        // 帧层（必填）
+	ECH           *echdns.Client // ECH 配置来源（必填）
+	Token         string         // 隧道令牌
+	FrontHost     string         // -f 地址中的主机名：SNI、HostHeader 与 IPs 只作用于该服务端
+	SNI           string         // 内层 SNI，为空时使用地址中的主机名
+	HostHeader    string         // 握手请求的 Host 头，为空时使用地址中的主机名
+	Header        http.Header    // 自定义握手请求头
+	IPs           *FrontingIPs   // 连接服务端的候选 IP，nil 表示解析主机名
+	ECHMode       string         // strict|retry|grease，为空按 strict
+	AllowPlainSNI bool           // grease 模式下 ECH 不可用时允许以明文 SNI 连接
+	Fingerprint   string         // TLS 指纹: go|chrome|firefox|safari，为空按 go
+	ClientCert    string         // mTLS 客户端证书文件
+	ClientKey     string         // mTLS 客户端私钥文件
+	PinSHA256     string         // 服务端证书 SPKI 指纹（Base64，逗号分隔）
+	Mux           string         // 多路复用方式，为空表示不复用
+}
+
+// Dialer 按 DialConfig 建立客户端通道，各连接池共享其 TLS 会话缓存
+type Dialer struct {
+	cfg       DialConfig
+	pins      [][]byte
+	tlsCache  tls.ClientSessionCache
+	utlsCache utls.ClientSessionCache
+	lastNames atomic.Pointer[string] // 上次记录的外层/内层 SNI
+}
+
+// NewDialer 校验参数并创建拨号器
+func NewDialer(cfg DialConfig) (*Dialer, error) {
+	if cfg.Frames == nil || cfg.ECH == nil {
+		return nil, errors.New("DialConfig 缺少 Frames 或 ECH")
+	}
+	if cfg.ECHMode == "" {
+		cfg.ECHMode = "strict"
+	}
+	if cfg.Fingerprint == "" {
+		cfg.Fingerprint = "go"
+	}
+	if _, ok := tlsFingerprints[cfg.Fingerprint]; !ok && cfg.Fingerprint != "go" {
+		return nil, fmt.Errorf("无效的 TLS 指纹: %s（可选 go|chrome|firefox|safari）", cfg.Fingerprint)
+	}
+	d := &Dialer{
+		cfg:       cfg,
+		tlsCache:  tls.NewLRUClientSessionCache(64),
+		utlsCache: utls.NewLRUClientSessionCache(64),
+	}
+	if cfg.PinSHA256 != "" {
+		pins, err := parseSPKIPins(cfg.PinSHA256)
+		if err != nil {
+			return nil, err
+		}
+		d.pins = pins
+	}
+	return d, nil
+}
+
+// Config 返回创建拨号器时的参数
+func (d *Dialer) Config() DialConfig { return d.cfg }
+
+// ServerName 连接 u 时 TLS 使用的服务器名称：SNI 或地址中的主机名
+func (d *Dialer) ServerName(u *url.URL) string {
+	if d.cfg.SNI != "" && d.isFrontHost(u.Hostname()) {
+		return d.cfg.SNI
+	}
+	return u.Hostname()
+}
+
+// isFrontHost host 是否为 FrontHost。IPs、SNI 与 HostHeader 只作用于该服务端，
+// 其他主机名的连接池按各自的地址解析、握手
+func (d *Dialer) isFrontHost(host string) bool {
+	return d.cfg.FrontHost != "" && strings.EqualFold(d.cfg.FrontHost, host)
+}
+
+// TLSConfig 构建带 ECH 的 TLS 配置
+func (d *Dialer) TLSConfig(serverName string, echList []byte) (*tls.Config, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("加载系统根证书失败: %w", err)
+	}
+	tcfg := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		ServerName: serverName,
+		// 重连时使用会话票据恢复，省去完整握手
+		ClientSessionCache: d.tlsCache,
+		// 完全采用 ECH，禁止回退（echList 为 nil 仅用于 grease 模式的降级连接）
+		EncryptedClientHelloConfigList: echList,
+		RootCAs:                        roots,
+	}
+	if d.cfg.ECHMode == "strict" {
+		tcfg.EncryptedClientHelloRejectionVerify = func(cs tls.ConnectionState) error {
+			return errors.New("服务器拒绝 ECH（禁止回退）")
+		}
+	}
+	if d.cfg.ClientCert != "" || d.cfg.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(d.cfg.ClientCert, d.cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("加载客户端证书失败: %w", err)
+		}
+		tcfg.Certificates = []tls.Certificate{cert}
+	}
+	if pins := d.pins; pins != nil {
+		tcfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs.PeerCertificates, pins)
+		}
+	}
+	return tcfg, nil
+}
+
+// parseSPKIPins 解析 SPKI 指纹（Base64 编码的 SPKI SHA-256，逗号分隔）
+func parseSPKIPins(s string) ([][]byte, error) {
+	var pins [][]byte
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimPrefix(strings.TrimSpace(p), "sha256/")
+		if p == "" {
+			continue
+		}
+		pin, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("无效的 SPKI 指纹: %s", p)
+		}
+		pins = append(pins, pin)
+	}
+	if len(pins) == 0 {
+		return nil, errors.New("未指定有效的 SPKI 指纹")
+	}
+	return pins, nil
+}
+
+// verifySPKIPins 校验证书链中至少有一张证书的 SPKI 与固定指纹匹配
+func verifySPKIPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+				return nil
+			}
+		}
+	}
+	return errors.New("服务端证书 SPKI 指纹不匹配（-pin-sha256）")
+}
+
+// RequestHeader 连接主机 host 的客户端握手请求头（自定义头、Host、协议版本、单条消息上限与 zstd 压缩），
+// HostHeader 仅用于 FrontHost
+func (d *Dialer) RequestHeader(host string) http.Header {
+	h := d.cfg.Header.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	if d.cfg.HostHeader != "" && d.isFrontHost(host) {
+		h.Set("Host", d.cfg.HostHeader)
+	}
+	f := d.cfg.Frames
+	h.Set(protocol.VersionHeader, strconv.Itoa(protocol.Version))
+	h.Set(protocol.MaxFrameHeader, strconv.Itoa(f.cfg.MaxFrameSize))
+	if f.enc != nil {
+		h.Set(compressHeader, "zstd")
+	}
+	return h
+}
+
+// Dial 建立通道连接（wss:// 为 WebSocket，grpc:// 为 gRPC 双向流，quic:// 为 QUIC 连接，带 ECH 重试），返回连接、协商的协议版本、
+// 单条消息上限与是否启用 zstd 负载压缩。
+// sessionID 非空时在握手中携带连接池的会话 ID（会话恢复）。
+// ECH 被拒绝时按 ECHMode 处理：strict 仅刷新 DoH 配置重试；retry 额外使用服务端下发的重试配置；
+// grease 在重试用尽后以带 GREASE ECH 扩展的 TLS 连接（SNI 明文可见，需 AllowPlainSNI）
+func (d *Dialer) Dial(serverAddr string, maxRetries int, sessionID string) (TunnelConn, int, int, bool, error) {
+	// 路径模板每个通道取不同的值
+	serverAddr = ExpandPathTemplate(serverAddr)
+	u, err := url.Parse(serverAddr)
+	if err != nil {
+		return nil, 0, 0, false, fmt.Errorf("解析服务地址失败: %v", err)
+	}
+	serverName := d.ServerName(u)
+	header := d.RequestHeader(u.Hostname())
+	if sessionID != "" {
+		header.Set(protocol.SessionHeader, sessionID)
+	}
+	// quic:// 通道的流本身即是 QUIC 流，不再叠加 yamux
+	mux := d.cfg.Mux
+	if u.Scheme == "quic" {
+		mux = ""
+	}
+	if mux != "" {
+		header.Set(protocol.MuxHeader, mux)
+	}
+
+	dial := func(tlsCfg *tls.Config) (TunnelConn, int, int, bool, error) {
+		var conn TunnelConn
+		var resp *http.Response
+		var dialErr error
+		switch u.Scheme {
+		case "grpc":
+			conn, resp, dialErr = d.DialGRPC(serverAddr, tlsCfg, header)
+		case "quic":
+			conn, resp, dialErr = d.DialQUIC(serverAddr, tlsCfg, header)
+		default:
+			conn, resp, dialErr = d.dialWebSocket(serverAddr, tlsCfg, header)
+		}
+		if dialErr != nil {
+			return nil, 0, 0, false, dialErr
+		}
+		return d.cfg.Frames.NegotiateChannel(conn, resp.Header, mux)
+	}
+
+	ech := d.cfg.ECH
+	var lastErr error
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		echBytes, echErr := ech.List()
+		if echErr != nil {
+			log.Printf("[ECH] 获取 ECH 配置失败: %v", echErr)
+			lastErr = fmt.Errorf("ECH 配置不可用: %v", echErr)
+			if attempt < maxRetries {
+				log.Printf("[ECH] 尝试刷新 ECH 配置...")
+				if refreshErr := ech.Refresh(); refreshErr != nil {
+					log.Printf("[ECH] 刷新失败: %v", refreshErr)
+				}
+				continue
+			}
+			break
+		}
+
+		tlsCfg, tlsErr := d.TLSConfig(serverName, echBytes)
+		if tlsErr != nil {
+			return nil, 0, 0, false, fmt.Errorf("构建 TLS(ECH) 配置失败: %v", tlsErr)
+		}
+
+		outerName := echdns.OuterName(echBytes)
+		conn, version, maxFrame, compress, dialErr := dial(tlsCfg)
+		if dialErr == nil {
+			d.logECHNames(outerName, serverName)
+			return conn, version, maxFrame, compress, nil
+		}
+		// 检查是否为 ECH 相关错误
+		if !strings.Contains(dialErr.Error(), "ECH") && !strings.Contains(dialErr.Error(), "ech") {
+			return nil, 0, 0, false, dialErr
+		}
+		lastErr = dialErr
+		log.Printf("[ECH] 连接失败（可能 ECH 公钥已轮换，外层 SNI %s，内层 SNI %s）: %v", outerName, serverName, dialErr)
+		if attempt == maxRetries {
+			break
+		}
+
+		var rejection *tls.ECHRejectionError
+		if d.cfg.ECHMode != "strict" && errors.As(dialErr, &rejection) && len(rejection.RetryConfigList) > 0 {
+			log.Printf("[ECH] %s 模式：服务端下发了新的 ECH 配置（%d 字节，外层 SNI %s），使用该配置重试 (尝试 %d/%d)", d.cfg.ECHMode, len(rejection.RetryConfigList), echdns.PublicNames(rejection.RetryConfigList), attempt, maxRetries)
+			ech.Set(rejection.RetryConfigList, "server-retry:"+serverName)
+			continue
+		}
+		log.Printf("[ECH] 尝试刷新 ECH 配置并重试 (尝试 %d/%d)...", attempt, maxRetries)
+		if refreshErr := ech.Refresh(); refreshErr != nil {
+			log.Printf("[ECH] 刷新失败: %v", refreshErr)
+		}
+		time.Sleep(time.Second)
+	}
+
+	if d.cfg.ECHMode == "grease" && d.cfg.AllowPlainSNI && lastErr != nil {
+		log.Printf("[ECH] ⚠ grease 模式：ECH 不可用（%v），本次以 GREASE ECH 扩展（随机内容，不加密任何字段）连接，服务端域名 %s 将以明文 SNI 暴露", lastErr, serverName)
+		tlsCfg, err := d.TLSConfig(serverName, nil)
+		if err != nil {
+			return nil, 0, 0, false, err
+		}
+		conn, version, maxFrame, compress, err := dial(tlsCfg)
+		if err == nil {
+			log.Printf("[ECH] ⚠ 通道已以 GREASE ECH 建立（明文 SNI %s），ECH 恢复后的重连将重新使用 ECH", serverName)
+		}
+		return conn, version, maxFrame, compress, err
+	}
+	if lastErr != nil {
+		return nil, 0, 0, false, lastErr
+	}
+	return nil, 0, 0, false, fmt.Errorf("WebSocket 连接失败，已达最大重试次数")
+}
+
+// NegotiateChannel 按服务端握手响应头 h 确定通道的协议版本、单条消息上限与是否启用 zstd，
+// 并设置 conn 的读取上限；版本不兼容或服务端未确认请求的多路复用方式 mux 时关闭 conn
+func (f *Frames) NegotiateChannel(conn TunnelConn, h http.Header, mux string) (TunnelConn, int, int, bool, error) {
+	version, err := protocol.NegotiateVersion(h)
+	if err != nil {
+		conn.Close()
+		return nil, 0, 0, false, err
+	}
+	if version < protocol.DataSeqVersion {
+		log.Printf("[客户端] 服务端未声明协议版本，按旧版协议（DATA 帧不含序号）通信")
+	}
+	if mux != "" && h.Get(protocol.MuxHeader) != mux {
+		conn.Close()
+		return nil, 0, 0, false, fmt.Errorf("服务端未接受多路复用（-mux %s）：服务端版本不支持或启用了 -psk", mux)
+	}
+	maxFrame := protocol.NegotiateMaxFrame(h, f.cfg.MaxFrameSize)
+	conn.SetReadLimit(int64(maxFrame))
+	return conn, version, maxFrame, f.negotiateZstd(h), nil
+}
+
+// dialServerTCP 连接服务端：FrontHost 指定了 IPs 时在其候选地址（上次成功的地址优先）间竞速，否则解析主机名后
+// 在全部候选地址间错峰并行建连（Happy Eyeballs），使用最先成功的连接
+func (d *Dialer) dialServerTCP(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		d := net.Dialer{Timeout: 10 * time.Second}
+		return d.DialContext(ctx, network, addr)
+	}
+	if ips := d.cfg.IPs; ips != nil && d.isFrontHost(host) {
+		cands := ips.Candidates(frontIPRaceWidth)
+		addrs := make([]string, len(cands))
+		for i, a := range cands {
+			addrs[i] = net.JoinHostPort(a.String(), port)
+		}
+		conn, err := netutil.RaceDial(ctx, addrs, 250*time.Millisecond, dial)
+		if err != nil {
+			ips.markFailed(cands[0])
+			return nil, err
+		}
+		if ta, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ips.markGood(ta.AddrPort().Addr().Unmap())
+		}
+		return conn, nil
+	}
+	if net.ParseIP(host) != nil {
+		return dial(ctx, address)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range sortAddrFamilies(ips, "auto", nil) {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s 没有可用地址", host)
+	}
+	return netutil.RaceDial(ctx, addrs, 250*time.Millisecond, dial)
+}
+
+// logTLSResumption 记录通道是否复用了 TLS 会话
+func logTLSResumption(cs tls.ConnectionState) {
+	if cs.DidResume {
+		log.Printf("[客户端] TLS 会话已复用，省去完整握手")
+	}
+}
+
+// dialWebSocket 使用给定 TLS 配置建立 WebSocket 连接（必须 wss），header 为握手请求头
+func (d *Dialer) dialWebSocket(serverAddr string, tlsCfg *tls.Config, header http.Header) (TunnelConn, *http.Response, error) {
+	f := d.cfg.Frames
+	// 配置WebSocket Dialer（增加缓冲区大小）
+	dialer := websocket.Dialer{
+		TLSClientConfig: tlsCfg,
+		Subprotocols: func() []string {
+			if d.cfg.Token == "" {
+				return nil
+			}
+			return []string{d.cfg.Token}
+		}(),
+		HandshakeTimeout:  10 * time.Second,
+		ReadBufferSize:    65536,                 // 增加读缓冲区到64KB
+		WriteBufferSize:   f.wsWriteBufferSize(), // 默认 64KB，WireFrameSize 限制帧大小
+		EnableCompression: f.cfg.WSCompress,
+	}
+
+	// 自定义拨号器：IPs 定向或多地址竞速（SNI 仍为 serverName）
+	dialer.NetDialContext = d.dialServerTCP
+	if d.cfg.Fingerprint != "go" || tlsCfg.EncryptedClientHelloConfigList == nil {
+		// 以浏览器指纹完成 TLS 握手；grease 模式的降级连接同样经 uTLS 发送 GREASE ECH 扩展
+		dialer.NetDialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.dialUTLS(ctx, network, addr, tlsCfg)
+		}
+	}
+
+	wsConn, resp, err := dialer.Dial(serverAddr, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch tc := wsConn.UnderlyingConn().(type) {
+	case *tls.Conn:
+		logTLSResumption(tc.ConnectionState())
+	case *utls.UConn:
+		logTLSResumption(stdConnectionState(tc.ConnectionState()))
+	}
+	if err := f.applyWSCompression(wsConn); err != nil {
+		wsConn.Close()
+		return nil, nil, err
+	}
+	return wsConn, resp, nil
+}
+
+// logECHNames 记录通道握手使用的外层与内层 SNI，便于排查中间设备按 SNI 的干扰；与上次相同时不重复输出
+func (d *Dialer) logECHNames(outer, inner string) {
+	pair := outer + "\x00" + inner
+	if old := d.lastNames.Swap(&pair); old != nil && *old == pair {
+		return
+	}
+	log.Printf("[ECH] 通道握手：外层 SNI %s（明文可见），内层 SNI %s（加密）", outer, inner)
+}
@@ -0,0 +1,9 @@
+// Package tunnel 实现隧道两端共用的通道层与完整的服务端：
+//
+//   - 帧层 Frames：端到端加密、zstd 压缩、填充、小包合并与按流的乱序重排、拥塞控制（frames.go 等）
+//   - 客户端拨号器 Dialer：经 ECH、域前置 IP 或 QUIC 建立通道（dialer.go、transport.go、quic.go）
+//   - 服务端 Server：路径路由与令牌策略、目标访问控制与出站、用量统计、访问与审计日志（server.go、websocket_server.go）
+//
+// 各部分分别由 FrameConfig、DialConfig 与 ServerConfig 配置，不读取命令行参数；
+// 客户端连接池与本地代理分别位于 pool、socks5 与 httpproxy 包。
+package tunnel
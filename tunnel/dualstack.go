@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// ParseListenFamily 校验本地监听的地址族（-listen-family 与规则参数 family）
+func ParseListenFamily(s string) (string, error) {
+	switch s {
+	case "auto", "dual", "ipv4", "ipv6":
+		return s, nil
+	}
+	return "", fmt.Errorf("无效的监听地址族: %s（可选 auto|dual|ipv4|ipv6）", s)
+}
+
+// ListenTCPFamily 按地址族监听 TCP 地址 addr：
+// auto 沿用系统默认（[::] 在多数系统上同时接受 IPv4 连接，取决于 bindv6only 等系统设置）；
+// ipv4/ipv6 只监听对应地址族，通配地址换为该族的通配地址，ipv6 下的 [::] 不接受 IPv4 连接；
+// dual 在通配地址或主机名上分别建立 IPv4 与 IPv6 两个套接字，不依赖系统的 v4 映射支持。
+// v4 映射地址（如 [::ffff:127.0.0.1]）视为其 IPv4 地址
+func ListenTCPFamily(addr, family string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, _ := netip.ParseAddr(host)
+	wildcard := host == "" || (ip.IsValid() && ip.Unmap().IsUnspecified())
+	if ip.Is4In6() {
+		host = ip.Unmap().String()
+	}
+
+	switch family {
+	case "ipv4":
+		if wildcard {
+			host = "0.0.0.0"
+		} else if ip.IsValid() && !ip.Unmap().Is4() {
+			return nil, fmt.Errorf("IPv4 监听不能使用 IPv6 地址 %s", ip)
+		}
+		return net.Listen("tcp4", net.JoinHostPort(host, port))
+	case "ipv6":
+		if wildcard {
+			host = "::"
+		} else if ip.IsValid() && ip.Unmap().Is4() {
+			return nil, fmt.Errorf("IPv6 监听不能使用 IPv4 地址 %s", ip)
+		}
+		return net.Listen("tcp6", net.JoinHostPort(host, port))
+	case "dual":
+		return listenDualStack(host, port, wildcard, ip.IsValid())
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, port))
+}
+
+// listenDualStack 在通配地址或主机名解析出的 IPv4、IPv6 地址上各监听一个套接字并合并；
+// 端口为 0 时 IPv6 套接字使用与 IPv4 相同的端口
+func listenDualStack(host, port string, wildcard, literal bool) (net.Listener, error) {
+	host4, host6 := "0.0.0.0", "::"
+	if !wildcard {
+		if literal {
+			return nil, fmt.Errorf("双栈监听需要通配地址或主机名，%s 只属于一个地址族", host)
+		}
+		ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		host4, host6 = "", ""
+		for _, a := range ips {
+			a = a.Unmap()
+			if a.Is4() && host4 == "" {
+				host4 = a.String()
+			} else if a.Is6() && host6 == "" {
+				host6 = a.String()
+			}
+		}
+		if host4 == "" || host6 == "" {
+			return nil, fmt.Errorf("主机名 %s 未同时解析出 IPv4 与 IPv6 地址，无法双栈监听", host)
+		}
+	}
+
+	ln4, err := net.Listen("tcp4", net.JoinHostPort(host4, port))
+	if err != nil {
+		return nil, err
+	}
+	if port == "0" {
+		_, port, _ = net.SplitHostPort(ln4.Addr().String())
+	}
+	ln6, err := net.Listen("tcp6", net.JoinHostPort(host6, port))
+	if err != nil {
+		ln4.Close()
+		return nil, err
+	}
+	return newDualListener(ln4, ln6), nil
+}
+
+// dualListener 合并 IPv4 与 IPv6 两个监听器，Addr 返回 IPv4 监听地址
+type dualListener struct {
+	lns   [2]net.Listener
+	conns chan net.Conn
+	errc  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newDualListener(ln4, ln6 net.Listener) *dualListener {
+	l := &dualListener{
+		lns:   [2]net.Listener{ln4, ln6},
+		conns: make(chan net.Conn),
+		errc:  make(chan error, 2),
+		done:  make(chan struct{}),
+	}
+	for _, ln := range l.lns {
+		go l.serve(ln)
+	}
+	return l
+}
+
+func (l *dualListener) serve(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			l.errc <- err
+			return
+		}
+		select {
+		case l.conns <- c:
+		case <-l.done:
+			c.Close()
+			return
+		}
+	}
+}
+
+// Accept 返回任一地址族上接受的连接；任一监听器出错时关闭两者并返回该错误
+func (l *dualListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case err := <-l.errc:
+		l.Close()
+		return nil, err
+	}
+}
+
+func (l *dualListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		for _, ln := range l.lns {
+			if e := ln.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+func (l *dualListener) Addr() net.Addr {
+	return l.lns[0].Addr()
+}
@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// newPayloadCipher 根据预共享密钥派生端到端加密密钥，psk 为空时返回 nil（不加密）
+func newPayloadCipher(psk string) (cipher.AEAD, error) {
+	if psk == "" {
+		return nil, nil
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(psk), []byte("ech-tunnel"), []byte("payload-v1")), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// StreamAAD 构造 DATA 帧的附加认证数据，绑定 connID 与序号防止帧被拼接或重放到其他位置
+func StreamAAD(connID string, seq uint64) []byte {
+	return strconv.AppendUint([]byte(connID+"|"), seq, 10)
+}
+
+// SealPayload 加密负载并追加到 dst（格式: nonce + 密文），未启用时原样追加
+func (f *Frames) SealPayload(dst, payload, aad []byte) []byte {
+	if f.aead == nil {
+		return append(dst, payload...)
+	}
+	nonceStart := len(dst)
+	dst = append(dst, make([]byte, f.aead.NonceSize())...)
+	nonce := dst[nonceStart:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return f.aead.Seal(dst, nonce, payload, aad)
+}
+
+// OpenPayload 解密负载，未启用时原样返回
+func (f *Frames) OpenPayload(data, aad []byte) ([]byte, error) {
+	if f.aead == nil {
+		return data, nil
+	}
+	ns := f.aead.NonceSize()
+	if len(data) < ns+f.aead.Overhead() {
+		return nil, errors.New("密文长度无效")
+	}
+	plain, err := f.aead.Open(nil, data[:ns], data[ns:], aad)
+	if err != nil {
+		return nil, errors.New("负载解密失败（两端 -psk 不一致？）")
+	}
+	return plain, nil
+}
@@ -0,0 +1,262 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+
+	"ech-tunnel/internal/netutil"
+)
+
+// dialTarget 服务端连接目标地址：域名解析出全部地址后按 RFC 8305（Happy Eyeballs v2）
+// 交错 IPv4/IPv6 依次发起连接，每隔 -happy-eyeballs-delay 或上一次尝试失败时启动下一次，
+// 使用最先成功的连接，避免某一地址族不可达时长时间卡在系统超时上。acl 与 src 为该会话的目标地址限制与出口地址
+func (s *Server) dialTarget(ctx context.Context, target string, acl *targetACL, src *egressAddrs) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if err := acl.check(ip); err != nil {
+			return nil, err
+		}
+		return s.dialEgress(ctx, target, src)
+	}
+	ips, err := s.targetCache.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ordered := sortAddrFamilies(ips, s.cfg.PreferFamily, src)
+	if len(ordered) == 0 {
+		return nil, fmt.Errorf("%s 没有可用的 %s 地址", host, s.cfg.PreferFamily)
+	}
+	// 解析结果需重新经目标地址限制检查，防止域名被解析到内网（DNS 重绑定）
+	if ordered, err = acl.filter(host, ordered); err != nil {
+		return nil, err
+	}
+	ordered = s.targetCache.preferWinner(host, ordered)
+	addrs := make([]string, len(ordered))
+	for i, ip := range ordered {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	conn, err := netutil.RaceDial(ctx, addrs, s.cfg.HappyEyeballsDelay, func(ctx context.Context, addr string) (net.Conn, error) {
+		return s.dialEgress(ctx, addr, src)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ta, ok := conn.RemoteAddr().(*net.TCPAddr); ok && len(ordered) > 1 {
+		s.targetCache.recordWinner(host, ta.IP)
+	}
+	return conn, nil
+}
+
+// sortAddrFamilies 按偏好交错排列 IPv4/IPv6 地址（首选地址族在前）。
+// prefer 为 auto 时以解析结果中第一个地址的地址族为首选；ipv4-only/ipv6-only 仅保留对应地址族；
+// src 为出口地址（可为 nil），配置了出口地址时只保留有对应出口地址的地址族
+func sortAddrFamilies(ips []net.IPAddr, prefer string, src *egressAddrs) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip.IP)
+		} else {
+			v6 = append(v6, ip.IP)
+		}
+	}
+	if src.configured() {
+		if src.v4 == nil {
+			v4 = nil
+		}
+		if src.v6 == nil {
+			v6 = nil
+		}
+	}
+	switch prefer {
+	case "ipv4-only":
+		return v4
+	case "ipv6-only":
+		return v6
+	}
+	primary, secondary := v6, v4
+	if prefer == "ipv4" || (prefer == "auto" && len(ips) > 0 && ips[0].IP.To4() != nil) {
+		primary, secondary = v4, v6
+	}
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			out = append(out, primary[i])
+		}
+		if i < len(secondary) {
+			out = append(out, secondary[i])
+		}
+	}
+	return out
+}
+
+// egressAddrs 出站连接绑定的源地址，每个地址族至多一个（未配置的地址族为 nil）
+type egressAddrs struct {
+	v4, v6 net.IP
+}
+
+// newEgressAddrs 按地址族选取各自的第一个地址
+func newEgressAddrs(ips []net.IP) *egressAddrs {
+	e := &egressAddrs{}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if e.v4 == nil {
+				e.v4 = ip
+			}
+		} else if e.v6 == nil {
+			e.v6 = ip
+		}
+	}
+	return e
+}
+
+// parseEgressIPs 解析逗号分隔的出口地址列表（一个 IPv4 与一个 IPv6）
+func parseEgressIPs(s string) (*egressAddrs, error) {
+	var ips []net.IP
+	for _, item := range strings.Split(s, ",") {
+		ip := net.ParseIP(strings.TrimSpace(item))
+		if ip == nil {
+			return nil, fmt.Errorf("无效的出口地址: %s", item)
+		}
+		ips = append(ips, ip)
+	}
+	return newEgressAddrs(ips), nil
+}
+
+func (e *egressAddrs) configured() bool {
+	return e != nil && (e.v4 != nil || e.v6 != nil)
+}
+
+// newEgress 按参数确定服务端默认的出站源地址：egressIP 可为一个 IPv4 与一个 IPv6 地址（逗号分隔）；
+// 未指定 egressIP 时取接口 egressInterface 的首个全局单播地址，Linux 上同时绑定到该接口
+func newEgress(egressIP, egressInterface string, egressMark uint) (*egressAddrs, error) {
+	if egressMark != 0 && runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("防火墙标记仅支持 Linux")
+	}
+	egressIPs := &egressAddrs{}
+	if egressIP != "" {
+		src, err := parseEgressIPs(egressIP)
+		if err != nil {
+			return nil, err
+		}
+		egressIPs = src
+	} else if egressInterface != "" {
+		ifi, err := net.InterfaceByName(egressInterface)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		var ips []net.IP
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("接口 %s 没有全局单播地址", egressInterface)
+		}
+		egressIPs = newEgressAddrs(ips)
+	}
+	if egressMark != 0 {
+		log.Printf("出站套接字防火墙标记: 0x%x", egressMark)
+	}
+	if egressIPs.configured() {
+		log.Printf("出站源地址: IPv4 %v，IPv6 %v（接口: %s）", egressIPs.v4, egressIPs.v6, orNone(egressInterface))
+	}
+	return egressIPs, nil
+}
+
+// addrFor 返回连接 remote 时应绑定的源地址；配置了出口地址但缺少该地址族时返回错误
+func (e *egressAddrs) addrFor(remote net.IP) (net.IP, error) {
+	if !e.configured() {
+		return nil, nil
+	}
+	if remote.To4() != nil {
+		if e.v4 == nil {
+			return nil, fmt.Errorf("未配置 IPv4 出口地址，无法连接 %s", remote)
+		}
+		return e.v4, nil
+	}
+	if e.v6 == nil {
+		return nil, fmt.Errorf("未配置 IPv6 出口地址，无法连接 %s", remote)
+	}
+	return e.v6, nil
+}
+
+// dialEgress 从出口地址 src（为 nil 时不绑定）与配置的接口连接 addr（IP:port）
+func (s *Server) dialEgress(ctx context.Context, addr string, src *egressAddrs) (net.Conn, error) {
+	d := net.Dialer{Control: s.egressSock.control}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if err := s.targetIPs.check(ip); err != nil {
+		return nil, err
+	}
+	local, err := src.addrFor(ip)
+	if err != nil {
+		return nil, err
+	}
+	if local != nil {
+		d.LocalAddr = &net.TCPAddr{IP: local}
+	}
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.cfg.SockOpts.Tune(c)
+	return c, nil
+}
+
+// listenEgressUDP 创建用于连接 remote 的 UDP 套接字（绑定出口地址 src 与接口）
+func (s *Server) listenEgressUDP(ctx context.Context, remote net.IP, src *egressAddrs) (*net.UDPConn, error) {
+	local, err := src.addrFor(remote)
+	if err != nil {
+		return nil, err
+	}
+	laddr := ""
+	if local != nil {
+		laddr = net.JoinHostPort(local.String(), "0")
+	}
+	lc := net.ListenConfig{Control: s.egressSock.control}
+	pc, err := lc.ListenPacket(ctx, "udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// checkRelayTarget 中继前按目标地址限制（-deny-private、-deny-cidr 与令牌的 cidr）检查 target。
+// 域名由下一跳自行解析，本机无法决定其连接的地址，因此要求本机解析到的全部地址均被允许
+func (s *Server) checkRelayTarget(ctx context.Context, target string, acl *targetACL) error {
+	if acl.unrestricted() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return acl.check(ip)
+	}
+	ips, err := s.targetCache.lookup(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := acl.check(ip.IP); err != nil {
+			return fmt.Errorf("%s 解析到被禁止的地址: %w", host, err)
+		}
+	}
+	return nil
+}
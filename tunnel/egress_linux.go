@@ -0,0 +1,37 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// egressSocket 服务端出站套接字绑定的接口（-egress-interface）与防火墙标记（-egress-mark）
+type egressSocket struct {
+	iface string
+	mark  uint
+}
+
+// control 为服务端出站套接字设置 SO_BINDTODEVICE 与 SO_MARK
+func (e egressSocket) control(network, address string, c syscall.RawConn) error {
+	if e.iface == "" && e.mark == 0 {
+		return nil
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if e.iface != "" {
+			if sockErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, e.iface); sockErr != nil {
+				return
+			}
+		}
+		if e.mark != 0 {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(e.mark))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package tunnel
+
+import "syscall"
+
+// egressSocket 服务端出站套接字绑定的接口与防火墙标记
+type egressSocket struct {
+	iface string
+	mark  uint
+}
+
+// control 非 Linux 平台仅通过绑定接口地址选择出口（见 newEgress），不支持防火墙标记
+func (e egressSocket) control(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,121 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// tlsFingerprints -tls-fingerprint 可选的浏览器 ClientHello 模板（go 表示使用标准库 crypto/tls）
+var tlsFingerprints = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"safari":  utls.HelloSafari_Auto,
+}
+
+// fingerprintSpec 按 TLS 指纹 name 生成本次握手的 ClientHello 模板：ALPN 只保留 http/1.1
+// （浏览器模板同时提供 h2，服务端或 CDN 选择 h2 时 WebSocket 升级无法进行）；
+// 模板中没有 ECH 扩展时（如 Safari）补上一个 GREASE ECH 扩展：有 ECH 配置时由 uTLS 替换为真实的 ECH，
+// 没有配置时（-ech-mode=grease 的降级连接）原样发送随机内容。
+// 标准库无法发送 GREASE ECH 扩展，go 指纹的降级连接使用 Chrome 模板
+func fingerprintSpec(name string) (*utls.ClientHelloSpec, error) {
+	id, ok := tlsFingerprints[name]
+	if !ok {
+		id = utls.HelloChrome_Auto
+	}
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	hasECH := false
+	for _, ext := range spec.Extensions {
+		switch e := ext.(type) {
+		case *utls.ALPNExtension:
+			e.AlpnProtocols = []string{"http/1.1"}
+		case utls.EncryptedClientHelloExtension:
+			hasECH = true
+		}
+	}
+	if !hasECH {
+		// 填充与 PSK 扩展须位于末尾
+		i := len(spec.Extensions)
+		for i > 0 {
+			switch spec.Extensions[i-1].(type) {
+			case *utls.UtlsPaddingExtension, utls.PreSharedKeyExtension:
+				i--
+				continue
+			}
+			break
+		}
+		spec.Extensions = append(spec.Extensions[:i], append([]utls.TLSExtension{utls.BoringGREASEECH()}, spec.Extensions[i:]...)...)
+	}
+	return &spec, nil
+}
+
+// dialUTLS 连接服务端并以 Fingerprint 指定的浏览器指纹完成 TLS(ECH) 握手，其余设置沿用 cfg
+func (d *Dialer) dialUTLS(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	spec, err := fingerprintSpec(d.cfg.Fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("生成 TLS 指纹失败: %w", err)
+	}
+	conn, err := d.dialServerTCP(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	uconn := utls.UClient(conn, utlsConfig(cfg, d.utlsCache), utls.HelloCustom)
+	if err := uconn.ApplyPreset(spec); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("应用 TLS 指纹失败: %w", err)
+	}
+	if err := uconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		// 转换为标准库的错误类型，沿用 ECH 被拒绝时的重试逻辑
+		var rejection *utls.ECHRejectionError
+		if errors.As(err, &rejection) {
+			return nil, &tls.ECHRejectionError{RetryConfigList: rejection.RetryConfigList}
+		}
+		return nil, err
+	}
+	return uconn, nil
+}
+
+// utlsConfig 将标准库 TLS 配置转换为 uTLS 配置（仅客户端用到的字段），会话票据缓存使用 cache
+func utlsConfig(cfg *tls.Config, cache utls.ClientSessionCache) *utls.Config {
+	u := &utls.Config{
+		ServerName:                     cfg.ServerName,
+		RootCAs:                        cfg.RootCAs,
+		MinVersion:                     cfg.MinVersion,
+		NextProtos:                     []string{"http/1.1"},
+		ClientSessionCache:             cache,
+		EncryptedClientHelloConfigList: cfg.EncryptedClientHelloConfigList,
+	}
+	for _, c := range cfg.Certificates {
+		u.Certificates = append(u.Certificates, utls.Certificate{Certificate: c.Certificate, PrivateKey: c.PrivateKey, Leaf: c.Leaf})
+	}
+	if verify := cfg.VerifyConnection; verify != nil {
+		u.VerifyConnection = func(cs utls.ConnectionState) error { return verify(stdConnectionState(cs)) }
+	}
+	if verify := cfg.EncryptedClientHelloRejectionVerify; verify != nil {
+		u.EncryptedClientHelloRejectionVerify = func(cs utls.ConnectionState) error { return verify(stdConnectionState(cs)) }
+	}
+	return u
+}
+
+// stdConnectionState 将 uTLS 连接状态转换为标准库类型（校验回调与日志用到的字段）
+func stdConnectionState(cs utls.ConnectionState) tls.ConnectionState {
+	return tls.ConnectionState{
+		Version:            cs.Version,
+		HandshakeComplete:  cs.HandshakeComplete,
+		DidResume:          cs.DidResume,
+		CipherSuite:        cs.CipherSuite,
+		NegotiatedProtocol: cs.NegotiatedProtocol,
+		ServerName:         cs.ServerName,
+		PeerCertificates:   cs.PeerCertificates,
+		VerifiedChains:     cs.VerifiedChains,
+		ECHAccepted:        cs.ECHAccepted,
+	}
+}
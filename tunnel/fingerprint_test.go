@@ -0,0 +1,46 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// TestGREASEClientHello 检查 -ech-mode=grease 的降级连接（无 ECH 配置）确实携带 GREASE ECH 扩展与明文 SNI
+func TestGREASEClientHello(t *testing.T) {
+	for _, fp := range []string{"go", "chrome", "firefox", "safari"} {
+		spec, err := fingerprintSpec(fp)
+		if err != nil {
+			t.Fatalf("%s: fingerprintSpec: %v", fp, err)
+		}
+
+		c, s := net.Pipe()
+		s.Close()
+		cfg := &tls.Config{ServerName: "tunnel.example.com", MinVersion: tls.VersionTLS13}
+		uconn := utls.UClient(c, utlsConfig(cfg, nil), utls.HelloCustom)
+		if err := uconn.ApplyPreset(spec); err != nil {
+			t.Fatalf("%s: ApplyPreset: %v", fp, err)
+		}
+		if err := uconn.BuildHandshakeState(); err != nil {
+			t.Fatalf("%s: BuildHandshakeState: %v", fp, err)
+		}
+		c.Close()
+
+		grease := false
+		for _, ext := range uconn.Extensions {
+			if _, ok := ext.(*utls.GREASEEncryptedClientHelloExtension); ok {
+				grease = true
+			}
+		}
+		raw := uconn.HandshakeState.Hello.Raw
+		if !grease || !bytes.Contains(raw, []byte{0xfe, 0x0d}) {
+			t.Errorf("%s: ClientHello 不含 GREASE ECH 扩展", fp)
+		}
+		if !bytes.Contains(raw, []byte("tunnel.example.com")) {
+			t.Errorf("%s: ClientHello 不含明文 SNI", fp)
+		}
+	}
+}
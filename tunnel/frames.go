@@ -0,0 +1,128 @@
+package tunnel
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+
+	"ech-tunnel/protocol"
+)
+
+// FrameConfig 通道帧层参数（对应 -psk、-zstd、-stream-buffer 等命令行参数），客户端连接池与服务端共用
+type FrameConfig struct {
+	PSK             string        // 端到端负载加密的预共享密钥，为空不加密
+	Zstd            bool          // 协商 DATA 负载的 zstd 压缩
+	MaxFrameSize    int           // 通道单条消息上限（握手时与对端协商取较小值）
+	WireFrameSize   int           // 本端发送的 WebSocket 帧大小上限，0 表示不限制
+	StreamBufferMB  int           // 单个流的乱序缓存上限（MB），同时决定发送窗口上限
+	MemBudgetMB     int           // 全部流乱序缓存的内存预算（MB），0 表示不限制
+	AckInterval     time.Duration // 累计确认的最长延迟，0 表示每次交付立即确认
+	PingInterval    time.Duration // 通道心跳间隔
+	PongTimeout     time.Duration // 超过该时间未收到对端任何消息即判定通道失联，0 表示不检测
+	Padding         bool          // 流量填充与空闲伪帧
+	PadBudget       int           // 填充流量占真实流量的最大百分比
+	PadIdleInterval time.Duration // 空闲通道发送伪帧的平均间隔，0 表示不发送
+	CoalesceDelay   time.Duration // 小包合并等待时间，0 表示不合并
+	NoDelayPorts    string        // 延迟敏感的目标端口（逗号分隔），不合并小包且默认为交互式优先级
+	WSCompress      bool          // 协商 WebSocket permessage-deflate 压缩
+	WSCompressLevel int           // WebSocket 压缩级别
+	Metrics         *Metrics      // 计数器，为 nil 时由 NewFrames 创建
+}
+
+// Metrics 流与字节计数器：客户端与服务端共用同一组名称，各自只累计本端的流与字节
+type Metrics struct {
+	StreamsOpened atomic.Int64 // TCP 流与 UDP 关联
+	StreamsClosed atomic.Int64
+	BytesUp       atomic.Int64 // 客户端 -> 目标
+	BytesDown     atomic.Int64 // 目标 -> 客户端
+	Reconnects    atomic.Int64 // 客户端通道断线后重连成功
+	CCLossEvents  atomic.Int64 // 拥塞控制因排队时延收缩窗口（两个方向的全部流）
+}
+
+// Frames 按 FrameConfig 初始化的帧层：端到端加密、zstd 编解码与缓冲内存预算，由同一端的全部通道共享
+type Frames struct {
+	cfg     FrameConfig
+	aead    cipher.AEAD // 端到端负载加密，nil 表示未启用
+	enc     *zstd.Encoder
+	dec     *zstd.Decoder
+	budget  *memBudget // 未设置内存预算时为 nil（不限制）
+	metrics *Metrics
+}
+
+// NewFrames 校验参数并创建帧层
+func NewFrames(cfg FrameConfig) (*Frames, error) {
+	if cfg.MaxFrameSize < protocol.MinMaxFrameSize {
+		return nil, fmt.Errorf("单条消息上限不能小于 %d", protocol.MinMaxFrameSize)
+	}
+	if cfg.WireFrameSize != 0 && cfg.WireFrameSize < MinWireFrameSize {
+		return nil, fmt.Errorf("WebSocket 帧大小上限不能小于 %d", MinWireFrameSize)
+	}
+	if cfg.StreamBufferMB <= 0 {
+		return nil, errors.New("单流乱序缓存上限必须大于 0")
+	}
+	f := &Frames{cfg: cfg, metrics: cfg.Metrics}
+	if f.metrics == nil {
+		f.metrics = &Metrics{}
+	}
+	var err error
+	if f.aead, err = newPayloadCipher(cfg.PSK); err != nil {
+		return nil, fmt.Errorf("初始化端到端加密失败: %w", err)
+	}
+	if cfg.Zstd {
+		if f.enc, f.dec, err = newZstd(cfg.MaxFrameSize); err != nil {
+			return nil, fmt.Errorf("初始化 zstd 压缩失败: %w", err)
+		}
+	}
+	if cfg.MemBudgetMB > 0 {
+		f.budget = newMemBudget(int64(cfg.MemBudgetMB) << 20)
+		log.Printf("缓冲内存预算: %d MB，单流乱序缓存上限: %d MB", cfg.MemBudgetMB, cfg.StreamBufferMB)
+	}
+	return f, nil
+}
+
+// Config 返回创建帧层时的参数
+func (f *Frames) Config() FrameConfig { return f.cfg }
+
+// Metrics 返回帧层累计的计数器
+func (f *Frames) Metrics() *Metrics { return f.metrics }
+
+// streamBuffer 单个流的乱序缓存上限（字节）
+func (f *Frames) streamBuffer() int64 { return int64(f.cfg.StreamBufferMB) << 20 }
+
+// ExtendReadDeadline 收到数据或心跳后延长读超时，超时未收到任何消息则判定对端失联
+func (f *Frames) ExtendReadDeadline(c TunnelConn) {
+	if f.cfg.PongTimeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(f.cfg.PongTimeout))
+	}
+}
+
+// IsLowLatencyTarget 目标端口是否在 NoDelayPorts 中（交互式协议，如 SSH、RDP）
+func (f *Frames) IsLowLatencyTarget(target string) bool {
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	for _, p := range strings.Split(f.cfg.NoDelayPorts, ",") {
+		if strings.TrimSpace(p) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// applyWSCompression 按参数设置已协商连接的压缩级别
+// 未协商 permessage-deflate 时写压缩不会生效，设置无副作用
+func (f *Frames) applyWSCompression(c *websocket.Conn) error {
+	if !f.cfg.WSCompress {
+		return nil
+	}
+	return c.SetCompressionLevel(f.cfg.WSCompressLevel)
+}
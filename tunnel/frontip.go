@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	frontIPRaceWidth  = 4 // 每次建连并行竞速的候选 IP 数量上限
+	frontIPProbeWidth = 8 // 每轮探测的候选 IP 数量
+)
+
+// FrontingIPs 客户端连接服务端时使用的候选 IP（-ip，逗号分隔的地址或 CIDR），
+// 记住最近一次连接成功的地址并在下次建连时优先使用
+type FrontingIPs struct {
+	mu        sync.Mutex
+	fixed     []netip.Addr
+	prefixes  []netip.Prefix
+	preferred netip.Addr
+}
+
+// ParseFrontingIPs 解析逗号分隔的候选地址与 CIDR 网段
+func ParseFrontingIPs(spec string) (*FrontingIPs, error) {
+	f := &FrontingIPs{}
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.Trim(strings.TrimSpace(s), "[]")
+		if s == "" {
+			continue
+		}
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("无效的 -ip 网段: %s", s)
+			}
+			f.prefixes = append(f.prefixes, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 -ip 地址: %s", s)
+		}
+		f.fixed = append(f.fixed, a.Unmap())
+	}
+	if len(f.fixed) == 0 && len(f.prefixes) == 0 {
+		return nil, fmt.Errorf("-ip 未包含任何地址")
+	}
+	return f, nil
+}
+
+// Candidates 返回本次建连的候选地址：优选地址在前，其余单个地址随机排列，
+// 不足 n 个时从网段中随机抽取补足
+func (f *FrontingIPs) Candidates(n int) []netip.Addr {
+	f.mu.Lock()
+	current := f.preferred
+	f.mu.Unlock()
+	return f.candidatesFrom(current, n)
+}
+
+// candidatesFrom 同 candidates，以 first 代替优选地址排在首位
+func (f *FrontingIPs) candidatesFrom(first netip.Addr, n int) []netip.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]netip.Addr, 0, n)
+	seen := make(map[netip.Addr]bool)
+	add := func(a netip.Addr) {
+		if len(out) < n && a.IsValid() && !seen[a] {
+			seen[a] = true
+			out = append(out, a)
+		}
+	}
+	add(first)
+	for _, i := range rand.Perm(len(f.fixed)) {
+		add(f.fixed[i])
+	}
+	for tries := 0; len(out) < n && len(f.prefixes) > 0 && tries < 4*n; tries++ {
+		add(randomAddrIn(f.prefixes[rand.Intn(len(f.prefixes))]))
+	}
+	return out
+}
+
+// markGood 记录连接成功的地址，作为下次建连的优选地址
+func (f *FrontingIPs) markGood(a netip.Addr) {
+	f.mu.Lock()
+	changed := f.preferred != a
+	f.preferred = a
+	f.mu.Unlock()
+	if changed {
+		log.Printf("[客户端] 优选服务端 IP: %s", a)
+	}
+}
+
+// markFailed 优选地址连接失败时清除，下次重新竞速
+func (f *FrontingIPs) markFailed(a netip.Addr) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.preferred == a {
+		f.preferred = netip.Addr{}
+	}
+}
+
+// randomAddrIn 在网段内随机选取一个地址（主机位随机）
+func randomAddrIn(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := range b {
+		bit := i * 8
+		if bit+8 <= p.Bits() {
+			continue
+		}
+		mask := byte(0xFF)
+		if bit < p.Bits() {
+			mask = 0xFF >> (p.Bits() - bit)
+		}
+		b[i] = b[i]&^mask | byte(rand.Intn(256))&mask
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// StartIPProber 每隔 interval 在后台测量 IPs 中候选地址连接 serverAddr 的 TCP 连接 + TLS 握手耗时，
+// 当前优选地址探测失败或明显慢于最快候选时切换优选地址（仅影响之后新建的通道）
+func (d *Dialer) StartIPProber(serverAddr string, interval time.Duration) {
+	ips := d.cfg.IPs
+	if interval <= 0 || ips == nil {
+		return
+	}
+	u, err := url.Parse(serverAddr)
+	if err != nil {
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	log.Printf("[探测] 每 %s 测量候选 IP 握手耗时", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			d.probe(ips, d.ServerName(u), port)
+			<-ticker.C
+		}
+	}()
+}
+
+// probe 并行探测一轮 f 中的候选地址
+func (d *Dialer) probe(f *FrontingIPs, host, port string) {
+	// 探测同样使用 ECH，避免以明文 SNI 暴露服务端域名
+	echBytes, err := d.cfg.ECH.List()
+	if err != nil {
+		return
+	}
+	tlsCfg, err := d.TLSConfig(host, echBytes)
+	if err != nil {
+		return
+	}
+	tlsCfg.ClientSessionCache = nil
+
+	type result struct {
+		addr netip.Addr
+		rtt  time.Duration
+		err  error
+	}
+	// 先读取当前优选地址再构建候选，保证其参与本轮探测
+	f.mu.Lock()
+	current := f.preferred
+	f.mu.Unlock()
+	cands := f.candidatesFrom(current, frontIPProbeWidth)
+	results := make(chan result, len(cands))
+	for _, a := range cands {
+		go func(a netip.Addr) {
+			rtt, err := probeFrontIP(a, port, tlsCfg)
+			results <- result{a, rtt, err}
+		}(a)
+	}
+
+	var best, cur *result
+	for range cands {
+		r := <-results
+		if r.addr == current {
+			cur = &r
+		}
+		if r.err == nil && (best == nil || r.rtt < best.rtt) {
+			best = &r
+		}
+	}
+	if best == nil {
+		log.Printf("[探测] %d 个候选 IP 均握手失败", len(cands))
+		return
+	}
+	switch {
+	case best.addr == current:
+		return
+	case !current.IsValid() || cur == nil:
+		log.Printf("[探测] 选用握手最快的 %s（%s）", best.addr, best.rtt.Round(time.Millisecond))
+	case cur.err != nil:
+		log.Printf("[探测] 当前优选 %s 握手失败: %v，切换到 %s（%s）", current, cur.err, best.addr, best.rtt.Round(time.Millisecond))
+	case best.rtt < cur.rtt*7/10:
+		log.Printf("[探测] 当前优选 %s 握手 %s，切换到更快的 %s（%s）", current, cur.rtt.Round(time.Millisecond), best.addr, best.rtt.Round(time.Millisecond))
+	default:
+		return
+	}
+	f.mu.Lock()
+	// 探测期间优选地址已被建连结果更新时不覆盖
+	if f.preferred == current {
+		f.preferred = best.addr
+	}
+	f.mu.Unlock()
+}
+
+// probeFrontIP 测量连接 addr 的 TCP + TLS 握手总耗时
+func probeFrontIP(addr netip.Addr, port string, tlsCfg *tls.Config) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	d := tls.Dialer{Config: tlsCfg}
+	c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	c.Close()
+	return rtt, nil
+}
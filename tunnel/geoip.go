@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPFilter 基于 MaxMind 数据库的国家/地区访问控制
+type geoIPFilter struct {
+	db    *maxminddb.Reader
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// geoRecord GeoLite2/GeoIP2 Country 与 City 数据库中所需的字段
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// newGeoIPFilter 按参数（-geoip-db、-geoip-allow、-geoip-deny）加载 GeoIP 数据库，
+// 未配置允许或拒绝的国家/地区时返回 nil
+func newGeoIPFilter(geoIPDB, geoIPAllow, geoIPDeny string) (*geoIPFilter, error) {
+	if geoIPAllow == "" && geoIPDeny == "" {
+		return nil, nil
+	}
+	if geoIPDB == "" {
+		return nil, fmt.Errorf("使用 -geoip-allow/-geoip-deny 时必须通过 -geoip-db 指定 MaxMind 数据库")
+	}
+	db, err := maxminddb.Open(geoIPDB)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("已加载 GeoIP 数据库 %s（%s），允许: %s，拒绝: %s", geoIPDB, db.Metadata.DatabaseType, orNone(geoIPAllow), orNone(geoIPDeny))
+	return &geoIPFilter{db: db, allow: parseCountryList(geoIPAllow), deny: parseCountryList(geoIPDeny)}, nil
+}
+
+// parseCountryList 解析逗号分隔的国家/地区代码（ISO 3166-1，不区分大小写）
+func parseCountryList(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			m[c] = true
+		}
+	}
+	return m
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "无"
+	}
+	return s
+}
+
+// country 查询 IP 所属国家/地区代码，查不到时返回空字符串
+func (g *geoIPFilter) country(ip net.IP) string {
+	var rec geoRecord
+	if err := g.db.Lookup(ip, &rec); err != nil {
+		log.Printf("[GeoIP] 查询 %s 失败: %v", ip, err)
+		return ""
+	}
+	if rec.Country.ISOCode != "" {
+		return rec.Country.ISOCode
+	}
+	return rec.RegisteredCountry.ISOCode
+}
+
+// allowIP 判断来源 IP 是否允许建立隧道会话，并返回其国家/地区代码。
+// 命中拒绝列表则拒绝；配置了允许列表时，仅放行列表内的国家/地区（查不到归属的 IP 同样拒绝）
+func (g *geoIPFilter) allowIP(ip net.IP) (string, bool) {
+	if g == nil {
+		return "", true
+	}
+	c := g.country(ip)
+	if g.deny[c] {
+		return c, false
+	}
+	if len(g.allow) > 0 && !g.allow[c] {
+		return c, false
+	}
+	return c, true
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// 内存预算耗尽时通道读取最长暂停时间，超过则放弃缓存该帧（对应的流被关闭）
+const memBudgetWait = 5 * time.Second
+
+// memBudget 进程级缓冲内存预算（-mem-budget），目前计入各流的乱序重排缓存。
+// 预算耗尽时申请方阻塞（暂停读取通道，由 TCP 流控向对端施加背压），直到其他流交付数据释放额度
+type memBudget struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	used   int64
+	limit  int64
+	paused bool
+}
+
+func newMemBudget(limit int64) *memBudget {
+	b := &memBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire 申请 n 字节额度，预算不足时最多等待 wait，超时返回 false
+func (b *memBudget) acquire(n int64, wait time.Duration) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit && b.used > 0 {
+		if !b.paused {
+			b.paused = true
+			log.Printf("[内存] 缓冲已用 %d KB，达到预算 %d MB，暂停读取通道", b.used>>10, b.limit>>20)
+		}
+		// sync.Cond 不支持超时，到期时广播唤醒以重新检查
+		deadline := time.Now().Add(wait)
+		timer := time.AfterFunc(wait, b.cond.Broadcast)
+		defer timer.Stop()
+		for b.used+n > b.limit && b.used > 0 {
+			if !time.Now().Before(deadline) {
+				return false
+			}
+			b.cond.Wait()
+		}
+	}
+	b.used += n
+	return true
+}
+
+// release 归还 n 字节额度并唤醒等待者
+func (b *memBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	if b.paused && b.used*4 < b.limit*3 {
+		b.paused = false
+		log.Printf("[内存] 缓冲降至 %d KB，恢复读取", b.used>>10)
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
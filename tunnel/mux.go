@@ -0,0 +1,284 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+
+	"ech-tunnel/internal/netutil"
+	"ech-tunnel/protocol"
+)
+
+// 多路复用模式（-mux yamux 或 quic:// 通道）：客户端在握手头中声明，服务端确认后通道上运行 yamux 会话，每个 TCP 流是一条
+// yamux 流，由 yamux 提供逐流的流量控制（接收窗口为 -stream-buffer）、背压与会话心跳（-ping-interval），
+// 取代 DATA/控制帧与按 connID 的分发；quic:// 通道的每个 TCP 流则直接是一条 QUIC 流（见 quic.go）。
+// 流在打开时绑定所在通道，CLAIM 竞选、填充、zstd、会话恢复、端到端加密（-psk）与 UDP 在该模式下均不可用；
+// 流的建连格式见 protocol/mux.go
+const (
+	// 服务端等待客户端在新流上写入建连请求的最长时间
+	muxRequestTimeout = 10 * time.Second
+	// 本端已关闭写方向的流等待对端关闭的最长时间，超时后强制关闭
+	muxStreamCloseTimeout = time.Minute
+)
+
+// MuxSession 多路复用会话：yamux 会话或 QUIC 连接
+type MuxSession interface {
+	OpenStream() (MuxStream, error)
+	AcceptStream() (MuxStream, error)
+	// Ping 测量一次往返时延
+	Ping() (time.Duration, error)
+	CloseChan() <-chan struct{}
+	IsClosed() bool
+	Close() error
+}
+
+// MuxStream 会话上的一条流：Close 只关闭写方向（向对端发送 FIN），此后仍可读取直至对端 FIN；
+// CloseRead 放弃读方向，丢弃尚未读取的数据并使阻塞的 Read 返回
+type MuxStream interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	CloseRead()
+}
+
+// CloseMuxStream 关闭流的两个方向
+func CloseMuxStream(s MuxStream) {
+	_ = s.Close()
+	s.CloseRead()
+}
+
+// yamuxSession 以 yamux 会话实现 muxSession
+type yamuxSession struct {
+	*yamux.Session
+}
+
+func (s yamuxSession) OpenStream() (MuxStream, error) {
+	st, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return yamuxStream{st}, nil
+}
+
+func (s yamuxSession) AcceptStream() (MuxStream, error) {
+	st, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return yamuxStream{st}, nil
+}
+
+type yamuxStream struct {
+	*yamux.Stream
+}
+
+// CloseRead yamux 没有单独关闭读方向的帧：对端未关闭时由 StreamCloseTimeout 强制关闭
+func (s yamuxStream) CloseRead() {}
+
+// negotiateMux 客户端的握手头是否请求多路复用；服务端启用了端到端加密时不接受，客户端据此报错而不是以明文传输
+func (f *Frames) negotiateMux(h http.Header) bool {
+	return f.aead == nil && h.Get(protocol.MuxHeader) == protocol.MuxYamux
+}
+
+// muxConfig yamux 会话参数：接收窗口取 StreamBufferMB，心跳间隔取 PingInterval，写超时取 PongTimeout
+func (f *Frames) muxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.MaxStreamWindowSize = max(uint32(f.streamBuffer()), cfg.MaxStreamWindowSize)
+	if f.cfg.PingInterval > 0 {
+		cfg.KeepAliveInterval = f.cfg.PingInterval
+	}
+	if f.cfg.PongTimeout > 0 {
+		cfg.ConnectionWriteTimeout = f.cfg.PongTimeout
+	}
+	cfg.StreamCloseTimeout = muxStreamCloseTimeout
+	cfg.LogOutput = nil
+	cfg.Logger = log.Default()
+	return cfg
+}
+
+// messageConn 将通道的消息连接适配为 yamux 所需的字节流：每次写入作为二进制消息发出（超过单条消息上限时拆分），
+// 读取时依次返回收到的消息内容
+type messageConn struct {
+	TunnelConn
+	maxMsg int
+
+	buf []byte
+	wmu sync.Mutex
+}
+
+func (c *messageConn) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		mt, msg, err := c.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if mt == websocket.BinaryMessage {
+			c.buf = msg
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *messageConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for off := 0; off < len(b); {
+		n := min(len(b)-off, c.maxMsg)
+		if err := c.WriteMessage(websocket.BinaryMessage, b[off:off+n]); err != nil {
+			return off, err
+		}
+		off += n
+	}
+	return len(b), nil
+}
+
+// ClientMuxSession 客户端在已协商多路复用的通道上建立会话：QUIC 通道直接使用其原生流，
+// 其余通道以 maxMsg 为单条消息上限运行 yamux
+func (f *Frames) ClientMuxSession(conn TunnelConn, maxMsg int) (MuxSession, error) {
+	if qc, ok := conn.(*QuicConn); ok {
+		return quicSession{qc.Conn}, nil
+	}
+	ys, err := yamux.Client(&messageConn{TunnelConn: conn, maxMsg: maxMsg}, f.muxConfig())
+	if err != nil {
+		return nil, err
+	}
+	return yamuxSession{ys}, nil
+}
+
+// serveYamux 服务端在通道上运行 yamux 会话，直至会话结束
+func (s *Server) serveYamux(conn TunnelConn, sess *sessionInfo) {
+	session, err := yamux.Server(&messageConn{TunnelConn: conn, maxMsg: sess.maxFrame}, s.frames.muxConfig())
+	if err != nil {
+		log.Printf("[服务端] 建立多路复用会话失败: %v", err)
+		_ = conn.Close()
+		return
+	}
+	log.Printf("[服务端] 通道 %s 以多路复用（yamux）方式承载流", conn.RemoteAddr())
+	s.handleMuxSession(yamuxSession{session}, conn.RemoteAddr(), sess)
+}
+
+// handleMuxSession 为客户端在会话上打开的每条流连接目标，直至会话结束
+func (s *Server) handleMuxSession(session MuxSession, remote net.Addr, sess *sessionInfo) {
+	s.activeSessions.Add(1)
+	defer s.activeSessions.Add(-1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		_ = session.Close()
+		log.Printf("通道 %s 已完全清理", remote)
+	}()
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if !errors.Is(err, yamux.ErrSessionShutdown) && !netutil.IsNormalCloseError(err) && !session.IsClosed() {
+				log.Printf("[服务端] 多路复用会话结束: %v", err)
+			}
+			return
+		}
+		go s.handleMuxStream(ctx, stream, sess)
+	}
+}
+
+// handleMuxStream 处理客户端在多路复用会话上打开的一条流：读取建连请求、按令牌权限连接目标并回复应答，
+// 随后双向转发，任一方向结束时只关闭对端的写方向
+func (s *Server) handleMuxStream(ctx context.Context, stream MuxStream, sess *sessionInfo) {
+	defer CloseMuxStream(stream)
+	_ = stream.SetReadDeadline(time.Now().Add(muxRequestTimeout))
+	targetAddr, first, err := protocol.ReadMuxRequest(stream)
+	if err != nil {
+		log.Printf("[服务端] 读取多路复用建连请求失败: %v", err)
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+
+	connID := uuid.New().String()
+	acct := s.newStreamAccounting("tcp", targetAddr, sess.usage)
+	tcpConn, first, release, err := s.openTarget(ctx, targetAddr, first, s.frames.PriorityFor(targetAddr), sess, acct)
+	if err != nil {
+		log.Printf("[服务端] 连接目标地址 %s 失败: %v", targetAddr, err)
+		code, reason := dialFailure(err)
+		_ = protocol.WriteMuxReply(stream, "", code, err)
+		s.logAccess(sess, connID, acct, reason)
+		return
+	}
+	defer release()
+	kill := func() {
+		_ = tcpConn.Close()
+		CloseMuxStream(stream)
+	}
+	defer sess.usage.track(acct, kill)()
+	defer s.serverStreams.track(connID, sess, acct, kill)()
+
+	s.activeTCPStreams.Add(1)
+	s.frames.metrics.StreamsOpened.Add(1)
+	reason := closeTarget
+	defer func() {
+		s.activeTCPStreams.Add(-1)
+		s.frames.metrics.StreamsClosed.Add(1)
+		_ = tcpConn.Close()
+		s.logAccess(sess, connID, acct, reason)
+	}()
+
+	if first != "" {
+		acct.addUp(len(first))
+		if _, err := tcpConn.Write([]byte(first)); err != nil {
+			log.Printf("[服务端] 发送第一帧失败: %v", err)
+			_ = protocol.WriteMuxReply(stream, "", protocol.CtrlErrDial, err)
+			reason = closeTargetError
+			return
+		}
+	}
+	if err := protocol.WriteMuxReply(stream, tcpConn.LocalAddr().String(), 0, nil); err != nil {
+		reason = closeTunnelError
+		return
+	}
+
+	tup, tdown := sess.policy.pacers()
+	up := make(chan struct{})
+	go func() {
+		defer close(up)
+		if err := copyPaced(tcpConn, stream, tup, acct.addUp); err == nil && netutil.CloseWrite(tcpConn) {
+			return
+		}
+		_ = tcpConn.Close()
+	}()
+	if err := copyPaced(stream, tcpConn, tdown, acct.addDown); err != nil && !netutil.IsNormalCloseError(err) {
+		reason = closeTargetError
+	}
+	// 目标方向结束：向客户端发送 FIN，等待客户端方向结束
+	_ = stream.Close()
+	<-up
+}
+
+// copyPaced 从 src 复制到 dst 直至 EOF（返回 nil），每段数据先按 pc 限速并经 count 计数
+func copyPaced(dst io.Writer, src io.Reader, pc *Pacer, count func(int)) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			pc.Wait(n)
+			count(n)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
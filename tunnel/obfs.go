@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ech-tunnel/protocol"
+)
+
+// 填充后的帧长度档位，隐藏真实负载大小
+var padBuckets = []int{512, 1024, 2048, 4096, 8192, 16384, 32768 + 2*frameHeaderReserve}
+
+// 启用填充后允许的初始填充额度（字节），之后按 PadBudget 比例约束
+const padInitialAllowance = 64 * 1024
+
+// Padder 流量填充与空闲混淆（每个通道/会话一个）
+type Padder struct {
+	mu        sync.Mutex
+	realBytes int64
+	padBytes  int64
+	lastSend  atomic.Int64 // 最近一次发送的时间（UnixNano）
+
+	budget int           // 填充流量占真实流量的最大百分比
+	idle   time.Duration // 空闲伪帧的平均间隔
+}
+
+// NewPadder 创建填充器，未启用填充时返回 nil
+func (f *Frames) NewPadder() *Padder {
+	if !f.cfg.Padding {
+		return nil
+	}
+	pd := &Padder{budget: f.cfg.PadBudget, idle: f.cfg.PadIdleInterval}
+	pd.lastSend.Store(time.Now().UnixNano())
+	return pd
+}
+
+// appendFrame 构建 DATA 帧；启用填充且额度允许时构建 DATAP 帧：
+// DATAP:<padLen>|<connID>|<seq>|<payload><padding>
+func (pd *Padder) appendFrame(dst []byte, version int, connID string, seq uint64, payload []byte) []byte {
+	if pd == nil {
+		return append(protocol.AppendDataHeader(dst, version, connID, seq), payload...)
+	}
+	pd.lastSend.Store(time.Now().UnixNano())
+
+	inner := len(connID) + len(strconv.FormatUint(seq, 10)) + 2 + len(payload)
+	fixed := len("DATAP:|") + inner
+	padLen := 0
+	for _, b := range padBuckets {
+		if b >= fixed+1 {
+			padLen = b - fixed
+			padLen -= len(strconv.Itoa(padLen))
+			if padLen < 0 {
+				padLen = 0
+			}
+			break
+		}
+	}
+
+	pd.mu.Lock()
+	pd.realBytes += int64(len(payload))
+	allowed := padInitialAllowance + pd.realBytes*int64(pd.budget)/100
+	if pd.padBytes+int64(padLen) > allowed {
+		padLen = 0
+	}
+	pd.padBytes += int64(padLen)
+	pd.mu.Unlock()
+
+	if padLen == 0 {
+		return append(protocol.AppendDataHeader(dst, version, connID, seq), payload...)
+	}
+	dst = append(dst, "DATAP:"...)
+	dst = strconv.AppendInt(dst, int64(padLen), 10)
+	dst = append(dst, '|')
+	dst = protocol.AppendStreamTag(dst, version, connID, seq)
+	dst = append(dst, payload...)
+	return appendRandomPadding(dst, padLen)
+}
+
+// IdleLoop 通道空闲时按随机间隔发送 PAD 伪帧，直到 done 关闭
+func (pd *Padder) IdleLoop(done <-chan struct{}, send func([]byte) error) {
+	if pd == nil || pd.idle <= 0 {
+		return
+	}
+	for {
+		// 在平均间隔的 0.5~1.5 倍之间随机抖动
+		wait := pd.idle/2 + time.Duration(rand.Int64N(int64(pd.idle)))
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+		if time.Since(time.Unix(0, pd.lastSend.Load())) < pd.idle/2 {
+			continue
+		}
+		frame := appendRandomPadding([]byte("PAD:"), 64+rand.IntN(960))
+		if err := send(frame); err != nil {
+			return
+		}
+		pd.lastSend.Store(time.Now().UnixNano())
+	}
+}
+
+// appendRandomPadding 追加 n 字节随机填充（随机内容避免被压缩后暴露）
+func appendRandomPadding(dst []byte, n int) []byte {
+	for n > 0 {
+		v := rand.Uint64()
+		for i := 0; i < 8 && n > 0; i++ {
+			dst = append(dst, byte(v>>(8*i)))
+			n--
+		}
+	}
+	return dst
+}
+
+// UnpadDataFrame 去除 DATAP 帧的填充，返回等价的 DATA 帧负载 <connID>|<seq>|<payload>
+func UnpadDataFrame(body []byte) ([]byte, bool) {
+	i := bytes.IndexByte(body, '|')
+	if i < 0 {
+		return nil, false
+	}
+	padLen, err := strconv.Atoi(string(body[:i]))
+	if err != nil || padLen < 0 || padLen > len(body)-i-1 {
+		return nil, false
+	}
+	return body[i+1 : len(body)-padLen], true
+}
@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// Pacer 令牌桶发送节奏控制，按瓶颈带宽平滑 WebSocket 写入，避免整块突发。
+// 通道级的 pacer 按 -pace 固定速率；拥塞控制生效后各流另按拥塞窗口估计的带宽平滑发送（见 congestionController.pace）
+type Pacer struct {
+	mu     sync.Mutex
+	rate   float64 // 字节/秒
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewPacer 按带宽（Mbps）创建 pacer，mbps <= 0 时返回 nil 表示不限速
+func NewPacer(mbps float64) *Pacer {
+	if mbps <= 0 {
+		return nil
+	}
+	return newRatePacer(mbps * 1000 * 1000 / 8)
+}
+
+// newRatePacer 按速率（字节/秒）创建 pacer，初始额度为一次突发量
+func newRatePacer(rate float64) *Pacer {
+	p := &Pacer{last: time.Now()}
+	p.setRate(rate)
+	p.tokens = p.burst
+	return p
+}
+
+// setRate 调整发送速率（字节/秒），此前累积的额度按原速率结算
+func (p *Pacer) setRate(rate float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refill(time.Now())
+	p.rate = rate
+	// 允许约 10ms 的突发量，至少一个完整读缓冲区
+	p.burst = max(rate/100, 32768)
+	p.tokens = min(p.tokens, p.burst)
+}
+
+// refill 按经过的时间补充额度（调用方持有 p.mu）
+func (p *Pacer) refill(now time.Time) {
+	p.tokens += now.Sub(p.last).Seconds() * p.rate
+	if p.tokens > p.burst {
+		p.tokens = p.burst
+	}
+	p.last = now
+}
+
+// Wait 为 n 字节预留发送额度，额度不足时等待到可发送时刻
+func (p *Pacer) Wait(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.refill(time.Now())
+	p.tokens -= float64(n)
+	var delay time.Duration
+	if p.tokens < 0 {
+		delay = time.Duration(-p.tokens / p.rate * float64(time.Second))
+	}
+	p.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// allow 额度足够时为 n 字节预留额度并返回 true，不足时不等待直接返回 false（用于可丢弃的 UDP 数据报）
+func (p *Pacer) allow(n int) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refill(time.Now())
+	if p.tokens < float64(n) {
+		return false
+	}
+	p.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 路径模板：隧道路径中的整段占位符在客户端每次建立通道时替换，服务端按相同模板匹配，
+// 使各通道的 URL 路径互不相同，增加按路径封锁与关联的难度
+//
+//	{rand}    8-16 位随机小写字母与数字，服务端接受 1-64 位字母、数字、- 与 _
+//	{a|b|c}   从给定集合中随机选取一个，服务端只接受集合中的值
+const (
+	randSegmentChars  = "abcdefghijklmnopqrstuvwxyz0123456789"
+	randSegmentMaxLen = 64
+)
+
+// pathTemplate 解析后的路径模板
+type pathTemplate struct {
+	pattern string      // 注册到 ServeMux 的模式，占位段替换为通配符 {pN}
+	params  []pathParam // 各占位段，顺序与通配符编号一致
+}
+
+// pathParam 一个占位段，choices 为空表示 {rand}
+type pathParam struct {
+	name    string
+	choices []string
+}
+
+// ParsePathTemplate 解析路径模板，不含占位符的路径原样作为模式
+func ParsePathTemplate(path string) (*pathTemplate, error) {
+	segs := strings.Split(path, "/")
+	t := &pathTemplate{}
+	for i, seg := range segs {
+		if !strings.ContainsAny(seg, "{}") {
+			continue
+		}
+		choices, err := parsePathSegment(seg)
+		if err != nil {
+			return nil, err
+		}
+		p := pathParam{name: "p" + strconv.Itoa(len(t.params)), choices: choices}
+		t.params = append(t.params, p)
+		segs[i] = "{" + p.name + "}"
+	}
+	t.pattern = strings.Join(segs, "/")
+	return t, nil
+}
+
+// parsePathSegment 解析单个占位段，返回 {a|b|c} 的候选集合（{rand} 返回 nil）
+func parsePathSegment(seg string) ([]string, error) {
+	inner, ok := strings.CutPrefix(seg, "{")
+	if inner, ok = strings.CutSuffix(inner, "}"); !ok || strings.ContainsAny(inner, "{}") {
+		return nil, fmt.Errorf("无效的路径占位符 %q（占位符须占据完整的路径段，如 /cdn-cgi/{rand}）", seg)
+	}
+	if inner == "rand" {
+		return nil, nil
+	}
+	choices := strings.Split(inner, "|")
+	if len(choices) < 2 {
+		return nil, fmt.Errorf("无效的路径占位符 %q（可选 {rand} 或 {a|b|c}）", seg)
+	}
+	for _, c := range choices {
+		if c == "" || url.PathEscape(c) != c {
+			return nil, fmt.Errorf("路径占位符 %q 的候选值无效: %q", seg, c)
+		}
+	}
+	return choices, nil
+}
+
+// match 请求路径中各占位段的值是否符合模板（ServeMux 已按模式匹配其余部分）
+func (t *pathTemplate) match(r *http.Request) bool {
+	for _, p := range t.params {
+		v := r.PathValue(p.name)
+		if p.choices == nil {
+			if !validRandSegment(v) {
+				return false
+			}
+			continue
+		}
+		found := false
+		for _, c := range p.choices {
+			if v == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// validRandSegment {rand} 段的取值是否合法
+func validRandSegment(v string) bool {
+	if v == "" || len(v) > randSegmentMaxLen {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ExpandPathTemplate 替换服务地址路径中的占位符，每次建立通道时调用；地址无效或不含占位符时原样返回
+func ExpandPathTemplate(serverAddr string) string {
+	u, err := url.Parse(serverAddr)
+	if err != nil || !strings.Contains(u.Path, "{") {
+		return serverAddr
+	}
+	segs := strings.Split(u.Path, "/")
+	for i, seg := range segs {
+		if !strings.ContainsAny(seg, "{}") {
+			continue
+		}
+		choices, err := parsePathSegment(seg)
+		if err != nil {
+			return serverAddr
+		}
+		if choices != nil {
+			segs[i] = choices[rand.IntN(len(choices))]
+			continue
+		}
+		b := make([]byte, 8+rand.IntN(9))
+		for j := range b {
+			b[j] = randSegmentChars[rand.IntN(len(randSegmentChars))]
+		}
+		segs[i] = string(b)
+	}
+	u.Path, u.RawPath = strings.Join(segs, "/"), ""
+	return u.String()
+}
@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portRange 目标端口区间，proto 为空时同时适用于 TCP 与 UDP
+type portRange struct {
+	proto  string
+	lo, hi int
+}
+
+func (r portRange) match(proto string, port int) bool {
+	return (r.proto == "" || r.proto == proto) && port >= r.lo && port <= r.hi
+}
+
+// portPolicy 服务端隧道流量的目标端口策略：命中 allow 的端口放行（优先于 block），
+// 命中 block 的端口拒绝，其余放行。-block-ports 1-65535 配合 -allow-ports 即为白名单
+type portPolicy struct {
+	allow []portRange
+	block []portRange
+}
+
+// parsePortRanges 解析逗号分隔的端口列表：25、6881-6889，可加协议前缀 tcp/25、udp/53
+func parsePortRanges(s string) ([]portRange, error) {
+	var out []portRange
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var r portRange
+		if proto, rest, ok := strings.Cut(item, "/"); ok {
+			proto = strings.ToLower(proto)
+			if proto != "tcp" && proto != "udp" {
+				return nil, fmt.Errorf("无效的协议 %s（可选 tcp、udp）", proto)
+			}
+			r.proto, item = proto, rest
+		}
+		loStr, hiStr, isRange := strings.Cut(item, "-")
+		lo, err1 := strconv.Atoi(loStr)
+		hi, err2 := lo, error(nil)
+		if isRange {
+			hi, err2 = strconv.Atoi(hiStr)
+		}
+		if err1 != nil || err2 != nil || lo < 1 || hi > 65535 || lo > hi {
+			return nil, fmt.Errorf("无效的端口或端口范围: %s", item)
+		}
+		r.lo, r.hi = lo, hi
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// newPortPolicy 按参数（-block-ports、-allow-ports）建立目标端口策略
+func newPortPolicy(blockPorts, allowPorts string) (*portPolicy, error) {
+	block, err := parsePortRanges(blockPorts)
+	if err != nil {
+		return nil, fmt.Errorf("禁止的端口: %w", err)
+	}
+	allow, err := parsePortRanges(allowPorts)
+	if err != nil {
+		return nil, fmt.Errorf("放行的端口: %w", err)
+	}
+	if len(block) > 0 {
+		log.Printf("目标端口策略: 禁止 %s，放行 %s", blockPorts, orNone(allowPorts))
+	}
+	return &portPolicy{allow: allow, block: block}, nil
+}
+
+// permits 判断是否允许经隧道连接 proto（tcp/udp）目标端口 port
+func (p *portPolicy) permits(proto string, port int) bool {
+	for _, r := range p.allow {
+		if r.match(proto, port) {
+			return true
+		}
+	}
+	for _, r := range p.block {
+		if r.match(proto, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTargetPort 检查目标地址 target（host:port）的端口是否被策略禁止
+func (s *Server) checkTargetPort(proto, target string) error {
+	_, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := net.LookupPort(proto, portStr)
+	if err != nil {
+		return err
+	}
+	if !s.targetPorts.permits(proto, port) {
+		return fmt.Errorf("目标端口 %d/%s %w", port, proto, errTargetDenied)
+	}
+	return nil
+}
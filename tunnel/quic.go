@@ -0,0 +1,299 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUIC 传输（quic://host:port/path）：每个通道是一条 QUIC 连接（ALPN ech-tunnel），客户端照常以 DoH 获取的 ECH 配置握手，
+// 服务端以 -ech-key 自行解密 ECH。客户端在连接上打开的第一条流承载通道握手：客户端写入 HTTP/1.1 格式的 GET 请求
+// （路径、Host、X-Tunnel-* 头与令牌），服务端按与 wss:// 相同的路由与校验处理后写回 HTTP/1.1 响应头，随后双方关闭该流。
+// 握手后通道固定以多路复用方式运行，每个 TCP 流是一条独立的 QUIC 流（建连格式见 protocol/mux.go），
+// 丢包只阻塞所在的流，不再像 TCP 上的 WebSocket 那样阻塞同一通道上的全部流
+const (
+	quicALPN = "ech-tunnel"
+
+	// 握手请求头的长度上限
+	quicMaxHandshake = 64 << 10
+	// 每条 QUIC 连接上允许同时打开的流数
+	quicMaxStreams = 4096
+)
+
+// quicConfig QUIC 连接参数：流接收窗口取 StreamBufferMB，保活间隔取 PingInterval，空闲超时取 PongTimeout
+func (f *Frames) quicConfig() *quic.Config {
+	cfg := &quic.Config{
+		HandshakeIdleTimeout:   10 * time.Second,
+		MaxStreamReceiveWindow: max(uint64(f.streamBuffer()), 6<<20),
+		MaxIncomingStreams:     quicMaxStreams,
+		KeepAlivePeriod:        f.cfg.PingInterval,
+	}
+	if f.cfg.PongTimeout > 0 {
+		cfg.MaxIdleTimeout = f.cfg.PongTimeout
+	}
+	return cfg
+}
+
+// QuicConn QUIC 通道。流直接承载于 QUIC 连接，通道上不收发消息，实现 tunnelConn 仅供连接池管理通道
+type QuicConn struct {
+	Conn *quic.Conn
+}
+
+// ReadMessage 阻塞至连接关闭
+func (c *QuicConn) ReadMessage() (int, []byte, error) {
+	<-c.Conn.Context().Done()
+	return 0, nil, context.Cause(c.Conn.Context())
+}
+
+func (c *QuicConn) WriteMessage(int, []byte) error {
+	return errors.New("QUIC 通道不承载消息")
+}
+
+func (c *QuicConn) SetReadDeadline(time.Time) error   { return nil }
+func (c *QuicConn) SetReadLimit(int64)                {}
+func (c *QuicConn) SetPingHandler(func(string) error) {}
+func (c *QuicConn) SetPongHandler(func(string) error) {}
+func (c *QuicConn) RemoteAddr() net.Addr              { return c.Conn.RemoteAddr() }
+func (c *QuicConn) Close() error                      { return c.Conn.CloseWithError(0, "") }
+
+// quicSession 以 QUIC 连接实现 muxSession
+type quicSession struct {
+	conn *quic.Conn
+}
+
+func (s quicSession) OpenStream() (MuxStream, error) {
+	st, err := s.conn.OpenStreamSync(s.conn.Context())
+	if err != nil {
+		return nil, err
+	}
+	return quicStream{st}, nil
+}
+
+func (s quicSession) AcceptStream() (MuxStream, error) {
+	st, err := s.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return quicStream{st}, nil
+}
+
+// Ping QUIC 连接由 KeepAlivePeriod 保活，往返时延取 QUIC 最近一次的 RTT 样本
+func (s quicSession) Ping() (time.Duration, error) {
+	if err := context.Cause(s.conn.Context()); err != nil {
+		return 0, err
+	}
+	return s.conn.ConnectionStats().LatestRTT, nil
+}
+
+func (s quicSession) CloseChan() <-chan struct{} { return s.conn.Context().Done() }
+func (s quicSession) IsClosed() bool             { return s.conn.Context().Err() != nil }
+func (s quicSession) Close() error               { return s.conn.CloseWithError(0, "") }
+
+type quicStream struct {
+	*quic.Stream
+}
+
+// CloseRead 发送 STOP_SENDING，对端随后不再发送该流的数据
+func (s quicStream) CloseRead() { s.CancelRead(0) }
+
+// DialQUIC 建立 QUIC 通道（TLS 配置与 WebSocket 相同，强制 ECH），header 为握手请求头
+func (d *Dialer) DialQUIC(serverAddr string, tlsCfg *tls.Config, header http.Header) (TunnelConn, *http.Response, error) {
+	u, err := url.Parse(serverAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	// IPs 定向时连接优选地址（SNI 仍为主机名）；QUIC 无法像 TCP 那样廉价地竞速，只尝试首个候选地址
+	if ips := d.cfg.IPs; ips != nil && d.isFrontHost(u.Hostname()) {
+		if cands := ips.Candidates(1); len(cands) > 0 {
+			addr = net.JoinHostPort(cands[0].String(), port)
+		}
+	}
+
+	tlsCfg = tlsCfg.Clone()
+	tlsCfg.NextProtos = []string{quicALPN}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, tlsCfg, d.cfg.Frames.quicConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	logTLSResumption(conn.ConnectionState().TLS)
+
+	resp, err := quicHandshake(ctx, conn, u, header, d.cfg.Token)
+	if err != nil {
+		_ = conn.CloseWithError(0, "")
+		return nil, nil, err
+	}
+	return &QuicConn{Conn: conn}, resp, nil
+}
+
+// quicHandshake 在连接的第一条流上发送握手请求（携带令牌 token）并读取响应头
+func quicHandshake(ctx context.Context, conn *quic.Conn, u *url.URL, header http.Header, token string) (*http.Response, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer CloseMuxStream(quicStream{stream})
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header.Clone(),
+		Host:       u.Host,
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	if token != "" {
+		req.Header.Set(grpcTokenHeader, token)
+	}
+	if err := req.Write(stream); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(io.LimitReader(stream, quicMaxHandshake)), req)
+	if err != nil {
+		return nil, fmt.Errorf("QUIC 握手失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("QUIC 握手失败: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// quicConnKey 服务端握手请求的 context 中保存所属 QUIC 连接的键
+type quicConnKey struct{}
+
+// quicConnFrom 返回经 QUIC 握手流到达的请求所属的连接（其他请求为 nil）
+func quicConnFrom(r *http.Request) *quic.Conn {
+	c, _ := r.Context().Value(quicConnKey{}).(*quic.Conn)
+	return c
+}
+
+// ListenQUIC 在 UDP 上监听 QUIC 连接，tlsCfg 通常取自 TLSConfig
+func (s *Server) ListenQUIC(addr string, tlsCfg *tls.Config) (*quic.Listener, error) {
+	if len(tlsCfg.EncryptedClientHelloKeys) == 0 {
+		return nil, errors.New("quic:// 服务端需要通过 -ech-key 指定 ECH 密钥：客户端直连服务端，ECH 须由服务端自行解密")
+	}
+	if s.frames.aead != nil {
+		return nil, errors.New("quic:// 服务端不支持 -psk：QUIC 流不经端到端加密")
+	}
+	tlsCfg = tlsCfg.Clone()
+	tlsCfg.NextProtos = []string{quicALPN}
+	return quic.ListenAddr(addr, tlsCfg, s.frames.quicConfig())
+}
+
+// ServeQUIC 接受 QUIC 连接直至监听关闭，握手请求交由 handler（与 wss:// 相同的隧道路由）处理
+func ServeQUIC(ln *quic.Listener, handler http.Handler) error {
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go serveQUICConn(conn, handler)
+	}
+}
+
+// serveQUICConn 读取连接的握手请求并交由 handler 处理；握手通过时 handler 在连接结束前不返回
+func serveQUICConn(conn *quic.Conn, handler http.Handler) {
+	defer conn.CloseWithError(0, "")
+	ctx, cancel := context.WithTimeout(conn.Context(), muxRequestTimeout)
+	stream, err := conn.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("[服务端] QUIC 连接 %s 未发送握手请求: %v", conn.RemoteAddr(), err)
+		return
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(muxRequestTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(io.LimitReader(stream, quicMaxHandshake)))
+	if err != nil {
+		log.Printf("[服务端] 读取 QUIC 握手请求失败（来自 %s）: %v", conn.RemoteAddr(), err)
+		CloseMuxStream(quicStream{stream})
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	state := conn.ConnectionState().TLS
+	req.TLS = &state
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req = req.WithContext(context.WithValue(conn.Context(), quicConnKey{}, conn))
+
+	w := &quicResponseWriter{stream: quicStream{stream}, header: http.Header{}}
+	handler.ServeHTTP(w, req)
+	w.finish()
+	// 握手被拒绝时等待客户端读完响应并关闭连接，立即关闭会使尚未送达的响应被丢弃
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(muxRequestTimeout):
+	}
+}
+
+// acceptQUIC 响应 QUIC 通道握手并关闭握手流（调用方须在通道结束前保持 Handler 不返回）
+func acceptQUIC(w http.ResponseWriter, respHeader http.Header) error {
+	qw, ok := w.(*quicResponseWriter)
+	if !ok {
+		return errors.New("ResponseWriter 不是 QUIC 握手流")
+	}
+	for k, v := range respHeader {
+		qw.header[k] = v
+	}
+	qw.finish()
+	return nil
+}
+
+// quicResponseWriter 将握手响应以 HTTP/1.1 格式写回握手流
+type quicResponseWriter struct {
+	stream MuxStream
+	header http.Header
+	wrote  bool
+	closed bool
+}
+
+func (w *quicResponseWriter) Header() http.Header { return w.header }
+
+func (w *quicResponseWriter) WriteHeader(code int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	b := bufio.NewWriter(w.stream)
+	fmt.Fprintf(b, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
+	_ = w.header.Write(b)
+	_, _ = b.WriteString("\r\n")
+	_ = b.Flush()
+}
+
+func (w *quicResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.stream.Write(p)
+}
+
+// finish 响应完毕，关闭握手流（握手成功时由 handler 提前调用，之后连接上的流用于承载 TCP 流）
+func (w *quicResponseWriter) finish() {
+	if w.closed {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.closed = true
+	CloseMuxStream(w.stream)
+}
@@ -0,0 +1,59 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// handshakeLimiter 按来源 IP 限制每分钟的隧道握手次数（固定窗口计数）
+type handshakeLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	entries map[string]*handshakeWindow
+	swept   time.Time
+}
+
+type handshakeWindow struct {
+	start time.Time
+	count int
+}
+
+// newHandshakeLimiter 创建握手限速器（perMinute 为 0 时返回 nil，不限制）
+func newHandshakeLimiter(perMinute int) *handshakeLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &handshakeLimiter{limit: perMinute, window: time.Minute, entries: make(map[string]*handshakeWindow), swept: time.Now()}
+}
+
+// allow 记录一次握手尝试，超过限额时返回 false 及距窗口重置的剩余时间
+func (l *handshakeLimiter) allow(ip string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// 定期清理过期窗口，避免大量来源 IP 导致 map 无限增长
+	if now.Sub(l.swept) >= l.window {
+		for k, e := range l.entries {
+			if now.Sub(e.start) >= l.window {
+				delete(l.entries, k)
+			}
+		}
+		l.swept = now
+	}
+
+	e, ok := l.entries[ip]
+	if !ok || now.Sub(e.start) >= l.window {
+		l.entries[ip] = &handshakeWindow{start: now, count: 1}
+		return true, 0
+	}
+	if e.count >= l.limit {
+		return false, e.start.Add(l.window).Sub(now)
+	}
+	e.count++
+	return true, 0
+}
@@ -0,0 +1,200 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 中继管道单方向缓存的数据上限（未推迟确认时），写满时阻塞写入方
+const RelayPipeBuffer = 256 << 10
+
+// relayHalf 中继管道的一个方向：写入方关闭后读取方读完剩余数据得到 io.EOF。
+// 写入方可能是通道的读取循环，若在此阻塞会连带阻塞同一通道上的 ACK，两跳各自等待对方确认而死锁；
+// 因此设置了 consumed 时改为在数据被读走后才确认，背压经发送窗口沿各跳传递，
+// 写入只在缓存超过 maxBuffer（对端未遵守发送窗口）时阻塞
+type relayHalf struct {
+	mu       sync.Mutex
+	buf      []byte
+	wake     chan struct{} // 状态变化时关闭并替换，唤醒等待者
+	eof      bool          // 写入方已关闭（半关闭）
+	closed   bool          // 读取方已关闭
+	deadline time.Time
+	consumed func(n int) // 数据被读走后确认（为 nil 时写入后即确认）
+	// 推迟确认时缓存的上限：遵守发送窗口的对端在途数据不超过窗口上限，不会触及该上限；
+	// 不遵守窗口（或协议版本 4 之前无窗口）的对端在此受到背压
+	maxBuffer int
+}
+
+func newRelayHalf(maxBuffer int) *relayHalf {
+	return &relayHalf{wake: make(chan struct{}), maxBuffer: maxBuffer}
+}
+
+// signal 唤醒等待者（调用方持有 h.mu）
+func (h *relayHalf) signal() {
+	close(h.wake)
+	h.wake = make(chan struct{})
+}
+
+func (h *relayHalf) read(b []byte) (int, error) {
+	for {
+		h.mu.Lock()
+		switch {
+		case h.closed:
+			h.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(h.buf) > 0:
+			n := copy(b, h.buf)
+			h.buf = h.buf[n:]
+			h.signal()
+			consumed := h.consumed
+			h.mu.Unlock()
+			if consumed != nil {
+				consumed(n)
+			}
+			return n, nil
+		case h.eof:
+			h.mu.Unlock()
+			return 0, io.EOF
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !h.deadline.IsZero() {
+			d := time.Until(h.deadline)
+			if d <= 0 {
+				h.mu.Unlock()
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		wake := h.wake
+		h.mu.Unlock()
+		select {
+		case <-wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (h *relayHalf) write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		h.mu.Lock()
+		if h.closed || h.eof {
+			h.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		limit := RelayPipeBuffer
+		if h.consumed != nil {
+			limit = h.maxBuffer
+		}
+		n := min(len(b)-written, limit-len(h.buf))
+		if n > 0 {
+			h.buf = append(h.buf, b[written:written+n]...)
+			written += n
+			h.signal()
+			h.mu.Unlock()
+			continue
+		}
+		wake := h.wake
+		h.mu.Unlock()
+		<-wake
+	}
+	return written, nil
+}
+
+func (h *relayHalf) closeWrite() {
+	h.mu.Lock()
+	h.eof = true
+	h.signal()
+	h.mu.Unlock()
+}
+
+func (h *relayHalf) closeRead() {
+	h.mu.Lock()
+	h.closed = true
+	h.buf = nil
+	h.signal()
+	h.mu.Unlock()
+}
+
+func (h *relayHalf) setDeadline(t time.Time) {
+	h.mu.Lock()
+	h.deadline = t
+	h.signal()
+	h.mu.Unlock()
+}
+
+// AckOnRead 写入本端的数据改为在对端读走后以 ack 确认
+func (c *RelayConn) AckOnRead(ack func(n int)) {
+	c.out.mu.Lock()
+	c.out.consumed = ack
+	c.out.mu.Unlock()
+}
+
+// AcksOnRead 写入 c 的数据是否推迟到被读走后才确认（调用方写入后不再确认）
+func AcksOnRead(c net.Conn) bool {
+	rc, ok := c.(*RelayConn)
+	if !ok {
+		return false
+	}
+	rc.out.mu.Lock()
+	defer rc.out.mu.Unlock()
+	return rc.out.consumed != nil
+}
+
+// RelayConn 中继管道的一端：服务端把它当作目标连接，另一端交给中继连接池
+type RelayConn struct {
+	in, out *relayHalf
+	target  string
+	Bound   string // 下一跳出站连接的本地地址（作为 CONNECTED 中的地址转告客户端）
+}
+
+// NewRelayPipe 创建一对相连的中继管道端点，maxBuffer 为推迟确认时单方向缓存的上限
+func NewRelayPipe(target string, maxBuffer int) (*RelayConn, *RelayConn) {
+	a, b := newRelayHalf(maxBuffer), newRelayHalf(maxBuffer)
+	return &RelayConn{in: a, out: b, target: target}, &RelayConn{in: b, out: a, target: target}
+}
+
+func (c *RelayConn) Read(b []byte) (int, error)  { return c.in.read(b) }
+func (c *RelayConn) Write(b []byte) (int, error) { return c.out.write(b) }
+
+// CloseWrite 半关闭：对端读完已写入的数据后得到 io.EOF
+func (c *RelayConn) CloseWrite() error {
+	c.out.closeWrite()
+	return nil
+}
+
+func (c *RelayConn) Close() error {
+	c.out.closeWrite()
+	c.in.closeRead()
+	return nil
+}
+
+func (c *RelayConn) LocalAddr() net.Addr  { return relayAddr(c.Bound) }
+func (c *RelayConn) RemoteAddr() net.Addr { return relayAddr(c.target) }
+
+func (c *RelayConn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *RelayConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline 写入只在缓存写满时阻塞，不支持写超时
+func (c *RelayConn) SetWriteDeadline(time.Time) error { return nil }
+
+// relayAddr 中继流的地址
+type relayAddr string
+
+func (a relayAddr) Network() string { return "relay" }
+func (a relayAddr) String() string  { return string(a) }
@@ -0,0 +1,125 @@
+package tunnel
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// 单个流允许缓存的乱序帧上限，超过则判定流已损坏
+const maxReorderPending = 1024
+
+// ReorderBuffer 按序号重排单个流的 DATA 帧，保证跨通道时数据按序交付
+type ReorderBuffer struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64][]byte
+	bytes   int64 // pending 中缓存的字节数（计入内存预算）
+	limit   int64 // 乱序缓存上限（字节）
+	budget  *memBudget
+}
+
+// NewReorderBuffer 创建重排缓冲区（上限与内存预算取自帧层参数）
+func (f *Frames) NewReorderBuffer() *ReorderBuffer {
+	return &ReorderBuffer{pending: make(map[uint64][]byte), limit: f.streamBuffer(), budget: f.budget}
+}
+
+// Push 放入一帧，返回当前可按序交付的数据（可能为空）
+func (rb *ReorderBuffer) Push(seq uint64, data []byte) ([][]byte, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if seq < rb.next {
+		// 重复帧，直接丢弃
+		return nil, nil
+	}
+	if seq > rb.next {
+		if len(rb.pending) >= maxReorderPending {
+			return nil, fmt.Errorf("乱序帧过多（期望 %d，收到 %d）", rb.next, seq)
+		}
+		if rb.bytes+int64(len(data)) > rb.limit {
+			return nil, fmt.Errorf("乱序缓存超过 %d MB（期望 %d，收到 %d）", rb.limit>>20, rb.next, seq)
+		}
+		if _, dup := rb.pending[seq]; dup {
+			return nil, nil
+		}
+		// 等待内存预算时释放锁，使本流按序到达的帧仍可交付并释放额度
+		rb.mu.Unlock()
+		ok := rb.budget.acquire(int64(len(data)), memBudgetWait)
+		rb.mu.Lock()
+		if !ok {
+			return nil, fmt.Errorf("内存预算耗尽（期望 %d，收到 %d）", rb.next, seq)
+		}
+		if _, dup := rb.pending[seq]; dup || seq < rb.next {
+			rb.budget.release(int64(len(data)))
+			return nil, nil
+		}
+		if seq > rb.next {
+			rb.pending[seq] = append([]byte(nil), data...)
+			rb.bytes += int64(len(data))
+			return nil, nil
+		}
+		// 等待期间缺口已补齐，按序交付
+		rb.budget.release(int64(len(data)))
+	}
+
+	out := [][]byte{data}
+	rb.next++
+	var freed int64
+	for {
+		d, ok := rb.pending[rb.next]
+		if !ok {
+			break
+		}
+		delete(rb.pending, rb.next)
+		freed += int64(len(d))
+		out = append(out, d)
+		rb.next++
+	}
+	rb.bytes -= freed
+	rb.budget.release(freed)
+	return out, nil
+}
+
+// Delivered 返回已按序交付的帧数（即下一个期望的序号）
+func (rb *ReorderBuffer) Delivered() uint64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.next
+}
+
+// sackRanges 返回乱序缓存中已收到的序号区间（[起, 止) 成对排列，按序号升序，至多 n 个区间，
+// 区间过多时保留序号最大的部分）
+func (rb *ReorderBuffer) sackRanges(n int) []uint64 {
+	rb.mu.Lock()
+	seqs := make([]uint64, 0, len(rb.pending))
+	for seq := range rb.pending {
+		seqs = append(seqs, seq)
+	}
+	rb.mu.Unlock()
+	if len(seqs) == 0 {
+		return nil
+	}
+	slices.Sort(seqs)
+	var ranges []uint64
+	for _, seq := range seqs {
+		if k := len(ranges); k > 0 && ranges[k-1] == seq {
+			ranges[k-1]++
+			continue
+		}
+		ranges = append(ranges, seq, seq+1)
+	}
+	if len(ranges) > 2*n {
+		ranges = ranges[len(ranges)-2*n:]
+	}
+	return ranges
+}
+
+// Discard 流结束时丢弃尚未交付的乱序帧并归还内存预算
+func (rb *ReorderBuffer) Discard() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.budget.release(rb.bytes)
+	rb.pending = make(map[uint64][]byte)
+	rb.bytes = 0
+}
@@ -0,0 +1,106 @@
+package tunnel
+
+import (
+	"reflect"
+	"testing"
+
+	"ech-tunnel/protocol"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	frames := testFrames(t, FrameConfig{StreamBufferMB: 1})
+
+	type step struct {
+		seq  uint64
+		data string
+		want []string // 本次可按序交付的数据
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		next  uint64
+		sack  []uint64
+	}{
+		{"in order", []step{{0, "a", []string{"a"}}, {1, "b", []string{"b"}}}, 2, nil},
+		{"gap filled", []step{{1, "b", nil}, {2, "c", nil}, {0, "a", []string{"a", "b", "c"}}}, 3, nil},
+		{"duplicate", []step{{0, "a", []string{"a"}}, {0, "a", nil}, {2, "c", nil}, {2, "c", nil}}, 1, []uint64{2, 3}},
+		{"sack ranges", []step{{2, "c", nil}, {3, "d", nil}, {5, "f", nil}, {9, "j", nil}}, 0, []uint64{2, 4, 5, 6, 9, 10}},
+		{"partial fill", []step{{1, "b", nil}, {3, "d", nil}, {0, "a", []string{"a", "b"}}}, 2, []uint64{3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rb := frames.NewReorderBuffer()
+			for _, s := range tt.steps {
+				out, err := rb.Push(s.seq, []byte(s.data))
+				if err != nil {
+					t.Fatalf("push(%d): %v", s.seq, err)
+				}
+				var got []string
+				for _, d := range out {
+					got = append(got, string(d))
+				}
+				if !reflect.DeepEqual(got, s.want) {
+					t.Fatalf("push(%d) 交付 %q，期望 %q", s.seq, got, s.want)
+				}
+			}
+			if got := rb.Delivered(); got != tt.next {
+				t.Errorf("delivered = %d，期望 %d", got, tt.next)
+			}
+			if got := rb.sackRanges(maxSACKRanges); !reflect.DeepEqual(got, tt.sack) {
+				t.Errorf("sackRanges = %v，期望 %v", got, tt.sack)
+			}
+		})
+	}
+}
+
+func TestReorderBufferLimits(t *testing.T) {
+	frames := testFrames(t, FrameConfig{StreamBufferMB: 1})
+
+	// 区间过多时保留序号最大的部分
+	rb := frames.NewReorderBuffer()
+	for seq := uint64(1); seq <= 11; seq += 2 {
+		if _, err := rb.Push(seq, []byte{0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := rb.sackRanges(2), []uint64{9, 10, 11, 12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sackRanges(2) = %v，期望 %v", got, want)
+	}
+
+	// 乱序缓存超过 -stream-buffer
+	rb = frames.NewReorderBuffer()
+	if _, err := rb.Push(1, make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rb.Push(2, []byte{0}); err == nil {
+		t.Error("乱序缓存超过上限时应返回错误")
+	}
+
+	// 乱序帧数超过 maxReorderPending
+	rb = frames.NewReorderBuffer()
+	for seq := uint64(1); seq <= maxReorderPending; seq++ {
+		if _, err := rb.Push(seq, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := rb.Push(maxReorderPending+1, nil); err == nil {
+		t.Error("乱序帧数超过上限时应返回错误")
+	}
+	rb.Discard()
+	if rb.sackRanges(maxSACKRanges) != nil {
+		t.Error("discard 后仍有乱序帧")
+	}
+}
+
+// testFrames 以 cfg 创建帧层，未设置的单条消息上限取协商下限
+func testFrames(t *testing.T, cfg FrameConfig) *Frames {
+	t.Helper()
+	if cfg.MaxFrameSize == 0 {
+		cfg.MaxFrameSize = protocol.MinMaxFrameSize
+	}
+	f, err := NewFrames(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
@@ -0,0 +1,459 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"ech-tunnel/internal/dnsmsg"
+)
+
+// dnsResolver 服务端解析目标域名所用的自定义解析器（udp/tcp/DoT/DoH）
+type dnsResolver struct {
+	scheme string // udp | tcp | tls | https
+	addr   string // host:port，DoH 时为完整 URL
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IPAddr
+	expires time.Time
+}
+
+// newTargetResolver 按参数（-resolver、-resolver-ttl）创建服务端目标解析器（spec 为空时返回 nil，使用系统解析）
+func newTargetResolver(spec string, ttl time.Duration) (*dnsResolver, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	r, err := newDNSResolver(spec, ttl)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("目标域名解析使用 %s://%s", r.scheme, strings.TrimPrefix(r.addr, "https://"))
+	return r, nil
+}
+
+// newDNSResolver 解析 -resolver 参数，格式: [udp|tcp|tls]://ip[:port] 或 https://host/dns-query，
+// 省略协议时为 udp，省略端口时 udp/tcp 为 53，tls 为 853
+func newDNSResolver(spec string, ttl time.Duration) (*dnsResolver, error) {
+	if !strings.Contains(spec, "://") {
+		spec = "udp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	r := &dnsResolver{scheme: u.Scheme, ttl: ttl, cache: make(map[string]dnsCacheEntry)}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+		port := u.Port()
+		if port == "" {
+			port = "53"
+			if u.Scheme == "tls" {
+				port = "853"
+			}
+		}
+		r.addr = net.JoinHostPort(u.Hostname(), port)
+	case "https":
+		r.addr = u.String()
+		r.client = &http.Client{Timeout: 5 * time.Second}
+	default:
+		return nil, fmt.Errorf("不支持的解析器协议: %s（可选 udp|tcp|tls|https）", u.Scheme)
+	}
+	return r, nil
+}
+
+const (
+	lookupTimeout  = 10 * time.Second // 合并后的单次查询不随发起连接取消，以此为上限
+	winnerTTL      = 10 * time.Minute // Happy Eyeballs 胜出地址的保留时长
+	hostCacheSweep = 4096             // 条目数达到该值时清理过期条目
+)
+
+// hostCache 服务端目标域名解析缓存：同一域名的并发查询只实际查询一次；未配置 -resolver 时
+// 系统解析结果按 -resolve-cache 缓存（自定义解析器自行按记录 TTL 缓存）；并记录最近一次
+// Happy Eyeballs 竞速胜出的地址，后续连接优先尝试该地址，避免每次重新竞速
+type hostCache struct {
+	resolver *dnsResolver  // 为 nil 时使用系统解析
+	ttl      time.Duration // 系统解析结果的缓存时长（-resolve-cache）
+
+	mu       sync.Mutex
+	entries  map[string]dnsCacheEntry
+	inflight map[string]*lookupCall
+	winners  map[string]winnerEntry
+}
+
+type lookupCall struct {
+	done chan struct{}
+	ips  []net.IPAddr
+	err  error
+}
+
+type winnerEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+func newHostCache(resolver *dnsResolver, ttl time.Duration) *hostCache {
+	return &hostCache{
+		resolver: resolver,
+		ttl:      ttl,
+		entries:  make(map[string]dnsCacheEntry),
+		inflight: make(map[string]*lookupCall),
+		winners:  make(map[string]winnerEntry),
+	}
+}
+
+// lookup 解析目标域名（配置了 -resolver 时使用自定义解析器），合并同一域名的并发查询
+func (c *hostCache) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	c.mu.Lock()
+	if e, ok := c.entries[host]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.ips, nil
+	}
+	call, ok := c.inflight[host]
+	if !ok {
+		call = &lookupCall{done: make(chan struct{})}
+		c.inflight[host] = call
+		go c.resolve(context.WithoutCancel(ctx), host, call)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.ips, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve 实际查询 host，结果交给所有等待的连接
+func (c *hostCache) resolve(ctx context.Context, host string, call *lookupCall) {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	if c.resolver != nil {
+		call.ips, call.err = c.resolver.LookupIPAddr(ctx, host)
+	} else {
+		call.ips, call.err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	delete(c.inflight, host)
+	if call.err == nil && c.resolver == nil && c.ttl > 0 {
+		if len(c.entries) >= hostCacheSweep {
+			for k, e := range c.entries {
+				if !now.Before(e.expires) {
+					delete(c.entries, k)
+				}
+			}
+		}
+		c.entries[host] = dnsCacheEntry{ips: call.ips, expires: now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// preferWinner 将 host 最近一次竞速胜出且仍在 ips 中的地址移到最前
+func (c *hostCache) preferWinner(host string, ips []net.IP) []net.IP {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	c.mu.Lock()
+	w, ok := c.winners[host]
+	c.mu.Unlock()
+	if !ok || !time.Now().Before(w.expires) {
+		return ips
+	}
+	for i, ip := range ips {
+		if ip.Equal(w.ip) {
+			out := make([]net.IP, 0, len(ips))
+			out = append(out, ip)
+			out = append(out, ips[:i]...)
+			return append(out, ips[i+1:]...)
+		}
+	}
+	return ips
+}
+
+// recordWinner 记录 host 竞速胜出的地址
+func (c *hostCache) recordWinner(host string, ip net.IP) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.winners) >= hostCacheSweep {
+		for k, w := range c.winners {
+			if !now.Before(w.expires) {
+				delete(c.winners, k)
+			}
+		}
+	}
+	c.winners[host] = winnerEntry{ip: ip, expires: now.Add(winnerTTL)}
+}
+
+// resolveUDPTarget 解析 UDP 目标地址，按 -prefer-family 选取首个地址（acl 与 src 为该会话的目标地址限制与出口地址）
+func (s *Server) resolveUDPTarget(ctx context.Context, target string, acl *targetACL, src *egressAddrs) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if err := acl.check(ip); err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	ips, err := s.targetCache.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ordered := sortAddrFamilies(ips, s.cfg.PreferFamily, src)
+	if len(ordered) == 0 {
+		return nil, fmt.Errorf("%s 没有可用的 %s 地址", host, s.cfg.PreferFamily)
+	}
+	if ordered, err = acl.filter(host, ordered); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ordered[0], Port: port}, nil
+}
+
+// LookupIPAddr 并发查询 A 与 AAAA 记录，结果按记录 TTL（或 -resolver-ttl）缓存
+func (r *dnsResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	r.mu.Lock()
+	if e, ok := r.cache[host]; ok && time.Now().Before(e.expires) {
+		r.mu.Unlock()
+		return e.ips, nil
+	}
+	r.mu.Unlock()
+
+	type answer struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	ch := make(chan answer, 2)
+	for _, qtype := range []uint16{dnsmsg.TypeA, dnsmsg.TypeAAAA} {
+		go func(qtype uint16) {
+			resp, err := r.exchange(ctx, dnsmsg.BuildQuery(host, qtype))
+			if err != nil {
+				ch <- answer{err: err}
+				return
+			}
+			ips, ttl, err := parseAddrAnswers(resp, qtype)
+			ch <- answer{ips, ttl, err}
+		}(qtype)
+	}
+
+	var ips []net.IPAddr
+	var firstErr error
+	minTTL := uint32(0)
+	for i := 0; i < 2; i++ {
+		a := <-ch
+		if a.err != nil {
+			if firstErr == nil {
+				firstErr = a.err
+			}
+			continue
+		}
+		for _, ip := range a.ips {
+			ips = append(ips, net.IPAddr{IP: ip})
+		}
+		if len(a.ips) > 0 && (minTTL == 0 || a.ttl < minTTL) {
+			minTTL = a.ttl
+		}
+	}
+	if len(ips) == 0 {
+		if firstErr == nil {
+			firstErr = errors.New("没有 A/AAAA 记录")
+		}
+		return nil, fmt.Errorf("解析 %s 失败: %w", host, firstErr)
+	}
+
+	ttl := r.ttl
+	if ttl <= 0 {
+		ttl = time.Duration(minTTL) * time.Second
+	}
+	names := make([]string, len(ips))
+	for i, ip := range ips {
+		names[i] = ip.String()
+	}
+	log.Printf("[解析] %s -> %s（%s://%s，缓存 %s）", host, strings.Join(names, ","), r.scheme, strings.TrimPrefix(r.addr, "https://"), ttl)
+	if ttl > 0 {
+		r.mu.Lock()
+		r.cache[host] = dnsCacheEntry{ips: ips, expires: time.Now().Add(ttl)}
+		r.mu.Unlock()
+	}
+	return ips, nil
+}
+
+// exchange 发送一次 DNS 查询并返回与之匹配（ID 与问题段一致）的响应报文
+func (r *dnsResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	resp, err := r.exchangeOnce(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := dnsmsg.CheckResponse(query, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (r *dnsResolver) exchangeOnce(ctx context.Context, query []byte) ([]byte, error) {
+	switch r.scheme {
+	case "https":
+		req, err := http.NewRequestWithContext(ctx, "POST", r.addr, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/dns-message")
+		req.Header.Set("Content-Type", "application/dns-message")
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("DoH 服务器返回错误: %d", resp.StatusCode)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, 65535))
+	case "udp":
+		resp, err := r.exchangeUDP(ctx, query)
+		// 响应被截断（TC）时改用 TCP 重试
+		if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+			return r.exchangeStream(ctx, query, false)
+		}
+		return resp, err
+	default:
+		return r.exchangeStream(ctx, query, r.scheme == "tls")
+	}
+}
+
+func (r *dnsResolver) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	// 与查询不匹配的报文（迟到或伪造的应答）丢弃后继续等待，直到超时
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if dnsmsg.CheckResponse(query, buf[:n]) == nil {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream 通过 TCP 或 DoT 查询（报文带 2 字节长度前缀）
+func (r *dnsResolver) exchangeStream(ctx context.Context, query []byte, useTLS bool) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if useTLS {
+		host, _, _ := net.SplitHostPort(r.addr)
+		d := tls.Dialer{Config: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}}
+		conn, err = d.DialContext(ctx, "tcp", r.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// parseAddrAnswers 从响应报文中提取 A/AAAA 记录及最小 TTL
+func parseAddrAnswers(msg []byte, qtype uint16) ([]net.IP, uint32, error) {
+	if len(msg) < 12 {
+		return nil, 0, errors.New("响应长度无效")
+	}
+	switch rcode := msg[3] & 0x0F; rcode {
+	case 0:
+	case 3:
+		return nil, 0, errors.New("域名不存在")
+	default:
+		return nil, 0, fmt.Errorf("DNS 服务器返回错误码 %d", rcode)
+	}
+	qdcount := binary.BigEndian.Uint16(msg[4:6])
+	ancount := binary.BigEndian.Uint16(msg[6:8])
+	offset := 12
+	for i := 0; i < int(qdcount); i++ {
+		offset = dnsmsg.SkipName(msg, offset) + 4
+	}
+
+	var ips []net.IP
+	var minTTL uint32
+	for i := 0; i < int(ancount); i++ {
+		offset = dnsmsg.SkipName(msg, offset)
+		if offset+10 > len(msg) {
+			break
+		}
+		rrType := binary.BigEndian.Uint16(msg[offset : offset+2])
+		ttl := binary.BigEndian.Uint32(msg[offset+4 : offset+8])
+		dataLen := int(binary.BigEndian.Uint16(msg[offset+8 : offset+10]))
+		offset += 10
+		if offset+dataLen > len(msg) {
+			break
+		}
+		data := msg[offset : offset+dataLen]
+		offset += dataLen
+		// CNAME 等其他记录跳过，仅取与查询类型一致的地址记录
+		if rrType != qtype || (rrType == dnsmsg.TypeA && dataLen != 4) || (rrType == dnsmsg.TypeAAAA && dataLen != 16) {
+			continue
+		}
+		ips = append(ips, net.IP(append([]byte(nil), data...)))
+		if minTTL == 0 || ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+	return ips, minTTL, nil
+}
@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"ech-tunnel/internal/dnsmsg"
+	"ech-tunnel/internal/dnsmsg/dnstest"
+)
+
+func TestParseAddrAnswers(t *testing.T) {
+	query := dnstest.Query(0x1234, "www.example.com", dnsmsg.TypeA)
+	cname := dnstest.RR{Type: 5, TTL: 300, Data: []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0xC0, 16}}
+	a1 := dnstest.RR{Type: dnsmsg.TypeA, TTL: 120, Data: []byte{93, 184, 216, 34}}
+	a2 := dnstest.RR{Type: dnsmsg.TypeA, TTL: 60, Data: []byte{93, 184, 216, 35}}
+	aaaa := dnstest.RR{Type: dnsmsg.TypeAAAA, TTL: 30, Data: net.ParseIP("2606:2800:220:1::1")}
+	tests := []struct {
+		name    string
+		msg     []byte
+		qtype   uint16
+		ips     []string
+		ttl     uint32
+		wantErr bool
+	}{
+		{"cname and a", dnstest.Response(query, 0, cname, a1, a2), dnsmsg.TypeA, []string{"93.184.216.34", "93.184.216.35"}, 60, false},
+		{"skip other type", dnstest.Response(query, 0, aaaa, a1), dnsmsg.TypeA, []string{"93.184.216.34"}, 120, false},
+		{"aaaa", dnstest.Response(query, 0, a1, aaaa), dnsmsg.TypeAAAA, []string{"2606:2800:220:1::1"}, 30, false},
+		{"bad a length", dnstest.Response(query, 0, dnstest.RR{Type: dnsmsg.TypeA, TTL: 60, Data: []byte{1, 2, 3}}), dnsmsg.TypeA, nil, 0, false},
+		{"truncated", dnstest.Response(query, 0, a1)[:len(query)+12], dnsmsg.TypeA, nil, 0, false},
+		{"nxdomain", dnstest.Response(query, 3), dnsmsg.TypeA, nil, 0, true},
+		{"servfail", dnstest.Response(query, 2), dnsmsg.TypeA, nil, 0, true},
+		{"short", query[:10], dnsmsg.TypeA, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, ttl, err := parseAddrAnswers(tt.msg, tt.qtype)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v，期望出错 %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tt.ips) || ttl != tt.ttl {
+				t.Errorf("parseAddrAnswers = %v, TTL %d，期望 %v, TTL %d", got, ttl, tt.ips, tt.ttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"ech-tunnel/protocol"
+)
+
+// resumeSession 服务端一个客户端连接池的会话（协议版本 5）：同一会话的各通道共享 TCP 流表，
+// 某通道断开时其上的流不随之关闭，而是保留 -resume-timeout，等待客户端重连后以 RESUME 帧
+// 在新通道上恢复；双方从对端已交付的位置重传在途数据，本地连接无感知
+type resumeSession struct {
+	key    string
+	ctx    context.Context // 会话过期时取消，关闭其余全部流
+	cancel context.CancelFunc
+
+	connMu sync.RWMutex
+	conns  map[string]*tcpStream
+
+	table    *resumeTable
+	channels int         // 当前已连接的通道数（由 table.mu 保护）
+	expiry   *time.Timer // 最后一个通道断开后的过期定时器
+}
+
+// resumeTable 服务端的全部可恢复会话，timeout 为流等待恢复的时长（-resume-timeout）
+type resumeTable struct {
+	mu      sync.Mutex
+	m       map[string]*resumeSession
+	timeout time.Duration
+}
+
+func newResumeTable(timeout time.Duration) *resumeTable {
+	return &resumeTable{m: make(map[string]*resumeSession), timeout: timeout}
+}
+
+// acquire 新通道加入会话（不存在时创建），会话按 token 隔离
+func (t *resumeTable) acquire(sess *sessionInfo, id string) *resumeSession {
+	key := sess.tokenID + "|" + id
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rs := t.m[key]
+	if rs == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		rs = &resumeSession{key: key, ctx: ctx, cancel: cancel, conns: make(map[string]*tcpStream), table: t}
+		t.m[key] = rs
+	}
+	if rs.expiry != nil {
+		rs.expiry.Stop()
+		rs.expiry = nil
+	}
+	rs.channels++
+	return rs
+}
+
+// release 通道离开会话；最后一个通道断开超过 -resume-timeout 仍无通道加入时删除会话并关闭其余流
+func (rs *resumeSession) release() {
+	t := rs.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rs.channels--
+	if rs.channels > 0 {
+		return
+	}
+	rs.expiry = time.AfterFunc(t.timeout, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if rs.channels > 0 || t.m[rs.key] != rs {
+			return
+		}
+		delete(t.m, rs.key)
+		rs.cancel()
+	})
+}
+
+// detachLocked 承载流的通道已断开：保留流等待恢复，超时仍未恢复则关闭（调用方持有 rs.connMu）
+func (rs *resumeSession) detachLocked(connID string, st *tcpStream) {
+	st.ch.Store(nil)
+	if st.expiry != nil {
+		st.expiry.Stop()
+	}
+	st.expiry = time.AfterFunc(rs.table.timeout, func() {
+		rs.connMu.Lock()
+		defer rs.connMu.Unlock()
+		if st.ch.Load() != nil || rs.conns[connID] != st {
+			return
+		}
+		log.Printf("[服务端] 连接 %s 超过 %s 未恢复，关闭", connID, rs.table.timeout)
+		st.expired.Store(true)
+		_ = st.conn.Close()
+		st.finish()
+	})
+}
+
+// attachLocked 将流切换到新通道（调用方持有 rs.connMu）。客户端可能先于服务端察觉旧通道失联，
+// 因此流仍挂在旧通道上时同样切换
+func (rs *resumeSession) attachLocked(connID string, st *tcpStream, ch *serverChannel) {
+	if ch.closed {
+		rs.detachLocked(connID, st)
+		return
+	}
+	if st.expiry != nil {
+		st.expiry.Stop()
+		st.expiry = nil
+	}
+	st.ch.Store(ch)
+}
+
+// serverChannel 服务端一个 WebSocket 通道的写入端
+type serverChannel struct {
+	ws      TunnelConn
+	version int
+	mu      *sync.Mutex
+	sq      *SendQueue
+	rs      *resumeSession // 通道所属的可恢复会话（未启用会话恢复时为 nil）
+	closed  bool           // 通道已断开（由流表锁保护）
+	recv    ActivityClock  // 最近一次收到客户端消息的时间
+}
+
+var errStreamDetached = errors.New("流所在通道已断开，等待恢复")
+
+// channelIdle 流当前所在通道的空闲时长（发送窗口等待用）；等待恢复期间视为已失联
+func (st *tcpStream) channelIdle() time.Duration {
+	ch := st.ch.Load()
+	if ch == nil {
+		return CCStallTimeout
+	}
+	return ch.recv.Idle()
+}
+
+// control 在流当前所在的通道上发送控制帧（等待恢复期间返回错误）
+func (st *tcpStream) control(f protocol.ControlFrame) error {
+	ch := st.ch.Load()
+	if ch == nil {
+		return errStreamDetached
+	}
+	return WriteControl(ch.ws, ch.mu, ch.version, f)
+}
+
+// resumeStream 流已切换到通道 ch：回复本端已交付的位置，从对端已交付的位置（peerSeq）起重传在途数据，
+// 断开期间发出的 FIN 一并重发
+func resumeStream(connID string, st *tcpStream, ch *serverChannel, peerSeq uint64, connMu *sync.RWMutex) {
+	first, frames, ok := st.cc.Resume(peerSeq)
+	if !ok {
+		log.Printf("[服务端] 连接 %s 缺少重传数据，无法恢复", connID)
+		_ = st.conn.Close()
+		return
+	}
+	_ = WriteControl(ch.ws, ch.mu, ch.version, protocol.ControlFrame{Type: protocol.CtrlResume, ConnID: connID, Seq: st.recv.Delivered()})
+	for i, data := range frames {
+		seq := first + uint64(i)
+		if err := ch.sq.Push(connID, st.prio, seq, QueuedPayload(data)); err != nil {
+			return
+		}
+	}
+	connMu.RLock()
+	finSent := st.finSent
+	connMu.RUnlock()
+	if finSent {
+		ch.sq.Drain(connID)
+		_ = WriteControl(ch.ws, ch.mu, ch.version, protocol.ControlFrame{Type: protocol.CtrlFIN, ConnID: connID})
+	}
+	log.Printf("[服务端] 连接 %s 已在新通道上恢复，重传 %d 帧", connID, len(frames))
+}
@@ -0,0 +1,264 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// StreamPriority 流的发送优先级（数值越小越优先）
+type StreamPriority int
+
+const (
+	priorityInteractive StreamPriority = iota // 交互式流（SSH、RDP 等），优先获得通道发送权
+	priorityBulk                              // 批量传输
+	numPriorities
+)
+
+// TCP 建连帧 Flags 中的优先级位（均未设置时服务端按目标端口推断，兼容旧客户端）
+const (
+	tcpFlagInteractive = 1 << iota
+	tcpFlagBulk
+)
+
+func (p StreamPriority) String() string {
+	if p == priorityInteractive {
+		return "interactive"
+	}
+	return "bulk"
+}
+
+// ParsePriority 解析规则参数中的优先级
+func ParsePriority(s string) (StreamPriority, error) {
+	switch s {
+	case "interactive", "high":
+		return priorityInteractive, nil
+	case "bulk", "low":
+		return priorityBulk, nil
+	}
+	return 0, fmt.Errorf("无效的优先级: %s（可选 interactive/high、bulk/low）", s)
+}
+
+// PriorityFor 按目标端口推断优先级：NoDelayPorts 中的端口视为交互式
+func (f *Frames) PriorityFor(target string) StreamPriority {
+	if f.IsLowLatencyTarget(target) {
+		return priorityInteractive
+	}
+	return priorityBulk
+}
+
+// TCPFlags 返回 TCP 建连帧中表示优先级的 Flags
+func (p StreamPriority) TCPFlags() uint64 {
+	if p == priorityInteractive {
+		return tcpFlagInteractive
+	}
+	return tcpFlagBulk
+}
+
+// priorityFromFlags 解析客户端在 TCP 建连帧中声明的优先级，未声明时按目标端口推断
+func (f *Frames) priorityFromFlags(flags uint64, target string) StreamPriority {
+	switch {
+	case flags&tcpFlagInteractive != 0:
+		return priorityInteractive
+	case flags&tcpFlagBulk != 0:
+		return priorityBulk
+	}
+	return f.PriorityFor(target)
+}
+
+const (
+	// 同一优先级内按赤字轮询（DRR）调度时每个流每轮获得的发送额度
+	drrQuantum = 64 << 10
+	// 单个流在发送队列中至多排队的字节数（至少可排入一帧），超过时阻塞该流的读取
+	sendQueueStreamBytes = 256 << 10
+)
+
+// SendQueue 单个通道的 DATA 帧发送队列：各流读取到的数据先进入自己的队列，由通道的发送协程
+// 按优先级取出写入（交互式流先于批量流，SSH 等不必排在大文件传输的全部数据帧之后），
+// 同一优先级内按赤字轮询在流之间按字节公平分配带宽，单个快速流不会独占通道。
+// 控制帧不经过队列；流的 FIN/CLOSE 须先调用 drain 等待该流已排队的数据发出
+type SendQueue struct {
+	mu     sync.Mutex
+	flows  map[string]*queuedFlow
+	active [numPriorities][]*queuedFlow // 各优先级有待发送帧的流（轮询顺序）
+	wake   chan struct{}
+	closed bool
+}
+
+// queuedFlow 发送队列中的单个流
+type queuedFlow struct {
+	key     string
+	prio    StreamPriority
+	deficit int
+	frames  []queuedFrame
+	bytes   int  // 已排队与正在写入的字节数
+	listed  bool // 是否在轮询列表中
+	err     error
+	space   chan struct{} // 每发出一帧关闭并替换，唤醒等待队列空间或 drain 的一方
+}
+
+type queuedFrame struct {
+	seq uint64
+	bp  *[]byte
+}
+
+var errSendQueueClosed = errors.New("通道发送队列已关闭")
+
+func NewSendQueue() *SendQueue {
+	return &SendQueue{flows: make(map[string]*queuedFlow), wake: make(chan struct{}, 1)}
+}
+
+// Push 将流 key 序号为 seq 的帧负载放入队列（接管 bp 的所有权），该流排队数据过多时阻塞；
+// 队列已关闭或该流此前的帧写入失败时返回错误
+func (q *SendQueue) Push(key string, prio StreamPriority, seq uint64, bp *[]byte) error {
+	n := len(*bp)
+	q.mu.Lock()
+	var f *queuedFlow
+	for {
+		err := errSendQueueClosed
+		if !q.closed {
+			// 每次唤醒后重新查找：等待期间流的队列状态可能已被释放
+			if f = q.flows[key]; f == nil {
+				f = &queuedFlow{key: key, prio: prio, space: make(chan struct{})}
+				q.flows[key] = f
+			}
+			err = f.err
+		}
+		if err != nil {
+			q.mu.Unlock()
+			PutFrameBuf(bp)
+			return err
+		}
+		if f.bytes == 0 || f.bytes+n <= sendQueueStreamBytes {
+			break
+		}
+		space := f.space
+		q.mu.Unlock()
+		<-space
+		q.mu.Lock()
+	}
+	f.frames = append(f.frames, queuedFrame{seq: seq, bp: bp})
+	f.bytes += n
+	if !f.listed {
+		f.listed = true
+		q.active[prio] = append(q.active[prio], f)
+	}
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next 按优先级与赤字轮询取出下一帧，队列为空时阻塞；队列关闭后返回 false
+func (q *SendQueue) next() (*queuedFlow, queuedFrame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return nil, queuedFrame{}, false
+		}
+		for prio := range q.active {
+			for len(q.active[prio]) > 0 {
+				f := q.active[prio][0]
+				if len(f.frames) == 0 {
+					// 流已无待发送帧：移出轮询，额度清零（空闲流不积累额度）
+					q.active[prio] = q.active[prio][1:]
+					f.listed, f.deficit = false, 0
+					if f.bytes == 0 && f.err == nil && q.flows[f.key] == f {
+						delete(q.flows, f.key)
+					}
+					continue
+				}
+				fr := f.frames[0]
+				if f.deficit < len(*fr.bp) {
+					// 额度不足：补充一轮额度并移到队尾
+					f.deficit += drrQuantum
+					q.active[prio] = append(q.active[prio][1:], f)
+					continue
+				}
+				f.deficit -= len(*fr.bp)
+				f.frames = f.frames[1:]
+				return f, fr, true
+			}
+		}
+		q.mu.Unlock()
+		<-q.wake
+		q.mu.Lock()
+	}
+}
+
+// done 一帧写入完成（err 非空时该流后续 push 返回该错误）
+func (q *SendQueue) done(f *queuedFlow, n int, err error) {
+	q.mu.Lock()
+	f.bytes -= n
+	if err != nil {
+		// 通道写入失败：该流已无法按序交付，丢弃其余排队帧
+		f.err = err
+		for _, fr := range f.frames {
+			f.bytes -= len(*fr.bp)
+			PutFrameBuf(fr.bp)
+		}
+		f.frames = nil
+	}
+	if f.bytes == 0 && !f.listed && f.err == nil && q.flows[f.key] == f {
+		delete(q.flows, f.key)
+	}
+	close(f.space)
+	f.space = make(chan struct{})
+	q.mu.Unlock()
+}
+
+// Drain 等待流 key 已排队的帧全部写出（或队列关闭），并释放该流的队列状态
+func (q *SendQueue) Drain(key string) {
+	q.mu.Lock()
+	for {
+		f := q.flows[key]
+		if f == nil {
+			break
+		}
+		if q.closed || f.bytes == 0 {
+			delete(q.flows, key)
+			break
+		}
+		space := f.space
+		q.mu.Unlock()
+		<-space
+		q.mu.Lock()
+	}
+	q.mu.Unlock()
+}
+
+// Run 发送协程：依次取出帧并调用 write 写入通道，直至队列关闭
+func (q *SendQueue) Run(write func(connID string, seq uint64, payload []byte) error) {
+	for {
+		f, fr, ok := q.next()
+		if !ok {
+			return
+		}
+		n := len(*fr.bp)
+		err := write(f.key, fr.seq, *fr.bp)
+		PutFrameBuf(fr.bp)
+		q.done(f, n, err)
+	}
+}
+
+// close 关闭队列：丢弃未发出的帧并唤醒所有等待者
+func (q *SendQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	for _, f := range q.flows {
+		for _, fr := range f.frames {
+			PutFrameBuf(fr.bp)
+		}
+		f.frames = nil
+		close(f.space)
+		f.space = make(chan struct{})
+	}
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
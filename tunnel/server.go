@@ -0,0 +1,422 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ech-tunnel/echdns"
+)
+
+// ServerConfig 隧道服务端参数（对应 -token、-path、-access-log 等命令行参数）
+type ServerConfig struct {
+	Frames *Frames // 帧层，不能为 nil
+	Routes []Route // 隧道路径，至少一个
+
+	FallbackURL string // 非隧道请求回落的站点（http:// 或 https://），为空时直接返回错误状态码
+	CertFile    string // TLS 证书与私钥文件，任一为空时使用自签名证书
+	KeyFile     string
+	ClientCA    string // 校验客户端证书的 CA 文件，设置后强制 mTLS
+	ECHKeyFile  string // 服务端 ECH 密钥文件，quic:// 必须指定
+
+	HandshakeRate  int           // 每个来源 IP 每分钟的握手次数上限，0 表示不限制
+	DialTimeout    time.Duration // 连接目标的超时，0 表示不限制
+	UDPIdleTimeout time.Duration // UDP 关联的空闲超时，0 表示不回收
+	ResumeTimeout  time.Duration // 通道断开后流等待恢复的时长，0 表示不支持会话恢复
+	PaceRate       float64       // 每个通道的发送节奏带宽（Mbps），0 表示不限制
+	AllowBench     bool          // 允许客户端以测速伪目标测速
+
+	PreferFamily       string        // 目标地址族偏好: auto|ipv4|ipv6|ipv4-only|ipv6-only，为空时为 auto
+	HappyEyeballsDelay time.Duration // 依次连接目标各地址的间隔
+	Resolver           string        // 解析目标域名的 DNS 服务器，为空时使用系统解析
+	ResolverTTL        time.Duration // Resolver 解析结果的缓存时长，0 表示按记录的 TTL
+	ResolveCacheTTL    time.Duration // 系统解析结果的缓存时长，0 表示不缓存
+	EgressIP           string        // 出站源地址（一个 IPv4 与一个 IPv6，逗号分隔）
+	EgressInterface    string        // 出站网络接口
+	EgressMark         uint          // 出站套接字的防火墙标记（仅 Linux）
+	SockOpts           SockOpts      // 出站 TCP 连接的套接字选项
+
+	BlockPorts    string   // 禁止的目标端口
+	AllowPorts    string   // 放行的目标端口，优先于 BlockPorts
+	DenyPrivate   bool     // 禁止连接内网地址
+	DenyCIDRs     string   // 禁止的目标网段（逗号分隔）
+	TokenPolicies []string // 各令牌的权限（格式见 parseTokenPolicy）
+	UsageFile     string   // 保存各令牌每月流量的文件，为空时只在内存中计数
+
+	AccessLog        string        // 访问日志文件，为空时不记录
+	AccessLogMaxSize int           // 单个日志文件的上限（MB），0 表示不限制
+	AccessLogRotate  time.Duration // 日志轮转周期，0 表示不按时间轮转
+	AccessLogBackups int           // 保留的轮转备份数，0 表示全部保留
+	AuditLog         string        // 审计日志文件（JSON Lines），为空时不记录
+	AuditDest        string        // 审计日志中目标地址的记录方式: full|hash|truncate，为空时为 full
+	AuditSecretFile  string        // AuditDest 为 hash 时的密钥文件，为空时为审计日志路径加 -secret
+
+	GeoIPDB    string // MaxMind 数据库文件
+	GeoIPAllow string // 允许的国家/地区代码（逗号分隔）
+	GeoIPDeny  string // 拒绝的国家/地区代码（逗号分隔）
+
+	Relay Relay // 中继模式下通往下一跳的连接，为 nil 时直接连接目标
+}
+
+// Relay 中继模式下经下一跳服务端连接目标（见 ServerConfig.Relay），first 为随建连请求发出的首帧
+type Relay interface {
+	Dial(ctx context.Context, target, first string, prio StreamPriority) (net.Conn, error)
+}
+
+// Server 隧道服务端：按路径校验来源与令牌后承载客户端的通道，并按服务端策略连接目标
+type Server struct {
+	cfg     ServerConfig
+	frames  *Frames
+	routes  []*serverRoute
+	handler http.Handler
+
+	upgradeLimiter *handshakeLimiter // -handshake-rate 为 0 时为 nil
+	geoFilter      *geoIPFilter      // 未配置 GeoIP 时为 nil
+	targetPorts    *portPolicy
+	targetIPs      *targetACL
+	egressIPs      *egressAddrs // 默认出口地址，令牌可另行指定
+	egressSock     egressSocket
+	targetCache    *hostCache
+	tokenPolicies  map[string]*tokenPolicy // 按令牌索引，未列出的令牌不受额外限制
+	trafficUsage   *usageMeter
+	accessLog      *rotatingFile // 未配置时为 nil
+	auditLog       *rotatingFile // 未配置时为 nil
+	auditKey       []byte        // AuditDest 为 hash 时计算主机名 HMAC 的密钥
+	resumeSessions *resumeTable
+	serverStreams  *streamTable
+
+	activeSessions   atomic.Int64
+	activeTCPStreams atomic.Int64
+	activeUDPStreams atomic.Int64
+}
+
+// NewServer 校验参数，打开日志并载入各项服务端策略
+func NewServer(cfg ServerConfig) (*Server, error) {
+	if cfg.Frames == nil {
+		return nil, errors.New("缺少帧层配置")
+	}
+	if len(cfg.Routes) == 0 {
+		return nil, errors.New("至少需要一个隧道路径")
+	}
+	if cfg.PreferFamily == "" {
+		cfg.PreferFamily = "auto"
+	}
+	switch cfg.PreferFamily {
+	case "auto", "ipv4", "ipv6", "ipv4-only", "ipv6-only":
+	default:
+		return nil, fmt.Errorf("无效的地址族偏好: %s（可选 auto|ipv4|ipv6|ipv4-only|ipv6-only）", cfg.PreferFamily)
+	}
+	if cfg.AuditDest == "" {
+		cfg.AuditDest = "full"
+	}
+	s := &Server{
+		cfg:            cfg,
+		frames:         cfg.Frames,
+		upgradeLimiter: newHandshakeLimiter(cfg.HandshakeRate),
+		egressSock:     egressSocket{iface: cfg.EgressInterface, mark: cfg.EgressMark},
+		resumeSessions: newResumeTable(cfg.ResumeTimeout),
+		serverStreams:  newStreamTable(),
+	}
+
+	seen := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for _, r := range cfg.Routes {
+		rt, err := newServerRoute(r.Path, r.Token, r.CIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("无效的隧道路径 %q: %w", r.Path, err)
+		}
+		if seen[rt.path] {
+			return nil, fmt.Errorf("重复的监听路径: %s", rt.path)
+		}
+		seen[rt.path] = true
+		tokens[rt.token] = true
+		s.routes = append(s.routes, rt)
+	}
+
+	var err error
+	if s.accessLog, err = openAccessLog(cfg); err != nil {
+		return nil, fmt.Errorf("打开访问日志失败: %w", err)
+	}
+	if s.auditLog, s.auditKey, err = openAuditLog(cfg); err != nil {
+		return nil, fmt.Errorf("打开审计日志失败: %w", err)
+	}
+	if s.geoFilter, err = newGeoIPFilter(cfg.GeoIPDB, cfg.GeoIPAllow, cfg.GeoIPDeny); err != nil {
+		return nil, fmt.Errorf("加载 GeoIP 数据库失败: %w", err)
+	}
+	if s.egressIPs, err = newEgress(cfg.EgressIP, cfg.EgressInterface, cfg.EgressMark); err != nil {
+		return nil, fmt.Errorf("无效的出口地址配置: %w", err)
+	}
+	resolver, err := newTargetResolver(cfg.Resolver, cfg.ResolverTTL)
+	if err != nil {
+		return nil, fmt.Errorf("无效的目标解析器: %w", err)
+	}
+	s.targetCache = newHostCache(resolver, cfg.ResolveCacheTTL)
+	if s.targetPorts, err = newPortPolicy(cfg.BlockPorts, cfg.AllowPorts); err != nil {
+		return nil, fmt.Errorf("无效的目标端口策略: %w", err)
+	}
+	if s.targetIPs, err = newTargetACL(cfg.DenyPrivate, cfg.DenyCIDRs); err != nil {
+		return nil, fmt.Errorf("无效的目标网段: %w", err)
+	}
+	if s.tokenPolicies, err = parseTokenPolicies(cfg.TokenPolicies, tokens); err != nil {
+		return nil, fmt.Errorf("无效的令牌权限: %w", err)
+	}
+	if s.trafficUsage, err = newUsageMeter(tokens, tokenQuotas(s.tokenPolicies), cfg.UsageFile); err != nil {
+		return nil, fmt.Errorf("载入流量计数失败: %w", err)
+	}
+	if s.handler, err = s.newHandler(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newHandler 创建隧道路由：各路径的隧道处理器与回落反向代理。隧道使用独立的路由，
+// 不暴露注册在默认路由上的调试接口（如 expvar 的 /debug/vars）
+func (s *Server) newHandler() (http.Handler, error) {
+	mux := http.NewServeMux()
+	fallback, err := newFallbackHandler(s.cfg.FallbackURL)
+	if err != nil {
+		return nil, fmt.Errorf("无效的回落地址: %w", err)
+	}
+	if fallback != nil {
+		log.Printf("非隧道流量将回落到: %s", s.cfg.FallbackURL)
+		if !s.hasRoute("/") {
+			mux.Handle("/", fallback)
+		}
+	}
+	for _, rt := range s.routes {
+		mux.Handle(rt.tmpl.pattern, s.newTunnelHandler(rt, fallback))
+		if len(s.routes) > 1 {
+			log.Printf("已注册隧道路径 %s（token: %t，CIDR: %s）", rt.path, rt.token != "", rt.cidrs)
+		}
+	}
+	return mux, nil
+}
+
+func (s *Server) hasRoute(path string) bool {
+	for _, rt := range s.routes {
+		if rt.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler 返回隧道路由，可挂载到自行创建的 HTTP 服务器上
+func (s *Server) Handler() http.Handler { return s.handler }
+
+// ListenAndServe 按 scheme（ws、wss 或 quic）在 addr 上监听并提供隧道服务，直至出错
+func (s *Server) ListenAndServe(scheme, addr string) error {
+	paths := make([]string, len(s.routes))
+	for i, rt := range s.routes {
+		paths[i] = rt.path
+	}
+	path := strings.Join(paths, ",")
+
+	switch scheme {
+	case "quic":
+		tlsCfg, desc, err := s.TLSConfig()
+		if err != nil {
+			return err
+		}
+		ln, err := s.ListenQUIC(addr, tlsCfg)
+		if err != nil {
+			return fmt.Errorf("启动 QUIC 服务端失败: %w", err)
+		}
+		log.Printf("QUIC 服务端使用%s启动，监听 %s%s（UDP）", desc, ln.Addr(), path)
+		return ServeQUIC(ln, s.handler)
+	case "wss":
+		tlsCfg, desc, err := s.TLSConfig()
+		if err != nil {
+			return err
+		}
+		server := &http.Server{
+			Addr:      addr,
+			Handler:   s.handler,
+			TLSConfig: tlsCfg,
+		}
+		log.Printf("WebSocket 服务端使用%s启动，监听 %s%s", desc, addr, path)
+		return server.ListenAndServeTLS("", "")
+	default:
+		log.Printf("WebSocket 服务端启动，监听 %s%s", addr, path)
+		return http.ListenAndServe(addr, s.handler)
+	}
+}
+
+// TLSConfig 服务端 TLS 配置：使用 CertFile/KeyFile 或自签名证书，按 ClientCA 启用 mTLS、按 ECHKeyFile 启用 ECH；
+// 同时返回证书来源的说明
+func (s *Server) TLSConfig() (*tls.Config, string, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS13}
+	desc := "提供的TLS证书"
+	if s.cfg.CertFile != "" && s.cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("加载TLS证书时出错: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	} else {
+		cert, err := GenerateSelfSignedCert()
+		if err != nil {
+			return nil, "", fmt.Errorf("生成自签名证书时出错: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		desc = "自签名证书"
+	}
+	if err := s.applyClientAuth(cfg); err != nil {
+		return nil, "", err
+	}
+	keys, err := echdns.LoadKeys(s.cfg.ECHKeyFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("加载 ECH 密钥失败: %w", err)
+	}
+	if keys != nil {
+		cfg.EncryptedClientHelloKeys = keys
+		log.Printf("已启用服务端 ECH（%d 个配置），密钥文件: %s", len(keys), s.cfg.ECHKeyFile)
+	}
+	return cfg, desc, nil
+}
+
+// applyClientAuth 配置了 ClientCA 时要求并校验客户端证书（mTLS）
+func (s *Server) applyClientAuth(cfg *tls.Config) error {
+	if s.cfg.ClientCA == "" {
+		return nil
+	}
+	pemData, err := os.ReadFile(s.cfg.ClientCA)
+	if err != nil {
+		return fmt.Errorf("读取客户端 CA 文件失败: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return fmt.Errorf("客户端 CA 文件中没有有效证书: %s", s.cfg.ClientCA)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	log.Printf("已启用客户端证书校验（mTLS），CA: %s", s.cfg.ClientCA)
+	return nil
+}
+
+// ServerStats 服务端运行统计
+type ServerStats struct {
+	Sessions   int64 // 活跃的隧道会话
+	TCPStreams int64 // 活跃的 TCP 流
+	UDPStreams int64 // 活跃的 UDP 关联
+}
+
+// Stats 返回服务端运行统计（s 为 nil 时均为 0）
+func (s *Server) Stats() ServerStats {
+	if s == nil {
+		return ServerStats{}
+	}
+	return ServerStats{Sessions: s.activeSessions.Load(), TCPStreams: s.activeTCPStreams.Load(), UDPStreams: s.activeUDPStreams.Load()}
+}
+
+// LogStats 输出配置了权限的各令牌的活动流数与当月流量
+func (s *Server) LogStats() {
+	if s == nil {
+		return
+	}
+	s.logTokenStats()
+	s.trafficUsage.logStats()
+}
+
+// ServeUsage 管理接口 GET /usage：返回各令牌当月与上个月的流量（JSON，与 UsageFile 格式相同）
+func (s *Server) ServeUsage(w http.ResponseWriter, r *http.Request) {
+	s.trafficUsage.serveHTTP(w, r)
+}
+
+// serverStream 服务端的活动流（TCP 流或 UDP 关联），供管理接口列出与终止
+type serverStream struct {
+	connID string
+	sess   *sessionInfo
+	acct   *streamAccounting
+	kill   func() // 关闭目标连接，流随之结束并通知客户端
+}
+
+// streamTable 服务端全部会话的活动流（客户端选择的连接 ID 在不同会话间可能重复，因此按流对象索引）
+type streamTable struct {
+	sync.Mutex
+	m map[*serverStream]struct{}
+}
+
+func newStreamTable() *streamTable {
+	return &streamTable{m: make(map[*serverStream]struct{})}
+}
+
+// track 登记服务端活动流，返回的函数在流结束时注销
+func (t *streamTable) track(connID string, sess *sessionInfo, acct *streamAccounting, kill func()) func() {
+	s := &serverStream{connID: connID, sess: sess, acct: acct, kill: kill}
+	t.Lock()
+	t.m[s] = struct{}{}
+	t.Unlock()
+	return func() {
+		t.Lock()
+		delete(t.m, s)
+		t.Unlock()
+	}
+}
+
+// list 返回服务端活动流（按建立时间排序）
+func (t *streamTable) list() []*serverStream {
+	t.Lock()
+	list := make([]*serverStream, 0, len(t.m))
+	for s := range t.m {
+		list = append(list, s)
+	}
+	t.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].acct.start.Before(list[j].acct.start) })
+	return list
+}
+
+// ServerStream 服务端活动流的快照
+type ServerStream struct {
+	Client string // 客户端 IP
+	Token  string // 令牌摘要（同访问日志）
+	Proto  string // tcp 或 udp
+	ConnID string
+	Target string
+	Up     int64 // 客户端 -> 目标
+	Down   int64 // 目标 -> 客户端
+	Start  time.Time
+}
+
+// Streams 返回服务端全部会话的活动流（按建立时间排序，s 为 nil 时为空）
+func (s *Server) Streams() []ServerStream {
+	if s == nil {
+		return nil
+	}
+	var out []ServerStream
+	for _, st := range s.serverStreams.list() {
+		out = append(out, ServerStream{
+			Client: st.sess.clientIP, Token: st.sess.tokenID, Proto: st.acct.proto, ConnID: st.connID,
+			Target: st.acct.target, Up: st.acct.up.Load(), Down: st.acct.down.Load(), Start: st.acct.start,
+		})
+	}
+	return out
+}
+
+// KillStream 终止连接 ID 为 connID 的服务端流（关闭目标连接，随后向客户端发送原因为 admin_close 的 CLOSE，
+// UDP 关联为 UDP_CLOSE），返回终止的数量
+func (s *Server) KillStream(connID string) int {
+	if s == nil {
+		return 0
+	}
+	n := 0
+	for _, st := range s.serverStreams.list() {
+		if st.connID == connID {
+			st.acct.force(closeAdmin)
+			st.kill()
+			n++
+		}
+	}
+	return n
+}
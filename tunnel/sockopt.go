@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// SockOpts TCP 套接字选项（对应 -tcp-nodelay/-tcp-keepalive/-tcp-rcvbuf/-tcp-sndbuf）
+type SockOpts struct {
+	NoDelay   bool
+	KeepAlive time.Duration // 大于 0 时启用保活并设置间隔，小于 0 时关闭，0 沿用系统默认
+	RecvBuf   int           // 接收缓冲区（字节），0 沿用系统默认
+	SendBuf   int           // 发送缓冲区（字节），0 沿用系统默认
+}
+
+// Tune 设置 TCP 套接字选项，非 TCP 连接（如 UNIX 套接字）直接忽略
+func (o SockOpts) Tune(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tc.SetNoDelay(o.NoDelay); err != nil {
+		log.Printf("设置 TCP_NODELAY 失败: %v", err)
+	}
+	switch {
+	case o.KeepAlive > 0:
+		_ = tc.SetKeepAlive(true)
+		_ = tc.SetKeepAlivePeriod(o.KeepAlive)
+	case o.KeepAlive < 0:
+		_ = tc.SetKeepAlive(false)
+	}
+	if o.RecvBuf > 0 {
+		if err := tc.SetReadBuffer(o.RecvBuf); err != nil {
+			log.Printf("设置接收缓冲区失败: %v", err)
+		}
+	}
+	if o.SendBuf > 0 {
+		if err := tc.SetWriteBuffer(o.SendBuf); err != nil {
+			log.Printf("设置发送缓冲区失败: %v", err)
+		}
+	}
+}
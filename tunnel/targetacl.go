@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// targetACL 服务端隧道流量的目标地址访问控制。检查针对实际连接的 IP：域名目标在解析后逐个校验，
+// 恶意 DNS 应答（DNS 重绑定）无法借域名把流量引向内网或被禁止的网段
+type targetACL struct {
+	denyPrivate bool
+	deny        []*net.IPNet
+	allow       []*net.IPNet // 仅允许的网段（令牌权限，为空时不限制）
+}
+
+// errTargetDenied 目标被服务端策略禁止（端口策略或地址限制）
+var errTargetDenied = errors.New("被服务端策略禁止")
+
+// sharedAddressSpace 运营商级 NAT 地址（RFC 6598），同样视为内网
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// newTargetACL 按参数（-deny-private、-deny-cidr）建立目标地址访问控制
+func newTargetACL(denyPrivate bool, denyCIDRs string) (*targetACL, error) {
+	acl := &targetACL{denyPrivate: denyPrivate}
+	for _, s := range strings.Split(denyCIDRs, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("无效的网段 %s: %w", s, err)
+		}
+		acl.deny = append(acl.deny, ipNet)
+	}
+	if acl.denyPrivate || len(acl.deny) > 0 {
+		log.Printf("目标地址限制: 禁止内网地址 %v，禁止网段 %s", acl.denyPrivate, orNone(denyCIDRs))
+	}
+	return acl, nil
+}
+
+// isPrivateTarget 是否为本机、内网、链路本地、组播或未指定地址
+func isPrivateTarget(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// unrestricted 是否未设置任何地址限制
+func (a *targetACL) unrestricted() bool {
+	return !a.denyPrivate && len(a.deny) == 0 && len(a.allow) == 0
+}
+
+// check 判断是否允许经隧道连接 ip
+func (a *targetACL) check(ip net.IP) error {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4 // v4 映射地址按 IPv4 检查
+	}
+	if a.denyPrivate && isPrivateTarget(ip) {
+		return fmt.Errorf("目标地址 %s 属于内网，%w", ip, errTargetDenied)
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return fmt.Errorf("目标地址 %s 属于禁止的网段 %s，%w", ip, n, errTargetDenied)
+		}
+	}
+	if len(a.allow) == 0 {
+		return nil
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("目标地址 %s 不在允许的网段内，%w", ip, errTargetDenied)
+}
+
+// filter 剔除解析结果中被禁止的地址；全部被禁止时返回首个地址的拒绝原因
+func (a *targetACL) filter(host string, ips []net.IP) ([]net.IP, error) {
+	out := ips[:0:0]
+	var first error
+	for _, ip := range ips {
+		if err := a.check(ip); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		out = append(out, ip)
+	}
+	if len(out) == 0 && first != nil {
+		log.Printf("[服务端] %s 的解析结果均被禁止（可能是 DNS 重绑定）: %v", host, first)
+		return nil, fmt.Errorf("%s 解析到的地址均被禁止: %w", host, first)
+	}
+	return out, nil
+}
@@ -0,0 +1,258 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// tokenPolicy 单个令牌的权限：可用的协议、允许的目标端口与网段、带宽上限，以及出口地址。
+// 在服务端处理 TCP 与 UDP_CONNECT 时检查，与全局端口策略和目标地址限制同时生效
+type tokenPolicy struct {
+	tcp, udp bool
+	ports    *portPolicy // 允许的目标端口（为 nil 时不额外限制）
+	portSpec string
+	nets     []*net.IPNet // 允许的目标网段（为空时不额外限制）
+	rate     float64      // 每个方向的带宽上限（Mbps，0 表示不限制）
+	up, down *Pacer       // 该令牌的全部会话共享
+	src      *egressAddrs // 出口地址（为 nil 时使用 -egress-ip/-egress-interface）
+
+	quota      int64        // 每月流量上限（字节，上下行合计，0 表示不限制）
+	maxStreams int64        // 同时活动的流（TCP 与 UDP 合计）上限，0 表示不限制
+	streams    atomic.Int64 // 该令牌全部会话当前活动的流数
+}
+
+// errStreamQuota 令牌的活动流数已达上限
+var errStreamQuota = errors.New("超过令牌的并发流上限")
+
+// parseTokenPolicy 解析 -token-policy 参数，格式: 令牌?proto=tcp,udp&ports=80,443&cidr=0.0.0.0/0&rate=10&egress=203.0.113.10&streams=200&quota=100
+func parseTokenPolicy(spec string) (string, *tokenPolicy, error) {
+	tok, query, _ := strings.Cut(spec, "?")
+	if tok = strings.TrimSpace(tok); tok == "" {
+		return "", nil, fmt.Errorf("缺少令牌")
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return "", nil, err
+	}
+	tp := &tokenPolicy{tcp: true, udp: true}
+	for key, vals := range q {
+		v := vals[len(vals)-1]
+		switch key {
+		case "proto":
+			tp.tcp, tp.udp = false, false
+			for _, p := range strings.Split(v, ",") {
+				switch strings.ToLower(strings.TrimSpace(p)) {
+				case "tcp":
+					tp.tcp = true
+				case "udp":
+					tp.udp = true
+				default:
+					return "", nil, fmt.Errorf("无效的协议 %s（可选 tcp、udp）", p)
+				}
+			}
+		case "ports":
+			allow, err := parsePortRanges(v)
+			if err != nil {
+				return "", nil, err
+			}
+			tp.ports = &portPolicy{allow: allow, block: []portRange{{lo: 1, hi: 65535}}}
+			tp.portSpec = v
+		case "cidr":
+			for _, s := range strings.Split(v, ",") {
+				_, ipNet, err := net.ParseCIDR(strings.TrimSpace(s))
+				if err != nil {
+					return "", nil, fmt.Errorf("无效的网段 %s", s)
+				}
+				tp.nets = append(tp.nets, ipNet)
+			}
+		case "rate":
+			tp.rate, err = strconv.ParseFloat(v, 64)
+			if err != nil || tp.rate < 0 {
+				return "", nil, fmt.Errorf("无效的带宽上限: %s", v)
+			}
+		case "quota":
+			gb, err := strconv.ParseFloat(v, 64)
+			if err != nil || gb < 0 {
+				return "", nil, fmt.Errorf("无效的每月流量上限: %s", v)
+			}
+			tp.quota = int64(gb * 1e9)
+		case "streams":
+			tp.maxStreams, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || tp.maxStreams < 0 {
+				return "", nil, fmt.Errorf("无效的并发流上限: %s", v)
+			}
+		case "egress":
+			if tp.src, err = parseEgressIPs(v); err != nil {
+				return "", nil, err
+			}
+		default:
+			return "", nil, fmt.Errorf("未知的参数: %s", key)
+		}
+	}
+	tp.up, tp.down = NewPacer(tp.rate), NewPacer(tp.rate)
+	return tok, tp, nil
+}
+
+// parseTokenPolicies 解析全部 -token-policy，返回按令牌索引的权限；known 为各隧道路径配置的令牌，引用未配置的令牌视为错误
+func parseTokenPolicies(specs []string, known map[string]bool) (map[string]*tokenPolicy, error) {
+	m := make(map[string]*tokenPolicy)
+	for _, spec := range specs {
+		tok, tp, err := parseTokenPolicy(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", spec, err)
+		}
+		if !known[tok] {
+			return nil, fmt.Errorf("令牌 %s 未被任何隧道路径使用（见 -token 与 -path）", tokenID(tok))
+		}
+		if _, dup := m[tok]; dup {
+			return nil, fmt.Errorf("令牌 %s 重复配置", tokenID(tok))
+		}
+		m[tok] = tp
+		log.Printf("令牌 %s 的权限: TCP %v，UDP %v，端口 %s，网段 %s，带宽 %s，并发流 %s，每月流量 %s，出口地址 %s",
+			tokenID(tok), tp.tcp, tp.udp, orUnlimited(tp.portSpec), tp.netsString(), tp.rateString(), tp.streamsString(), tp.quotaString(), tp.egressString())
+	}
+	return m, nil
+}
+
+// tokenQuotas 返回 policies 中配置了每月流量上限的令牌（按明文令牌索引）
+func tokenQuotas(policies map[string]*tokenPolicy) map[string]int64 {
+	m := make(map[string]int64)
+	for tok, tp := range policies {
+		if tp.quota > 0 {
+			m[tok] = tp.quota
+		}
+	}
+	return m
+}
+
+// orUnlimited 空值显示为"不限"
+func orUnlimited(s string) string {
+	if s == "" {
+		return "不限"
+	}
+	return s
+}
+
+func (tp *tokenPolicy) netsString() string {
+	s := make([]string, len(tp.nets))
+	for i, n := range tp.nets {
+		s[i] = n.String()
+	}
+	return orUnlimited(strings.Join(s, ","))
+}
+
+func (tp *tokenPolicy) rateString() string {
+	if tp.rate == 0 {
+		return "不限"
+	}
+	return strconv.FormatFloat(tp.rate, 'f', -1, 64) + " Mbps"
+}
+
+// checkTarget 判断令牌 tp 是否可经 proto（tcp/udp）连接 target（host:port），并检查全局端口策略
+func (s *Server) checkTarget(tp *tokenPolicy, proto, target string) error {
+	if err := s.checkTargetPort(proto, target); err != nil {
+		return err
+	}
+	if tp == nil {
+		return nil
+	}
+	if (proto == "tcp" && !tp.tcp) || (proto == "udp" && !tp.udp) {
+		return fmt.Errorf("令牌不允许使用 %s，%w", strings.ToUpper(proto), errTargetDenied)
+	}
+	if tp.ports != nil {
+		_, portStr, _ := net.SplitHostPort(target)
+		port, _ := net.LookupPort(proto, portStr)
+		if !tp.ports.permits(proto, port) {
+			return fmt.Errorf("目标端口 %d/%s 不在令牌允许的范围内，%w", port, proto, errTargetDenied)
+		}
+	}
+	return nil
+}
+
+// targetACL 返回该令牌会话使用的目标地址限制（全局限制 base 加上令牌允许的网段）
+func (tp *tokenPolicy) targetACL(base *targetACL) *targetACL {
+	if tp == nil || len(tp.nets) == 0 {
+		return base
+	}
+	acl := *base
+	acl.allow = tp.nets
+	return &acl
+}
+
+// pacers 返回该令牌共享的上行、下行限速器（不限速时为 nil）
+func (tp *tokenPolicy) pacers() (up, down *Pacer) {
+	if tp == nil {
+		return nil, nil
+	}
+	return tp.up, tp.down
+}
+
+func (tp *tokenPolicy) streamsString() string {
+	if tp.maxStreams == 0 {
+		return "不限"
+	}
+	return strconv.FormatInt(tp.maxStreams, 10)
+}
+
+func (tp *tokenPolicy) quotaString() string {
+	if tp.quota == 0 {
+		return "不限"
+	}
+	return formatBytes(tp.quota)
+}
+
+func (tp *tokenPolicy) egressString() string {
+	if tp.src == nil {
+		return "默认"
+	}
+	return fmt.Sprintf("IPv4 %v，IPv6 %v", tp.src.v4, tp.src.v6)
+}
+
+// egress 返回该令牌会话连接目标时绑定的出口地址（令牌未指定时为服务端默认出口地址 def）
+func (tp *tokenPolicy) egress(def *egressAddrs) *egressAddrs {
+	if tp == nil || tp.src == nil {
+		return def
+	}
+	return tp.src
+}
+
+// acquireStream 为新的 TCP 流或 UDP 关联占用一个名额，达到上限时返回 errStreamQuota
+func (tp *tokenPolicy) acquireStream() error {
+	if tp == nil {
+		return nil
+	}
+	if n := tp.streams.Add(1); tp.maxStreams > 0 && n > tp.maxStreams {
+		tp.streams.Add(-1)
+		return fmt.Errorf("%w（%d）", errStreamQuota, tp.maxStreams)
+	}
+	return nil
+}
+
+// releaseStream 归还 acquireStream 占用的名额
+func (tp *tokenPolicy) releaseStream() {
+	if tp != nil {
+		tp.streams.Add(-1)
+	}
+}
+
+// logTokenStats 输出配置了权限的各令牌当前活动的流数
+func (s *Server) logTokenStats() {
+	toks := make([]string, 0, len(s.tokenPolicies))
+	for tok := range s.tokenPolicies {
+		toks = append(toks, tok)
+	}
+	sort.Strings(toks)
+	for _, tok := range toks {
+		tp := s.tokenPolicies[tok]
+		if n := tp.streams.Load(); n > 0 {
+			log.Printf("[统计] 令牌 %s 活动流: %d/%s", tokenID(tok), n, tp.streamsString())
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// TunnelConn 通道的消息连接，*websocket.Conn 与 gRPC 双向流均实现该接口
+type TunnelConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPingHandler(h func(appData string) error)
+	SetPongHandler(h func(appData string) error)
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// fragmentedWSConn 设置了 -wire-frame 时的服务端 WebSocket 连接：gorilla/websocket 服务端的
+// WriteMessage 总以单帧发出整条消息，改经 NextWriter 写出，超过写缓冲区的消息以 continuation 帧分片
+type fragmentedWSConn struct {
+	*websocket.Conn
+}
+
+func (c fragmentedWSConn) WriteMessage(messageType int, data []byte) error {
+	w, err := c.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// gRPC 传输：每个通道是一条 gRPC 双向流（HTTP/2 POST，content-type: application/grpc），
+// 每条 gRPC 消息为 protobuf {1: 消息类型（与 WebSocket 消息类型一致）, 2: 数据}。
+const (
+	grpcContentType = "application/grpc"
+	grpcTokenHeader = "X-Tunnel-Token"
+	grpcMaxMessage  = 16 << 20
+)
+
+// isGRPCRequest 判断是否为 gRPC 传输请求
+func isGRPCRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.ProtoMajor == 2 &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType)
+}
+
+// grpcAddr gRPC 流的对端地址
+type grpcAddr string
+
+func (a grpcAddr) Network() string { return "tcp" }
+func (a grpcAddr) String() string  { return string(a) }
+
+// grpcConn 基于 gRPC 双向流的通道连接
+type grpcConn struct {
+	r      *bufio.Reader
+	body   io.Closer
+	w      io.Writer
+	flush  func()
+	cancel func()
+	remote net.Addr
+
+	wmu    sync.Mutex
+	closed atomic.Bool
+
+	dmu      sync.Mutex
+	deadline *time.Timer
+	timedOut bool
+
+	readLimit int64 // 单条消息上限（0 为 grpcMaxMessage）
+
+	pingHandler func(string) error
+	pongHandler func(string) error
+}
+
+func newGRPCConn(r io.ReadCloser, w io.Writer, flush, cancel func(), remote net.Addr) *grpcConn {
+	c := &grpcConn{r: bufio.NewReaderSize(r, 65536), body: r, w: w, flush: flush, cancel: cancel, remote: remote}
+	c.pingHandler = func(data string) error { return c.WriteMessage(websocket.PongMessage, []byte(data)) }
+	c.pongHandler = func(string) error { return nil }
+	return c
+}
+
+// ReadMessage 读取一条消息，Ping/Pong 交由处理函数处理（与 gorilla/websocket 行为一致）
+func (c *grpcConn) ReadMessage() (int, []byte, error) {
+	for {
+		mt, data, err := c.readFrame()
+		if err != nil {
+			c.dmu.Lock()
+			timedOut := c.timedOut
+			c.dmu.Unlock()
+			if timedOut {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			return 0, nil, err
+		}
+		switch mt {
+		case websocket.PingMessage:
+			if err := c.pingHandler(string(data)); err != nil {
+				return 0, nil, err
+			}
+		case websocket.PongMessage:
+			if err := c.pongHandler(string(data)); err != nil {
+				return 0, nil, err
+			}
+		case websocket.CloseMessage:
+			return 0, nil, io.EOF
+		default:
+			return mt, data, nil
+		}
+	}
+}
+
+// readFrame 读取一条 gRPC 长度前缀消息并解码
+func (c *grpcConn) readFrame() (int, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	if hdr[0] != 0 {
+		return 0, nil, errors.New("不支持压缩的 gRPC 消息")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	limit := int64(grpcMaxMessage)
+	if c.readLimit > 0 {
+		// 消息含类型字段与长度前缀，额外预留少量字节
+		limit = c.readLimit + 16
+	}
+	if int64(n) > limit {
+		return 0, nil, fmt.Errorf("gRPC 消息过大: %d", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(c.r, msg); err != nil {
+		return 0, nil, err
+	}
+
+	var mt int
+	var data []byte
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return 0, nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(msg)
+			if n < 0 {
+				return 0, nil, protowire.ParseError(n)
+			}
+			mt, msg = int(v), msg[n:]
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(msg)
+			if n < 0 {
+				return 0, nil, protowire.ParseError(n)
+			}
+			data, msg = v, msg[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, msg)
+			if n < 0 {
+				return 0, nil, protowire.ParseError(n)
+			}
+			msg = msg[n:]
+		}
+	}
+	return mt, data, nil
+}
+
+// WriteMessage 写入一条消息（调用方负责串行化，与 websocket.Conn 约定一致）
+func (c *grpcConn) WriteMessage(messageType int, data []byte) error {
+	bp := GetFrameBuf()
+	b := append(*bp, 0, 0, 0, 0, 0)
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(messageType))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, data)
+	binary.BigEndian.PutUint32(b[1:5], uint32(len(b)-5))
+
+	c.wmu.Lock()
+	var err error
+	if c.closed.Load() {
+		err = net.ErrClosed
+	} else if _, err = c.w.Write(b); err == nil {
+		c.flush()
+	}
+	c.wmu.Unlock()
+
+	*bp = b
+	PutFrameBuf(bp)
+	return err
+}
+
+// SetReadDeadline 到期后关闭流，阻塞中的 ReadMessage 返回超时错误
+func (c *grpcConn) SetReadDeadline(t time.Time) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	switch {
+	case t.IsZero():
+		if c.deadline != nil {
+			c.deadline.Stop()
+		}
+	case c.deadline == nil:
+		c.deadline = time.AfterFunc(time.Until(t), c.expire)
+	default:
+		c.deadline.Reset(time.Until(t))
+	}
+	return nil
+}
+
+// expire 读超时到期
+func (c *grpcConn) expire() {
+	c.dmu.Lock()
+	c.timedOut = true
+	c.dmu.Unlock()
+	_ = c.Close()
+}
+
+// SetReadLimit 设置单条消息上限，超过时 ReadMessage 返回错误（须在开始读取前调用）
+func (c *grpcConn) SetReadLimit(limit int64) { c.readLimit = limit }
+
+func (c *grpcConn) SetPingHandler(h func(string) error) { c.pingHandler = h }
+func (c *grpcConn) SetPongHandler(h func(string) error) { c.pongHandler = h }
+func (c *grpcConn) RemoteAddr() net.Addr                { return c.remote }
+
+// Close 关闭流，之后的写入返回 net.ErrClosed
+func (c *grpcConn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	err := c.body.Close()
+	// 等待进行中的写入结束，保证 Close 返回后不再写入 ResponseWriter
+	c.wmu.Lock()
+	c.wmu.Unlock()
+	return err
+}
+
+// DialGRPC 建立 gRPC 双向流通道（TLS 配置与 WebSocket 相同，强制 ECH），header 为握手请求头
+func (d *Dialer) DialGRPC(serverAddr string, tlsCfg *tls.Config, header http.Header) (TunnelConn, *http.Response, error) {
+	target := "https://" + strings.TrimPrefix(serverAddr, "grpc://")
+
+	transport := &http.Transport{
+		TLSClientConfig:     tlsCfg,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		// IPs 定向或多地址竞速（SNI 仍为主机名）
+		DialContext: d.dialServerTCP,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, pr)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	req.Header = header.Clone()
+	// net/http 以 req.Host 作为 :authority，忽略请求头中的 Host
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	req.Header.Set("Content-Type", grpcContentType)
+	req.Header.Set("TE", "trailers")
+	if d.cfg.Token != "" {
+		req.Header.Set(grpcTokenHeader, d.cfg.Token)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		resp.Body.Close()
+		cancel()
+		return nil, nil, fmt.Errorf("gRPC 握手失败: %s %s", resp.Proto, resp.Status)
+	}
+	if resp.TLS != nil {
+		logTLSResumption(*resp.TLS)
+	}
+
+	closeAll := func() {
+		_ = pw.Close()
+		cancel()
+		transport.CloseIdleConnections()
+	}
+	return newGRPCConn(resp.Body, pw, func() {}, closeAll, grpcAddr(req.URL.Host)), resp, nil
+}
+
+// acceptGRPC 响应 gRPC 握手并返回通道连接（调用方须在处理完毕前保持 Handler 不返回）
+func acceptGRPC(w http.ResponseWriter, r *http.Request, respHeader http.Header) (*grpcConn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("ResponseWriter 不支持 Flush")
+	}
+	for k, v := range respHeader {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return newGRPCConn(r.Body, w, flusher.Flush, nil, grpcAddr(r.RemoteAddr)), nil
+}
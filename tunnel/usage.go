@@ -0,0 +1,288 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenUsage 单个令牌当月的流量计数（up: 客户端 -> 目标，down: 目标 -> 客户端）
+type tokenUsage struct {
+	id       string // tokenID
+	up, down atomic.Int64
+	cap      int64 // 每月流量上限（字节，上下行合计，0 表示不限制）
+
+	mu      sync.Mutex
+	streams map[*streamAccounting]func() // 该令牌的活动流及其关闭函数，流量达到上限时全部关闭
+}
+
+// errTransferQuota 令牌当月流量已达上限
+var errTransferQuota = errors.New("令牌本月流量已达上限")
+
+// addUp/addDown 累计流量（u 为 nil 时忽略），达到上限时关闭该令牌的活动流
+func (u *tokenUsage) addUp(n int) {
+	if u != nil {
+		u.up.Add(int64(n))
+		u.enforce()
+	}
+}
+
+func (u *tokenUsage) addDown(n int) {
+	if u != nil {
+		u.down.Add(int64(n))
+		u.enforce()
+	}
+}
+
+// track 登记活动流 a，流量达到上限时调用 kill 关闭该流；返回的函数在流结束时注销
+func (u *tokenUsage) track(a *streamAccounting, kill func()) func() {
+	if u == nil || u.cap == 0 {
+		return func() {}
+	}
+	u.mu.Lock()
+	if u.streams == nil {
+		u.streams = make(map[*streamAccounting]func())
+	}
+	u.streams[a] = kill
+	u.mu.Unlock()
+	// 登记前的流量可能已达上限
+	u.enforce()
+	return func() {
+		u.mu.Lock()
+		delete(u.streams, a)
+		u.mu.Unlock()
+	}
+}
+
+// enforce 当月流量达到上限时关闭全部已登记的活动流（已在传输中的流不再等到下次建连才受限）
+func (u *tokenUsage) enforce() {
+	if u.cap == 0 || u.up.Load()+u.down.Load() < u.cap {
+		return
+	}
+	u.mu.Lock()
+	kills := u.streams
+	u.streams = nil
+	u.mu.Unlock()
+	if len(kills) == 0 {
+		return
+	}
+	log.Printf("[流量] 令牌 %s 本月流量已达上限 %s，关闭 %d 个活动流", u.id, formatBytes(u.cap), len(kills))
+	for a, kill := range kills {
+		a.force(closeQuota)
+		kill()
+	}
+}
+
+// check 当月流量达到上限时返回 errTransferQuota，新建的流将被拒绝
+func (u *tokenUsage) check() error {
+	if u == nil || u.cap == 0 {
+		return nil
+	}
+	if u.up.Load()+u.down.Load() >= u.cap {
+		return fmt.Errorf("%w（%s）", errTransferQuota, formatBytes(u.cap))
+	}
+	return nil
+}
+
+// usageMeter 按令牌累计每月流量，设置 -usage-file 时定期写入文件，重启后继续累计
+type usageMeter struct {
+	file string // -usage-file，为空时不写入文件
+
+	mu     sync.Mutex
+	month  string                 // 计数所属月份（2006-01）
+	tokens map[string]*tokenUsage // 键为 tokenID，不保存令牌明文
+	prev   *usageSnapshot         // 上个月的最终计数
+}
+
+// usageSnapshot -usage-file 文件格式（亦为管理接口 /usage 的响应）
+type usageSnapshot struct {
+	Month    string                  `json:"month"`
+	Tokens   map[string]usageCounter `json:"tokens"`
+	Previous *usageSnapshot          `json:"previous,omitempty"`
+}
+
+type usageCounter struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+	Cap  int64 `json:"cap,omitempty"`
+}
+
+// usageFlushInterval 检查跨月与写入 -usage-file 的间隔
+const usageFlushInterval = time.Minute
+
+func currentMonth() string { return time.Now().Format("2006-01") }
+
+// newUsageMeter 为各隧道路径的令牌建立计数器，caps 为令牌的每月流量上限（按明文令牌索引）；
+// file 不为空时载入其中当月的计数并定期写回
+func newUsageMeter(tokens map[string]bool, caps map[string]int64, file string) (*usageMeter, error) {
+	m := &usageMeter{file: file, month: currentMonth(), tokens: make(map[string]*tokenUsage)}
+	for tok := range tokens {
+		m.tokens[tokenID(tok)] = &tokenUsage{id: tokenID(tok), cap: caps[tok]}
+	}
+	if file != "" {
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+		log.Printf("令牌流量计数: %s（每 %s 写入）", file, usageFlushInterval)
+	}
+	go m.flushLoop()
+	return m, nil
+}
+
+// forToken 返回令牌的计数器（未建立计数时为 nil）
+func (m *usageMeter) forToken(tok string) *tokenUsage {
+	if m == nil {
+		return nil
+	}
+	return m.tokens[tokenID(tok)]
+}
+
+// load 读取 -usage-file，文件中为当月的计数时继续累计，否则作为上个月的计数保留
+func (m *usageMeter) load() error {
+	data, err := os.ReadFile(m.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s usageSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("流量计数文件 %s 无效: %w", m.file, err)
+	}
+	if s.Month != m.month {
+		s.Previous = nil
+		m.prev = &s
+		return nil
+	}
+	m.prev = s.Previous
+	for id, c := range s.Tokens {
+		u, ok := m.tokens[id]
+		if !ok {
+			// 已不再使用的令牌保留其计数
+			u = &tokenUsage{id: id}
+			m.tokens[id] = u
+		}
+		u.up.Store(c.Up)
+		u.down.Store(c.Down)
+	}
+	return nil
+}
+
+// snapshot 返回当前计数；跨月时先把截至此刻的计数记为上个月并从计数器中扣除
+func (m *usageMeter) snapshot() *usageSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if month := currentMonth(); month != m.month {
+		log.Printf("[流量] %s 计数结束，开始统计 %s", m.month, month)
+		last := m.countersLocked()
+		for id, u := range m.tokens {
+			c := last.Tokens[id]
+			u.up.Add(-c.Up)
+			u.down.Add(-c.Down)
+		}
+		m.prev, m.month = last, month
+	}
+	s := m.countersLocked()
+	s.Previous = m.prev
+	return s
+}
+
+func (m *usageMeter) countersLocked() *usageSnapshot {
+	s := &usageSnapshot{Month: m.month, Tokens: make(map[string]usageCounter, len(m.tokens))}
+	for id, u := range m.tokens {
+		s.Tokens[id] = usageCounter{Up: u.up.Load(), Down: u.down.Load(), Cap: u.cap}
+	}
+	return s
+}
+
+// serveHTTP 管理接口 GET /usage：返回各令牌当月与上个月的流量（JSON，与 -usage-file 格式相同）
+func (m *usageMeter) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(m.snapshot())
+}
+
+// flushLoop 定期检查跨月（未设置 -usage-file 时同样需要按月重置上限）并写入计数文件
+func (m *usageMeter) flushLoop() {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if m.file == "" {
+			m.snapshot()
+			continue
+		}
+		if err := m.save(); err != nil {
+			log.Printf("[流量] 写入计数文件失败: %v", err)
+		}
+	}
+}
+
+// save 先写临时文件再重命名，避免进程中途退出留下不完整的计数
+func (m *usageMeter) save() error {
+	data, err := json.MarshalIndent(m.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.file), ".usage-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), m.file)
+}
+
+// logStats 输出各令牌当月的流量
+func (m *usageMeter) logStats() {
+	if m == nil {
+		return
+	}
+	s := m.snapshot()
+	ids := make([]string, 0, len(s.Tokens))
+	for id := range s.Tokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		c := s.Tokens[id]
+		if c.Up+c.Down == 0 {
+			continue
+		}
+		limit := "不限"
+		if c.Cap > 0 {
+			limit = formatBytes(c.Cap)
+		}
+		log.Printf("[统计] 令牌 %s %s 流量: 上行 %s，下行 %s，上限 %s", id, s.Month, formatBytes(c.Up), formatBytes(c.Down), limit)
+	}
+}
+
+// formatBytes 以 KB/MB/GB 等单位显示字节数（1000 进制，与 -token-policy quota 一致）
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
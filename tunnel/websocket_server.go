@@ -0,0 +1,1177 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"ech-tunnel/internal/netutil"
+	"ech-tunnel/protocol"
+)
+
+// GenerateSelfSignedCert 生成自签名证书
+func GenerateSelfSignedCert() (tls.Certificate, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Organization: []string{"自签名组织"},
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:  x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+		},
+		BasicConstraintsValid: true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return cert, nil
+}
+
+// serverRoute 单个隧道路径及其独立的认证配置
+type serverRoute struct {
+	path        string
+	tmpl        *pathTemplate // path 中含 {rand} 等占位符时按模板匹配
+	token       string
+	cidrs       string
+	allowedNets []*net.IPNet
+}
+
+// newServerRoute 创建隧道路径配置
+func newServerRoute(path, tok, cidrList string) (*serverRoute, error) {
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("路径必须以 / 开头: %s", path)
+	}
+	tmpl, err := ParsePathTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+	rt := &serverRoute{path: path, tmpl: tmpl, token: tok, cidrs: cidrList}
+	for _, cidr := range strings.Split(cidrList, ",") {
+		_, allowedNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		rt.allowedNets = append(rt.allowedNets, allowedNet)
+	}
+	return rt, nil
+}
+
+// Route 一个隧道路径及其认证配置
+type Route struct {
+	Path  string // 以 / 开头，可含 {rand} 等占位段，为空时为 /
+	Token string // 客户端须携带的令牌，为空时不校验
+	CIDRs string // 允许的来源 IP 范围（CIDR，逗号分隔）
+}
+
+// ParseRoute 解析 -path 参数，格式: /路径[=token][@cidr1,cidr2]
+// 未指定的 token 与 CIDR 沿用 tok 与 cidrList（即全局 -token/-cidr）
+func ParseRoute(spec, tok, cidrList string) (Route, error) {
+	path := spec
+	if i := strings.Index(path, "@"); i >= 0 {
+		path, cidrList = path[:i], path[i+1:]
+	}
+	if i := strings.Index(path, "="); i >= 0 {
+		path, tok = path[:i], path[i+1:]
+	}
+	r := Route{Path: strings.TrimSpace(path), Token: strings.TrimSpace(tok), CIDRs: cidrList}
+	if _, err := newServerRoute(r.Path, r.Token, r.CIDRs); err != nil {
+		return Route{}, err
+	}
+	return r, nil
+}
+
+// allowIP 判断来源 IP 是否在该路径允许的范围内
+func (rt *serverRoute) allowIP(ip net.IP) bool {
+	for _, allowedNet := range rt.allowedNets {
+		if allowedNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newTunnelHandler 创建单个路径的 WebSocket 隧道处理器
+func (s *Server) newTunnelHandler(rt *serverRoute, fallback http.Handler) http.Handler {
+	reject := func(w http.ResponseWriter, r *http.Request, code int) {
+		if fallback != nil {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Connection", "close")
+		http.Error(w, http.StatusText(code), code)
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+		Subprotocols: func() []string {
+			if rt.token == "" {
+				return nil
+			}
+			return []string{rt.token}
+		}(),
+		ReadBufferSize:    65536,                        // 增加读缓冲区到64KB
+		WriteBufferSize:   s.frames.wsWriteBufferSize(), // 默认 64KB，-wire-frame 限制帧大小
+		EnableCompression: s.frames.cfg.WSCompress,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 路径占位段的取值不符合模板
+		if !rt.tmpl.match(r) {
+			reject(w, r, http.StatusNotFound)
+			return
+		}
+
+		// 非 WebSocket 升级（且非 gRPC、QUIC 通道）请求直接回落
+		grpc := isGRPCRequest(r)
+		qc := quicConnFrom(r)
+		if fallback != nil && !grpc && qc == nil && !websocket.IsWebSocketUpgrade(r) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		// 验证来源IP
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			log.Printf("无法解析客户端地址: %v", err)
+			reject(w, r, http.StatusBadRequest)
+			return
+		}
+		if ok, retry := s.upgradeLimiter.allow(clientIP); !ok {
+			log.Printf("拒绝握手: IP %s 每分钟握手次数超过 %d，路径 %s", clientIP, s.cfg.HandshakeRate, rt.path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			w.Header().Set("Connection", "close")
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		if !rt.allowIP(net.ParseIP(clientIP)) {
+			log.Printf("拒绝访问: IP %s 不在路径 %s 允许的范围内 (%s)", clientIP, rt.path, rt.cidrs)
+			reject(w, r, http.StatusForbidden)
+			return
+		}
+		if country, ok := s.geoFilter.allowIP(net.ParseIP(clientIP)); !ok {
+			log.Printf("拒绝访问: IP %s 所属国家/地区 %q 不被允许，路径 %s", clientIP, country, rt.path)
+			reject(w, r, http.StatusForbidden)
+			return
+		}
+
+		// 验证 Subprotocol token
+		if rt.token != "" {
+			clientToken := r.Header.Get("Sec-WebSocket-Protocol")
+			if grpc || qc != nil {
+				clientToken = r.Header.Get(grpcTokenHeader)
+			}
+			if clientToken != rt.token {
+				log.Printf("Token验证失败，来自 %s，路径 %s", r.RemoteAddr, rt.path)
+				reject(w, r, http.StatusUnauthorized)
+				return
+			}
+		}
+
+		// 协商协议版本，不兼容时拒绝升级，避免误解析帧
+		version, err := protocol.NegotiateVersion(r.Header)
+		if err != nil {
+			log.Printf("拒绝来自 %s 的连接: %v", r.RemoteAddr, err)
+			reject(w, r, http.StatusUpgradeRequired)
+			return
+		}
+		if version < protocol.DataSeqVersion {
+			log.Printf("来自 %s 的客户端未声明协议版本，按旧版协议（DATA 帧不含序号）通信", r.RemoteAddr)
+		}
+		maxFrame := protocol.NegotiateMaxFrame(r.Header, s.frames.cfg.MaxFrameSize)
+		respHeader := http.Header{}
+		respHeader.Set(protocol.VersionHeader, strconv.Itoa(version))
+		respHeader.Set(protocol.MaxFrameHeader, strconv.Itoa(maxFrame))
+		sess := &sessionInfo{clientIP: clientIP, path: rt.path, tokenID: tokenID(rt.token), maxFrame: maxFrame, zstd: s.frames.negotiateZstd(r.Header), relay: s.cfg.Relay, policy: s.tokenPolicies[rt.token], usage: s.trafficUsage.forToken(rt.token)}
+		if sess.zstd {
+			respHeader.Set(compressHeader, "zstd")
+		}
+		mux := s.frames.negotiateMux(r.Header)
+		if mux {
+			respHeader.Set(protocol.MuxHeader, protocol.MuxYamux)
+		}
+		if version >= protocol.ResumeVersion && s.cfg.ResumeTimeout > 0 {
+			sess.resumeID = r.Header.Get(protocol.SessionHeader)
+		}
+
+		// QUIC 通道：每个 TCP 流是一条 QUIC 流，在 Handler 内处理直至连接结束
+		if qc != nil {
+			if err := acceptQUIC(w, respHeader); err != nil {
+				log.Println("QUIC 通道建立失败:", err)
+				return
+			}
+			log.Printf("新的 QUIC 通道来自 %s，路径 %s，协议版本 %d", r.RemoteAddr, rt.path, version)
+			s.handleMuxSession(quicSession{qc}, qc.RemoteAddr(), sess)
+			return
+		}
+
+		// gRPC 双向流通道：在 Handler 内处理直至通道结束
+		if grpc {
+			conn, err := acceptGRPC(w, r, respHeader)
+			if err != nil {
+				log.Println("gRPC 通道建立失败:", err)
+				return
+			}
+			conn.SetReadLimit(int64(maxFrame))
+			log.Printf("新的 gRPC 通道来自 %s，路径 %s，协议版本 %d", r.RemoteAddr, rt.path, version)
+			if mux {
+				s.serveYamux(conn, sess)
+			} else {
+				s.handleWebSocket(conn, version, sess)
+			}
+			w.Header().Set("Grpc-Status", "0")
+			return
+		}
+
+		wsConn, err := upgrader.Upgrade(w, r, respHeader)
+		if err != nil {
+			log.Println("WebSocket 升级失败:", err)
+			return
+		}
+		wsConn.SetReadLimit(int64(maxFrame))
+		if err := s.frames.applyWSCompression(wsConn); err != nil {
+			log.Printf("设置 WebSocket 压缩失败: %v", err)
+			wsConn.Close()
+			return
+		}
+
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			log.Printf("新的 WebSocket 连接来自 %s，路径 %s，协议版本 %d，客户端证书: %s", r.RemoteAddr, rt.path, version, r.TLS.PeerCertificates[0].Subject)
+		} else {
+			log.Printf("新的 WebSocket 连接来自 %s，路径 %s，协议版本 %d", r.RemoteAddr, rt.path, version)
+		}
+		var conn TunnelConn = wsConn
+		if s.frames.cfg.WireFrameSize > 0 {
+			conn = fragmentedWSConn{wsConn}
+		}
+		if mux {
+			go s.serveYamux(conn, sess)
+			return
+		}
+		go s.handleWebSocket(conn, version, sess)
+	})
+}
+
+// newFallbackHandler 创建回落反向代理（未配置时返回 nil）
+func newFallbackHandler(target string) (http.Handler, error) {
+	if target == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("仅支持 http:// 或 https:// 地址: %s", target)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("[回落] 转发 %s %s 失败: %v", r.Method, r.URL.Path, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy, nil
+}
+
+// tcpStream 服务端单个 TCP 流
+type tcpStream struct {
+	conn net.Conn
+	recv *ReorderBuffer
+	acct *streamAccounting
+	cc   *CongestionController // 服务端到客户端方向的拥塞控制（协议版本 4）
+	ack  *AckScheduler         // 客户端到服务端方向的累计确认
+	up   *targetWriter         // 客户端到服务端方向的写协程
+	prio StreamPriority
+
+	// 会话恢复（协议版本 5）：ch 为当前承载该流的通道，所在通道断开等待恢复期间为 nil；
+	// expiry 为等待恢复的超时定时器（由流表锁保护），expired 表示因超时未恢复而关闭
+	ch      atomic.Pointer[serverChannel]
+	expiry  *time.Timer
+	expired atomic.Bool
+
+	// 半关闭状态（由 connMu 保护）：finSent 目标已读到 EOF 并向客户端发送了 FIN，
+	// finRecv 收到客户端 FIN；closed 在流可以整体关闭时关闭
+	finSent, finRecv bool
+	closed           chan struct{}
+	closeOnce        sync.Once
+}
+
+// finish 通知等待半关闭或发送窗口的读取方流已结束
+func (st *tcpStream) finish() {
+	st.closeOnce.Do(func() { close(st.closed) })
+	st.cc.Close()
+}
+
+// targetWriter 客户端到目标方向的写协程：按序写出已重排的数据及其后的 FIN/CLOSE 处理，
+// token 上行限速的等待与目标写入阻塞只影响本流，不阻塞通道读循环中的 ACK、控制帧与其他流
+type targetWriter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []targetWrite
+	bytes  int64
+	limit  int64 // 无发送窗口的旧版客户端排队数据的上限
+	closed bool
+}
+
+// targetWrite 待写出的数据，或 data 为空时在此前的数据写出后执行的 then
+type targetWrite struct {
+	data []byte
+	then func()
+}
+
+func newTargetWriter(limit int64) *targetWriter {
+	w := &targetWriter{limit: limit}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// push 排队待写数据。协议版本 4 起在途数据受客户端发送窗口约束；更早的客户端没有发送窗口，
+// 排队超过 -stream-buffer 时在此等待写协程消化
+func (w *targetWriter) push(chunks [][]byte, windowed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for !windowed && !w.closed && w.bytes > w.limit {
+		w.cond.Wait()
+	}
+	for _, c := range chunks {
+		w.queue = append(w.queue, targetWrite{data: c})
+		w.bytes += int64(len(c))
+	}
+	w.cond.Broadcast()
+}
+
+// then 在已排队的数据写出后执行 f（写协程已退出时立即执行）
+func (w *targetWriter) then(f func()) {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		f()
+		return
+	}
+	w.queue = append(w.queue, targetWrite{then: f})
+	w.cond.Broadcast()
+	w.mu.Unlock()
+}
+
+// close 流结束时停止写协程，丢弃未写出的数据（排队的 FIN/CLOSE 处理仍会执行）
+func (w *targetWriter) close() {
+	w.mu.Lock()
+	rest := w.queue
+	w.closed, w.queue = true, nil
+	w.cond.Broadcast()
+	w.mu.Unlock()
+	runThen(rest)
+}
+
+// runThen 执行 items 中排队的 then
+func runThen(items []targetWrite) {
+	for _, it := range items {
+		if it.then != nil {
+			it.then()
+		}
+	}
+}
+
+// run 依次写出排队的数据，write 返回错误或 close 后退出
+func (w *targetWriter) run(write func([]byte) error) {
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		item := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		if item.then != nil {
+			item.then()
+			continue
+		}
+		err := write(item.data)
+		w.mu.Lock()
+		w.bytes -= int64(len(item.data))
+		w.cond.Broadcast()
+		w.mu.Unlock()
+		if err != nil {
+			// 目标不可写：此后的 FIN/CLOSE 处理仍需执行
+			w.close()
+			return
+		}
+	}
+}
+
+// handleWebSocket 处理单个 WebSocket 连接（version 为协商的协议版本，sess 为访问日志所需的来源信息）
+func (s *Server) handleWebSocket(wsConn TunnelConn, version int, sess *sessionInfo) {
+	// 创建一个 context 用于通知所有 goroutine 退出
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // 函数退出时取消所有子 goroutine
+
+	s.activeSessions.Add(1)
+	defer s.activeSessions.Add(-1)
+
+	var mu sync.Mutex
+	pc := NewPacer(s.cfg.PaceRate)
+	tup, tdown := sess.policy.pacers()
+	pd := s.frames.NewPadder()
+	// 各 TCP 流的下行数据经发送队列按优先级与公平调度写入 WebSocket
+	sq := NewSendQueue()
+	defer sq.close()
+	go sq.Run(func(connID string, seq uint64, payload []byte) error {
+		bp := GetFrameBuf()
+		defer PutFrameBuf(bp)
+		*bp = s.frames.EncodePayload(*bp, connID, seq, payload, sess.zstd)
+		tdown.Wait(len(*bp))
+		pc.Wait(len(*bp))
+		mu.Lock()
+		err := WriteDataFrame(wsConn, websocket.BinaryMessage, version, pd, connID, seq, *bp)
+		mu.Unlock()
+		if err != nil && !netutil.IsNormalCloseError(err) {
+			log.Printf("[服务端] 写入 WebSocket 失败: %v", err)
+		}
+		return err
+	})
+	chn := &serverChannel{ws: wsConn, version: version, mu: &mu, sq: sq}
+
+	// TCP 流表：客户端携带会话 ID 时由同一会话的各通道共享，通道断开后其上的流保留等待恢复
+	connMu, conns, streamCtx := &sync.RWMutex{}, make(map[string]*tcpStream), ctx
+	if sess.resumeID != "" {
+		chn.rs = s.resumeSessions.acquire(sess, sess.resumeID)
+		defer chn.rs.release()
+		connMu, conns, streamCtx = &chn.rs.connMu, chn.rs.conns, chn.rs.ctx
+	}
+
+	// UDP 连接管理
+	udpConns := make(map[string]*net.UDPConn)
+	udpTargets := make(map[string]*net.UDPAddr)
+	udpAccts := make(map[string]*streamAccounting)
+
+	defer func() {
+		// 先取消所有 goroutine
+		cancel()
+
+		// 关闭本通道上的所有 TCP 连接（这会让阻塞的 Read 立即返回错误），可恢复的流保留等待客户端重连
+		connMu.Lock()
+		chn.closed = true
+		detached := 0
+		for id, st := range conns {
+			if st.ch.Load() != chn {
+				continue
+			}
+			if chn.rs != nil {
+				chn.rs.detachLocked(id, st)
+				detached++
+				continue
+			}
+			_ = st.conn.Close()
+			st.cc.Close()
+			delete(conns, id)
+			log.Printf("[服务端] 清理TCP连接: %s", id)
+		}
+		connMu.Unlock()
+		if detached > 0 {
+			log.Printf("[服务端] 通道断开，%d 个流等待恢复（%s）", detached, s.cfg.ResumeTimeout)
+		}
+
+		// 关闭所有 UDP 连接
+		connMu.Lock()
+		for id, uc := range udpConns {
+			_ = uc.Close()
+			log.Printf("[服务端] 清理UDP连接: %s", id)
+		}
+		udpConns = make(map[string]*net.UDPConn)
+		udpTargets = make(map[string]*net.UDPAddr)
+		connMu.Unlock()
+
+		// 最后关闭 WebSocket
+		_ = wsConn.Close()
+		log.Printf("WebSocket 连接 %s 已完全清理", wsConn.RemoteAddr())
+	}()
+
+	// writeStream 按序号将客户端数据写入目标连接
+	writeStream := func(body []byte) {
+		connID, seq, payload, ok := protocol.ParseDataFrame(body, version)
+		if !ok {
+			return
+		}
+		connMu.RLock()
+		st, ok := conns[connID]
+		connMu.RUnlock()
+		if !ok {
+			return
+		}
+		if version < protocol.DataSeqVersion {
+			// 旧版客户端的流固定在单个通道上，按到达顺序编号
+			seq = st.recv.Delivered()
+		}
+		plain, err := s.frames.OpenPayload(payload, StreamAAD(connID, seq))
+		if err == nil && sess.zstd {
+			plain, err = s.frames.DecompressPayload(plain)
+		}
+		var chunks [][]byte
+		if err == nil {
+			chunks, err = st.recv.Push(seq, plain)
+		}
+		if err != nil {
+			log.Printf("[服务端] 连接 %s 数据重排失败: %v，关闭连接", connID, err)
+			_ = st.conn.Close()
+			return
+		}
+		if len(chunks) > 0 {
+			st.up.push(chunks, version >= protocol.FlowControlVersion)
+		}
+	}
+
+	// 空闲时发送伪帧
+	go pd.IdleLoop(ctx.Done(), func(frame []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return wsConn.WriteMessage(websocket.BinaryMessage, frame)
+	})
+
+	// 设置WebSocket保活（客户端定期发送 Ping，超时未收到任何消息则关闭会话）
+	s.frames.ExtendReadDeadline(wsConn)
+	chn.recv.Touch()
+	wsConn.SetPingHandler(func(message string) error {
+		s.frames.ExtendReadDeadline(wsConn)
+		chn.recv.Touch()
+		mu.Lock()
+		defer mu.Unlock()
+		return wsConn.WriteMessage(websocket.PongMessage, []byte(message))
+	})
+
+	for {
+		typ, msg, readErr := wsConn.ReadMessage()
+		if readErr != nil {
+			if !netutil.IsNormalCloseError(readErr) {
+				log.Printf("WebSocket 读取失败 %s: %v", wsConn.RemoteAddr(), readErr)
+			}
+			return // defer 会触发清理
+		}
+		s.frames.ExtendReadDeadline(wsConn)
+		chn.recv.Touch()
+
+		if typ == websocket.BinaryMessage {
+			// 处理 UDP 数据（带 connID）
+			if len(msg) > 9 && string(msg[:9]) == "UDP_DATA:" {
+				parts := bytes.SplitN(msg[9:], []byte("|"), 2)
+				if len(parts) == 2 {
+					connID := string(parts[0])
+					data, err := s.frames.OpenPayload(parts[1], parts[0])
+					if err != nil {
+						log.Printf("[服务端UDP:%s] %v", connID, err)
+						continue
+					}
+
+					connMu.RLock()
+					udpConn, ok1 := udpConns[connID]
+					targetAddr, ok2 := udpTargets[connID]
+					acct := udpAccts[connID]
+					connMu.RUnlock()
+					if ok1 {
+						if ok2 {
+							// 在通道读循环中不等待限速：超出令牌上行带宽的数据报直接丢弃
+							if !tup.allow(len(data)) {
+								log.Printf("[服务端UDP:%s] 超出令牌上行带宽，丢弃 %d 字节", connID, len(data))
+								continue
+							}
+							acct.addUp(len(data))
+							if _, err := udpConn.WriteToUDP(data, targetAddr); err != nil {
+								log.Printf("[服务端UDP:%s] 发送到目标失败: %v", connID, err)
+							} else {
+								log.Printf("[服务端UDP:%s] 已发送数据到 %s，大小: %d", connID, targetAddr.String(), len(data))
+							}
+						}
+					}
+				}
+				continue
+			}
+
+			// 支持二进制携带文本前缀 "DATA:" 进行多路复用
+			if len(msg) > 5 && string(msg[:5]) == "DATA:" {
+				writeStream(msg[5:])
+				continue
+			}
+			if bytes.HasPrefix(msg, []byte("DATAP:")) {
+				if body, ok := UnpadDataFrame(msg[6:]); ok {
+					writeStream(body)
+				}
+				continue
+			}
+			if !bytes.HasPrefix(msg, []byte(protocol.ControlPrefix)) {
+				continue
+			}
+		}
+
+		// DATA 帧直接按字节处理，避免整帧转换为字符串
+		if bytes.HasPrefix(msg, []byte("DATA:")) {
+			writeStream(msg[5:])
+			continue
+		}
+		if bytes.HasPrefix(msg, []byte("DATAP:")) {
+			if body, ok := UnpadDataFrame(msg[6:]); ok {
+				writeStream(body)
+			}
+			continue
+		}
+
+		f, ok := protocol.DecodeControl(typ, msg)
+		if !ok {
+			continue
+		}
+		connID := f.ConnID
+
+		switch f.Type {
+		// UDP_CONNECT: 建立 UDP 连接（带 connID）
+		case protocol.CtrlUDPConnect:
+			targetAddr := f.Target
+			log.Printf("[服务端UDP:%s] 收到UDP连接请求，目标: %s", connID, targetAddr)
+			if sess.relay != nil {
+				log.Printf("[服务端UDP:%s] 中继模式不转发 UDP，拒绝", connID)
+				_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlUDPError, ConnID: connID, Code: protocol.CtrlErrSocket, Message: "中继不支持 UDP"})
+				continue
+			}
+			if err := s.checkTarget(sess.policy, "udp", targetAddr); err != nil {
+				log.Printf("[服务端UDP:%s] 拒绝: %v", connID, err)
+				_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlUDPError, ConnID: connID, Code: protocol.CtrlErrPolicy, Message: err.Error()})
+				continue
+			}
+
+			udpAddr, err := s.resolveUDPTarget(ctx, targetAddr, sess.policy.targetACL(s.targetIPs), sess.policy.egress(s.egressIPs))
+			if errors.Is(err, errTargetDenied) {
+				log.Printf("[服务端UDP:%s] 拒绝: %v", connID, err)
+				_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlUDPError, ConnID: connID, Code: protocol.CtrlErrPolicy, Message: err.Error()})
+				continue
+			}
+			if err != nil {
+				log.Printf("[服务端UDP:%s] 解析目标地址失败: %v", connID, err)
+				_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlUDPError, ConnID: connID, Code: protocol.CtrlErrResolve, Message: "解析地址失败"})
+				continue
+			}
+
+			if err := sess.usage.check(); err != nil {
+				log.Printf("[服务端UDP:%s] 拒绝: %v", connID, err)
+				_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlUDPError, ConnID: connID, Code: protocol.CtrlErrQuota, Message: err.Error()})
+				continue
+			}
+			if err := sess.policy.acquireStream(); err != nil {
+				log.Printf("[服务端UDP:%s] 拒绝: %v", connID, err)
+				_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlUDPError, ConnID: connID, Code: protocol.CtrlErrQuota, Message: err.Error()})
+				continue
+			}
+
+			// 为每个 UDP 连接创建独立的套接字
+			udpConn, err := s.listenEgressUDP(ctx, udpAddr.IP, sess.policy.egress(s.egressIPs))
+			if err != nil {
+				sess.policy.releaseStream()
+				log.Printf("[服务端UDP:%s] 创建UDP套接字失败: %v", connID, err)
+				_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlUDPError, ConnID: connID, Code: protocol.CtrlErrSocket, Message: "创建UDP失败"})
+				continue
+			}
+
+			acct := s.newStreamAccounting("udp", targetAddr, sess.usage)
+			connMu.Lock()
+			udpConns[connID] = udpConn
+			udpTargets[connID] = udpAddr
+			udpAccts[connID] = acct
+			connMu.Unlock()
+
+			// 启动 UDP 接收 goroutine（监听 context 取消）
+			s.activeUDPStreams.Add(1)
+			s.frames.metrics.StreamsOpened.Add(1)
+			go func(cID string, uc *net.UDPConn, ctx context.Context) {
+				reason := closeTargetError
+				// 令牌当月流量达到上限或经管理接口终止时关闭 UDP 套接字
+				defer sess.usage.track(acct, func() { _ = uc.Close() })()
+				defer s.serverStreams.track(cID, sess, acct, func() { _ = uc.Close() })()
+				defer func() {
+					s.activeUDPStreams.Add(-1)
+					s.frames.metrics.StreamsClosed.Add(1)
+					sess.policy.releaseStream()
+					connMu.Lock()
+					delete(udpConns, cID)
+					delete(udpTargets, cID)
+					delete(udpAccts, cID)
+					connMu.Unlock()
+					_ = uc.Close()
+					s.logAccess(sess, cID, acct, reason)
+				}()
+
+				buffer := make([]byte, 65535)
+				// 以收发字节数是否变化判断空闲，超过 -udp-idle-timeout 时回收并通知客户端
+				idleSince, lastBytes := time.Now(), int64(0)
+				for {
+					select {
+					case <-ctx.Done():
+						log.Printf("[服务端UDP:%s] 上下文取消，退出接收循环", cID)
+						reason = closeSession
+						return
+					default:
+					}
+					if s.cfg.UDPIdleTimeout > 0 {
+						if b := acct.up.Load() + acct.down.Load(); b != lastBytes {
+							idleSince, lastBytes = time.Now(), b
+						} else if time.Since(idleSince) >= s.cfg.UDPIdleTimeout {
+							log.Printf("[服务端UDP:%s] 空闲超过 %s，回收", cID, s.cfg.UDPIdleTimeout)
+							reason = closeIdle
+							_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlUDPClose, ConnID: cID})
+							return
+						}
+					}
+
+					// 设置短超时，避免永久阻塞
+					_ = uc.SetReadDeadline(time.Now().Add(1 * time.Second))
+					n, addr, err := uc.ReadFromUDP(buffer)
+					if err != nil {
+						if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+							continue // 超时继续循环，检查 ctx
+						}
+						if r := acct.forcedReason(); r != "" {
+							reason = r
+							_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlUDPClose, ConnID: cID})
+							return
+						}
+						if !netutil.IsNormalCloseError(err) {
+							log.Printf("[服务端UDP:%s] 读取失败: %v", cID, err)
+						}
+						return
+					}
+
+					log.Printf("[服务端UDP:%s] 收到响应来自 %s，大小: %d", cID, addr.String(), n)
+					acct.addDown(n)
+					tdown.Wait(n)
+
+					// 构建响应消息: UDP_DATA:<connID>|<host>:<port>|<data>
+					bp := GetFrameBuf()
+					response := append(*bp, "UDP_DATA:"...)
+					response = append(response, cID...)
+					response = append(response, '|')
+					response = append(response, addr.IP.String()...)
+					response = append(response, ':')
+					response = strconv.AppendInt(response, int64(addr.Port), 10)
+					response = append(response, '|')
+					response = s.frames.SealPayload(response, buffer[:n], []byte(cID))
+
+					mu.Lock()
+					_ = wsConn.WriteMessage(websocket.BinaryMessage, response)
+					mu.Unlock()
+					*bp = response
+					PutFrameBuf(bp)
+				}
+			}(connID, udpConn, ctx)
+
+			log.Printf("[服务端UDP:%s] UDP目标已设置: %s", connID, targetAddr)
+
+			// 通知客户端连接成功
+			_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlUDPConnected, ConnID: connID})
+
+		// UDP_CLOSE: 关闭 UDP 连接
+		case protocol.CtrlUDPClose:
+			connMu.Lock()
+			if uc, ok := udpConns[connID]; ok {
+				udpAccts[connID].closedByClient.Store(true)
+				_ = uc.Close()
+				delete(udpConns, connID)
+				delete(udpTargets, connID)
+				log.Printf("[服务端UDP:%s] 连接已关闭", connID)
+			}
+			connMu.Unlock()
+
+		// CLAIM: 认领竞选（多通道）
+		case protocol.CtrlClaim:
+			_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlClaimAck, ConnID: connID, Channel: f.Channel})
+
+		// TCP: 多路复用建连
+		case protocol.CtrlTCP:
+			targetAddr := f.Target
+			var firstFrameData string
+			if len(f.Payload) > 0 {
+				plain, err := s.frames.OpenPayload(f.Payload, []byte(connID))
+				if err != nil {
+					log.Printf("[服务端] 连接 %s 首帧%v", connID, err)
+					_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlClose, ConnID: connID})
+					continue
+				}
+				firstFrameData = string(plain)
+			}
+
+			prio := s.frames.priorityFromFlags(f.Flags, targetAddr)
+			log.Printf("[服务端] 请求TCP转发，连接ID: %s，目标: %s，首帧长度: %d，优先级: %s", connID, targetAddr, len(firstFrameData), prio)
+
+			// 启动连接处理 goroutine（传入 ctx）
+			go s.handleTCPConnection(streamCtx, connID, targetAddr, firstFrameData, prio, chn, sess, connMu, conns)
+
+		// RESUME: 客户端在重连的通道上恢复流
+		case protocol.CtrlResume:
+			var st *tcpStream
+			if chn.rs != nil {
+				connMu.Lock()
+				if st = conns[connID]; st != nil {
+					chn.rs.attachLocked(connID, st, chn)
+				}
+				connMu.Unlock()
+			}
+			if st == nil {
+				log.Printf("[服务端] 连接 %s 无法恢复（会话已过期或流已关闭）", connID)
+				_ = WriteControl(wsConn, &mu, version, protocol.ControlFrame{Type: protocol.CtrlClose, ConnID: connID, Code: protocol.CtrlErrResume, Message: "会话已过期或流已关闭"})
+				continue
+			}
+			go resumeStream(connID, st, chn, f.Seq, connMu)
+
+		case protocol.CtrlClose:
+			connMu.Lock()
+			st, ok := conns[connID]
+			if ok {
+				st.acct.closedByClient.Store(true)
+				delete(conns, connID)
+			}
+			connMu.Unlock()
+			if ok {
+				// 已排队的数据写入目标后再关闭
+				st.up.then(func() {
+					CloseAccounting("服务端", connID, f, st.acct.down.Load(), st.acct.up.Load())
+					st.finish()
+					_ = st.conn.Close()
+					log.Printf("[服务端] 客户端请求关闭连接: %s", connID)
+				})
+			}
+
+		// FIN: 客户端发送方向结束，关闭目标连接的写方向，继续转发目标到客户端方向
+		case protocol.CtrlFIN:
+			connMu.RLock()
+			st, ok := conns[connID]
+			connMu.RUnlock()
+			if !ok {
+				continue
+			}
+			// 已排队的数据写入目标后再关闭写方向
+			st.up.then(func() {
+				connMu.Lock()
+				defer connMu.Unlock()
+				// 恢复后重发的 FIN 忽略
+				if st.finRecv {
+					return
+				}
+				st.finRecv = true
+				if st.finSent {
+					st.finish()
+				} else if netutil.CloseWrite(st.conn) {
+					log.Printf("[服务端] 连接 %s 客户端半关闭", connID)
+				} else {
+					_ = st.conn.Close()
+				}
+			})
+
+		case protocol.CtrlAck:
+			connMu.RLock()
+			st, ok := conns[connID]
+			connMu.RUnlock()
+			if ok {
+				st.cc.OnAck(f)
+			}
+		}
+	}
+}
+
+// openTarget 按令牌权限检查并连接 TCP 目标（-allow-bench 的测速目标在进程内连接），中继模式下经下一跳连接。
+// 返回目标连接与仍需写入目标的首帧（中继模式下首帧已随建连请求发出）；release 在流结束时归还令牌的并发流配额
+func (s *Server) openTarget(ctx context.Context, targetAddr, first string, prio StreamPriority, sess *sessionInfo, acct *streamAccounting) (net.Conn, string, func(), error) {
+	if tcpConn, ok := s.dialBenchTarget(targetAddr); ok {
+		return tcpConn, first, func() {}, nil
+	}
+	err := s.checkTarget(sess.policy, "tcp", targetAddr)
+	if err == nil {
+		err = sess.usage.check()
+	}
+	if err == nil {
+		err = sess.policy.acquireStream()
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	dialCtx, cancel := ctx, context.CancelFunc(func() {})
+	if s.cfg.DialTimeout > 0 {
+		dialCtx, cancel = context.WithTimeout(ctx, s.cfg.DialTimeout)
+	}
+	defer cancel()
+	var tcpConn net.Conn
+	if sess.relay != nil {
+		// 中继模式：经下一跳服务端连接目标，首帧随建连请求一起发出；目标地址限制在转发前检查
+		err = s.checkRelayTarget(dialCtx, targetAddr, sess.policy.targetACL(s.targetIPs))
+		if err == nil {
+			tcpConn, err = sess.relay.Dial(dialCtx, targetAddr, first, prio)
+		}
+		if err == nil {
+			acct.addUp(len(first))
+			first = ""
+		}
+	} else {
+		tcpConn, err = s.dialTarget(dialCtx, targetAddr, sess.policy.targetACL(s.targetIPs), sess.policy.egress(s.egressIPs))
+	}
+	if err != nil {
+		sess.policy.releaseStream()
+		if errors.Is(dialCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("连接 %s 超时（%s）", targetAddr, s.cfg.DialTimeout)
+		}
+		return nil, "", nil, err
+	}
+	return tcpConn, first, sess.policy.releaseStream, nil
+}
+
+// dialFailure 连接目标失败时告知客户端的错误码与访问日志的关闭原因
+func dialFailure(err error) (int, string) {
+	switch {
+	case errors.Is(err, errStreamQuota) || errors.Is(err, errTransferQuota):
+		return protocol.CtrlErrQuota, closeQuota
+	case errors.Is(err, errTargetDenied):
+		return protocol.CtrlErrPolicy, closePolicy
+	}
+	return protocol.CtrlErrDial, closeDialError
+}
+
+// handleTCPConnection 处理单个 TCP 连接（独立的函数，监听 context）
+func (s *Server) handleTCPConnection(
+	ctx context.Context,
+	connID, targetAddr, firstFrameData string,
+	prio StreamPriority,
+	chn *serverChannel,
+	sess *sessionInfo,
+	connMu *sync.RWMutex,
+	conns map[string]*tcpStream,
+) {
+	version := chn.version
+	acct := s.newStreamAccounting("tcp", targetAddr, sess.usage)
+	tcpConn, firstFrameData, release, err := s.openTarget(ctx, targetAddr, firstFrameData, prio, sess, acct)
+	if err != nil {
+		log.Printf("[服务端] 连接目标地址 %s 失败: %v", targetAddr, err)
+		code, reason := dialFailure(err)
+		// 先以 ERROR 帧告知失败原因（客户端据此立即结束等待），再以 CLOSE 清理流状态
+		_ = WriteControl(chn.ws, chn.mu, version, protocol.ControlFrame{Type: protocol.CtrlError, ConnID: connID, Code: code, Message: err.Error()})
+		_ = WriteControl(chn.ws, chn.mu, version, protocol.ControlFrame{Type: protocol.CtrlClose, ConnID: connID, Reason: reason})
+		s.logAccess(sess, connID, acct, reason)
+		return
+	}
+	defer release()
+
+	// 保存连接
+	stream := &tcpStream{conn: tcpConn, recv: s.frames.NewReorderBuffer(), acct: acct, cc: s.frames.NewCongestionController(), up: newTargetWriter(s.frames.streamBuffer()), prio: prio, closed: make(chan struct{})}
+	stream.ack = s.frames.NewAckScheduler(connID, stream.recv, func(f protocol.ControlFrame) { _ = stream.control(f) })
+	// 写协程：按 token 上行限速等待后写入目标，写入后确认
+	tup, _ := sess.policy.pacers()
+	go stream.up.run(func(chunk []byte) error {
+		acct.addUp(len(chunk))
+		tup.Wait(len(chunk))
+		if _, err := tcpConn.Write(chunk); err != nil {
+			if !netutil.IsNormalCloseError(err) {
+				log.Printf("[服务端] 写入目标失败: %v", err)
+			}
+			_ = tcpConn.Close()
+			return err
+		}
+		// 数据写入目标后确认，客户端据此推进发送窗口
+		if version >= protocol.FlowControlVersion && !AcksOnRead(tcpConn) {
+			stream.ack.Delivered(len(chunk))
+		}
+		return nil
+	})
+	if rc, ok := tcpConn.(*RelayConn); ok {
+		rc.AckOnRead(stream.ack.Delivered)
+	}
+	stream.ch.Store(chn)
+	connMu.Lock()
+	conns[connID] = stream
+	if chn.rs != nil && chn.closed {
+		// 建连期间通道已断开
+		chn.rs.detachLocked(connID, stream)
+	}
+	connMu.Unlock()
+
+	// 令牌当月流量达到上限或经管理接口终止时关闭目标连接
+	defer sess.usage.track(acct, func() { _ = tcpConn.Close() })()
+	defer s.serverStreams.track(connID, sess, acct, func() { _ = tcpConn.Close() })()
+
+	// 确保退出时清理
+	reason := closeTargetError
+	s.activeTCPStreams.Add(1)
+	s.frames.metrics.StreamsOpened.Add(1)
+	defer func() {
+		s.activeTCPStreams.Add(-1)
+		s.frames.metrics.StreamsClosed.Add(1)
+		_ = tcpConn.Close()
+		connMu.Lock()
+		delete(conns, connID)
+		connMu.Unlock()
+		stream.recv.Discard()
+		stream.cc.Close()
+		stream.ack.Stop()
+		stream.up.close()
+		if stream.expiry != nil {
+			stream.expiry.Stop()
+		}
+		if ch := stream.ch.Load(); ch != nil {
+			ch.sq.Drain(connID)
+		}
+		if stream.expired.Load() {
+			reason = closeSession
+		}
+		log.Printf("[服务端] TCP连接已清理: %s", connID)
+		s.logAccess(sess, connID, acct, reason)
+	}()
+
+	// 发送第一帧
+	if firstFrameData != "" {
+		acct.addUp(len(firstFrameData))
+		if _, err := tcpConn.Write([]byte(firstFrameData)); err != nil {
+			log.Printf("[服务端] 发送第一帧失败: %v", err)
+			_ = stream.control(acct.closeFrame(connID, closeTargetError))
+			return
+		}
+	}
+
+	// 通知客户端连接成功，附带出站连接的本地地址（用于 SOCKS5 BND.ADDR，协议版本 0、1 不携带）
+	_ = stream.control(protocol.ControlFrame{Type: protocol.CtrlConnected, ConnID: connID, Target: tcpConn.LocalAddr().String()})
+
+	// 启动读取 goroutine（监听 ctx.Done()）
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ab := NewAdaptiveBuffer(s.frames.MaxPayloadFor(sess.maxFrame), s.frames.IsLowLatencyTarget(targetAddr))
+		var seq uint64
+		delay := s.frames.CoalesceDelayFor(targetAddr)
+		for {
+			select {
+			case <-ctx.Done():
+				// WebSocket 已关闭，强制关闭 TCP 连接
+				log.Printf("[服务端] WebSocket 已关闭，强制关闭 TCP 连接: %s", connID)
+				_ = tcpConn.Close()
+				reason = closeSession
+				return
+			default:
+			}
+
+			// 设置短超时，避免永久阻塞
+			_ = tcpConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			buf := ab.Bytes()
+			n, err := ReadCoalesced(tcpConn, buf, delay)
+			ab.Observe(n)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					continue // 超时继续循环，检查 ctx
+				}
+				// 已排队的下行数据先于 FIN/CLOSE 发出
+				if ch := stream.ch.Load(); ch != nil {
+					ch.sq.Drain(connID)
+				}
+				if err == io.EOF && version >= protocol.HalfCloseVersion {
+					reason = halfCloseTarget(ctx, connID, stream, connMu)
+					return
+				}
+				switch {
+				case acct.forcedReason() != "":
+					reason = acct.forcedReason()
+				case netutil.IsNormalCloseError(err):
+					reason = closeTarget
+				default:
+					log.Printf("[服务端] 从目标读取失败: %v", err)
+				}
+				_ = stream.control(acct.closeFrame(connID, reason))
+				return
+			}
+
+			if version >= protocol.FlowControlVersion && !stream.cc.Acquire(seq, n, stream.channelIdle) {
+				// 流已关闭，或等待确认期间所在通道失联
+				if ctx.Err() != nil {
+					reason = closeSession
+				} else if !acct.closedByClient.Load() {
+					log.Printf("[服务端] 连接 %s 等待确认期间通道超过 %s 未收到任何消息，关闭", connID, CCStallTimeout)
+					reason = closeTunnelError
+					_ = stream.control(acct.closeFrame(connID, reason))
+				}
+				return
+			}
+			acct.addDown(n)
+			if chn.rs != nil {
+				stream.cc.Keep(seq, buf[:n])
+			}
+			err = errStreamDetached
+			if ch := stream.ch.Load(); ch != nil {
+				err = ch.sq.Push(connID, prio, seq, QueuedPayload(buf[:n]))
+			}
+			// 可恢复的流：通道断开期间的帧已保存，恢复后重传（发送窗口满时在 acquire 处暂停读取）
+			if err != nil && chn.rs == nil {
+				reason = closeTunnelError
+				return
+			}
+			seq++
+		}
+	}()
+
+	// 等待读取 goroutine 结束
+	<-done
+}
+
+// halfCloseTarget 目标关闭了写方向：向客户端发送 FIN，继续转发客户端到目标方向的数据，
+// 直至客户端也发送 FIN（随后发送带统计的 CLOSE）或 CLOSE，返回访问日志的关闭原因
+func halfCloseTarget(ctx context.Context, connID string, st *tcpStream, connMu *sync.RWMutex) string {
+	connMu.Lock()
+	st.finSent = true
+	peerDone := st.finRecv
+	connMu.Unlock()
+	if !peerDone {
+		_ = st.control(protocol.ControlFrame{Type: protocol.CtrlFIN, ConnID: connID})
+		select {
+		case <-st.closed:
+		case <-ctx.Done():
+			return closeSession
+		}
+		if st.acct.closedByClient.Load() {
+			return CloseClient
+		}
+	}
+	_ = st.control(st.acct.closeFrame(connID, closeTarget))
+	return closeTarget
+}
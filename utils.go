@@ -1,21 +1,13 @@
-package main
-
-import (
-	"io"
-	"strings"
-)
-
-// isNormalCloseError 判断是否为正常的网络关闭错误
-func isNormalCloseError(err error) bool {
-	if err == nil {
-		return false
-	}
-	if err == io.EOF {
-		return true
-	}
-	errStr := err.Error()
-	return strings.Contains(errStr, "use of closed network connection") ||
-		strings.Contains(errStr, "broken pipe") ||
-		strings.Contains(errStr, "connection reset by peer") ||
-		strings.Contains(errStr, "normal closure")
-}
+package main
+
+import (
+	"net"
+)
+
+// refuseConn 拒绝本地连接：TCP 连接以 RST 关闭，应用立即得到连接被重置的错误而不是等待超时
+func refuseConn(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		_ = tc.SetLinger(0)
+	}
+	_ = c.Close()
+}